@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// StatsAggregator keeps the statistics snapshots pushed by the instances of the fleet.
+// The snapshots are kept in memory only: the instances push their cumulative statistics
+// every snapshot interval, so the fleet statistics are complete again soon after a restart
+type StatsAggregator struct {
+	mu    sync.RWMutex
+	snaps map[string]statsSnapshot
+}
+
+// NewStatsAggregator constructs a new instance of the statistics aggregator
+func NewStatsAggregator() *StatsAggregator {
+	a := &StatsAggregator{snaps: make(map[string]statsSnapshot)}
+	metrics.NewGaugeFunc("phs_aggregator_instances", "Number of instances which pushed their statistics", func() float64 {
+		a.mu.RLock()
+		defer a.mu.RUnlock()
+		return float64(len(a.snaps))
+	})
+	return a
+}
+
+// PutStats saves the snapshot unless a later one of the same instance has been saved already
+func (a *StatsAggregator) PutStats(snap statsSnapshot) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if prev, ok := a.snaps[snap.Instance]; ok && prev.Updated.After(snap.Updated) {
+		return nil
+	}
+	a.snaps[snap.Instance] = snap
+	return nil
+}
+
+// ListStats returns the last snapshots of all the instances ordered by the instance identifiers
+func (a *StatsAggregator) ListStats() ([]statsSnapshot, error) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	snaps := make([]statsSnapshot, 0, len(a.snaps))
+	for _, snap := range a.snaps {
+		snaps = append(snaps, snap)
+	}
+	sort.Slice(snaps, func(i, j int) bool { return snaps[i].Instance < snaps[j].Instance })
+	return snaps, nil
+}
+
+// statsPusher saves the statistics snapshots of the instance by pushing them to the aggregator
+type statsPusher struct {
+	url    string
+	token  string
+	client *http.Client
+}
+
+// newStatsPusher constructs a new instance of the pusher to the aggregator at the base URL
+func newStatsPusher(baseURL, token string) *statsPusher {
+	return &statsPusher{
+		url:    strings.TrimSuffix(baseURL, "/") + statsPushRoutePath,
+		token:  token,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// PutStats pushes the snapshot to the aggregator
+func (p *statsPusher) PutStats(snap statsSnapshot) error {
+	body, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, p.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if p.token != "" {
+		req.Header.Set("Authorization", "Bearer "+p.token)
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("aggregator: %s", resp.Status)
+	}
+	return nil
+}
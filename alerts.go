@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// alertCheckInterval is the interval of evaluating the alert thresholds
+const alertCheckInterval = 10 * time.Second
+
+// alertRule raises the alert while the watched value exceeds the threshold
+type alertRule struct {
+	name      string
+	threshold float64
+	value     func(now time.Time) float64
+	firing    bool
+	// notified is the state last delivered to the webhook
+	notified bool
+}
+
+// alertNotification is the body POSTed to the alert webhook when an alert starts or stops firing
+type alertNotification struct {
+	Alert     string    `json:"alert"`
+	Status    string    `json:"status"`
+	Value     float64   `json:"value"`
+	Threshold float64   `json:"threshold"`
+	Instance  string    `json:"instance"`
+	At        time.Time `json:"at"`
+}
+
+// alertWebhook notifies the alerting endpoint of the alerts starting and stopping to fire
+type alertWebhook struct {
+	url      string
+	token    string
+	instance string
+	client   *http.Client
+	failures *Counter
+}
+
+// Notify POSTs the notification to the webhook
+func (h *alertWebhook) Notify(n alertNotification) error {
+	n.Instance = h.instance
+	body, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, h.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if h.token != "" {
+		req.Header.Set("Authorization", "Bearer "+h.token)
+	}
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("alert webhook: %s", resp.Status)
+	}
+	return nil
+}
+
+// AlertEvaluator periodically checks the queue and the replication against the configured
+// thresholds. The alerts are logged and sent to the webhook, if any, when they start and stop firing,
+// and reported by the phs_alert_firing metric, so that the growth of the queues is noticed before it is too late
+type AlertEvaluator struct {
+	mu      sync.Mutex
+	rules   []*alertRule
+	webhook *alertWebhook
+}
+
+// NewAlertEvaluator constructs a new instance of the evaluator of the thresholds configured
+// for the storage and, if shipping the records, the replication
+func NewAlertEvaluator(cfg *Config, storage *HashStorage, shipper *ReplicationShipper) *AlertEvaluator {
+	e := &AlertEvaluator{}
+	if cfg.AlertWebhookURL != "" {
+		e.webhook = &alertWebhook{
+			url:      cfg.AlertWebhookURL,
+			token:    cfg.AlertWebhookToken,
+			instance: cfg.InstanceID,
+			client:   &http.Client{Timeout: 10 * time.Second},
+			failures: metrics.NewCounter("phs_alert_notification_failures_total", "Number of the alert notifications the webhook failed to receive"),
+		}
+	}
+	if cfg.AlertQueueDepth > 0 {
+		e.add("queue_depth", float64(cfg.AlertQueueDepth), func(time.Time) float64 {
+			return float64(storage.QueueLength())
+		})
+	}
+	if cfg.AlertPendingAge > 0 {
+		e.add("pending_age", cfg.AlertPendingAge.Seconds(), func(now time.Time) float64 {
+			return storage.OldestPending(now).Seconds()
+		})
+	}
+	if cfg.AlertReplicationLag > 0 && shipper != nil {
+		e.add("replication_lag", cfg.AlertReplicationLag.Seconds(), func(now time.Time) float64 {
+			return shipper.Lag(now).Seconds()
+		})
+	}
+	return e
+}
+
+// add registers the rule along with its metric
+func (e *AlertEvaluator) add(name string, threshold float64, value func(now time.Time) float64) {
+	rule := &alertRule{name: name, threshold: threshold, value: value}
+	e.rules = append(e.rules, rule)
+	metrics.NewGaugeFunc("phs_alert_firing", "Whether the alert is firing (1) or not (0)", func() float64 {
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		if rule.firing {
+			return 1
+		}
+		return 0
+	}, "alert", name)
+	metrics.NewGaugeFunc("phs_alert_threshold", "Threshold of the alert", func() float64 { return threshold }, "alert", name)
+}
+
+// Empty checks whether no thresholds are configured
+func (e *AlertEvaluator) Empty() bool {
+	return len(e.rules) == 0
+}
+
+// Evaluate checks the values against the thresholds, logging the alerts starting and stopping to fire.
+// The webhook is notified of the changes it has not received yet, so a failed notification is retried
+// at the next evaluation unless the alert has changed back in the meantime
+func (e *AlertEvaluator) Evaluate(now time.Time) {
+	for _, rule := range e.rules {
+		value := rule.value(now)
+		firing := value > rule.threshold
+		e.mu.Lock()
+		changed := firing != rule.firing
+		rule.firing = firing
+		e.mu.Unlock()
+		switch {
+		case changed && firing:
+			logf(logLevelWarn, "Alert %s firing: %g exceeds %g\n", rule.name, value, rule.threshold)
+		case changed:
+			logf(logLevelInfo, "Alert %s resolved: %g within %g\n", rule.name, value, rule.threshold)
+		}
+		if e.webhook != nil && firing != rule.notified {
+			status := "resolved"
+			if firing {
+				status = "firing"
+			}
+			n := alertNotification{Alert: rule.name, Status: status, Value: value, Threshold: rule.threshold, At: now.UTC()}
+			if err := e.webhook.Notify(n); err != nil {
+				e.webhook.failures.Inc()
+				logf(logLevelError, "Error while notifying the alert %s: %v\n", rule.name, err)
+				continue
+			}
+			rule.notified = firing
+		}
+	}
+}
+
+// Run evaluates the thresholds every alertCheckInterval until done is closed
+func (e *AlertEvaluator) Run(done <-chan struct{}) {
+	ticker := time.NewTicker(alertCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-ticker.C:
+			e.Evaluate(now)
+		}
+	}
+}
+
+// registerQueueMetrics reports the pending hash calculations and the unwritten records
+func registerQueueMetrics(storage *HashStorage) {
+	metrics.NewGaugeFunc("phs_queue_pending_jobs", "Number of hash calculations not stored yet", func() float64 {
+		return float64(storage.QueueLength())
+	})
+	metrics.NewGaugeFunc("phs_queue_oldest_pending_seconds", "Age of the oldest hash calculation not stored yet", func() float64 {
+		return storage.OldestPending(time.Now()).Seconds()
+	})
+	metrics.NewGaugeFunc("phs_storage_unflushed_records", "Number of completed records waiting for the batched write", func() float64 {
+		return float64(storage.Unflushed())
+	})
+}
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// API key scopes
+const (
+	scopeHashWrite  = "hash:write"
+	scopeHashRead   = "hash:read"
+	scopeHashDelete = "hash:delete"
+	scopeStatsRead  = "stats:read"
+	scopeStatsPush  = "stats:push"
+	// scopeHashParams allows reading the salts and the parameters of the hashes, implied by scopeHashRead
+	scopeHashParams = "hash:params"
+	// scopeHashVerify allows verifying the passwords without reading the hashes, implied by scopeHashRead
+	scopeHashVerify = "hash:verify"
+	// scopeHashSalt allows supplying the salt of the hash calculation
+	scopeHashSalt = "hash:salt"
+	// scopeAdmin grants all the other scopes along with the access to the admin API
+	scopeAdmin = "admin"
+)
+
+var knownScopes = map[string]bool{
+	scopeHashWrite:  true,
+	scopeHashRead:   true,
+	scopeHashDelete: true,
+	scopeStatsRead:  true,
+	scopeStatsPush:  true,
+	scopeHashParams: true,
+	scopeHashVerify: true,
+	scopeHashSalt:   true,
+	scopeAdmin:      true,
+}
+
+// impliedScopes lists the scopes granted along with a broader one
+var impliedScopes = map[string][]string{
+	scopeHashRead: {scopeHashParams, scopeHashVerify},
+}
+
+// scopeAliases name the restricted sets of scopes, expanded when the keys are created. The write-only
+// keys cannot read back the hashes they create, and the verify-only keys cannot retrieve the digests,
+// limiting what a leaked key exposes
+var scopeAliases = map[string][]string{
+	"write-only":  {scopeHashWrite},
+	"verify-only": {scopeHashVerify},
+}
+
+// keyCacheTTL is the time after which the cached API keys are reloaded from the store,
+// so that the keys revoked by another instance sharing the storage stop working
+const keyCacheTTL = 30 * time.Second
+
+var (
+	// ErrUnauthenticated is returned for missing, unknown, expired or revoked API keys
+	ErrUnauthenticated = errors.New("invalid API key")
+	// ErrKeyNotFound is returned when managing a non-existent API key
+	ErrKeyNotFound = fmt.Errorf("API key %w", ErrNotFound)
+)
+
+// apiKey represents a managed API key. Only the hash of the key secret is kept
+type apiKey struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name,omitempty"`
+	Tenant     string     `json:"tenant,omitempty"`
+	Scopes     []string   `json:"scopes"`
+	SecretHash string     `json:"secret_hash"`
+	Created    time.Time  `json:"created"`
+	Expires    *time.Time `json:"expires,omitempty"`
+	Rotated    *time.Time `json:"rotated,omitempty"`
+	Revoked    *time.Time `json:"revoked,omitempty"`
+}
+
+// apiKeyInfo represents the API key as reported by the admin API
+type apiKeyInfo struct {
+	ID      string     `json:"id"`
+	Name    string     `json:"name,omitempty"`
+	Tenant  string     `json:"tenant,omitempty"`
+	Scopes  []string   `json:"scopes"`
+	Created time.Time  `json:"created"`
+	Expires *time.Time `json:"expires,omitempty"`
+	Rotated *time.Time `json:"rotated,omitempty"`
+	Revoked *time.Time `json:"revoked,omitempty"`
+	// Token is returned only once, when the key is created or rotated
+	Token string `json:"token,omitempty"`
+}
+
+// info returns the API key as reported by the admin API
+func (k *apiKey) info() apiKeyInfo {
+	return apiKeyInfo{ID: k.ID, Name: k.Name, Tenant: k.Tenant, Scopes: k.Scopes,
+		Created: k.Created, Expires: k.Expires, Rotated: k.Rotated, Revoked: k.Revoked}
+}
+
+// active checks whether the key is neither expired nor revoked
+func (k *apiKey) active(now time.Time) bool {
+	return k.Revoked == nil && (k.Expires == nil || now.Before(*k.Expires))
+}
+
+// HasScope checks whether the key grants the scope
+func (k *apiKey) HasScope(scope string) bool {
+	for _, s := range k.Scopes {
+		if s == scope || s == scopeAdmin {
+			return true
+		}
+		for _, implied := range impliedScopes[s] {
+			if implied == scope {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// mayReadHashes checks whether the request may be answered with the hashes. The keys lacking
+// the hash:read scope, such as the write-only ones, get the identifiers only
+func mayReadHashes(r *http.Request) bool {
+	key := requestAPIKey(r)
+	return key == nil || key.HasScope(scopeHashRead)
+}
+
+// apiKeyStore is implemented by the backends able to persist the API keys
+type apiKeyStore interface {
+	PutKey(key apiKey) error
+	GetKey(id string) (key apiKey, ok bool, err error)
+	ListKeys() ([]apiKey, error)
+}
+
+// cachedKey is an API key loaded from the store
+type cachedKey struct {
+	key    apiKey
+	loaded time.Time
+}
+
+// KeyManager creates, rotates, revokes and authenticates the API keys.
+// The keys are persisted in the storage backend
+type KeyManager struct {
+	mu       sync.Mutex
+	store    apiKeyStore
+	readOnly int32
+	adminKey string
+	cache    map[string]cachedKey
+}
+
+// NewKeyManager constructs a new instance of the API key manager on top of the store.
+// The static admin key, if not empty, is accepted along with the managed keys
+func NewKeyManager(store apiKeyStore, adminKey string, readOnly bool) *KeyManager {
+	m := &KeyManager{store: store, adminKey: adminKey, cache: make(map[string]cachedKey)}
+	if readOnly {
+		m.readOnly = 1
+	}
+	return m
+}
+
+// Promote allows a promoted standby replica to manage the keys
+func (m *KeyManager) Promote() {
+	atomic.StoreInt32(&m.readOnly, 0)
+}
+
+// staticAdminKey is the key authenticated by the admin key from the configuration
+var staticAdminKey = apiKey{ID: "static-admin", Name: "Static admin key", Scopes: []string{scopeAdmin}}
+
+// Authenticate returns the API key the token belongs to
+func (m *KeyManager) Authenticate(token string) (*apiKey, error) {
+	if token == "" {
+		return nil, ErrUnauthenticated
+	}
+	if m.adminKey != "" && subtle.ConstantTimeCompare([]byte(token), []byte(m.adminKey)) == 1 {
+		key := staticAdminKey
+		return &key, nil
+	}
+	parts := strings.SplitN(token, ".", 2)
+	if len(parts) != 2 {
+		return nil, ErrUnauthenticated
+	}
+	key, ok, err := m.lookup(parts[0])
+	if err != nil {
+		return nil, err
+	}
+	if !ok || !key.active(time.Now()) ||
+		subtle.ConstantTimeCompare([]byte(hashKeySecret(parts[1])), []byte(key.SecretHash)) != 1 {
+		return nil, ErrUnauthenticated
+	}
+	return &key, nil
+}
+
+// lookup returns the key from the cache, reloading it from the store when stale
+func (m *KeyManager) lookup(id string) (apiKey, bool, error) {
+	m.mu.Lock()
+	cached, ok := m.cache[id]
+	m.mu.Unlock()
+	if ok && time.Since(cached.loaded) < keyCacheTTL {
+		return cached.key, true, nil
+	}
+	key, ok, err := m.store.GetKey(id)
+	if err != nil || !ok {
+		return key, false, err
+	}
+	m.mu.Lock()
+	m.cache[id] = cachedKey{key: key, loaded: time.Now()}
+	m.mu.Unlock()
+	return key, true, nil
+}
+
+// save persists the key and updates the cache
+func (m *KeyManager) save(key apiKey) error {
+	if atomic.LoadInt32(&m.readOnly) != 0 {
+		return ErrReadOnly
+	}
+	if err := m.store.PutKey(key); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	m.cache[key.ID] = cachedKey{key: key, loaded: time.Now()}
+	m.mu.Unlock()
+	return nil
+}
+
+// Create generates a new API key. The returned info carries the token, which is not stored anywhere
+func (m *KeyManager) Create(name, tenant string, scopes []string, ttl time.Duration) (apiKeyInfo, error) {
+	if err := validateScopes(scopes); err != nil {
+		return apiKeyInfo{}, err
+	}
+	id, err := randomString(8, hex.EncodeToString)
+	if err != nil {
+		return apiKeyInfo{}, err
+	}
+	secret, err := randomString(32, base64.RawURLEncoding.EncodeToString)
+	if err != nil {
+		return apiKeyInfo{}, err
+	}
+	key := apiKey{ID: id, Name: name, Tenant: tenant, Scopes: scopes, SecretHash: hashKeySecret(secret), Created: time.Now().UTC()}
+	if ttl > 0 {
+		expires := key.Created.Add(ttl)
+		key.Expires = &expires
+	}
+	if err := m.save(key); err != nil {
+		return apiKeyInfo{}, err
+	}
+	info := key.info()
+	info.Token = id + "." + secret
+	return info, nil
+}
+
+// Get returns the API key
+func (m *KeyManager) Get(id string) (apiKeyInfo, error) {
+	key, ok, err := m.store.GetKey(id)
+	if err != nil {
+		return apiKeyInfo{}, err
+	}
+	if !ok {
+		return apiKeyInfo{}, ErrKeyNotFound
+	}
+	return key.info(), nil
+}
+
+// List returns all the API keys ordered by their creation time
+func (m *KeyManager) List() ([]apiKeyInfo, error) {
+	keys, err := m.store.ListKeys()
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Created.Before(keys[j].Created) })
+	infos := make([]apiKeyInfo, 0, len(keys))
+	for i := range keys {
+		infos = append(infos, keys[i].info())
+	}
+	return infos, nil
+}
+
+// Rotate replaces the secret of the active API key. The returned info carries the new token
+func (m *KeyManager) Rotate(id string) (apiKeyInfo, error) {
+	key, ok, err := m.store.GetKey(id)
+	if err != nil {
+		return apiKeyInfo{}, err
+	}
+	if !ok || !key.active(time.Now()) {
+		return apiKeyInfo{}, ErrKeyNotFound
+	}
+	secret, err := randomString(32, base64.RawURLEncoding.EncodeToString)
+	if err != nil {
+		return apiKeyInfo{}, err
+	}
+	now := time.Now().UTC()
+	key.SecretHash = hashKeySecret(secret)
+	key.Rotated = &now
+	if err := m.save(key); err != nil {
+		return apiKeyInfo{}, err
+	}
+	info := key.info()
+	info.Token = id + "." + secret
+	return info, nil
+}
+
+// Revoke disables the API key. The revoked keys are kept for the audit purposes
+func (m *KeyManager) Revoke(id string) error {
+	key, ok, err := m.store.GetKey(id)
+	if err != nil {
+		return err
+	}
+	if !ok || key.Revoked != nil {
+		return ErrKeyNotFound
+	}
+	now := time.Now().UTC()
+	key.Revoked = &now
+	return m.save(key)
+}
+
+// requestKey is the context key of the API key authenticating the request
+type requestKey struct{}
+
+// requestAPIKey returns the API key authenticating the request, if any
+func requestAPIKey(r *http.Request) *apiKey {
+	key, _ := r.Context().Value(requestKey{}).(*apiKey)
+	return key
+}
+
+// contextTenant returns the tenant of the API key authenticating the request, if any
+func contextTenant(ctx context.Context) string {
+	if key, _ := ctx.Value(requestKey{}).(*apiKey); key != nil {
+		return key.Tenant
+	}
+	return ""
+}
+
+// requestToken returns the API key token sent either as a bearer token or in the X-API-Key header
+func requestToken(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); len(auth) > 7 && strings.EqualFold(auth[:7], "Bearer ") {
+		return strings.TrimSpace(auth[7:])
+	}
+	return r.Header.Get("X-API-Key")
+}
+
+// hashKeySecret returns the hex encoded SHA256 hash of the key secret
+func hashKeySecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// randomString returns n random bytes encoded with the given function
+func randomString(n int, encode func([]byte) string) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return encode(b), nil
+}
+
+// validateScopes checks that the scopes are known and not empty
+func validateScopes(scopes []string) error {
+	if len(scopes) == 0 {
+		return policyViolation("at least one scope is required")
+	}
+	for _, scope := range scopes {
+		if !knownScopes[scope] {
+			return policyViolation("unknown scope %q", scope)
+		}
+	}
+	return nil
+}
+
+// parseScopes splits the comma separated list of scopes, expanding the scope aliases
+func parseScopes(v string) []string {
+	var scopes []string
+	for _, scope := range strings.Split(v, ",") {
+		if scope = strings.TrimSpace(scope); scope == "" {
+			continue
+		}
+		if alias, ok := scopeAliases[scope]; ok {
+			scopes = append(scopes, alias...)
+			continue
+		}
+		scopes = append(scopes, scope)
+	}
+	return scopes
+}
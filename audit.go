@@ -0,0 +1,411 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// auditBatchSize is the largest number of events the HTTP forwarder sends at once
+	auditBatchSize = 100
+	// auditFlushInterval is the longest time an event waits in the HTTP forwarder before being sent
+	auditFlushInterval = time.Second
+	// auditHTTPAttempts is the number of attempts to send a batch before it is dropped
+	auditHTTPAttempts = 5
+	// auditMaxBackoff bounds the wait between the attempts, doubled from a second after every failure
+	auditMaxBackoff = 30 * time.Second
+)
+
+// Outcomes of the audited requests
+const (
+	auditSuccess = "success"
+	auditDenied  = "denied"
+	auditFailure = "failure"
+)
+
+// errAuditBufferFull is returned when the event does not fit in the buffer of the HTTP forwarder
+var errAuditBufferFull = errors.New("audit buffer full")
+
+// auditEvent records a security relevant request: an admin operation, a deletion, a sign in or out,
+// or a request rejected for its credentials. The request body and query are never recorded. Residency
+// is the residency region keeping the records of the tenant, empty for the home storage
+type auditEvent struct {
+	Time      time.Time `json:"time"`
+	Action    string    `json:"action"`
+	Actor     string    `json:"actor,omitempty"`
+	Tenant    string    `json:"tenant,omitempty"`
+	Residency string    `json:"residency,omitempty"`
+	Source    string    `json:"source"`
+	RequestID string    `json:"request_id,omitempty"`
+	Status    int       `json:"status"`
+	Outcome   string    `json:"outcome"`
+}
+
+// auditOutcome classifies the response status of the audited request
+func auditOutcome(status int) string {
+	switch {
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		return auditDenied
+	case status >= http.StatusBadRequest:
+		return auditFailure
+	}
+	return auditSuccess
+}
+
+// auditSink is a destination of the audit events
+type auditSink interface {
+	// Write records the event, or queues it to be recorded
+	Write(ev auditEvent) error
+	// Close records the queued events until the context is done and releases the sink
+	Close(ctx context.Context) error
+}
+
+// AuditLog writes the audit events to all the configured sinks, independently of the application log.
+// The failure of a sink neither stops the others nor the audited request
+type AuditLog struct {
+	names    []string
+	sinks    []auditSink
+	events   *Counter
+	failures []*Counter
+	// health remembers whether the sinks recorded the last event
+	health healthState
+}
+
+// NewAuditLog constructs the audit log writing to the sinks configured, or returns nil if none is
+func NewAuditLog(cfg *Config) (*AuditLog, error) {
+	a := &AuditLog{}
+	if cfg.AuditFile != "" {
+		sink, err := newFileAuditSink(cfg.AuditFile)
+		if err != nil {
+			return nil, err
+		}
+		a.add("file", sink)
+	}
+	if cfg.AuditSyslog != "" {
+		sink, err := newSyslogAuditSink(cfg.AuditSyslog)
+		if err != nil {
+			a.Close(context.Background())
+			return nil, err
+		}
+		a.add("syslog", sink)
+	}
+	if cfg.AuditHTTPURL != "" {
+		a.add("http", newHTTPAuditSink(cfg.AuditHTTPURL, cfg.AuditHTTPToken, cfg.AuditHTTPBuffer))
+	}
+	if len(a.sinks) == 0 {
+		return nil, nil
+	}
+	a.events = metrics.NewCounter("phs_audit_events_total", "Number of audit events recorded")
+	for _, name := range a.names {
+		a.failures = append(a.failures, metrics.NewCounter("phs_audit_sink_failures_total", "Number of audit events a sink failed to record", "sink", name))
+	}
+	logf(logLevelInfo, "Audit: Writing to %v\n", a.names)
+	return a, nil
+}
+
+// add appends the sink
+func (a *AuditLog) add(name string, sink auditSink) {
+	a.names = append(a.names, name)
+	a.sinks = append(a.sinks, sink)
+}
+
+// Record writes the event to all the sinks. It is safe to call on a nil log
+func (a *AuditLog) Record(ev auditEvent) {
+	if a == nil {
+		return
+	}
+	a.events.Inc()
+	var failed error
+	for i, sink := range a.sinks {
+		if err := sink.Write(ev); err != nil {
+			a.failures[i].Inc()
+			logf(logLevelWarn, "Audit: %s sink: %v\n", a.names[i], err)
+			failed = fmt.Errorf("%s sink: %v", a.names[i], err)
+		}
+	}
+	a.health.Record(failed)
+}
+
+// forwarder returns the HTTP forwarder among the sinks, if any
+func (a *AuditLog) forwarder() *httpAuditSink {
+	for _, sink := range a.sinks {
+		if h, ok := sink.(*httpAuditSink); ok {
+			return h
+		}
+	}
+	return nil
+}
+
+// Close flushes and closes all the sinks, returning the first error
+func (a *AuditLog) Close(ctx context.Context) error {
+	if a == nil {
+		return nil
+	}
+	var first error
+	for i, sink := range a.sinks {
+		if err := sink.Close(ctx); err != nil {
+			logf(logLevelError, "Audit: Closing the %s sink: %v\n", a.names[i], err)
+			if first == nil {
+				first = err
+			}
+		}
+	}
+	return first
+}
+
+// auditRequest records the request answered with the status, authenticated by the key unless nil
+func (s *HashService) auditRequest(r *http.Request, key *apiKey, status int) {
+	s.recordAudit(r.Method+" "+r.URL.Path, requestSource(r), r.Header.Get("X-Request-ID"), key, status)
+}
+
+// recordAudit records the action of the source, authenticated by the key unless nil, which ended with
+// the HTTP status
+func (s *HashService) recordAudit(action, source, requestID string, key *apiKey, status int) {
+	if s.audit == nil {
+		return
+	}
+	ev := auditEvent{
+		Time:      time.Now().UTC(),
+		Action:    action,
+		Source:    source,
+		RequestID: requestID,
+		Status:    status,
+		Outcome:   auditOutcome(status),
+	}
+	if key != nil {
+		ev.Actor, ev.Tenant, ev.Residency = key.ID, key.Tenant, s.residencyOf(key.Tenant)
+	}
+	s.audit.Record(ev)
+}
+
+// audited wraps the handler recording the admin operations and the deletions in the audit log,
+// along with the API key authorizing them
+func (s *HashService) audited(scopes map[string]string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if scopes[r.Method] != scopeAdmin && r.Method != http.MethodDelete {
+			handler(w, r)
+			return
+		}
+		rec := &statusRecorder{ResponseWriter: w}
+		defer func() {
+			if rec.status == 0 {
+				rec.status = http.StatusOK
+			}
+			s.auditRequest(r, requestAPIKey(r), rec.status)
+		}()
+		handler(rec, r)
+	}
+}
+
+// fileAuditSink appends the events to a local file, one JSON document per line
+type fileAuditSink struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+// newFileAuditSink opens the file for appending, creating it readable by the owner only
+func newFileAuditSink(path string) (*fileAuditSink, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("audit file: %v", err)
+	}
+	return &fileAuditSink{file: f}, nil
+}
+
+// Write appends the event to the file
+func (f *fileAuditSink) Write(ev auditEvent) error {
+	line, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, err = f.file.Write(append(line, '\n'))
+	return err
+}
+
+// Close syncs and closes the file
+func (f *fileAuditSink) Close(ctx context.Context) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.file.Sync(); err != nil {
+		f.file.Close()
+		return err
+	}
+	return f.file.Close()
+}
+
+// parseSyslogTarget parses the syslog target: local for the local syslog daemon, or journald through
+// its syslog socket, else udp://host:port or tcp://host:port for a remote one
+func parseSyslogTarget(target string) (network, addr string, err error) {
+	if target == "local" {
+		return "", "", nil
+	}
+	u, err := url.Parse(target)
+	if err != nil || (u.Scheme != "udp" && u.Scheme != "tcp") || u.Port() == "" || u.Path != "" {
+		return "", "", fmt.Errorf("audit syslog %q must be local, udp://host:port or tcp://host:port", target)
+	}
+	return u.Scheme, u.Host, nil
+}
+
+// httpAuditSink forwards the events in batches to an HTTP collector, in the background. The events
+// wait in a bounded buffer, so that a slow or unavailable collector never blocks the requests; the
+// events not fitting in the buffer are dropped, as are the batches still failing after the retries
+type httpAuditSink struct {
+	url     string
+	token   string
+	client  *http.Client
+	mu      sync.RWMutex
+	closed  bool
+	events  chan auditEvent
+	quit    chan struct{}
+	done    chan struct{}
+	dropped *Counter
+	// health remembers the outcome of the last delivery attempt
+	health healthState
+}
+
+// newHTTPAuditSink constructs the HTTP forwarder buffering up to size events and starts it
+func newHTTPAuditSink(url, token string, size int) *httpAuditSink {
+	h := &httpAuditSink{
+		url:     url,
+		token:   token,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		events:  make(chan auditEvent, size),
+		quit:    make(chan struct{}),
+		done:    make(chan struct{}),
+		dropped: metrics.NewCounter("phs_audit_dropped_total", "Number of audit events dropped by the HTTP forwarder", "sink", "http"),
+	}
+	metrics.NewGaugeFunc("phs_audit_buffered", "Number of audit events waiting in the HTTP forwarder", func() float64 {
+		return float64(len(h.events))
+	}, "sink", "http")
+	go h.run()
+	return h
+}
+
+// Write queues the event, failing right away if the buffer is full
+func (h *httpAuditSink) Write(ev auditEvent) error {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if h.closed {
+		return errors.New("audit forwarder closed")
+	}
+	select {
+	case h.events <- ev:
+		return nil
+	default:
+		h.dropped.Inc()
+		return errAuditBufferFull
+	}
+}
+
+// Close sends the buffered events until the context is done, then drops those left
+func (h *httpAuditSink) Close(ctx context.Context) error {
+	h.mu.Lock()
+	if !h.closed {
+		h.closed = true
+		close(h.events)
+	}
+	h.mu.Unlock()
+	select {
+	case <-h.done:
+		return nil
+	case <-ctx.Done():
+		close(h.quit)
+		<-h.done
+		return fmt.Errorf("audit forwarder: %d events left unsent: %v", len(h.events), ctx.Err())
+	}
+}
+
+// run sends the events in batches of up to auditBatchSize, at least every auditFlushInterval
+func (h *httpAuditSink) run() {
+	defer close(h.done)
+	ticker := time.NewTicker(auditFlushInterval)
+	defer ticker.Stop()
+	var batch []auditEvent
+	for {
+		select {
+		case ev, ok := <-h.events:
+			if !ok {
+				h.send(batch)
+				return
+			}
+			batch = append(batch, ev)
+			if len(batch) < auditBatchSize {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+		h.send(batch)
+		batch = nil
+	}
+}
+
+// send posts the batch, retrying the failed attempts with an exponential backoff. The batches
+// rejected by the collector with a 4xx status other than 429 are dropped without retrying
+func (h *httpAuditSink) send(batch []auditEvent) {
+	if len(batch) == 0 {
+		return
+	}
+	body, err := json.Marshal(batch)
+	if err != nil {
+		logf(logLevelError, "Audit: Encoding the batch: %v\n", err)
+		return
+	}
+	backoff := time.Second
+	for attempt := 1; ; attempt++ {
+		retry, err := h.post(body)
+		h.health.Record(err)
+		if err == nil {
+			return
+		}
+		if !retry || attempt == auditHTTPAttempts {
+			h.dropped.Add(uint64(len(batch)))
+			logf(logLevelError, "Audit: Dropped %d events after %d attempts: %v\n", len(batch), attempt, err)
+			return
+		}
+		logf(logLevelWarn, "Audit: Forwarding %d events failed, retrying in %v: %v\n", len(batch), backoff, err)
+		select {
+		case <-time.After(backoff):
+		case <-h.quit:
+			h.dropped.Add(uint64(len(batch)))
+			return
+		}
+		if backoff *= 2; backoff > auditMaxBackoff {
+			backoff = auditMaxBackoff
+		}
+	}
+}
+
+// post sends the encoded batch once, telling whether a failure is worth retrying
+func (h *httpAuditSink) post(body []byte) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, h.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if h.token != "" {
+		req.Header.Set("Authorization", "Bearer "+h.token)
+	}
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		return false, nil
+	}
+	retry := resp.StatusCode >= http.StatusInternalServerError || resp.StatusCode == http.StatusTooManyRequests
+	return retry, fmt.Errorf("collector: %s", resp.Status)
+}
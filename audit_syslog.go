@@ -0,0 +1,45 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/syslog"
+)
+
+// syslogAuditSink writes the events to syslog with the auth facility, as JSON documents
+type syslogAuditSink struct {
+	w *syslog.Writer
+}
+
+// newSyslogAuditSink connects to the syslog daemon of the target, see parseSyslogTarget
+func newSyslogAuditSink(target string) (auditSink, error) {
+	network, addr, err := parseSyslogTarget(target)
+	if err != nil {
+		return nil, err
+	}
+	w, err := syslog.Dial(network, addr, syslog.LOG_INFO|syslog.LOG_AUTH, "password-hash-service")
+	if err != nil {
+		return nil, err
+	}
+	return &syslogAuditSink{w: w}, nil
+}
+
+// Write sends the event, with the warning severity if the request was denied
+func (s *syslogAuditSink) Write(ev auditEvent) error {
+	line, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	if ev.Outcome == auditDenied {
+		return s.w.Warning(string(line))
+	}
+	return s.w.Info(string(line))
+}
+
+// Close closes the connection to the syslog daemon
+func (s *syslogAuditSink) Close(ctx context.Context) error {
+	return s.w.Close()
+}
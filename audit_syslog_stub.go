@@ -0,0 +1,11 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package main
+
+import "errors"
+
+// newSyslogAuditSink fails, syslog is not available on this platform
+func newSyslogAuditSink(target string) (auditSink, error) {
+	return nil, errors.New("audit syslog is not supported on this platform")
+}
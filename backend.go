@@ -0,0 +1,194 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// hashRecord represents the stored password hash along with its metadata
+type hashRecord struct {
+	Hash string `json:"hash"`
+	// Algorithm is set for the imported hashes, which are kept in their native encoding
+	Algorithm string `json:"algorithm,omitempty"`
+	// Arm is the experiment arm which calculated the hash, if any
+	Arm string `json:"arm,omitempty"`
+	// Tenant is the tenant of the API key which created the record, if any, which selects its residency region
+	Tenant string `json:"tenant,omitempty"`
+	// Enqueued, Started and Created are the times when the calculation was requested,
+	// when it was picked up by a worker and when it was completed
+	Enqueued time.Time  `json:"enqueued"`
+	Started  time.Time  `json:"started"`
+	Created  time.Time  `json:"created"`
+	Expires  *time.Time `json:"expires,omitempty"`
+	// Unclaimed, if set, is the time the record is purged unless fetched before, the first fetch clears it
+	Unclaimed *time.Time `json:"unclaimed,omitempty"`
+}
+
+// deadline returns the time the record is purged, the earlier of its expiration and its claim deadline, if any
+func (rec *hashRecord) deadline() *time.Time {
+	if rec.Unclaimed != nil && (rec.Expires == nil || rec.Unclaimed.Before(*rec.Expires)) {
+		return rec.Unclaimed
+	}
+	return rec.Expires
+}
+
+// expired checks whether the record has outlived its TTL or its claim deadline
+func (rec *hashRecord) expired(now time.Time) bool {
+	d := rec.deadline()
+	return d != nil && !now.Before(*d)
+}
+
+// HashBackend persists the calculated password hash records
+type HashBackend interface {
+	// Put stores the record under the given identifier
+	Put(id uint64, rec hashRecord) error
+	// Get returns the record stored under the given identifier
+	Get(id uint64) (rec hashRecord, ok bool, err error)
+	// Delete removes the record stored under the given identifier
+	Delete(id uint64) (ok bool, err error)
+	// Scan calls fn for every stored record
+	Scan(fn func(id uint64, rec hashRecord) error) error
+	// Close releases the resources held by the backend
+	Close() error
+}
+
+// storagePinger is implemented by the backends which may become unreachable
+type storagePinger interface {
+	Ping() error
+}
+
+// newHomeBackend constructs the storage backend selected by the configuration
+func newHomeBackend(cfg *Config) (HashBackend, error) {
+	switch cfg.StorageBackend {
+	case "memory":
+		return NewMemoryBackend(), nil
+	case "file":
+		return NewFileBackend(cfg.StorageDir, cfg.StorageCompression)
+	case "tiered":
+		cold, err := NewFileBackend(cfg.StorageDir, cfg.StorageCompression)
+		if err != nil {
+			return nil, err
+		}
+		return NewTieredBackend(cold, cfg.HotTierSize, cfg.HotTierAge), nil
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", cfg.StorageBackend)
+	}
+}
+
+// NewHashBackend constructs the storage backend selected by the configuration, routing the records of
+// the tenants bound to a residency region to the storage of their region
+func NewHashBackend(cfg *Config) (HashBackend, error) {
+	home, err := newHomeBackend(cfg)
+	if err == nil && cfg.StorageMigrateTo != "" {
+		home, err = newDualWriteHome(cfg, home)
+	}
+	if err != nil || cfg.ResidencyRegions == "" {
+		return home, err
+	}
+	residency, err := parseResidency(cfg.ResidencyRegions, cfg.TenantResidency)
+	if err != nil {
+		home.Close()
+		return nil, err
+	}
+	b, err := NewResidencyBackend(home, residency, cfg.StorageCompression)
+	if err != nil {
+		home.Close()
+		return nil, err
+	}
+	return b, nil
+}
+
+// MemoryBackend keeps the password hash records in memory
+type MemoryBackend struct {
+	mu   sync.RWMutex
+	data map[uint64]hashRecord
+	keys map[string]apiKey
+	// idempotency holds the idempotency records by their keys
+	idempotency map[string]idempotencyRecord
+	// meta holds the encoded metadata documents by their names
+	meta map[string][]byte
+}
+
+// NewMemoryBackend constructs a new instance of the in-memory storage backend
+func NewMemoryBackend() *MemoryBackend {
+	return &MemoryBackend{
+		data:        make(map[uint64]hashRecord),
+		keys:        make(map[string]apiKey),
+		idempotency: make(map[string]idempotencyRecord),
+		meta:        make(map[string][]byte),
+	}
+}
+
+// Put stores the record under the given identifier
+func (b *MemoryBackend) Put(id uint64, rec hashRecord) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.data[id] = rec
+	return nil
+}
+
+// Get returns the record stored under the given identifier
+func (b *MemoryBackend) Get(id uint64) (rec hashRecord, ok bool, err error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	rec, ok = b.data[id]
+	return
+}
+
+// Delete removes the record stored under the given identifier
+func (b *MemoryBackend) Delete(id uint64) (ok bool, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	_, ok = b.data[id]
+	delete(b.data, id)
+	return
+}
+
+// Scan calls fn for every stored record
+func (b *MemoryBackend) Scan(fn func(id uint64, rec hashRecord) error) error {
+	b.mu.RLock()
+	records := make(map[uint64]hashRecord, len(b.data))
+	for id, rec := range b.data {
+		records[id] = rec
+	}
+	b.mu.RUnlock()
+	for id, rec := range records {
+		if err := fn(id, rec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PutKey saves the API key
+func (b *MemoryBackend) PutKey(key apiKey) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.keys[key.ID] = key
+	return nil
+}
+
+// GetKey returns the API key with the given identifier
+func (b *MemoryBackend) GetKey(id string) (key apiKey, ok bool, err error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	key, ok = b.keys[id]
+	return
+}
+
+// ListKeys returns all the saved API keys
+func (b *MemoryBackend) ListKeys() ([]apiKey, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	keys := make([]apiKey, 0, len(b.keys))
+	for _, key := range b.keys {
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// Close releases the resources held by the backend
+func (b *MemoryBackend) Close() error {
+	return nil
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// backendTLS configures the TLS connections of the service to a backend
+type backendTLS struct {
+	backend string
+	// ca is the bundle of the certificate authorities trusted instead of the system ones
+	ca string
+	// cert and key are the client certificate presented to the backend
+	cert, key string
+	// serverName overrides the name sent in the SNI and verified in the certificate of the backend
+	serverName string
+	// pins are the SHA-256 digests of the public keys, one of which the certificate chain of the backend must contain
+	pins [][]byte
+}
+
+// backendTLSNames are the backends which can be reached over TLS
+var backendTLSNames = []string{"redis"}
+
+// parseBackendTLS parses the TLS settings of the backends given as "backend:option=value,...;...",
+// e.g. "redis:ca=/etc/phs/ca.pem,cert=/etc/phs/redis.pem,key=/etc/phs/redis.key,server_name=redis.internal,pin=sha256/..."
+func parseBackendTLS(v string) (map[string]*backendTLS, error) {
+	backends := make(map[string]*backendTLS)
+	for _, entry := range strings.Split(v, ";") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		i := strings.Index(entry, ":")
+		if i < 0 {
+			return nil, fmt.Errorf("invalid backend TLS %q", entry)
+		}
+		name := strings.TrimSpace(entry[:i])
+		known := false
+		for _, n := range backendTLSNames {
+			known = known || n == name
+		}
+		if !known {
+			return nil, fmt.Errorf("backend TLS %s: unknown backend, expected one of %s", name, strings.Join(backendTLSNames, ", "))
+		}
+		if _, ok := backends[name]; ok {
+			return nil, fmt.Errorf("duplicate backend TLS %q", name)
+		}
+		b := &backendTLS{backend: name}
+		for _, option := range strings.Split(entry[i+1:], ",") {
+			if strings.TrimSpace(option) == "" {
+				continue
+			}
+			j := strings.Index(option, "=")
+			if j < 0 {
+				return nil, fmt.Errorf("backend TLS %s: invalid option %q", name, option)
+			}
+			value := strings.TrimSpace(option[j+1:])
+			switch key := strings.TrimSpace(option[:j]); key {
+			case "ca":
+				b.ca = value
+			case "cert":
+				b.cert = value
+			case "key":
+				b.key = value
+			case "server_name":
+				b.serverName = value
+			case "pin":
+				pin, err := parsePublicKeyPin(value)
+				if err != nil {
+					return nil, fmt.Errorf("backend TLS %s: %v", name, err)
+				}
+				b.pins = append(b.pins, pin)
+			default:
+				return nil, fmt.Errorf("backend TLS %s: unknown option %q", name, key)
+			}
+		}
+		if (b.cert == "") != (b.key == "") {
+			return nil, fmt.Errorf("backend TLS %s: both the client certificate and key must be given", name)
+		}
+		backends[name] = b
+	}
+	return backends, nil
+}
+
+// parsePublicKeyPin parses a pin given as sha256/ followed by the base64 digest of the public key,
+// as printed by openssl x509 -pubkey -noout | openssl pkey -pubin -outform der | openssl dgst -sha256 -binary | base64
+func parsePublicKeyPin(v string) ([]byte, error) {
+	if !strings.HasPrefix(v, "sha256/") {
+		return nil, fmt.Errorf("invalid pin %q, expected sha256/<base64 digest>", v)
+	}
+	pin, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(v, "sha256/"))
+	if err != nil || len(pin) != sha256.Size {
+		return nil, fmt.Errorf("invalid pin %q, expected sha256/<base64 digest>", v)
+	}
+	return pin, nil
+}
+
+// clientConfig loads the certificates and returns the TLS configuration of the connections to the backend,
+// verifying the pins once the certificate chain has been verified
+func (b *backendTLS) clientConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{ServerName: b.serverName}
+	if b.ca != "" {
+		pool, err := loadCertPool(b.ca)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if b.cert != "" {
+		cert, err := tls.LoadX509KeyPair(b.cert, b.key)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	if len(b.pins) > 0 {
+		tlsConfig.VerifyConnection = func(cs tls.ConnectionState) error {
+			if err := verifyPublicKeyPins(cs.PeerCertificates, b.pins); err != nil {
+				return fmt.Errorf("%s backend %s: %v", b.backend, cs.ServerName, err)
+			}
+			return nil
+		}
+	}
+	return tlsConfig, nil
+}
+
+// verifyPublicKeyPins returns an error unless one of the certificates has one of the pinned public keys
+func verifyPublicKeyPins(certs []*x509.Certificate, pins [][]byte) error {
+	for _, cert := range certs {
+		digest := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+		for _, pin := range pins {
+			if bytes.Equal(digest[:], pin) {
+				return nil
+			}
+		}
+	}
+	return errors.New("none of the certificates has a pinned public key")
+}
+
+// backendClientConfig returns the TLS configuration of the connections to the backend,
+// nil if no TLS settings are given for it
+func backendClientConfig(cfg *Config, backend string) (*tls.Config, error) {
+	backends, err := parseBackendTLS(cfg.BackendTLS)
+	if err != nil {
+		return nil, err
+	}
+	b, ok := backends[backend]
+	if !ok {
+		return nil, nil
+	}
+	return b.clientConfig()
+}
+
+// backendClientCerts returns the client certificate and key files of the backends by their names
+func backendClientCerts(cfg *Config) map[string][2]string {
+	backends, _ := parseBackendTLS(cfg.BackendTLS)
+	certs := make(map[string][2]string)
+	for name, b := range backends {
+		if b.cert != "" {
+			certs[name] = [2]string{b.cert, b.key}
+		}
+	}
+	return certs
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// minRetryAfter is the shortest retry interval suggested to the throttled clients
+const minRetryAfter = time.Second
+
+// backoffGuidance represents the hints returned to the throttled clients.
+// The durations are reported in milliseconds
+type backoffGuidance struct {
+	Error           string `json:"error"`
+	QueueDepth      int    `json:"queue_depth"`
+	EstimatedWaitMs int64  `json:"estimated_wait_ms"`
+	RetryAfterMs    int64  `json:"retry_after_ms"`
+}
+
+// backoffGuidance estimates how long the pending hash calculations take to drain
+// and when the client should retry
+func (s *HashService) backoffGuidance(message string) backoffGuidance {
+	detailed := s.storage.DetailedStats()
+	hashDuration := time.Duration(detailed.AverageHashDuration) * time.Microsecond
+
+	// The whole queue drains in the estimated wait, while a single slot frees up much earlier
+	var estimatedWait, retryAfter time.Duration
+	if rate := detailed.Throughput["1m"]; rate > 0 {
+		perJob := time.Duration(float64(time.Second) / rate)
+		estimatedWait = perJob * time.Duration(detailed.Pending)
+		retryAfter = perJob
+	} else {
+		// No recent completions to judge by, so rely on the configured delay
+		estimatedWait = s.cfg.HashDelay + hashDuration*time.Duration(detailed.Pending)/time.Duration(s.cfg.Workers)
+		retryAfter = s.cfg.HashDelay
+	}
+	if retryAfter < minRetryAfter {
+		retryAfter = minRetryAfter
+	}
+	if estimatedWait > minRetryAfter && retryAfter > estimatedWait {
+		retryAfter = estimatedWait
+	}
+	return backoffGuidance{
+		Error:           message,
+		QueueDepth:      detailed.Pending,
+		EstimatedWaitMs: estimatedWait.Milliseconds(),
+		RetryAfterMs:    retryAfter.Milliseconds(),
+	}
+}
+
+// writeThrottled replies with the status and the backoff guidance, along with the Retry-After header
+func (s *HashService) writeThrottled(w http.ResponseWriter, status int, message string) {
+	guidance := s.backoffGuidance(message)
+	retryAfter := int64(math.Ceil(float64(guidance.RetryAfterMs) / 1000))
+	w.Header().Set("Retry-After", strconv.FormatInt(retryAfter, 10))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(guidance)
+}
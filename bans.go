@@ -0,0 +1,204 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxTrackedSources bounds the number of sources whose failing requests are counted.
+// The counts are cleared when exceeded
+const maxTrackedSources = 100000
+
+// sourceActivity counts the requests of a source in the current window
+type sourceActivity struct {
+	windowStart time.Time
+	requests    int
+	errors      int
+}
+
+// sourceBan is a temporary ban of a source
+type sourceBan struct {
+	Source   string    `json:"source"`
+	Reason   string    `json:"reason"`
+	Requests int       `json:"requests"`
+	Errors   int       `json:"errors"`
+	Since    time.Time `json:"since"`
+	Until    time.Time `json:"until"`
+}
+
+// BanList counts the failing requests of each source, such as the probing of the hash identifiers,
+// and temporarily bans the sources exceeding the threshold within the window
+type BanList struct {
+	mu        sync.Mutex
+	threshold int
+	window    time.Duration
+	duration  time.Duration
+	sources   map[string]*sourceActivity
+	bans      map[string]sourceBan
+
+	banned   *Counter
+	rejected *Counter
+}
+
+// NewBanList constructs a new instance of the ban list banning the sources for the duration
+// once their failing requests reach the threshold within the window
+func NewBanList(threshold int, window, duration time.Duration) *BanList {
+	l := &BanList{
+		threshold: threshold,
+		window:    window,
+		duration:  duration,
+		sources:   make(map[string]*sourceActivity),
+		bans:      make(map[string]sourceBan),
+		banned:    metrics.NewCounter("phs_bans_total", "Number of sources banned for sending too many failing requests"),
+		rejected:  metrics.NewCounter("phs_banned_requests_total", "Number of requests rejected because their source is banned"),
+	}
+	metrics.NewGaugeFunc("phs_bans_active", "Number of sources currently banned", func() float64 {
+		return float64(len(l.List(time.Now())))
+	})
+	return l
+}
+
+// isClientError checks whether the response status counts as a failing request of the source.
+// The throttling and the server errors are not the fault of the source
+func isClientError(status int) bool {
+	switch status {
+	case http.StatusBadRequest, http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound,
+		http.StatusMethodNotAllowed, http.StatusRequestURITooLong, http.StatusUnprocessableEntity:
+		return true
+	}
+	return false
+}
+
+// Banned returns the ban of the source, if any
+func (l *BanList) Banned(source string, now time.Time) (sourceBan, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	ban, ok := l.bans[source]
+	if ok && !now.Before(ban.Until) {
+		delete(l.bans, source)
+		return sourceBan{}, false
+	}
+	return ban, ok
+}
+
+// Record counts the request of the source answered with the status, banning the source
+// once its failing requests reach the threshold
+func (l *BanList) Record(source string, status int, now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	a, ok := l.sources[source]
+	if !ok || now.Sub(a.windowStart) >= l.window {
+		if !ok && len(l.sources) >= maxTrackedSources {
+			l.sources = make(map[string]*sourceActivity)
+		}
+		a = &sourceActivity{windowStart: now}
+		l.sources[source] = a
+	}
+	a.requests++
+	if !isClientError(status) {
+		return
+	}
+	a.errors++
+	if a.errors < l.threshold {
+		return
+	}
+	ban := sourceBan{
+		Source:   source,
+		Reason:   strconv.Itoa(a.errors) + " failing requests within " + l.window.String(),
+		Requests: a.requests,
+		Errors:   a.errors,
+		Since:    now.UTC(),
+		Until:    now.Add(l.duration).UTC(),
+	}
+	l.bans[source] = ban
+	delete(l.sources, source)
+	l.banned.Inc()
+	logf(logLevelWarn, "Banned %s until %v: %s\n", source, ban.Until.Format(time.RFC3339), ban.Reason)
+}
+
+// List returns the active bans ordered by their start
+func (l *BanList) List(now time.Time) []sourceBan {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	bans := make([]sourceBan, 0, len(l.bans))
+	for source, ban := range l.bans {
+		if !now.Before(ban.Until) {
+			delete(l.bans, source)
+			continue
+		}
+		bans = append(bans, ban)
+	}
+	sort.Slice(bans, func(i, j int) bool { return bans[i].Since.Before(bans[j].Since) })
+	return bans
+}
+
+// Lift removes the ban of the source. It returns ErrNotFound if the source is not banned
+func (l *BanList) Lift(source string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.bans[source]; !ok {
+		return ErrNotFound
+	}
+	delete(l.bans, source)
+	logf(logLevelInfo, "Lifted the ban of %s\n", source)
+	return nil
+}
+
+// requestSource returns the address of the client sending the request
+func requestSource(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// statusRecorder remembers the status of the response
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+// WriteHeader remembers the status and writes it
+func (w *statusRecorder) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Write writes the body, with the status 200 OK unless set before
+func (w *statusRecorder) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// banSources rejects the requests of the banned sources with 403 Forbidden and counts the failing
+// requests of the others. The ops routes and the ban management are always served
+func (s *HashService) banSources(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isOpsRoute(r) || strings.HasPrefix(r.URL.Path, adminBansPath) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		source := requestSource(r)
+		now := time.Now()
+		if ban, ok := s.bans.Banned(source, now); ok {
+			s.bans.rejected.Inc()
+			logf(logLevelDebug, "Forbidden: %s is banned (%v)\n", source, r.URL)
+			w.Header().Set("Retry-After", strconv.FormatInt(int64(ban.Until.Sub(now)/time.Second)+1, 10))
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		s.bans.Record(source, rec.status, now)
+	})
+}
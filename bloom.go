@@ -0,0 +1,87 @@
+package main
+
+import (
+	"math"
+	"sync"
+)
+
+// bloomFilter remembers the identifiers assigned to the records, so that the lookups of the
+// identifiers which definitely do not exist are answered without reaching the backend.
+// The identifiers are never removed, the deleted records only cost the backend lookup
+type bloomFilter struct {
+	mu     sync.RWMutex
+	bits   []uint64
+	hashes uint64
+	// count is the number of the added identifiers, reported along with the capacity
+	count    int
+	capacity int
+	skips    *Counter
+}
+
+// newBloomFilter constructs a new instance of the filter sized for the capacity identifiers
+// at the false positive rate. The rate grows once the capacity is exceeded
+func newBloomFilter(capacity int, fpRate float64) *bloomFilter {
+	m := math.Ceil(-float64(capacity) * math.Log(fpRate) / (math.Ln2 * math.Ln2))
+	k := math.Max(1, math.Round(m/float64(capacity)*math.Ln2))
+	f := &bloomFilter{
+		bits:     make([]uint64, (uint64(m)+63)/64),
+		hashes:   uint64(k),
+		capacity: capacity,
+		skips:    metrics.NewCounter("phs_bloom_filter_skips_total", "Number of hash lookups answered by the bloom filter without reaching the backend"),
+	}
+	metrics.NewGaugeFunc("phs_bloom_filter_entries", "Number of identifiers added to the bloom filter", func() float64 {
+		f.mu.RLock()
+		defer f.mu.RUnlock()
+		return float64(f.count)
+	})
+	metrics.NewGaugeFunc("phs_bloom_filter_capacity", "Number of identifiers the bloom filter is sized for", func() float64 {
+		return float64(capacity)
+	})
+	return f
+}
+
+// splitmix64 scrambles the identifier, the consecutive identifiers would otherwise set adjacent bits
+func splitmix64(x uint64) uint64 {
+	x += 0x9e3779b97f4a7c15
+	x = (x ^ (x >> 30)) * 0xbf58476d1ce4e5b9
+	x = (x ^ (x >> 27)) * 0x94d049bb133111eb
+	return x ^ (x >> 31)
+}
+
+// positions calls fn with the bit positions of the identifier, derived by the double hashing
+func (f *bloomFilter) positions(id uint64, fn func(pos uint64) bool) {
+	h1 := splitmix64(id)
+	h2 := splitmix64(h1) | 1
+	size := uint64(len(f.bits)) * 64
+	for i := uint64(0); i < f.hashes; i++ {
+		if !fn((h1 + i*h2) % size) {
+			return
+		}
+	}
+}
+
+// Add remembers the identifier
+func (f *bloomFilter) Add(id uint64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.positions(id, func(pos uint64) bool {
+		f.bits[pos/64] |= 1 << (pos % 64)
+		return true
+	})
+	f.count++
+}
+
+// MayContain checks whether the identifier may have been added. The false result is certain
+func (f *bloomFilter) MayContain(id uint64) bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	found := true
+	f.positions(id, func(pos uint64) bool {
+		found = f.bits[pos/64]&(1<<(pos%64)) != 0
+		return found
+	})
+	if !found {
+		f.skips.Inc()
+	}
+	return found
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+)
+
+// bootstrapMetaName is the name of the metadata document recording the bootstrap
+const bootstrapMetaName = "bootstrap"
+
+// errAlreadyBootstrapped is returned when the storage already holds the API keys or has been bootstrapped before
+var errAlreadyBootstrapped = errors.New("already bootstrapped")
+
+// bootstrapRecord records when the initial admin key has been provisioned
+type bootstrapRecord struct {
+	Created time.Time `json:"created"`
+	KeyID   string    `json:"key_id"`
+	Tenant  string    `json:"tenant,omitempty"`
+}
+
+// runBootstrap runs the bootstrap subcommand and returns the exit code. It provisions the initial admin key
+// in the storage directory of the configuration and prints it as JSON. The exit code is 3 if the storage
+// has been bootstrapped before, so that the provisioning scripts can tell it from a failure
+func runBootstrap(args []string) int {
+	fs := flag.NewFlagSet("bootstrap", flag.ContinueOnError)
+	name := fs.String("name", "Bootstrap admin key", "Name of the admin key")
+	tenant := fs.String("tenant", "", "Tenant of the admin key")
+	cfg, err := LoadConfig(fs, args)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "bootstrap: %v\n", err)
+		return 2
+	}
+	info, err := bootstrap(cfg, *name, *tenant)
+	if err == errAlreadyBootstrapped {
+		fmt.Fprintf(os.Stderr, "bootstrap: %v\n", err)
+		return 3
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "bootstrap: %v\n", err)
+		return 1
+	}
+	// The token is printed this once and is not stored anywhere
+	json.NewEncoder(os.Stdout).Encode(info)
+	return 0
+}
+
+// bootstrap creates the admin key unless the storage holds any keys or has been bootstrapped before
+func bootstrap(cfg *Config, name, tenant string) (apiKeyInfo, error) {
+	if cfg.StorageBackend == "memory" {
+		return apiKeyInfo{}, errors.New("bootstrapping requires a persistent storage backend")
+	}
+	if cfg.Replica {
+		return apiKeyInfo{}, ErrReadOnly
+	}
+	backend, err := NewHashBackend(cfg)
+	if err != nil {
+		return apiKeyInfo{}, err
+	}
+	meta := backend.(metadataStore)
+	var rec bootstrapRecord
+	ok, err := meta.GetMeta(bootstrapMetaName, &rec)
+	if err != nil {
+		return apiKeyInfo{}, err
+	}
+	if ok {
+		return apiKeyInfo{}, errAlreadyBootstrapped
+	}
+	keys := NewKeyManager(backend.(apiKeyStore), "", false)
+	existing, err := keys.List()
+	if err != nil {
+		return apiKeyInfo{}, err
+	}
+	if len(existing) > 0 {
+		return apiKeyInfo{}, errAlreadyBootstrapped
+	}
+	info, err := keys.Create(name, tenant, []string{scopeAdmin}, 0)
+	if err != nil {
+		return apiKeyInfo{}, err
+	}
+	rec = bootstrapRecord{Created: info.Created, KeyID: info.ID, Tenant: tenant}
+	if err := meta.PutMeta(bootstrapMetaName, rec); err != nil {
+		return apiKeyInfo{}, err
+	}
+	return info, nil
+}
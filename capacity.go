@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bufio"
+	"math"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// calibrationRounds is the number of hashes calculated to measure the hash cost on this host
+const calibrationRounds = 2000
+
+var (
+	calibrationOnce     sync.Once
+	calibrationDuration time.Duration
+)
+
+// calibrateHash returns the time a single hash calculation takes on this host.
+// It is measured once, on the first call
+func calibrateHash() time.Duration {
+	calibrationOnce.Do(func() {
+		pw := strings.Repeat("x", 32)
+		start := time.Now()
+		for i := 0; i < calibrationRounds; i++ {
+			calculateHash(pw)
+		}
+		calibrationDuration = time.Since(start) / calibrationRounds
+	})
+	return calibrationDuration
+}
+
+// CapacityReport represents the estimated capacity of the instance.
+// The durations are reported in microseconds, the rates in hashes per second
+type CapacityReport struct {
+	Algorithm          string  `json:"algorithm"`
+	Workers            int     `json:"workers"`
+	CPUs               int     `json:"cpus"`
+	HostMemoryBytes    uint64  `json:"host_memory_bytes,omitempty"`
+	ProcessMemoryBytes uint64  `json:"process_memory_bytes"`
+	CalibratedHash     float64 `json:"calibrated_hash_duration"`
+	ObservedHash       uint64  `json:"observed_hash_duration,omitempty"`
+	ComputeLimit       float64 `json:"compute_limit"`
+	AdmissionLimit     float64 `json:"admission_limit,omitempty"`
+	MaxSustainable     float64 `json:"max_sustainable"`
+	LimitingFactor     string  `json:"limiting_factor"`
+	CurrentThroughput  float64 `json:"current_throughput"`
+	Utilization        float64 `json:"utilization"`
+	TargetRate         float64 `json:"target_rate,omitempty"`
+	InstancesForTarget int     `json:"instances_for_target,omitempty"`
+}
+
+// capacityReport estimates the maximal sustainable hash rate of the instance.
+// The workers calculating the hashes in parallel are bounded by the number of CPUs;
+// the hash cost is the observed average, or the calibrated one before enough hashes
+// have been calculated. Since every password waits for the hash delay while holding
+// a queue slot, the queue size divided by the delay bounds the admission rate.
+// If target is positive, the number of instances required to sustain it is estimated
+func (s *HashService) capacityReport(target float64) CapacityReport {
+	detailed := s.storage.DetailedStats()
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	report := CapacityReport{
+		Algorithm:          "sha512",
+		Workers:            s.cfg.Workers,
+		CPUs:               runtime.NumCPU(),
+		HostMemoryBytes:    hostMemory(),
+		ProcessMemoryBytes: mem.Sys,
+		CalibratedHash:     float64(calibrateHash()) / float64(time.Microsecond),
+		CurrentThroughput:  detailed.Throughput["1m"],
+	}
+
+	hashDuration := calibrateHash()
+	// A handful of samples is dominated by the scheduling noise, while the averages
+	// below a microsecond are not resolved. The calculations of the last 15 minutes,
+	// timed without the delay and the queue wait, reflect the current hash parameters
+	if recent := detailed.Phases["15m"]; recent.Completed >= 100 && recent.Compute > 0 {
+		report.ObservedHash = recent.Compute
+		hashDuration = time.Duration(recent.Compute) * time.Microsecond
+	} else if detailed.Completed >= 100 && detailed.AverageHashDuration > 0 {
+		report.ObservedHash = detailed.AverageHashDuration
+		hashDuration = time.Duration(detailed.AverageHashDuration) * time.Microsecond
+	}
+	if hashDuration <= 0 {
+		hashDuration = time.Microsecond
+	}
+	parallel := report.Workers
+	if parallel > report.CPUs {
+		parallel = report.CPUs
+	}
+	report.ComputeLimit = float64(parallel) / hashDuration.Seconds()
+	report.MaxSustainable = report.ComputeLimit
+	report.LimitingFactor = "cpu"
+	if report.Workers < report.CPUs {
+		report.LimitingFactor = "workers"
+	}
+	if s.cfg.HashDelay > 0 {
+		report.AdmissionLimit = float64(s.cfg.QueueSize) / (s.cfg.HashDelay + hashDuration).Seconds()
+		if report.AdmissionLimit < report.MaxSustainable {
+			report.MaxSustainable = report.AdmissionLimit
+			report.LimitingFactor = "queue"
+		}
+	}
+	report.Utilization = report.CurrentThroughput / report.MaxSustainable
+	if target > 0 {
+		report.TargetRate = target
+		report.InstancesForTarget = int(math.Ceil(target / report.MaxSustainable))
+	}
+	return report
+}
+
+// hostMemory returns the total memory of the host, or 0 if it cannot be determined
+func hostMemory() uint64 {
+	f, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "MemTotal:" {
+			kb, err := strconv.ParseUint(fields[1], 10, 64)
+			if err != nil {
+				return 0
+			}
+			return kb * 1024
+		}
+	}
+	return 0
+}
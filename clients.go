@@ -0,0 +1,10 @@
+//go:build clients
+// +build clients
+
+// The Python and TypeScript clients are generated from the OpenAPI document served at /openapi.json.
+// The generator runs with npx, so it requires Node.js and Java
+
+//go:generate npx --yes @openapitools/openapi-generator-cli generate -i openapi.json -g python -o clients/python --package-name password_hash_client --additional-properties=packageVersion=1.0.0
+//go:generate npx --yes @openapitools/openapi-generator-cli generate -i openapi.json -g typescript-fetch -o clients/typescript --additional-properties=npmName=password-hash-client,npmVersion=1.0.0,supportsES6=true
+
+package main
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// diskBlockSize is the allocation unit used to estimate the on-disk size of the records
+	diskBlockSize = 4096
+	// staleTempAge is the age after which the leftover temporary files are considered abandoned
+	staleTempAge = time.Minute
+)
+
+// StorageUsage represents the storage backend usage report
+type StorageUsage struct {
+	Backend        string     `json:"backend"`
+	Records        uint64     `json:"records"`
+	HotRecords     *uint64    `json:"hot_records,omitempty"`
+	LogicalBytes   int64      `json:"logical_bytes"`
+	DiskBytes      int64      `json:"disk_bytes"`
+	Fragmentation  float64    `json:"fragmentation"`
+	LastCompaction *time.Time `json:"last_compaction,omitempty"`
+	// Migration reports the progress of the migration to another backend, if any
+	Migration *MigrationStatus `json:"migration,omitempty"`
+}
+
+// storageUsageReporter is implemented by the backends able to report their usage
+type storageUsageReporter interface {
+	Usage() (StorageUsage, error)
+}
+
+// storageCompactor is implemented by the backends requiring periodic compaction
+type storageCompactor interface {
+	Compact() error
+}
+
+// Usage reports the number of records kept in memory
+func (b *MemoryBackend) Usage() (StorageUsage, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return StorageUsage{Backend: "memory", Records: uint64(len(b.data))}, nil
+}
+
+// Usage reports the number of records and the space they occupy on disk.
+// The fragmentation is the share of the disk space not occupied by the record data
+func (b *FileBackend) Usage() (StorageUsage, error) {
+	usage := StorageUsage{Backend: "file"}
+	err := filepath.Walk(b.dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			usage.DiskBytes += diskBlockSize
+			if path != b.dir && !isShardDir(info) {
+				// Only the shard directories hold the records
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		usage.DiskBytes += (info.Size() + diskBlockSize - 1) / diskBlockSize * diskBlockSize
+		if strings.HasSuffix(info.Name(), recordFileExt) {
+			usage.Records++
+			usage.LogicalBytes += info.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		return usage, err
+	}
+	if usage.DiskBytes > 0 {
+		usage.Fragmentation = 1 - float64(usage.LogicalBytes)/float64(usage.DiskBytes)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.lastCompaction.IsZero() {
+		last := b.lastCompaction
+		usage.LastCompaction = &last
+	}
+	return usage, nil
+}
+
+// Compact removes the temporary files abandoned by interrupted writes and the empty shard directories
+func (b *FileBackend) Compact() error {
+	shards, err := ioutil.ReadDir(b.dir)
+	if err != nil {
+		return err
+	}
+	removed := 0
+	for _, shard := range shards {
+		if !isShardDir(shard) {
+			continue
+		}
+		shardPath := filepath.Join(b.dir, shard.Name())
+		files, err := ioutil.ReadDir(shardPath)
+		if err != nil {
+			return err
+		}
+		left := len(files)
+		for _, f := range files {
+			if strings.HasPrefix(f.Name(), recordTempPrefix) && time.Since(f.ModTime()) > staleTempAge {
+				if err := os.Remove(filepath.Join(shardPath, f.Name())); err != nil {
+					return err
+				}
+				removed++
+				left--
+			}
+		}
+		if left == 0 {
+			// Put may be creating a record in the directory concurrently, so do not insist
+			if os.Remove(shardPath) == nil {
+				removed++
+			}
+		}
+	}
+
+	b.mu.Lock()
+	b.lastCompaction = time.Now().UTC()
+	b.mu.Unlock()
+	logf(logLevelDebug, "Storage compaction removed %d stale entries\n", removed)
+	return nil
+}
+
+// Usage reports the usage of the cold tier along with the number of hot records
+func (b *TieredBackend) Usage() (StorageUsage, error) {
+	var usage StorageUsage
+	if r, ok := b.cold.(storageUsageReporter); ok {
+		var err error
+		if usage, err = r.Usage(); err != nil {
+			return usage, err
+		}
+	}
+	b.mu.Lock()
+	hot := uint64(b.lru.Len())
+	b.mu.Unlock()
+	usage.Backend = "tiered"
+	usage.HotRecords = &hot
+	return usage, nil
+}
+
+// Compact compacts the cold tier
+func (b *TieredBackend) Compact() error {
+	if c, ok := b.cold.(storageCompactor); ok {
+		return c.Compact()
+	}
+	return nil
+}
+
+// runCompaction periodically compacts the storage backend until done is closed
+func runCompaction(c storageCompactor, interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if err := c.Compact(); err != nil {
+				logf(logLevelError, "Storage compaction failed: %v\n", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io/ioutil"
+)
+
+// Compression algorithms of the stored records
+const (
+	compressionNone = "none"
+	compressionGzip = "gzip"
+	compressionZstd = "zstd"
+)
+
+// Magic numbers starting the compressed files. The uncompressed records are JSON objects
+// starting with '{', so the files written with any setting can be told apart on reading
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// errZstdUnsupported reports that the binary was built without the zstd compression
+var errZstdUnsupported = errors.New("zstd support is not compiled in, rebuild with -tags zstd")
+
+// compressionSupported checks whether the records can be written with the compression algorithm
+func compressionSupported(algorithm string) bool {
+	switch algorithm {
+	case compressionNone, compressionGzip:
+		return true
+	case compressionZstd:
+		return zstdSupported
+	}
+	return false
+}
+
+// compressRecord compresses the serialized record with the algorithm
+func compressRecord(algorithm string, data []byte) ([]byte, error) {
+	switch algorithm {
+	case "", compressionNone:
+		return data, nil
+	case compressionGzip:
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		if _, err := zw.Write(data); err != nil {
+			return nil, err
+		}
+		if err := zw.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case compressionZstd:
+		return compressZstd(data)
+	}
+	return nil, fmt.Errorf("unknown compression %q", algorithm)
+}
+
+// decompressRecord returns the serialized record, detecting the compression by its magic number
+func decompressRecord(data []byte) ([]byte, error) {
+	switch {
+	case bytes.HasPrefix(data, gzipMagic):
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		return ioutil.ReadAll(zr)
+	case bytes.HasPrefix(data, zstdMagic):
+		return decompressZstd(data)
+	}
+	return data, nil
+}
@@ -0,0 +1,18 @@
+//go:build !zstd
+// +build !zstd
+
+package main
+
+// zstdSupported tells whether the binary is built with the zstd compression.
+// zstd requires github.com/klauspost/compress
+const zstdSupported = false
+
+// compressZstd reports that the binary was built without the zstd compression
+func compressZstd(data []byte) ([]byte, error) {
+	return nil, errZstdUnsupported
+}
+
+// decompressZstd reports that the binary was built without the zstd compression
+func decompressZstd(data []byte) ([]byte, error) {
+	return nil, errZstdUnsupported
+}
@@ -0,0 +1,25 @@
+//go:build zstd
+// +build zstd
+
+package main
+
+import "github.com/klauspost/compress/zstd"
+
+// zstdSupported tells whether the binary is built with the zstd compression
+const zstdSupported = true
+
+// The encoder and the decoder are safe for the concurrent EncodeAll and DecodeAll calls
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil)
+	zstdDecoder, _ = zstd.NewReader(nil)
+)
+
+// compressZstd compresses the data with zstd
+func compressZstd(data []byte) ([]byte, error) {
+	return zstdEncoder.EncodeAll(data, nil), nil
+}
+
+// decompressZstd decompresses the zstd compressed data
+func decompressZstd(data []byte) ([]byte, error) {
+	return zstdDecoder.DecodeAll(data, nil)
+}
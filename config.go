@@ -0,0 +1,1284 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config represents the password hashing service settings
+type Config struct {
+	Addr string
+	// ExternalURL is the base URL of the service as seen by the clients, used in the Location headers
+	ExternalURL string
+	// TrustForwardedHeaders honors the X-Forwarded-* headers of the proxy in the Location headers
+	TrustForwardedHeaders bool
+	OpsAddr               string
+	// ReadinessFile is the path of the file describing the started instance, see announceStartup
+	ReadinessFile  string
+	HashDelay      time.Duration
+	Sync           bool
+	Workers        int
+	QueueSize      int
+	StorageBackend string
+	StorageDir     string
+	// StorageCompression is the compression of the records written by the file-based backends
+	StorageCompression string
+	HotTierSize        int
+	HotTierAge         time.Duration
+	Compaction         time.Duration
+	DefaultTTL         time.Duration
+	ReaperInterval     time.Duration
+	ShutdownDelay      time.Duration
+	// ShutdownDelayP99Multiple extends the shutdown delay by that many p99 request latencies, up to ShutdownDelayMax
+	ShutdownDelayP99Multiple float64
+	ShutdownDelayMax         time.Duration
+	ShutdownHookTimeout      time.Duration
+	Replica                  bool
+	// PrimaryURL is the primary instance serving the strongly consistent reads of a replica
+	PrimaryURL string
+	// StandbyOf is the active instance watched by a standby replica, which promotes itself once
+	// the active fails its health checks for StandbyFailoverAfter
+	StandbyOf            string
+	StandbyPollInterval  time.Duration
+	StandbyFailoverAfter time.Duration
+	// RegistrationURL receives the readiness document of the instance on startup and on promotion
+	RegistrationURL  string
+	StatsSnapshot    time.Duration
+	StatsPushURL     string
+	StatsPushToken   string
+	Aggregator       bool
+	InstanceID       string
+	RegionID         int
+	WarmupDuration   time.Duration
+	WarmupCount      uint64
+	JournalRate      float64
+	JournalSize      int
+	HedgeWindow      time.Duration
+	NegativeCacheTTL time.Duration
+	// TombstoneTTL is the time the records purged by the retention are answered with 410 Gone, 0 answers 404
+	TombstoneTTL time.Duration
+	// CallerSalts allows the callers to supply the salts of the hash calculations
+	CallerSalts bool
+	// Experiment* define the experiment hashing a share of the passwords with alternate parameters
+	ExperimentName string
+	ExperimentArms string
+	// HardeningSchedule raises the cost of the new hashes over time, see parseHardeningSchedule
+	HardeningSchedule string
+	// BloomFilter* size the filter of the identifiers answering the lookups of the nonexistent ones
+	BloomFilterCapacity int
+	BloomFilterFPRate   float64
+	TimingHeaders       bool
+	TimingJitter        time.Duration
+	IdempotencyWindow   time.Duration
+	IdempotencySecret   string
+	AuthEnabled         bool
+	AdminKey            string
+	// WriteBatch* configure the batched writes of the completed hashes
+	WriteBatchSize  int
+	WriteBatchDelay time.Duration
+	WriteBatchSync  bool
+	// MaxConcurrentRequests bounds the public requests served at once, 0 means unlimited
+	MaxConcurrentRequests int
+	// RouteWeights and RouteCaps set the share and the concurrency limit of the route classes,
+	// QueueTimeout is the time the requests over a limit wait for a slot
+	RouteWeights string
+	RouteCaps    string
+	QueueTimeout time.Duration
+	// DeprecatedRoutes lists the routes being retired, see parseDeprecatedRoutes
+	DeprecatedRoutes string
+	// Ban* configure the temporary bans of the sources sending too many failing requests
+	BanThreshold int
+	BanWindow    time.Duration
+	BanDuration  time.Duration
+	// RateLimit* configure the per client rate limit, kept in the Redis server at RateLimitRedis unless empty
+	RateLimit             float64
+	RateLimitBurst        int
+	RateLimitRedis        string
+	RateLimitRedisTimeout time.Duration
+	// MirrorURL is the base URL of the instance receiving MirrorPercent of the POST /hash requests, empty disables the mirroring
+	MirrorURL     string
+	MirrorPercent float64
+	// MirrorCredentials copies the credentials of the clients to the mirrored requests
+	MirrorCredentials bool
+	// FederationPeers lists the deployments owning parts of the namespace, see parseFederationPeers
+	FederationPeers   string
+	FederationToken   string
+	FederationTimeout time.Duration
+	// AutoMigrate applies the pending storage migrations at startup
+	AutoMigrate bool
+	// Alert* are the thresholds of the alerts on the queue and the replication, 0 disables them
+	AlertQueueDepth     int
+	AlertPendingAge     time.Duration
+	AlertReplicationLag time.Duration
+	// AlertWebhook* configure the endpoint notified of the alerts starting and stopping to fire
+	AlertWebhookURL   string
+	AlertWebhookToken string
+	// OIDC* configure the sign in of the admin users with an OIDC provider
+	OIDCIssuer       string
+	OIDCClientID     string
+	OIDCClientSecret string
+	OIDCRedirectURL  string
+	OIDCGroupsClaim  string
+	OIDCGroupScopes  string
+	OIDCSessionTTL   time.Duration
+	TLSCertFile      string
+	TLSKeyFile       string
+	// Replication* configure the shipping of the completed records to a peer instance over mTLS
+	ReplicationPeer     string
+	ReplicationCert     string
+	ReplicationKey      string
+	ReplicationCA       string
+	ReplicationClientCA string
+	ReplicationInterval time.Duration
+	LogLevel            string
+	// Audit* configure the sinks of the audit log, see NewAuditLog
+	AuditFile       string
+	AuditSyslog     string
+	AuditHTTPURL    string
+	AuditHTTPToken  string
+	AuditHTTPBuffer int
+	// ResidencyRegions and TenantResidency bind the tenants to the storage of their regions, see parseResidency
+	ResidencyRegions string
+	TenantResidency  string
+	// AlgorithmPools gives the algorithms their own workers and queues, see parseAlgorithmPools
+	AlgorithmPools string
+	// VerifyBudget is the number of failed verifications of an identity per hour before it is locked out
+	// for VerifyLockout, 0 disables the budget
+	VerifyBudget  int
+	VerifyLockout time.Duration
+	// BackendTLS configures the TLS connections to the backends, see parseBackendTLS
+	BackendTLS string
+	// ReceiptKeys are the Ed25519 key files of the receipts, the first one signing, see NewReceiptSigner
+	ReceiptKeys string
+	// StorageMigrateTo is the backend the storage is migrating to as backend:dir, see DualWriteBackend
+	StorageMigrateTo string
+}
+
+// DefaultConfig returns the settings used when nothing else is specified
+func DefaultConfig() *Config {
+	hostname, _ := os.Hostname()
+	return &Config{
+		Addr:                  ":8080",
+		HashDelay:             5 * time.Second,
+		Workers:               runtime.NumCPU(),
+		QueueSize:             10000,
+		WriteBatchDelay:       50 * time.Millisecond,
+		WriteBatchSync:        true,
+		BanWindow:             time.Minute,
+		BanDuration:           15 * time.Minute,
+		VerifyLockout:         time.Hour,
+		RateLimitBurst:        20,
+		RateLimitRedisTimeout: 100 * time.Millisecond,
+		MirrorPercent:         100,
+		AutoMigrate:           true,
+		ShutdownDelayMax:      time.Minute,
+		StandbyPollInterval:   time.Second,
+		StandbyFailoverAfter:  10 * time.Second,
+		FederationTimeout:     5 * time.Second,
+		StorageBackend:        "memory",
+		StorageDir:            "data",
+		StorageCompression:    compressionNone,
+		HotTierSize:           10000,
+		HotTierAge:            10 * time.Minute,
+		Compaction:            time.Hour,
+		ReaperInterval:        time.Minute,
+		ShutdownHookTimeout:   10 * time.Second,
+		AuditHTTPBuffer:       10000,
+		StatsSnapshot:         10 * time.Second,
+		InstanceID:            hostname,
+		JournalSize:           1000,
+		HedgeWindow:           10 * time.Second,
+		BloomFilterFPRate:     0.01,
+		IdempotencyWindow:     24 * time.Hour,
+		OIDCGroupsClaim:       "groups",
+		OIDCSessionTTL:        8 * time.Hour,
+		ReplicationInterval:   time.Second,
+		LogLevel:              "info",
+	}
+}
+
+// redactedValue replaces the secret settings in the diagnostics
+const redactedValue = "[REDACTED]"
+
+// Redacted returns the settings by their config file keys, with the secrets replaced by redactedValue
+func (c *Config) Redacted() map[string]string {
+	settings := make(map[string]string, len(configSettings))
+	for _, cs := range configSettings {
+		v := cs.get(c)
+		if cs.secret && v != "" {
+			v = redactedValue
+		} else if u, err := url.Parse(v); err == nil && u.User != nil {
+			// The credentials embedded in the URLs
+			u.User = url.User("REDACTED")
+			v = u.String()
+		}
+		settings[cs.key] = v
+	}
+	return settings
+}
+
+// configSetting describes a single setting along with the names it is known by
+// in the configuration file, the environment and the command line
+type configSetting struct {
+	key   string
+	env   string
+	flag  string
+	usage string
+	// isBool is set for the settings given as boolean command line flags
+	isBool bool
+	// secret is set for the settings redacted from the diagnostics
+	secret bool
+	set    func(c *Config, v string) error
+	get    func(c *Config) string
+}
+
+var configSettings = []configSetting{
+	{
+		key: "addr", env: "PHS_ADDR", flag: "addr", usage: "HTTP listen address",
+		set: func(c *Config, v string) error { c.Addr = v; return nil },
+		get: func(c *Config) string { return c.Addr },
+	},
+	{
+		key: "external_url", env: "PHS_EXTERNAL_URL", flag: "external-url", usage: "Base URL of the service as seen by the clients, e.g. behind a proxy (taken from the requests if empty)",
+		set: func(c *Config, v string) error { c.ExternalURL = v; return nil },
+		get: func(c *Config) string { return c.ExternalURL },
+	},
+	{
+		key: "trust_forwarded_headers", env: "PHS_TRUST_FORWARDED_HEADERS", flag: "trust-forwarded-headers", usage: "Honor the X-Forwarded-Proto, X-Forwarded-Host and X-Forwarded-Prefix headers set by the proxy", isBool: true,
+		set: func(c *Config, v string) (err error) { c.TrustForwardedHeaders, err = strconv.ParseBool(v); return },
+		get: func(c *Config) string { return strconv.FormatBool(c.TrustForwardedHeaders) },
+	},
+	{
+		key: "ops_addr", env: "PHS_OPS_ADDR", flag: "ops-addr", usage: "Address of the reserved listener serving the health checks and the statistics",
+		set: func(c *Config, v string) error { c.OpsAddr = v; return nil },
+		get: func(c *Config) string { return c.OpsAddr },
+	},
+	{
+		key: "readiness_file", env: "PHS_READINESS_FILE", flag: "readiness-file", usage: "Path of the JSON file written once the listeners are bound and removed on shutdown (disabled if empty)",
+		set: func(c *Config, v string) error { c.ReadinessFile = v; return nil },
+		get: func(c *Config) string { return c.ReadinessFile },
+	},
+	{
+		key: "hash_delay", env: "PHS_HASH_DELAY", flag: "hash-delay", usage: "Delay before the password hash is calculated",
+		set: func(c *Config, v string) (err error) { c.HashDelay, err = time.ParseDuration(v); return },
+		get: func(c *Config) string { return c.HashDelay.String() },
+	},
+	{
+		key: "sync", env: "PHS_SYNC", flag: "sync", usage: "Calculate the hash while handling the request and return it right away, ignoring the hash delay", isBool: true,
+		set: func(c *Config, v string) (err error) { c.Sync, err = strconv.ParseBool(v); return },
+		get: func(c *Config) string { return strconv.FormatBool(c.Sync) },
+	},
+	{
+		key: "workers", env: "PHS_WORKERS", flag: "workers", usage: "Number of hash calculation workers",
+		set: func(c *Config, v string) (err error) { c.Workers, err = strconv.Atoi(v); return },
+		get: func(c *Config) string { return strconv.Itoa(c.Workers) },
+	},
+	{
+		key: "queue_size", env: "PHS_QUEUE_SIZE", flag: "queue-size", usage: "Maximal number of pending hash calculations",
+		set: func(c *Config, v string) (err error) { c.QueueSize, err = strconv.Atoi(v); return },
+		get: func(c *Config) string { return strconv.Itoa(c.QueueSize) },
+	},
+	{
+		key: "algorithm_pools", env: "PHS_ALGORITHM_POOLS", flag: "algorithm-pools", usage: "Dedicated worker pools of the hashing algorithms as algorithm=workers:queue separated by semicolons",
+		set: func(c *Config, v string) error { c.AlgorithmPools = v; return nil },
+		get: func(c *Config) string { return c.AlgorithmPools },
+	},
+	{
+		key: "receipt_keys", env: "PHS_RECEIPT_KEYS", flag: "receipt-keys", usage: "Ed25519 private key files (PKCS#8 PEM) of the receipts of POST /hash, comma separated, the first one signing and the others only published",
+		set: func(c *Config, v string) error { c.ReceiptKeys = v; return nil },
+		get: func(c *Config) string { return c.ReceiptKeys },
+	},
+	{
+		key: "max_concurrent_requests", env: "PHS_MAX_CONCURRENT_REQUESTS", flag: "max-concurrent-requests", usage: "Maximal number of public requests served at once (0 is unlimited)",
+		set: func(c *Config, v string) (err error) { c.MaxConcurrentRequests, err = strconv.Atoi(v); return },
+		get: func(c *Config) string { return strconv.Itoa(c.MaxConcurrentRequests) },
+	},
+	{
+		key: "route_weights", env: "PHS_ROUTE_WEIGHTS", flag: "route-weights", usage: "Shares of the freed slots given to the waiting requests of the route classes, as class=weight,... (hash_write, hash_read, verify, admin, other; 1 by default)",
+		set: func(c *Config, v string) error { c.RouteWeights = v; return nil },
+		get: func(c *Config) string { return c.RouteWeights },
+	},
+	{
+		key: "route_caps", env: "PHS_ROUTE_CAPS", flag: "route-caps", usage: "Maximal numbers of the requests of the route classes served at once, as class=cap,...",
+		set: func(c *Config, v string) error { c.RouteCaps = v; return nil },
+		get: func(c *Config) string { return c.RouteCaps },
+	},
+	{
+		key: "queue_timeout", env: "PHS_QUEUE_TIMEOUT", flag: "queue-timeout", usage: "Time the requests over the concurrency limits wait for a slot before being rejected (0 rejects them right away)",
+		set: func(c *Config, v string) (err error) { c.QueueTimeout, err = time.ParseDuration(v); return },
+		get: func(c *Config) string { return c.QueueTimeout.String() },
+	},
+	{
+		key: "deprecated_routes", env: "PHS_DEPRECATED_ROUTES", flag: "deprecated-routes", usage: "Routes being retired, as path=deprecation,sunset,link;path=... with RFC 3339 times",
+		set: func(c *Config, v string) error { c.DeprecatedRoutes = v; return nil },
+		get: func(c *Config) string { return c.DeprecatedRoutes },
+	},
+	{
+		key: "ban_threshold", env: "PHS_BAN_THRESHOLD", flag: "ban-threshold", usage: "Number of failing requests within the ban window which bans the source (0 disables the bans)",
+		set: func(c *Config, v string) (err error) { c.BanThreshold, err = strconv.Atoi(v); return },
+		get: func(c *Config) string { return strconv.Itoa(c.BanThreshold) },
+	},
+	{
+		key: "ban_window", env: "PHS_BAN_WINDOW", flag: "ban-window", usage: "Window in which the failing requests of a source are counted",
+		set: func(c *Config, v string) (err error) { c.BanWindow, err = time.ParseDuration(v); return },
+		get: func(c *Config) string { return c.BanWindow.String() },
+	},
+	{
+		key: "ban_duration", env: "PHS_BAN_DURATION", flag: "ban-duration", usage: "Time for which the source is banned",
+		set: func(c *Config, v string) (err error) { c.BanDuration, err = time.ParseDuration(v); return },
+		get: func(c *Config) string { return c.BanDuration.String() },
+	},
+	{
+		key: "verify_budget", env: "PHS_VERIFY_BUDGET", flag: "verify-budget", usage: "Failed password verifications allowed to an identity per hour before it is locked out (0 disables the budget)",
+		set: func(c *Config, v string) (err error) { c.VerifyBudget, err = strconv.Atoi(v); return },
+		get: func(c *Config) string { return strconv.Itoa(c.VerifyBudget) },
+	},
+	{
+		key: "verify_lockout", env: "PHS_VERIFY_LOCKOUT", flag: "verify-lockout", usage: "Time for which the identity out of its verification budget is locked out",
+		set: func(c *Config, v string) (err error) { c.VerifyLockout, err = time.ParseDuration(v); return },
+		get: func(c *Config) string { return c.VerifyLockout.String() },
+	},
+	{
+		key: "rate_limit", env: "PHS_RATE_LIMIT", flag: "rate-limit", usage: "Requests per second allowed to every API key, or to every source without the authentication (0 disables the limit)",
+		set: func(c *Config, v string) (err error) { c.RateLimit, err = strconv.ParseFloat(v, 64); return },
+		get: func(c *Config) string { return strconv.FormatFloat(c.RateLimit, 'g', -1, 64) },
+	},
+	{
+		key: "rate_limit_burst", env: "PHS_RATE_LIMIT_BURST", flag: "rate-limit-burst", usage: "Number of requests a client may send at once above the rate limit",
+		set: func(c *Config, v string) (err error) { c.RateLimitBurst, err = strconv.Atoi(v); return },
+		get: func(c *Config) string { return strconv.Itoa(c.RateLimitBurst) },
+	},
+	{
+		key: "rate_limit_redis", env: "PHS_RATE_LIMIT_REDIS", flag: "rate-limit-redis", usage: "Redis server keeping the rate limits shared by the replicas, as host:port or redis://[:password@]host:port[/db]",
+		set: func(c *Config, v string) error { c.RateLimitRedis = v; return nil },
+		get: func(c *Config) string { return c.RateLimitRedis },
+	},
+	{
+		key: "backend_tls", env: "PHS_BACKEND_TLS", flag: "backend-tls", usage: "TLS settings of the backends as backend:ca=file,cert=file,key=file,server_name=name,pin=sha256/digest separated by semicolons",
+		set: func(c *Config, v string) error { c.BackendTLS = v; return nil },
+		get: func(c *Config) string { return c.BackendTLS },
+	},
+	{
+		key: "rate_limit_redis_timeout", env: "PHS_RATE_LIMIT_REDIS_TIMEOUT", flag: "rate-limit-redis-timeout", usage: "Timeout of the Redis calls, after which the local rate limits are used",
+		set: func(c *Config, v string) (err error) { c.RateLimitRedisTimeout, err = time.ParseDuration(v); return },
+		get: func(c *Config) string { return c.RateLimitRedisTimeout.String() },
+	},
+	{
+		key: "mirror_url", env: "PHS_MIRROR_URL", flag: "mirror-url", usage: "Base URL of a secondary instance, e.g. a canary build, receiving copies of the POST /hash requests",
+		set: func(c *Config, v string) error { c.MirrorURL = v; return nil },
+		get: func(c *Config) string { return c.MirrorURL },
+	},
+	{
+		key: "mirror_percent", env: "PHS_MIRROR_PERCENT", flag: "mirror-percent", usage: "Percentage of the POST /hash requests mirrored",
+		set: func(c *Config, v string) (err error) { c.MirrorPercent, err = strconv.ParseFloat(v, 64); return },
+		get: func(c *Config) string { return strconv.FormatFloat(c.MirrorPercent, 'g', -1, 64) },
+	},
+	{
+		key: "mirror_credentials", env: "PHS_MIRROR_CREDENTIALS", flag: "mirror-credentials", usage: "Copy the API keys, the Authorization headers and the cookies of the clients to the mirrored requests", isBool: true,
+		set: func(c *Config, v string) (err error) { c.MirrorCredentials, err = strconv.ParseBool(v); return },
+		get: func(c *Config) string { return strconv.FormatBool(c.MirrorCredentials) },
+	},
+	{
+		key: "auto_migrate", env: "PHS_AUTO_MIGRATE", flag: "auto-migrate", usage: "Apply the pending storage migrations at startup, otherwise refuse to start until they are applied with the migrate subcommand", isBool: true,
+		set: func(c *Config, v string) (err error) { c.AutoMigrate, err = strconv.ParseBool(v); return },
+		get: func(c *Config) string { return strconv.FormatBool(c.AutoMigrate) },
+	},
+	{
+		key: "federation_peers", env: "PHS_FEDERATION_PEERS", flag: "federation-peers", usage: "Peer deployments verifying the records they own, as range:lo-hi=url or tenant:name=url separated by semicolons",
+		set: func(c *Config, v string) error { c.FederationPeers = v; return nil },
+		get: func(c *Config) string { return c.FederationPeers },
+	},
+	{
+		key: "federation_token", env: "PHS_FEDERATION_TOKEN", flag: "federation-token", usage: "API key sent to the federation peers", secret: true,
+		set: func(c *Config, v string) error { c.FederationToken = v; return nil },
+		get: func(c *Config) string { return c.FederationToken },
+	},
+	{
+		key: "federation_timeout", env: "PHS_FEDERATION_TIMEOUT", flag: "federation-timeout", usage: "Timeout of the verification requests to the federation peers",
+		set: func(c *Config, v string) (err error) { c.FederationTimeout, err = time.ParseDuration(v); return },
+		get: func(c *Config) string { return c.FederationTimeout.String() },
+	},
+	{
+		key: "alert_queue_depth", env: "PHS_ALERT_QUEUE_DEPTH", flag: "alert-queue-depth", usage: "Number of pending hash calculations above which the queue depth alert fires (0 disables)",
+		set: func(c *Config, v string) (err error) { c.AlertQueueDepth, err = strconv.Atoi(v); return },
+		get: func(c *Config) string { return strconv.Itoa(c.AlertQueueDepth) },
+	},
+	{
+		key: "alert_pending_age", env: "PHS_ALERT_PENDING_AGE", flag: "alert-pending-age", usage: "Age of the oldest pending hash calculation above which the pending age alert fires (0 disables)",
+		set: func(c *Config, v string) (err error) { c.AlertPendingAge, err = time.ParseDuration(v); return },
+		get: func(c *Config) string { return c.AlertPendingAge.String() },
+	},
+	{
+		key: "alert_replication_lag", env: "PHS_ALERT_REPLICATION_LAG", flag: "alert-replication-lag", usage: "Replication lag above which the replication lag alert fires (0 disables)",
+		set: func(c *Config, v string) (err error) { c.AlertReplicationLag, err = time.ParseDuration(v); return },
+		get: func(c *Config) string { return c.AlertReplicationLag.String() },
+	},
+	{
+		key: "alert_webhook_url", env: "PHS_ALERT_WEBHOOK_URL", flag: "alert-webhook-url", usage: "URL the alerts are POSTed to when they start and stop firing (disabled if empty)",
+		set: func(c *Config, v string) error { c.AlertWebhookURL = v; return nil },
+		get: func(c *Config) string { return c.AlertWebhookURL },
+	},
+	{
+		key: "alert_webhook_token", env: "PHS_ALERT_WEBHOOK_TOKEN", flag: "alert-webhook-token", usage: "Bearer token presented to the alert webhook", secret: true,
+		set: func(c *Config, v string) error { c.AlertWebhookToken = v; return nil },
+		get: func(c *Config) string { return c.AlertWebhookToken },
+	},
+	{
+		key: "write_batch_size", env: "PHS_WRITE_BATCH_SIZE", flag: "write-batch-size", usage: "Maximal number of completed hashes written to the storage at once (0 writes them one by one)",
+		set: func(c *Config, v string) (err error) { c.WriteBatchSize, err = strconv.Atoi(v); return },
+		get: func(c *Config) string { return strconv.Itoa(c.WriteBatchSize) },
+	},
+	{
+		key: "write_batch_delay", env: "PHS_WRITE_BATCH_DELAY", flag: "write-batch-delay", usage: "Maximal time a completed hash waits for the batched write",
+		set: func(c *Config, v string) (err error) { c.WriteBatchDelay, err = time.ParseDuration(v); return },
+		get: func(c *Config) string { return c.WriteBatchDelay.String() },
+	},
+	{
+		key: "write_batch_sync", env: "PHS_WRITE_BATCH_SYNC", flag: "write-batch-sync", usage: "Flush the batched writes to the disk, so that they survive a power failure", isBool: true,
+		set: func(c *Config, v string) (err error) { c.WriteBatchSync, err = strconv.ParseBool(v); return },
+		get: func(c *Config) string { return strconv.FormatBool(c.WriteBatchSync) },
+	},
+	{
+		key: "storage_backend", env: "PHS_STORAGE_BACKEND", flag: "storage", usage: "Password hash storage backend (memory, file, tiered)",
+		set: func(c *Config, v string) error { c.StorageBackend = v; return nil },
+		get: func(c *Config) string { return c.StorageBackend },
+	},
+	{
+		key: "storage_dir", env: "PHS_STORAGE_DIR", flag: "storage-dir", usage: "Directory of the file storage backend",
+		set: func(c *Config, v string) error { c.StorageDir = v; return nil },
+		get: func(c *Config) string { return c.StorageDir },
+	},
+	{
+		key: "storage_migrate_to", env: "PHS_STORAGE_MIGRATE_TO", flag: "storage-migrate-to", usage: "Storage backend to migrate to as backend:dir (file or tiered), written along with the current one and backfilled",
+		set: func(c *Config, v string) error { c.StorageMigrateTo = v; return nil },
+		get: func(c *Config) string { return c.StorageMigrateTo },
+	},
+	{
+		key: "storage_compression", env: "PHS_STORAGE_COMPRESSION", flag: "storage-compression", usage: "Compression of the records and snapshots written by the file and tiered backends (none, gzip, zstd)",
+		set: func(c *Config, v string) error { c.StorageCompression = v; return nil },
+		get: func(c *Config) string { return c.StorageCompression },
+	},
+	{
+		key: "residency_regions", env: "PHS_RESIDENCY_REGIONS", flag: "residency-regions", usage: "Storage directories of the residency regions as name=dir separated by semicolons",
+		set: func(c *Config, v string) error { c.ResidencyRegions = v; return nil },
+		get: func(c *Config) string { return c.ResidencyRegions },
+	},
+	{
+		key: "tenant_residency", env: "PHS_TENANT_RESIDENCY", flag: "tenant-residency", usage: "Residency regions of the tenants as tenant=region separated by semicolons",
+		set: func(c *Config, v string) error { c.TenantResidency = v; return nil },
+		get: func(c *Config) string { return c.TenantResidency },
+	},
+	{
+		key: "hot_tier_size", env: "PHS_HOT_TIER_SIZE", flag: "hot-tier-size", usage: "Maximal number of records in the hot tier of the tiered backend",
+		set: func(c *Config, v string) (err error) { c.HotTierSize, err = strconv.Atoi(v); return },
+		get: func(c *Config) string { return strconv.Itoa(c.HotTierSize) },
+	},
+	{
+		key: "hot_tier_age", env: "PHS_HOT_TIER_AGE", flag: "hot-tier-age", usage: "Time after which the records are demoted from the hot tier",
+		set: func(c *Config, v string) (err error) { c.HotTierAge, err = time.ParseDuration(v); return },
+		get: func(c *Config) string { return c.HotTierAge.String() },
+	},
+	{
+		key: "compaction_interval", env: "PHS_COMPACTION_INTERVAL", flag: "compaction-interval", usage: "Interval of the persistent storage compaction (disabled if 0)",
+		set: func(c *Config, v string) (err error) { c.Compaction, err = time.ParseDuration(v); return },
+		get: func(c *Config) string { return c.Compaction.String() },
+	},
+	{
+		key: "default_ttl", env: "PHS_DEFAULT_TTL", flag: "default-ttl", usage: "Time after which the stored hashes expire (never if 0)",
+		set: func(c *Config, v string) (err error) { c.DefaultTTL, err = time.ParseDuration(v); return },
+		get: func(c *Config) string { return c.DefaultTTL.String() },
+	},
+	{
+		key: "reaper_interval", env: "PHS_REAPER_INTERVAL", flag: "reaper-interval", usage: "Interval of the expired hashes eviction",
+		set: func(c *Config, v string) (err error) { c.ReaperInterval, err = time.ParseDuration(v); return },
+		get: func(c *Config) string { return c.ReaperInterval.String() },
+	},
+	{
+		key: "shutdown_delay", env: "PHS_SHUTDOWN_DELAY", flag: "shutdown-delay", usage: "Time to keep serving while reporting not ready before shutting down",
+		set: func(c *Config, v string) (err error) { c.ShutdownDelay, err = time.ParseDuration(v); return },
+		get: func(c *Config) string { return c.ShutdownDelay.String() },
+	},
+	{
+		key: "shutdown_delay_p99_multiple", env: "PHS_SHUTDOWN_DELAY_P99_MULTIPLE", flag: "shutdown-delay-p99-multiple", usage: "Multiple of the p99 latency of the latest requests added to the shutdown delay (0 keeps the delay fixed)",
+		set: func(c *Config, v string) (err error) {
+			c.ShutdownDelayP99Multiple, err = strconv.ParseFloat(v, 64)
+			return
+		},
+		get: func(c *Config) string { return strconv.FormatFloat(c.ShutdownDelayP99Multiple, 'g', -1, 64) },
+	},
+	{
+		key: "shutdown_delay_max", env: "PHS_SHUTDOWN_DELAY_MAX", flag: "shutdown-delay-max", usage: "Upper bound of the shutdown delay extended by the p99 latency",
+		set: func(c *Config, v string) (err error) { c.ShutdownDelayMax, err = time.ParseDuration(v); return },
+		get: func(c *Config) string { return c.ShutdownDelayMax.String() },
+	},
+	{
+		key: "shutdown_hook_timeout", env: "PHS_SHUTDOWN_HOOK_TIMEOUT", flag: "shutdown-hook-timeout", usage: "Time after which a shutdown hook of the embedding application is abandoned",
+		set: func(c *Config, v string) (err error) { c.ShutdownHookTimeout, err = time.ParseDuration(v); return },
+		get: func(c *Config) string { return c.ShutdownHookTimeout.String() },
+	},
+	{
+		key: "replica", env: "PHS_REPLICA", flag: "replica", usage: "Serve the hashes and statistics read-only from the storage directory maintained by the primary instance", isBool: true,
+		set: func(c *Config, v string) (err error) { c.Replica, err = strconv.ParseBool(v); return },
+		get: func(c *Config) string { return strconv.FormatBool(c.Replica) },
+	},
+	{
+		key: "primary_url", env: "PHS_PRIMARY_URL", flag: "primary-url", usage: "Base URL of the primary instance serving the reads of the replica requested with consistency=strong",
+		set: func(c *Config, v string) error { c.PrimaryURL = v; return nil },
+		get: func(c *Config) string { return c.PrimaryURL },
+	},
+	{
+		key: "standby_of", env: "PHS_STANDBY_OF", flag: "standby-of", usage: "Base URL of the active instance whose health a standby replica polls, promoting itself once the active fails",
+		set: func(c *Config, v string) error { c.StandbyOf = v; return nil },
+		get: func(c *Config) string { return c.StandbyOf },
+	},
+	{
+		key: "standby_poll_interval", env: "PHS_STANDBY_POLL_INTERVAL", flag: "standby-poll-interval", usage: "Interval of the health checks of the active instance by the standby",
+		set: func(c *Config, v string) (err error) { c.StandbyPollInterval, err = time.ParseDuration(v); return },
+		get: func(c *Config) string { return c.StandbyPollInterval.String() },
+	},
+	{
+		key: "standby_failover_after", env: "PHS_STANDBY_FAILOVER_AFTER", flag: "standby-failover-after", usage: "Time the active instance must keep failing its health checks before the standby promotes itself",
+		set: func(c *Config, v string) (err error) { c.StandbyFailoverAfter, err = time.ParseDuration(v); return },
+		get: func(c *Config) string { return c.StandbyFailoverAfter.String() },
+	},
+	{
+		key: "registration_url", env: "PHS_REGISTRATION_URL", flag: "registration-url", usage: "URL the readiness document of the instance is PUT to on startup and on the promotion of a standby",
+		set: func(c *Config, v string) error { c.RegistrationURL = v; return nil },
+		get: func(c *Config) string { return c.RegistrationURL },
+	},
+	{
+		key: "audit_file", env: "PHS_AUDIT_FILE", flag: "audit-file", usage: "File the audit events are appended to as JSON lines",
+		set: func(c *Config, v string) error { c.AuditFile = v; return nil },
+		get: func(c *Config) string { return c.AuditFile },
+	},
+	{
+		key: "audit_syslog", env: "PHS_AUDIT_SYSLOG", flag: "audit-syslog", usage: "Syslog the audit events are sent to: local, udp://host:port or tcp://host:port",
+		set: func(c *Config, v string) error { c.AuditSyslog = v; return nil },
+		get: func(c *Config) string { return c.AuditSyslog },
+	},
+	{
+		key: "audit_http_url", env: "PHS_AUDIT_HTTP_URL", flag: "audit-http-url", usage: "URL the audit events are POSTed to in batches",
+		set: func(c *Config, v string) error { c.AuditHTTPURL = v; return nil },
+		get: func(c *Config) string { return c.AuditHTTPURL },
+	},
+	{
+		key: "audit_http_token", env: "PHS_AUDIT_HTTP_TOKEN", flag: "audit-http-token", usage: "Bearer token presented to the audit collector", secret: true,
+		set: func(c *Config, v string) error { c.AuditHTTPToken = v; return nil },
+		get: func(c *Config) string { return c.AuditHTTPToken },
+	},
+	{
+		key: "audit_http_buffer", env: "PHS_AUDIT_HTTP_BUFFER", flag: "audit-http-buffer", usage: "Number of audit events buffered for the collector before they are dropped",
+		set: func(c *Config, v string) (err error) { c.AuditHTTPBuffer, err = strconv.Atoi(v); return },
+		get: func(c *Config) string { return strconv.Itoa(c.AuditHTTPBuffer) },
+	},
+	{
+		key: "stats_snapshot_interval", env: "PHS_STATS_SNAPSHOT_INTERVAL", flag: "stats-snapshot-interval", usage: "Interval of saving the statistics to the persistent storage (disabled if 0)",
+		set: func(c *Config, v string) (err error) { c.StatsSnapshot, err = time.ParseDuration(v); return },
+		get: func(c *Config) string { return c.StatsSnapshot.String() },
+	},
+	{
+		key: "stats_push_url", env: "PHS_STATS_PUSH_URL", flag: "stats-push-url", usage: "URL of the aggregator receiving the statistics snapshots",
+		set: func(c *Config, v string) error { c.StatsPushURL = v; return nil },
+		get: func(c *Config) string { return c.StatsPushURL },
+	},
+	{
+		key: "stats_push_token", env: "PHS_STATS_PUSH_TOKEN", flag: "stats-push-token", usage: "API key presented to the aggregator", secret: true,
+		set: func(c *Config, v string) error { c.StatsPushToken = v; return nil },
+		get: func(c *Config) string { return c.StatsPushToken },
+	},
+	{
+		key: "aggregator", env: "PHS_AGGREGATOR", flag: "aggregator", usage: "Receive the statistics snapshots pushed by the instances and serve the fleet statistics", isBool: true,
+		set: func(c *Config, v string) (err error) { c.Aggregator, err = strconv.ParseBool(v); return },
+		get: func(c *Config) string { return strconv.FormatBool(c.Aggregator) },
+	},
+	{
+		key: "instance_id", env: "PHS_INSTANCE_ID", flag: "instance-id", usage: "Identifier of the instance, unique within the cluster",
+		set: func(c *Config, v string) error { c.InstanceID = v; return nil },
+		get: func(c *Config) string { return c.InstanceID },
+	},
+	{
+		key: "region_id", env: "PHS_REGION_ID", flag: "region-id", usage: "Region number (0-255) prefixing the hash identifiers, unique among the replicating writers",
+		set: func(c *Config, v string) (err error) { c.RegionID, err = strconv.Atoi(v); return },
+		get: func(c *Config) string { return strconv.Itoa(c.RegionID) },
+	},
+	{
+		key: "warmup_duration", env: "PHS_WARMUP_DURATION", flag: "warmup-duration", usage: "Time after the start during which the request latencies are accounted separately",
+		set: func(c *Config, v string) (err error) { c.WarmupDuration, err = time.ParseDuration(v); return },
+		get: func(c *Config) string { return c.WarmupDuration.String() },
+	},
+	{
+		key: "warmup_count", env: "PHS_WARMUP_COUNT", flag: "warmup-count", usage: "Number of the first requests whose latencies are accounted separately",
+		set: func(c *Config, v string) (err error) { c.WarmupCount, err = strconv.ParseUint(v, 10, 64); return },
+		get: func(c *Config) string { return strconv.FormatUint(c.WarmupCount, 10) },
+	},
+	{
+		key: "journal_sample_rate", env: "PHS_JOURNAL_SAMPLE_RATE", flag: "journal-sample-rate", usage: "Share of the requests whose lifecycle is journaled for debugging (disabled if 0)",
+		set: func(c *Config, v string) (err error) { c.JournalRate, err = strconv.ParseFloat(v, 64); return },
+		get: func(c *Config) string { return strconv.FormatFloat(c.JournalRate, 'g', -1, 64) },
+	},
+	{
+		key: "journal_size", env: "PHS_JOURNAL_SIZE", flag: "journal-size", usage: "Maximal number of the journaled requests kept",
+		set: func(c *Config, v string) (err error) { c.JournalSize, err = strconv.Atoi(v); return },
+		get: func(c *Config) string { return strconv.Itoa(c.JournalSize) },
+	},
+	{
+		key: "hedge_window", env: "PHS_HEDGE_WINDOW", flag: "hedge-window", usage: "Time within which the reads with the same X-Request-ID are counted once (disabled if 0)",
+		set: func(c *Config, v string) (err error) { c.HedgeWindow, err = time.ParseDuration(v); return },
+		get: func(c *Config) string { return c.HedgeWindow.String() },
+	},
+	{
+		key: "negative_cache_ttl", env: "PHS_NEGATIVE_CACHE_TTL", flag: "negative-cache-ttl", usage: "Time for which the identifiers not found are answered without reaching the storage (0 disables)",
+		set: func(c *Config, v string) (err error) { c.NegativeCacheTTL, err = time.ParseDuration(v); return },
+		get: func(c *Config) string { return c.NegativeCacheTTL.String() },
+	},
+	{
+		key: "tombstone_ttl", env: "PHS_TOMBSTONE_TTL", flag: "tombstone-ttl", usage: "Time for which the records purged by the retention are answered with 410 Gone rather than 404 (0 disables)",
+		set: func(c *Config, v string) (err error) { c.TombstoneTTL, err = time.ParseDuration(v); return },
+		get: func(c *Config) string { return c.TombstoneTTL.String() },
+	},
+	{
+		key: "bloom_filter_capacity", env: "PHS_BLOOM_FILTER_CAPACITY", flag: "bloom-filter-capacity", usage: "Expected number of records the bloom filter of the identifiers is sized for (0 disables)",
+		set: func(c *Config, v string) (err error) { c.BloomFilterCapacity, err = strconv.Atoi(v); return },
+		get: func(c *Config) string { return strconv.Itoa(c.BloomFilterCapacity) },
+	},
+	{
+		key: "bloom_filter_fp_rate", env: "PHS_BLOOM_FILTER_FP_RATE", flag: "bloom-filter-fp-rate", usage: "False positive rate of the bloom filter of the identifiers",
+		set: func(c *Config, v string) (err error) { c.BloomFilterFPRate, err = strconv.ParseFloat(v, 64); return },
+		get: func(c *Config) string { return strconv.FormatFloat(c.BloomFilterFPRate, 'g', -1, 64) },
+	},
+	{
+		key: "experiment_name", env: "PHS_EXPERIMENT_NAME", flag: "experiment-name", usage: "Name of the hashing parameters experiment reported in the metrics",
+		set: func(c *Config, v string) error { c.ExperimentName = v; return nil },
+		get: func(c *Config) string { return c.ExperimentName },
+	},
+	{
+		key: "experiment_arms", env: "PHS_EXPERIMENT_ARMS", flag: "experiment-arms", usage: "Arms of the hashing parameters experiment, as arm=percent:prf:iterations;arm=... (disabled if empty)",
+		set: func(c *Config, v string) error { c.ExperimentArms = v; return nil },
+		get: func(c *Config) string { return c.ExperimentArms },
+	},
+	{
+		key: "hardening_schedule", env: "PHS_HARDENING_SCHEDULE", flag: "hardening-schedule", usage: "Hash the new passwords at a cost raised on a schedule, as algorithm=pbkdf2|bcrypt,iterations|cost=N,start=YYYY-MM-DD,step=+N|xF,every=MONTHS[,prf=sha512][,max=N]",
+		set: func(c *Config, v string) error { c.HardeningSchedule = v; return nil },
+		get: func(c *Config) string { return c.HardeningSchedule },
+	},
+	{
+		key: "caller_salts", env: "PHS_CALLER_SALTS", flag: "caller-salts", usage: "Allow the callers with the hash:salt scope to supply the salt and the PBKDF2 parameters of the hash", isBool: true,
+		set: func(c *Config, v string) (err error) { c.CallerSalts, err = strconv.ParseBool(v); return },
+		get: func(c *Config) string { return strconv.FormatBool(c.CallerSalts) },
+	},
+	{
+		key: "timing_headers", env: "PHS_TIMING_HEADERS", flag: "timing-headers", usage: "Report the queue wait and the calculation time of the hashes in the response headers", isBool: true,
+		set: func(c *Config, v string) (err error) { c.TimingHeaders, err = strconv.ParseBool(v); return },
+		get: func(c *Config) string { return strconv.FormatBool(c.TimingHeaders) },
+	},
+	{
+		key: "timing_jitter", env: "PHS_TIMING_JITTER", flag: "timing-jitter", usage: "Maximal random time added to the hash calculation delay and the lookups to mask the timing (0 disables)",
+		set: func(c *Config, v string) (err error) { c.TimingJitter, err = time.ParseDuration(v); return },
+		get: func(c *Config) string { return c.TimingJitter.String() },
+	},
+	{
+		key: "idempotency_window", env: "PHS_IDEMPOTENCY_WINDOW", flag: "idempotency-window", usage: "Time within which the retries with the same Idempotency-Key return the same hash (disabled if 0)",
+		set: func(c *Config, v string) (err error) { c.IdempotencyWindow, err = time.ParseDuration(v); return },
+		get: func(c *Config) string { return c.IdempotencyWindow.String() },
+	},
+	{
+		key: "idempotency_secret", env: "PHS_IDEMPOTENCY_SECRET", flag: "idempotency-secret", usage: "Secret keying the fingerprints of the idempotency records, shared by the instances using the storage (the passwords are left out of the fingerprints if empty)", secret: true,
+		set: func(c *Config, v string) error { c.IdempotencySecret = v; return nil },
+		get: func(c *Config) string { return c.IdempotencySecret },
+	},
+	{
+		key: "auth", env: "PHS_AUTH", flag: "auth", usage: "Require an API key for all the calls but the health probes", isBool: true,
+		set: func(c *Config, v string) (err error) { c.AuthEnabled, err = strconv.ParseBool(v); return },
+		get: func(c *Config) string { return strconv.FormatBool(c.AuthEnabled) },
+	},
+	{
+		key: "admin_key", env: "PHS_ADMIN_KEY", flag: "admin-key", usage: "Static API key granting the admin scope, used to bootstrap the managed API keys", secret: true,
+		set: func(c *Config, v string) error { c.AdminKey = v; return nil },
+		get: func(c *Config) string { return c.AdminKey },
+	},
+	{
+		key: "oidc_issuer", env: "PHS_OIDC_ISSUER", flag: "oidc-issuer", usage: "Issuer URL of the OIDC provider the admin users sign in with (disabled if empty)",
+		set: func(c *Config, v string) error { c.OIDCIssuer = v; return nil },
+		get: func(c *Config) string { return c.OIDCIssuer },
+	},
+	{
+		key: "oidc_client_id", env: "PHS_OIDC_CLIENT_ID", flag: "oidc-client-id", usage: "OIDC client identifier",
+		set: func(c *Config, v string) error { c.OIDCClientID = v; return nil },
+		get: func(c *Config) string { return c.OIDCClientID },
+	},
+	{
+		key: "oidc_client_secret", env: "PHS_OIDC_CLIENT_SECRET", flag: "oidc-client-secret", usage: "OIDC client secret", secret: true,
+		set: func(c *Config, v string) error { c.OIDCClientSecret = v; return nil },
+		get: func(c *Config) string { return c.OIDCClientSecret },
+	},
+	{
+		key: "oidc_redirect_url", env: "PHS_OIDC_REDIRECT_URL", flag: "oidc-redirect-url", usage: "External URL of the /auth/callback route registered with the OIDC provider",
+		set: func(c *Config, v string) error { c.OIDCRedirectURL = v; return nil },
+		get: func(c *Config) string { return c.OIDCRedirectURL },
+	},
+	{
+		key: "oidc_groups_claim", env: "PHS_OIDC_GROUPS_CLAIM", flag: "oidc-groups-claim", usage: "ID token claim listing the groups of the user",
+		set: func(c *Config, v string) error { c.OIDCGroupsClaim = v; return nil },
+		get: func(c *Config) string { return c.OIDCGroupsClaim },
+	},
+	{
+		key: "oidc_group_scopes", env: "PHS_OIDC_GROUP_SCOPES", flag: "oidc-group-scopes", usage: "Scopes granted to the groups, as group=scope,scope;group=scope",
+		set: func(c *Config, v string) error { c.OIDCGroupScopes = v; return nil },
+		get: func(c *Config) string { return c.OIDCGroupScopes },
+	},
+	{
+		key: "oidc_session_ttl", env: "PHS_OIDC_SESSION_TTL", flag: "oidc-session-ttl", usage: "Time after which the admin users have to sign in again",
+		set: func(c *Config, v string) (err error) { c.OIDCSessionTTL, err = time.ParseDuration(v); return },
+		get: func(c *Config) string { return c.OIDCSessionTTL.String() },
+	},
+	{
+		key: "tls_cert", env: "PHS_TLS_CERT", flag: "tls-cert", usage: "TLS certificate file",
+		set: func(c *Config, v string) error { c.TLSCertFile = v; return nil },
+		get: func(c *Config) string { return c.TLSCertFile },
+	},
+	{
+		key: "tls_key", env: "PHS_TLS_KEY", flag: "tls-key", usage: "TLS private key file",
+		set: func(c *Config, v string) error { c.TLSKeyFile = v; return nil },
+		get: func(c *Config) string { return c.TLSKeyFile },
+	},
+	{
+		key: "replication_peer", env: "PHS_REPLICATION_PEER", flag: "replication-peer", usage: "URL of the peer instance receiving the completed records",
+		set: func(c *Config, v string) error { c.ReplicationPeer = v; return nil },
+		get: func(c *Config) string { return c.ReplicationPeer },
+	},
+	{
+		key: "replication_cert", env: "PHS_REPLICATION_CERT", flag: "replication-cert", usage: "Client certificate file presented to the replication peer",
+		set: func(c *Config, v string) error { c.ReplicationCert = v; return nil },
+		get: func(c *Config) string { return c.ReplicationCert },
+	},
+	{
+		key: "replication_key", env: "PHS_REPLICATION_KEY", flag: "replication-key", usage: "Private key file of the replication client certificate",
+		set: func(c *Config, v string) error { c.ReplicationKey = v; return nil },
+		get: func(c *Config) string { return c.ReplicationKey },
+	},
+	{
+		key: "replication_ca", env: "PHS_REPLICATION_CA", flag: "replication-ca", usage: "CA certificates verifying the replication peer (system roots if empty)",
+		set: func(c *Config, v string) error { c.ReplicationCA = v; return nil },
+		get: func(c *Config) string { return c.ReplicationCA },
+	},
+	{
+		key: "replication_client_ca", env: "PHS_REPLICATION_CLIENT_CA", flag: "replication-client-ca", usage: "CA certificates verifying the instances shipping records to this one (receiving disabled if empty)",
+		set: func(c *Config, v string) error { c.ReplicationClientCA = v; return nil },
+		get: func(c *Config) string { return c.ReplicationClientCA },
+	},
+	{
+		key: "replication_interval", env: "PHS_REPLICATION_INTERVAL", flag: "replication-interval", usage: "Interval of shipping the completed records to the replication peer",
+		set: func(c *Config, v string) (err error) { c.ReplicationInterval, err = time.ParseDuration(v); return },
+		get: func(c *Config) string { return c.ReplicationInterval.String() },
+	},
+	{
+		key: "log_level", env: "PHS_LOG_LEVEL", flag: "log-level", usage: "Log level (debug, info, warn, error)",
+		set: func(c *Config, v string) error { c.LogLevel = v; return nil },
+		get: func(c *Config) string { return c.LogLevel },
+	},
+}
+
+// findConfigSetting looks up the setting by its configuration file key
+func findConfigSetting(key string) (*configSetting, bool) {
+	for i := range configSettings {
+		if configSettings[i].key == key {
+			return &configSettings[i], true
+		}
+	}
+	return nil, false
+}
+
+// LoadConfig builds the service settings from the defaults, the selected profile, the configuration file,
+// the environment variables and the command line flags, in the increasing order of precedence
+func LoadConfig(fs *flag.FlagSet, args []string) (*Config, error) {
+	cfg := DefaultConfig()
+
+	configFile := fs.String("config", os.Getenv("PHS_CONFIG"), "Configuration file (YAML)")
+	profile := fs.String("profile", os.Getenv("PHS_PROFILE"), "Configuration profile (dev, staging, prod or defined in the configuration file)")
+	for _, cs := range configSettings {
+		if cs.isBool {
+			fs.Bool(cs.flag, cs.get(cfg) == "true", cs.usage)
+		} else {
+			fs.String(cs.flag, cs.get(cfg), cs.usage)
+		}
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	// The profile defined in the configuration file may override a built-in one
+	profiles := builtinConfigProfiles()
+	var entries []configEntry
+	if *configFile != "" {
+		all, err := readConfigFile(*configFile)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range all {
+			if isProfileEntry(e) {
+				if err := addProfileEntry(profiles, e); err != nil {
+					return nil, err
+				}
+			} else {
+				entries = append(entries, e)
+			}
+		}
+	}
+	if *profile != "" {
+		if err := applyConfigProfile(cfg, profiles, *profile); err != nil {
+			return nil, err
+		}
+	}
+	for _, e := range entries {
+		if err := e.apply(cfg); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, cs := range configSettings {
+		if v, ok := os.LookupEnv(cs.env); ok {
+			if err := cs.set(cfg, v); err != nil {
+				return nil, fmt.Errorf("%s: %v", cs.env, err)
+			}
+		}
+	}
+
+	var flagErr error
+	fs.Visit(func(f *flag.Flag) {
+		for _, cs := range configSettings {
+			if cs.flag == f.Name && flagErr == nil {
+				if err := cs.set(cfg, f.Value.String()); err != nil {
+					flagErr = fmt.Errorf("-%s: %v", cs.flag, err)
+				}
+			}
+		}
+	})
+	if flagErr != nil {
+		return nil, flagErr
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// configEntry is a single "key: value" line of the configuration file
+type configEntry struct {
+	key   string
+	value string
+	// pos locates the line in the file for the error messages
+	pos string
+}
+
+// readConfigFile reads the entries of the configuration file.
+// Only the flat "key: value" subset of YAML is supported
+func readConfigFile(path string) ([]configEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []configEntry
+	scanner := bufio.NewScanner(f)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := stripConfigComment(scanner.Text())
+		if strings.TrimSpace(line) == "" || line == "---" {
+			continue
+		}
+		if line[0] == ' ' || line[0] == '\t' {
+			return nil, fmt.Errorf("%s:%d: nested values are not supported", path, lineNo)
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected \"key: value\"", path, lineNo)
+		}
+		entries = append(entries, configEntry{
+			key:   strings.TrimSpace(parts[0]),
+			value: unquoteConfigValue(strings.TrimSpace(parts[1])),
+			pos:   fmt.Sprintf("%s:%d", path, lineNo),
+		})
+	}
+	return entries, scanner.Err()
+}
+
+// apply sets the configuration file entry
+func (e configEntry) apply(c *Config) error {
+	cs, ok := findConfigSetting(e.key)
+	if !ok {
+		return fmt.Errorf("%s: unknown setting %q", e.pos, e.key)
+	}
+	if err := cs.set(c, e.value); err != nil {
+		return fmt.Errorf("%s: %s: %v", e.pos, e.key, err)
+	}
+	return nil
+}
+
+// stripConfigComment removes the trailing comment from the configuration file line
+func stripConfigComment(line string) string {
+	inQuotes := byte(0)
+	for i := 0; i < len(line); i++ {
+		switch ch := line[i]; {
+		case inQuotes != 0:
+			if ch == inQuotes {
+				inQuotes = 0
+			}
+		case ch == '"' || ch == '\'':
+			inQuotes = ch
+		case ch == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			return strings.TrimRight(line[:i], " \t")
+		}
+	}
+	return strings.TrimRight(line, " \t")
+}
+
+// unquoteConfigValue removes the optional quotes around the configuration value
+func unquoteConfigValue(v string) string {
+	if len(v) >= 2 && (v[0] == '"' || v[0] == '\'') && v[len(v)-1] == v[0] {
+		return v[1 : len(v)-1]
+	}
+	return v
+}
+
+// Validate checks the settings for consistency
+func (c *Config) Validate() error {
+	if c.ExternalURL != "" {
+		u, err := url.Parse(c.ExternalURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.RawQuery != "" || u.Fragment != "" {
+			return fmt.Errorf("external URL %q must be an absolute http or https URL without a query", c.ExternalURL)
+		}
+	}
+	if c.HashDelay < 0 {
+		return errors.New("hash delay must not be negative")
+	}
+	if c.Workers < 1 {
+		return errors.New("at least one worker is required")
+	}
+	if c.QueueSize < 1 {
+		return errors.New("queue size must be positive")
+	}
+	if _, err := parseAlgorithmPools(c.AlgorithmPools); err != nil {
+		return err
+	}
+	if _, err := parseBackendTLS(c.BackendTLS); err != nil {
+		return err
+	}
+	switch c.StorageBackend {
+	case "memory":
+	case "file", "tiered":
+		if c.StorageDir == "" {
+			return errors.New("persistent storage backends require a storage directory")
+		}
+		if c.StorageBackend == "tiered" && (c.HotTierSize < 1 || c.HotTierAge <= 0) {
+			return errors.New("hot tier size and age must be positive")
+		}
+		if !compressionSupported(c.StorageCompression) {
+			if c.StorageCompression == compressionZstd {
+				return errZstdUnsupported
+			}
+			return fmt.Errorf("unknown storage compression %q", c.StorageCompression)
+		}
+	default:
+		return fmt.Errorf("unknown storage backend %q", c.StorageBackend)
+	}
+	if c.StorageMigrateTo != "" {
+		backend, dir, err := parseMigrationTarget(c.StorageMigrateTo)
+		if err != nil {
+			return err
+		}
+		if c.StorageBackend != "memory" && filepath.Clean(c.StorageDir) == filepath.Clean(dir) {
+			if backend == c.StorageBackend {
+				return errors.New("storage migration target is the current storage backend")
+			}
+			return fmt.Errorf("storage migration target shares the storage directory %s", dir)
+		}
+	}
+	if c.TenantResidency != "" && c.ResidencyRegions == "" {
+		return errors.New("tenant residency requires the residency regions")
+	}
+	if c.ResidencyRegions != "" {
+		residency, err := parseResidency(c.ResidencyRegions, c.TenantResidency)
+		if err != nil {
+			return err
+		}
+		for name, dir := range residency.dirs {
+			if c.StorageDir != "" && filepath.Clean(c.StorageDir) == dir {
+				return fmt.Errorf("residency region %q shares the storage directory %s", name, dir)
+			}
+		}
+		if !compressionSupported(c.StorageCompression) {
+			return fmt.Errorf("unknown storage compression %q", c.StorageCompression)
+		}
+		if len(residency.tenants) > 0 && !c.AuthEnabled {
+			return errors.New("tenant residency requires the authentication, the tenants are those of the API keys")
+		}
+	}
+	if c.ShutdownHookTimeout <= 0 {
+		return errors.New("shutdown hook timeout must be positive")
+	}
+	if c.Compaction < 0 {
+		return errors.New("compaction interval must not be negative")
+	}
+	if c.DefaultTTL < 0 {
+		return errors.New("default TTL must not be negative")
+	}
+	if c.ReaperInterval <= 0 {
+		return errors.New("reaper interval must be positive")
+	}
+	if c.ShutdownDelay < 0 {
+		return errors.New("shutdown delay must not be negative")
+	}
+	if c.ShutdownDelayP99Multiple < 0 {
+		return errors.New("shutdown delay p99 multiple must not be negative")
+	}
+	if c.ShutdownDelayP99Multiple > 0 && c.ShutdownDelayMax < c.ShutdownDelay {
+		return errors.New("maximal shutdown delay must not be below the shutdown delay")
+	}
+	if c.BanThreshold < 0 {
+		return errors.New("ban threshold must not be negative")
+	}
+	if c.BanThreshold > 0 && (c.BanWindow <= 0 || c.BanDuration <= 0) {
+		return errors.New("ban window and duration must be positive")
+	}
+	if c.VerifyBudget < 0 {
+		return errors.New("verify budget must not be negative")
+	}
+	if c.VerifyBudget > 0 && c.VerifyLockout <= 0 {
+		return errors.New("verify lockout must be positive")
+	}
+	if c.RateLimit < 0 {
+		return errors.New("rate limit must not be negative")
+	}
+	if c.RateLimit > 0 && (c.RateLimitBurst < 1 || c.RateLimitRedisTimeout <= 0) {
+		return errors.New("rate limit burst and Redis timeout must be positive")
+	}
+	if c.MirrorURL != "" {
+		if u, err := url.Parse(c.MirrorURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return errors.New("mirror URL must be an absolute HTTP(S) URL")
+		}
+		if c.MirrorPercent <= 0 || c.MirrorPercent > 100 {
+			return errors.New("mirror percentage must be in (0, 100]")
+		}
+	}
+	if c.PrimaryURL != "" {
+		if !c.Replica {
+			return errors.New("primary URL requires the replica mode")
+		}
+		if u, err := url.Parse(c.PrimaryURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("primary URL %q must be an absolute http or https URL", c.PrimaryURL)
+		}
+	}
+	if c.StandbyOf != "" {
+		if !c.Replica {
+			return errors.New("standby mode requires the replica mode")
+		}
+		if u, err := url.Parse(c.StandbyOf); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("standby active URL %q must be an absolute http or https URL", c.StandbyOf)
+		}
+		if c.StandbyPollInterval <= 0 {
+			return errors.New("standby poll interval must be positive")
+		}
+		if c.StandbyFailoverAfter < c.StandbyPollInterval {
+			return errors.New("standby failover period must not be shorter than the poll interval")
+		}
+	}
+	if c.RegistrationURL != "" {
+		if u, err := url.Parse(c.RegistrationURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("registration URL %q must be an absolute http or https URL", c.RegistrationURL)
+		}
+	}
+	if c.AuditSyslog != "" {
+		if _, _, err := parseSyslogTarget(c.AuditSyslog); err != nil {
+			return err
+		}
+	}
+	if c.AuditHTTPURL != "" {
+		if u, err := url.Parse(c.AuditHTTPURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("audit HTTP URL %q must be an absolute http or https URL", c.AuditHTTPURL)
+		}
+	}
+	if c.AlertWebhookURL != "" {
+		if u, err := url.Parse(c.AlertWebhookURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("alert webhook URL %q must be an absolute http or https URL", c.AlertWebhookURL)
+		}
+	}
+	if c.AuditHTTPBuffer < 1 {
+		return errors.New("audit HTTP buffer must be at least 1")
+	}
+	if c.FederationPeers != "" {
+		if _, err := parseFederationPeers(c.FederationPeers); err != nil {
+			return err
+		}
+		if c.FederationTimeout <= 0 {
+			return errors.New("federation timeout must be positive")
+		}
+	}
+	if c.RateLimitRedis != "" {
+		if _, err := newRedisClient(c.RateLimitRedis, c.RateLimitRedisTimeout, nil); err != nil {
+			return fmt.Errorf("rate limit Redis: %v", err)
+		}
+	}
+	if c.AlertQueueDepth < 0 || c.AlertPendingAge < 0 || c.AlertReplicationLag < 0 {
+		return errors.New("alert thresholds must not be negative")
+	}
+	if _, err := parseRouteValues(c.RouteWeights); err != nil {
+		return err
+	}
+	if _, err := parseRouteValues(c.RouteCaps); err != nil {
+		return err
+	}
+	if c.QueueTimeout < 0 {
+		return errors.New("queue timeout must not be negative")
+	}
+	if c.MaxConcurrentRequests < 0 {
+		return errors.New("maximal number of concurrent requests must not be negative")
+	}
+	if c.WriteBatchSize < 0 {
+		return errors.New("write batch size must not be negative")
+	}
+	if c.WriteBatchSize > 0 && c.WriteBatchDelay <= 0 {
+		return errors.New("write batch delay must be positive")
+	}
+	if c.Replica && c.StorageBackend != "file" {
+		return errors.New("replica mode requires the file storage backend")
+	}
+	if c.StatsSnapshot < 0 {
+		return errors.New("statistics snapshot interval must not be negative")
+	}
+	if c.StatsPushURL != "" {
+		if !strings.HasPrefix(c.StatsPushURL, "http://") && !strings.HasPrefix(c.StatsPushURL, "https://") {
+			return errors.New("statistics push URL must be an http or https URL")
+		}
+		if c.StatsSnapshot == 0 {
+			return errors.New("pushing the statistics requires a positive snapshot interval")
+		}
+		if c.Aggregator {
+			return errors.New("the aggregator cannot push its statistics")
+		}
+	}
+	if c.InstanceID == "" {
+		return errors.New("instance identifier must not be empty")
+	}
+	if c.RegionID < 0 || c.RegionID > maxRegionID {
+		return fmt.Errorf("region identifier must be between 0 and %d", maxRegionID)
+	}
+	if c.WarmupDuration < 0 {
+		return errors.New("warm-up duration must not be negative")
+	}
+	if c.JournalRate < 0 || c.JournalRate > 1 {
+		return errors.New("journal sample rate must be between 0 and 1")
+	}
+	if c.JournalRate > 0 && c.JournalSize < 1 {
+		return errors.New("journal size must be positive")
+	}
+	if c.HedgeWindow < 0 {
+		return errors.New("hedge window must not be negative")
+	}
+	if c.TimingJitter < 0 {
+		return errors.New("timing jitter must not be negative")
+	}
+	if c.NegativeCacheTTL < 0 {
+		return errors.New("negative cache TTL must not be negative")
+	}
+	if c.TombstoneTTL < 0 {
+		return errors.New("tombstone TTL must not be negative")
+	}
+	if _, err := parseDeprecatedRoutes(c.DeprecatedRoutes); err != nil {
+		return err
+	}
+	if c.ExperimentArms != "" {
+		if c.ExperimentName == "" {
+			return errors.New("experiment requires a name")
+		}
+		if _, err := parseExperimentArms(c.ExperimentArms); err != nil {
+			return err
+		}
+	}
+	if c.HardeningSchedule != "" {
+		if c.ExperimentArms != "" {
+			return errors.New("hardening schedule and experiment must not be configured together")
+		}
+		if _, err := parseHardeningSchedule(c.HardeningSchedule); err != nil {
+			return err
+		}
+	}
+	if c.BloomFilterCapacity < 0 {
+		return errors.New("bloom filter capacity must not be negative")
+	}
+	if c.BloomFilterCapacity > 0 {
+		if c.BloomFilterFPRate <= 0 || c.BloomFilterFPRate >= 1 {
+			return errors.New("bloom filter false positive rate must be between 0 and 1")
+		}
+		if c.Replica {
+			// The records are written by the primary, so the filter of the replica would be stale
+			return errors.New("bloom filter is not supported by replicas")
+		}
+	}
+	if c.IdempotencyWindow < 0 {
+		return errors.New("idempotency window must not be negative")
+	}
+	if c.IdempotencySecret != "" && len(c.IdempotencySecret) < 16 {
+		return errors.New("idempotency secret must be at least 16 bytes long")
+	}
+	if c.CallerSalts && !c.AuthEnabled {
+		return errors.New("caller salts require the authentication, the callers need the hash:salt scope")
+	}
+	if c.AuthEnabled && c.AdminKey == "" && c.StorageBackend == "memory" {
+		return errors.New("authentication with the memory storage backend requires an admin key")
+	}
+	if c.OIDCIssuer != "" {
+		if !c.AuthEnabled {
+			return errors.New("OIDC sign in requires the authentication to be enabled")
+		}
+		if c.OIDCClientID == "" || c.OIDCRedirectURL == "" || c.OIDCGroupScopes == "" {
+			return errors.New("OIDC sign in requires the client identifier, the redirect URL and the group scopes")
+		}
+		if _, err := parseGroupScopes(c.OIDCGroupScopes); err != nil {
+			return err
+		}
+		if c.OIDCSessionTTL <= 0 {
+			return errors.New("OIDC session TTL must be positive")
+		}
+	}
+	if (c.TLSCertFile == "") != (c.TLSKeyFile == "") {
+		return errors.New("both TLS certificate and key files must be specified")
+	}
+	if c.ReplicationPeer != "" {
+		if !strings.HasPrefix(c.ReplicationPeer, "https://") {
+			return errors.New("replication peer must be an https URL")
+		}
+		if c.ReplicationCert == "" || c.ReplicationKey == "" {
+			return errors.New("replication requires the client certificate and key files")
+		}
+		if c.ReplicationInterval <= 0 {
+			return errors.New("replication interval must be positive")
+		}
+		if c.Replica {
+			return errors.New("read-only replicas cannot ship records")
+		}
+	}
+	if c.ReplicationClientCA != "" {
+		if c.TLSCertFile == "" {
+			return errors.New("receiving replicated records requires TLS")
+		}
+		if c.Replica {
+			return errors.New("read-only replicas cannot receive replicated records")
+		}
+	}
+	if _, err := parseLogLevel(c.LogLevel); err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+)
+
+// Consistency levels of the reads, requested with the consistency query parameter
+const (
+	// consistencyEventual reads may be served by a replica lagging behind the primary, the default
+	consistencyEventual = "eventual"
+	// consistencyStrong reads are served by the primary
+	consistencyStrong = "strong"
+)
+
+const (
+	// consistencyHeader reports the consistency level the read was served at
+	consistencyHeader = "X-Consistency"
+	// consistencyForwardedHeader marks the reads forwarded to the primary, so that a misconfigured
+	// primary URL pointing to a replica does not forward them in a loop
+	consistencyForwardedHeader = "X-PHS-Consistency-Forwarded"
+)
+
+// newPrimaryProxy constructs the proxy forwarding the strongly consistent reads of a replica to the primary
+func newPrimaryProxy(primaryURL string) (*httputil.ReverseProxy, error) {
+	u, err := url.Parse(primaryURL)
+	if err != nil {
+		return nil, err
+	}
+	proxy := httputil.NewSingleHostReverseProxy(u)
+	director := proxy.Director
+	proxy.Director = func(r *http.Request) {
+		director(r)
+		r.Header.Set(consistencyForwardedHeader, "1")
+	}
+	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		logf(logLevelWarn, "Forwarding to the primary: Bad gateway: %v\n", err)
+		http.Error(w, "Bad gateway", http.StatusBadGateway)
+	}
+	return proxy, nil
+}
+
+// routeRead serves the read at the requested consistency level when this instance cannot: a replica
+// forwards the strongly consistent reads to the primary, or rejects them without the primary URL.
+// It returns false if the read is to be served locally, after reporting its consistency level
+func (s *HashService) routeRead(w http.ResponseWriter, r *http.Request, handler string) bool {
+	level := r.URL.Query().Get("consistency")
+	switch level {
+	case "", consistencyEventual, consistencyStrong:
+	default:
+		s.writeError(w, r, handler, policyViolation("consistency must be %s or %s", consistencyStrong, consistencyEventual))
+		return true
+	}
+	if !s.isReplica() {
+		// The primary writes the records it serves, so its reads are always strongly consistent
+		w.Header().Set(consistencyHeader, consistencyStrong)
+		return false
+	}
+	if level != consistencyStrong {
+		w.Header().Set(consistencyHeader, consistencyEventual)
+		return false
+	}
+	if s.primary == nil || r.Header.Get(consistencyForwardedHeader) != "" {
+		logf(logLevelInfo, "%s: Strongly consistent read unavailable on the replica (%v)\n", handler, r.URL)
+		http.Error(w, "Service unavailable: strong consistency requires the primary", http.StatusServiceUnavailable)
+		return true
+	}
+	s.primary.ServeHTTP(w, r)
+	return true
+}
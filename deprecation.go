@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// deprecatedRoute describes a route being retired. The route is announced deprecated since the
+// deprecation time, if any, and is gone after the sunset time, if any
+type deprecatedRoute struct {
+	path       string
+	deprecated time.Time
+	sunset     time.Time
+	link       string
+	requests   *Counter
+}
+
+// matches checks whether the request path falls under the route, following the http.ServeMux rules
+func (d *deprecatedRoute) matches(path string) bool {
+	if strings.HasSuffix(d.path, "/") {
+		return strings.HasPrefix(path, d.path)
+	}
+	return path == d.path
+}
+
+// parseDeprecatedRoutes parses the deprecated routes given as "path=deprecation,sunset,link;path=...".
+// The times are RFC 3339 and may be left empty, as may the link to the migration guide
+func parseDeprecatedRoutes(v string) ([]*deprecatedRoute, error) {
+	var routes []*deprecatedRoute
+	for _, entry := range strings.Split(v, ";") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		i := strings.Index(entry, "=")
+		path := strings.TrimSpace(entry)
+		var fields []string
+		if i >= 0 {
+			path = strings.TrimSpace(entry[:i])
+			fields = strings.SplitN(entry[i+1:], ",", 3)
+		}
+		if !strings.HasPrefix(path, "/") {
+			return nil, fmt.Errorf("invalid deprecated route %q", entry)
+		}
+		route := &deprecatedRoute{path: path}
+		for n, field := range fields {
+			field = strings.TrimSpace(field)
+			if field == "" {
+				continue
+			}
+			switch n {
+			case 0, 1:
+				t, err := time.Parse(time.RFC3339, field)
+				if err != nil {
+					return nil, fmt.Errorf("deprecated route %s: %v", path, err)
+				}
+				if n == 0 {
+					route.deprecated = t
+				} else {
+					route.sunset = t
+				}
+			case 2:
+				route.link = field
+			}
+		}
+		if !route.deprecated.IsZero() && !route.sunset.IsZero() && route.sunset.Before(route.deprecated) {
+			return nil, fmt.Errorf("deprecated route %s: sunset precedes the deprecation", path)
+		}
+		routes = append(routes, route)
+	}
+	return routes, nil
+}
+
+// deprecateRoutes announces the deprecation of the configured routes with the Deprecation, Sunset
+// and Link headers and counts their use. After the sunset the routes answer 410 Gone
+func (s *HashService) deprecateRoutes(routes []*deprecatedRoute, next http.Handler) http.Handler {
+	for _, route := range routes {
+		route.requests = metrics.NewCounter("phs_deprecated_route_requests_total", "Number of requests to the deprecated routes", "route", route.path)
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		now := time.Now()
+		for _, route := range routes {
+			if !route.matches(r.URL.Path) || now.Before(route.deprecated) {
+				continue
+			}
+			route.requests.Inc()
+			if route.deprecated.IsZero() {
+				w.Header().Set("Deprecation", "?1")
+			} else {
+				w.Header().Set("Deprecation", "@"+strconv.FormatInt(route.deprecated.Unix(), 10))
+			}
+			if !route.sunset.IsZero() {
+				w.Header().Set("Sunset", route.sunset.UTC().Format(http.TimeFormat))
+			}
+			if route.link != "" {
+				w.Header().Add("Link", "<"+route.link+">; rel=\"deprecation\"")
+			}
+			if !route.sunset.IsZero() && !now.Before(route.sunset) {
+				logf(logLevelDebug, "Gone: %v is past its sunset\n", r.URL)
+				http.Error(w, "Gone", http.StatusGone)
+				return
+			}
+			logf(logLevelDebug, "Deprecated route %s requested (%v)\n", route.path, r.URL)
+			break
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"regexp"
+	"runtime"
+	"runtime/debug"
+	"runtime/pprof"
+	"strings"
+	"time"
+)
+
+// logSecretPattern matches the form and query fields carrying the passwords and the credentials
+// which may have made their way into the logged URLs
+var logSecretPattern = regexp.MustCompile(`(?i)\b(password|passwords\[\]|passwords%5B%5D|token|secret|code|state)=[^&\s]*`)
+
+// diagnosticsBuild describes the binary and the runtime in the diagnostics bundle
+type diagnosticsBuild struct {
+	GoVersion  string    `json:"go_version"`
+	OS         string    `json:"os"`
+	Arch       string    `json:"arch"`
+	CPUs       int       `json:"cpus"`
+	Goroutines int       `json:"goroutines"`
+	Module     string    `json:"module,omitempty"`
+	Version    string    `json:"version,omitempty"`
+	Instance   string    `json:"instance"`
+	Started    time.Time `json:"started"`
+	Created    time.Time `json:"created"`
+}
+
+// scrubLogLine removes the secret settings and the password fields from the log line
+func (s *HashService) scrubLogLine(line string, secrets []string) string {
+	for _, secret := range secrets {
+		line = strings.Replace(line, secret, redactedValue, -1)
+	}
+	return logSecretPattern.ReplaceAllString(line, "$1="+redactedValue)
+}
+
+// writeDiagnostics writes the gzipped tar bundle of the goroutine dump, the heap profile, the redacted
+// configuration, the last lines of the log, the metrics and the build information. The bundle is meant
+// to be attached to the support tickets, so the secrets and the passwords are scrubbed
+func (s *HashService) writeDiagnostics(w io.Writer, now time.Time) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	add := func(name string, data []byte) error {
+		hdr := &tar.Header{Name: name, Mode: 0600, Size: int64(len(data)), ModTime: now}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		_, err := tw.Write(data)
+		return err
+	}
+	addJSON := func(name string, v interface{}) error {
+		data, err := json.MarshalIndent(v, "", "  ")
+		if err != nil {
+			return err
+		}
+		return add(name, append(data, '\n'))
+	}
+
+	var buf bytes.Buffer
+	pprof.Lookup("goroutine").WriteTo(&buf, 2)
+	if err := add("goroutines.txt", buf.Bytes()); err != nil {
+		return err
+	}
+	// The heap profile holds the allocation sites and sizes, not the memory contents
+	buf.Reset()
+	pprof.Lookup("heap").WriteTo(&buf, 0)
+	if err := add("heap.pprof", buf.Bytes()); err != nil {
+		return err
+	}
+	if err := addJSON("config.json", s.cfg.Redacted()); err != nil {
+		return err
+	}
+
+	var secrets []string
+	for _, cs := range configSettings {
+		if v := cs.get(s.cfg); cs.secret && v != "" {
+			secrets = append(secrets, v)
+		}
+	}
+	buf.Reset()
+	for _, line := range recentLogs.Lines() {
+		buf.WriteString(s.scrubLogLine(line, secrets))
+	}
+	if err := add("logs.txt", buf.Bytes()); err != nil {
+		return err
+	}
+
+	buf.Reset()
+	metrics.WriteTo(&buf)
+	if err := add("metrics.txt", buf.Bytes()); err != nil {
+		return err
+	}
+
+	build := diagnosticsBuild{
+		GoVersion:  runtime.Version(),
+		OS:         runtime.GOOS,
+		Arch:       runtime.GOARCH,
+		CPUs:       runtime.NumCPU(),
+		Goroutines: runtime.NumGoroutine(),
+		Instance:   s.cfg.InstanceID,
+		Started:    s.storage.Recovery().Started,
+		Created:    now.UTC(),
+	}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		build.Module = info.Main.Path
+		build.Version = info.Main.Version
+	}
+	if err := addJSON("build.json", build); err != nil {
+		return err
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Severities of the doctor findings, from the least severe
+const (
+	severityOK       = "ok"
+	severityInfo     = "info"
+	severityWarning  = "warning"
+	severityCritical = "critical"
+)
+
+// severityRank orders the severities
+var severityRank = map[string]int{severityOK: 0, severityInfo: 1, severityWarning: 2, severityCritical: 3}
+
+// doctorTimeout bounds the checks reaching the storage and the peers
+const doctorTimeout = 2 * time.Second
+
+// doctorFinding is the outcome of a single check of the doctor
+type doctorFinding struct {
+	Check       string `json:"check"`
+	Severity    string `json:"severity"`
+	Summary     string `json:"summary"`
+	Remediation string `json:"remediation,omitempty"`
+}
+
+// doctorReport is the outcome of all the checks, with the most severe finding as its severity
+type doctorReport struct {
+	Checked  time.Time       `json:"checked"`
+	Severity string          `json:"severity"`
+	Findings []doctorFinding `json:"findings"`
+}
+
+// doctor runs the checks of the live state of the instance against the common operational
+// problems, suggesting the remediation of those found
+func (s *HashService) doctor(now time.Time) doctorReport {
+	report := doctorReport{Checked: now.UTC(), Severity: severityOK}
+	for _, check := range []func(time.Time) doctorFinding{
+		s.checkQueueDepth,
+		s.checkStorageLatency,
+		s.checkMemoryHeadroom,
+		s.checkTLSExpiry,
+		s.checkClockSkew,
+	} {
+		finding := check(now)
+		if severityRank[finding.Severity] > severityRank[report.Severity] {
+			report.Severity = finding.Severity
+		}
+		report.Findings = append(report.Findings, finding)
+	}
+	return report
+}
+
+// checkQueueDepth compares the pending hash calculations with the queue size and the workers
+// of the fullest worker pool
+func (s *HashService) checkQueueDepth(now time.Time) doctorFinding {
+	f := doctorFinding{Check: "queue_depth", Severity: severityOK}
+	pools, oldest := s.storage.PoolUsage(), s.storage.OldestPending(now)
+	fullest, fill := pools[0], -1.0
+	for _, p := range pools {
+		if pf := float64(p.Pending) / float64(p.QueueSize); pf > fill {
+			fullest, fill = p, pf
+		}
+	}
+	f.Summary = fmt.Sprintf("%d of %d queue slots used by %d workers, oldest pending for %v", fullest.Pending, fullest.QueueSize, fullest.Workers, oldest.Round(time.Millisecond))
+	if len(pools) > 1 {
+		f.Summary = fmt.Sprintf("Pool %s: %s", fullest.Name, f.Summary)
+	}
+	// Every calculation waits for the hash delay, so only the wait beyond it means the workers lag behind
+	lagging := oldest > s.cfg.HashDelay+10*time.Second
+	switch {
+	case fill >= 0.9:
+		f.Severity = severityCritical
+	case fill >= 0.5 || lagging:
+		f.Severity = severityWarning
+	default:
+		return f
+	}
+	if fullest.Name != s.storage.shared.name {
+		f.Remediation = fmt.Sprintf("Raise the workers or the queue of the %s pool in algorithm_pools, or add instances", fullest.Name)
+	} else if s.cfg.Workers < runtime.NumCPU() {
+		f.Remediation = fmt.Sprintf("Raise workers from %d up to the %d CPUs, or add instances", s.cfg.Workers, runtime.NumCPU())
+	} else {
+		f.Remediation = "The workers use all the CPUs: add instances, or lower the hash delay to free the queue slots sooner"
+	}
+	return f
+}
+
+// checkStorageLatency times a round trip to the storage backend
+func (s *HashService) checkStorageLatency(now time.Time) doctorFinding {
+	f := doctorFinding{Check: "storage_latency", Severity: severityOK}
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() { done <- s.storage.Ping() }()
+	var err error
+	select {
+	case err = <-done:
+	case <-time.After(doctorTimeout):
+		err = fmt.Errorf("no answer within %v", doctorTimeout)
+	}
+	latency := time.Since(start)
+	switch {
+	case err != nil:
+		f.Severity = severityCritical
+		f.Summary = fmt.Sprintf("%s storage check failed: %v", s.cfg.StorageBackend, err)
+		f.Remediation = "Check that the storage directory is mounted, writable and not full; see /admin/storage"
+	case latency > 500*time.Millisecond:
+		f.Severity = severityCritical
+	case latency > 50*time.Millisecond:
+		f.Severity = severityWarning
+	}
+	if err == nil {
+		f.Summary = fmt.Sprintf("%s storage answered in %v", s.cfg.StorageBackend, latency.Round(time.Microsecond))
+		if f.Severity != severityOK {
+			f.Remediation = "Move the storage to a local or faster disk, or enable the write batching to spread the cost of the writes"
+		}
+	}
+	return f
+}
+
+// memoryLimit returns the memory the process may use: the Go memory limit, the cgroup limit
+// or the host memory, whichever is set first, or 0 if none can be determined
+func memoryLimit() (uint64, string) {
+	if limit := debug.SetMemoryLimit(-1); limit != math.MaxInt64 {
+		return uint64(limit), "GOMEMLIMIT"
+	}
+	if data, err := ioutil.ReadFile("/sys/fs/cgroup/memory.max"); err == nil {
+		if limit, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64); err == nil {
+			return limit, "cgroup"
+		}
+	}
+	if limit := hostMemory(); limit > 0 {
+		return limit, "host"
+	}
+	return 0, ""
+}
+
+// checkMemoryHeadroom compares the memory obtained by the process with its limit
+func (s *HashService) checkMemoryHeadroom(now time.Time) doctorFinding {
+	f := doctorFinding{Check: "memory_headroom", Severity: severityOK}
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	limit, source := memoryLimit()
+	if limit == 0 {
+		f.Severity = severityInfo
+		f.Summary = fmt.Sprintf("%d MiB in use, the memory limit is unknown", mem.Sys>>20)
+		return f
+	}
+	headroom := 1 - float64(mem.Sys)/float64(limit)
+	f.Summary = fmt.Sprintf("%d MiB in use of the %d MiB %s limit, %.0f%% headroom", mem.Sys>>20, limit>>20, source, headroom*100)
+	switch {
+	case headroom < 0.1:
+		f.Severity = severityCritical
+	case headroom < 0.25:
+		f.Severity = severityWarning
+	default:
+		return f
+	}
+	f.Remediation = "Lower the queue size, the hot tier size or the bloom filter capacity, or raise the memory limit"
+	return f
+}
+
+// checkTLSExpiry checks how long the configured certificates remain valid
+func (s *HashService) checkTLSExpiry(now time.Time) doctorFinding {
+	f := doctorFinding{Check: "tls_expiry", Severity: severityOK}
+	certs := map[string][2]string{}
+	if s.cfg.TLSCertFile != "" {
+		certs["server"] = [2]string{s.cfg.TLSCertFile, s.cfg.TLSKeyFile}
+	}
+	if s.cfg.ReplicationCert != "" {
+		certs["replication client"] = [2]string{s.cfg.ReplicationCert, s.cfg.ReplicationKey}
+	}
+	for backend, files := range backendClientCerts(s.cfg) {
+		certs[backend+" client"] = files
+	}
+	if len(certs) == 0 {
+		f.Severity = severityInfo
+		f.Summary = "No certificates configured"
+		return f
+	}
+	var summaries []string
+	for name, files := range certs {
+		expires, err := certificateExpiry(files[0], files[1])
+		if err != nil {
+			f.Severity = severityCritical
+			summaries = append(summaries, fmt.Sprintf("%s certificate unreadable: %v", name, err))
+			continue
+		}
+		left := expires.Sub(now)
+		summaries = append(summaries, fmt.Sprintf("%s certificate expires on %s, in %d days", name, expires.Format("2006-01-02"), int(left.Hours()/24)))
+		switch {
+		case left < 7*24*time.Hour:
+			f.Severity = severityCritical
+		case left < 30*24*time.Hour && f.Severity == severityOK:
+			f.Severity = severityWarning
+		}
+	}
+	f.Summary = strings.Join(summaries, "; ")
+	if f.Severity != severityOK {
+		f.Remediation = "Renew the certificate and restart the instance, the certificates are loaded at startup"
+	}
+	return f
+}
+
+// certificateExpiry returns the expiration time of the leaf certificate of the pair
+func certificateExpiry(certFile, keyFile string) (time.Time, error) {
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return time.Time{}, err
+	}
+	leaf, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return time.Time{}, err
+	}
+	return leaf.NotAfter, nil
+}
+
+// clockPeers returns the URLs of the configured instances the clock is compared with
+func (s *HashService) clockPeers() []string {
+	var peers []string
+	for _, u := range []string{s.cfg.PrimaryURL, s.cfg.StandbyOf, s.cfg.MirrorURL} {
+		if u != "" {
+			peers = append(peers, strings.TrimSuffix(u, "/"))
+		}
+	}
+	if s.federation != nil {
+		for _, peer := range s.federation.peers {
+			peers = append(peers, peer.url)
+		}
+	}
+	return peers
+}
+
+// checkClockSkew compares the clock with the Date headers of the configured peers. The skew breaks
+// the expiration of the hashes, the API keys and the OIDC sessions across the instances
+func (s *HashService) checkClockSkew(now time.Time) doctorFinding {
+	f := doctorFinding{Check: "clock_skew", Severity: severityOK}
+	peers := s.clockPeers()
+	if len(peers) == 0 {
+		f.Severity = severityInfo
+		f.Summary = "No peers configured to compare the clock with"
+		return f
+	}
+	client := &http.Client{Timeout: doctorTimeout}
+	var worst time.Duration
+	var worstPeer string
+	var unreachable []string
+	for _, peer := range peers {
+		sent := time.Now()
+		resp, err := client.Get(peer + healthzRoutePath)
+		if err != nil {
+			unreachable = append(unreachable, peer)
+			continue
+		}
+		resp.Body.Close()
+		date, err := http.ParseTime(resp.Header.Get("Date"))
+		if err != nil {
+			unreachable = append(unreachable, peer)
+			continue
+		}
+		// The Date header has a second resolution, taken somewhere during the round trip
+		received := time.Now()
+		local := sent.Add(received.Sub(sent) / 2).Truncate(time.Second)
+		skew := date.Sub(local)
+		if skew < 0 {
+			skew = -skew
+		}
+		if skew >= worst {
+			worst, worstPeer = skew, peer
+		}
+	}
+	if worstPeer == "" {
+		f.Severity = severityWarning
+		f.Summary = "No peer answered with its time: " + strings.Join(unreachable, ", ")
+		f.Remediation = "Check that the peers are up and reachable from this instance"
+		return f
+	}
+	f.Summary = fmt.Sprintf("Largest skew %v, with %s", worst, worstPeer)
+	if len(unreachable) > 0 {
+		f.Summary += "; unreachable: " + strings.Join(unreachable, ", ")
+	}
+	switch {
+	case worst > 30*time.Second:
+		f.Severity = severityCritical
+	case worst > 2*time.Second:
+		f.Severity = severityWarning
+	default:
+		return f
+	}
+	f.Remediation = "Synchronize the clocks of the hosts with NTP"
+	return f
+}
@@ -0,0 +1,506 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The kinds of divergence between the backends reported by the dual-write migration
+const (
+	// divergenceWriteFailed counts the writes and deletions which failed in the new backend only
+	divergenceWriteFailed = "write_failed"
+	// divergenceReadFallback counts the reads missing, or failing, in the old backend served by the new one
+	divergenceReadFallback = "read_fallback"
+	// divergenceMissing, divergenceMismatched and divergenceExtra count the records the backfill found
+	// missing, different or left over in the new backend. The extra records are removed only when the
+	// old backend is durable, see DualWriteBackend
+	divergenceMissing    = "missing"
+	divergenceMismatched = "mismatched"
+	divergenceExtra      = "extra"
+)
+
+// divergenceKinds lists the kinds of divergence in the reports
+var divergenceKinds = []string{divergenceWriteFailed, divergenceReadFallback, divergenceMissing, divergenceMismatched, divergenceExtra}
+
+// parseMigrationTarget parses the backend the storage migrates to, given as file:dir or tiered:dir
+func parseMigrationTarget(v string) (backend, dir string, err error) {
+	i := strings.Index(v, ":")
+	if i < 0 || v[i+1:] == "" {
+		return "", "", fmt.Errorf("invalid storage migration target %q, expected backend:dir", v)
+	}
+	backend, dir = v[:i], v[i+1:]
+	if backend != "file" && backend != "tiered" {
+		return "", "", fmt.Errorf("storage migration target %q: expected the file or tiered backend", v)
+	}
+	return backend, dir, nil
+}
+
+// newDualWriteHome constructs the backend the storage migrates to and wraps the home backend
+// to write to both. The home backend is closed on error
+func newDualWriteHome(cfg *Config, home HashBackend) (HashBackend, error) {
+	backend, dir, err := parseMigrationTarget(cfg.StorageMigrateTo)
+	if err != nil {
+		home.Close()
+		return nil, err
+	}
+	target := *cfg
+	target.StorageBackend, target.StorageDir = backend, dir
+	next, err := newHomeBackend(&target)
+	if err != nil {
+		home.Close()
+		return nil, err
+	}
+	return NewDualWriteBackend(home, next, cfg.StorageMigrateTo), nil
+}
+
+// MigrationStatus reports the progress of the dual-write migration and the divergence found so far
+type MigrationStatus struct {
+	Target       string            `json:"target"`
+	Backfilled   bool              `json:"backfilled"`
+	Scanned      uint64            `json:"scanned"`
+	Divergence   map[string]uint64 `json:"divergence"`
+	BackfillErr  string            `json:"backfill_error,omitempty"`
+	BackfillDone *time.Time        `json:"backfill_done,omitempty"`
+}
+
+// DualWriteBackend migrates the storage to a new backend without downtime. Everything is written to the
+// old backend, which stays authoritative, and then to the new one, whose failures are only counted. The reads are served by the old backend, falling back to the new one.
+// In the background, the backfill copies the records, the API keys, the metadata, the idempotency records
+// and the statistics snapshots written before to the new backend and reconciles the records which diverged,
+// so that the instances can be cut over to the new backend. The records found in the new backend only are
+// removed unless the old backend is the memory one, which is empty after a restart: the new backend then
+// keeps them, and becomes authoritative at the cutover
+type DualWriteBackend struct {
+	old, next HashBackend
+	target    string
+	// durable is set unless the old backend loses its records on restart
+	durable bool
+	// mu serializes the record writes with their reconciliation by the backfill
+	mu         sync.Mutex
+	divergence map[string]*Counter
+
+	statusMu sync.Mutex
+	status   MigrationStatus
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// NewDualWriteBackend constructs the backend migrating from the old backend to the next one, described
+// by the target, and starts the backfill. Both backends are closed along with it
+func NewDualWriteBackend(old, next HashBackend, target string) *DualWriteBackend {
+	b := &DualWriteBackend{
+		old:        old,
+		next:       next,
+		target:     target,
+		durable:    !isMemoryBackend(old),
+		divergence: make(map[string]*Counter),
+		status:     MigrationStatus{Target: target},
+		done:       make(chan struct{}),
+	}
+	for _, kind := range divergenceKinds {
+		b.divergence[kind] = metrics.NewCounter("phs_dual_write_divergence_total", "Number of records found diverging between the old and the new backend of the migration", "kind", kind)
+	}
+	metrics.NewGaugeFunc("phs_dual_write_backfill_complete", "Whether the backfill of the new backend of the migration has completed (1) or not (0)", func() float64 {
+		b.statusMu.Lock()
+		defer b.statusMu.Unlock()
+		if b.status.Backfilled {
+			return 1
+		}
+		return 0
+	})
+	logf(logLevelInfo, "Migrating the storage to %s: writing to both backends, reading from the old one\n", target)
+	if !b.durable {
+		logf(logLevelWarn, "Storage migration: The old backend is not durable, the records found in %s only are kept\n", target)
+	}
+	b.wg.Add(1)
+	go b.backfill()
+	return b
+}
+
+// diverged counts the divergence of the record and logs it
+func (b *DualWriteBackend) diverged(kind string, id uint64, err error) {
+	b.divergence[kind].Inc()
+	if err != nil {
+		logf(logLevelWarn, "Storage migration: %s for hash %d: %v\n", kind, id, err)
+	}
+}
+
+// Put stores the record in the old backend and then in the new one
+func (b *DualWriteBackend) Put(id uint64, rec hashRecord) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.old.Put(id, rec); err != nil {
+		return err
+	}
+	if err := b.next.Put(id, rec); err != nil {
+		b.diverged(divergenceWriteFailed, id, err)
+	}
+	return nil
+}
+
+// PutBatch stores the records in the old backend and then in the new one
+func (b *DualWriteBackend) PutBatch(recs map[uint64]hashRecord, durable bool) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := putBatch(b.old, recs, durable); err != nil {
+		return err
+	}
+	if err := putBatch(b.next, recs, durable); err != nil {
+		b.divergence[divergenceWriteFailed].Add(uint64(len(recs)))
+		logf(logLevelWarn, "Storage migration: %s for a batch of %d hashes: %v\n", divergenceWriteFailed, len(recs), err)
+	}
+	return nil
+}
+
+// Get returns the record stored in the old backend, or else in the new one
+func (b *DualWriteBackend) Get(id uint64) (hashRecord, bool, error) {
+	rec, ok, err := b.old.Get(id)
+	if err == nil && ok {
+		return rec, true, nil
+	}
+	fallback, found, nextErr := b.next.Get(id)
+	if nextErr != nil || !found {
+		return rec, ok, err
+	}
+	b.diverged(divergenceReadFallback, id, err)
+	return fallback, true, nil
+}
+
+// Delete removes the record from the old backend and then from the new one
+func (b *DualWriteBackend) Delete(id uint64) (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ok, err := b.old.Delete(id)
+	if err != nil {
+		return ok, err
+	}
+	if _, err := b.next.Delete(id); err != nil {
+		b.diverged(divergenceWriteFailed, id, err)
+	}
+	return ok, nil
+}
+
+// Scan calls fn for every record stored in the old backend
+func (b *DualWriteBackend) Scan(fn func(id uint64, rec hashRecord) error) error {
+	return b.old.Scan(fn)
+}
+
+// backfill copies the records and the API keys of the old backend missing in the new one, reconciles the
+// records which differ and removes those left over in the new backend, until done or closed
+func (b *DualWriteBackend) backfill() {
+	defer b.wg.Done()
+	start := time.Now()
+	errStopped := errors.New("stopped")
+	var scanned uint64
+	seen := make(map[uint64]bool)
+	err := b.old.Scan(func(id uint64, _ hashRecord) error {
+		select {
+		case <-b.done:
+			return errStopped
+		default:
+		}
+		seen[id] = true
+		scanned++
+		if scanned%1000 == 0 {
+			b.statusMu.Lock()
+			b.status.Scanned = scanned
+			b.statusMu.Unlock()
+		}
+		return b.reconcile(id)
+	})
+	if err == nil {
+		err = b.next.Scan(func(id uint64, _ hashRecord) error {
+			select {
+			case <-b.done:
+				return errStopped
+			default:
+			}
+			if seen[id] {
+				return nil
+			}
+			return b.reconcile(id)
+		})
+	}
+	if err == nil {
+		err = b.copyMetadata()
+	}
+	if err == errStopped {
+		return
+	}
+	now := time.Now().UTC()
+	b.statusMu.Lock()
+	b.status.Scanned = scanned
+	if err != nil {
+		b.status.BackfillErr = err.Error()
+	} else {
+		b.status.Backfilled, b.status.BackfillDone = true, &now
+	}
+	b.statusMu.Unlock()
+	if err != nil {
+		logf(logLevelError, "Storage migration: Backfill of %s failed after %d records: %v\n", b.target, scanned, err)
+		return
+	}
+	logf(logLevelInfo, "Storage migration: Backfilled %s with %d records in %v\n", b.target, scanned, time.Since(start).Round(time.Millisecond))
+}
+
+// reconcile makes the new backend hold the record as stored in the old one, counting the divergence fixed
+func (b *DualWriteBackend) reconcile(id uint64) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	rec, ok, err := b.old.Get(id)
+	if err != nil {
+		return err
+	}
+	next, found, err := b.next.Get(id)
+	if err != nil {
+		return err
+	}
+	switch {
+	case !ok && found:
+		b.divergence[divergenceExtra].Inc()
+		if b.durable {
+			_, err = b.next.Delete(id)
+		}
+	case ok && !found:
+		b.divergence[divergenceMissing].Inc()
+		err = b.next.Put(id, rec)
+	case ok && !sameRecord(rec, next):
+		b.divergence[divergenceMismatched].Inc()
+		err = b.next.Put(id, rec)
+	}
+	return err
+}
+
+// sameRecord compares the records as they are encoded
+func sameRecord(a, b hashRecord) bool {
+	ea, errA := json.Marshal(a)
+	eb, errB := json.Marshal(b)
+	return errA == nil && errB == nil && bytes.Equal(ea, eb)
+}
+
+// copyMetadata copies the API keys, the metadata documents, the unexpired idempotency records and the
+// statistics snapshots of the old backend to the new one. The migration is not backfilled until they are
+func (b *DualWriteBackend) copyMetadata() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	keys, err := b.old.(apiKeyStore).ListKeys()
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err := b.next.(apiKeyStore).PutKey(key); err != nil {
+			return err
+		}
+	}
+	lister, ok := b.old.(metadataLister)
+	if !ok {
+		return errors.New("the old backend does not list its metadata")
+	}
+	names, err := lister.ListMeta()
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		var doc json.RawMessage
+		if ok, err := b.old.(metadataStore).GetMeta(name, &doc); err != nil {
+			return err
+		} else if !ok {
+			continue
+		}
+		if err := b.next.(metadataStore).PutMeta(name, doc); err != nil {
+			return err
+		}
+	}
+	idempotency, ok := b.old.(idempotencyLister)
+	if !ok {
+		return errors.New("the old backend does not list its idempotency records")
+	}
+	recs, err := idempotency.ListIdempotency(time.Now())
+	if err != nil {
+		return err
+	}
+	for _, rec := range recs {
+		if _, _, err := b.next.(idempotencyStore).ClaimIdempotency(rec); err != nil {
+			return err
+		}
+	}
+	if store, ok := b.old.(statsSnapshotStore); ok {
+		snaps, err := store.ListStats()
+		if err != nil {
+			return err
+		}
+		for _, snap := range snaps {
+			if err := b.next.(statsSnapshotStore).PutStats(snap); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// isMemoryBackend reports whether the backend keeps its records in memory only
+func isMemoryBackend(b HashBackend) bool {
+	_, ok := b.(*MemoryBackend)
+	return ok
+}
+
+// Status reports the progress of the migration
+func (b *DualWriteBackend) Status() MigrationStatus {
+	b.statusMu.Lock()
+	status := b.status
+	b.statusMu.Unlock()
+	status.Divergence = make(map[string]uint64)
+	for kind, c := range b.divergence {
+		status.Divergence[kind] = c.Value()
+	}
+	return status
+}
+
+// Ping checks whether the old backend is reachable, the failures of the new one are counted as divergence
+func (b *DualWriteBackend) Ping() error {
+	if p, ok := b.old.(storagePinger); ok {
+		return p.Ping()
+	}
+	return nil
+}
+
+// Usage reports the usage of the old backend along with the progress of the migration
+func (b *DualWriteBackend) Usage() (StorageUsage, error) {
+	r, ok := b.old.(storageUsageReporter)
+	if !ok {
+		return StorageUsage{}, errors.New("storage backend does not report its usage")
+	}
+	usage, err := r.Usage()
+	if err != nil {
+		return usage, err
+	}
+	status := b.Status()
+	usage.Migration = &status
+	return usage, nil
+}
+
+// Compact compacts both backends requiring it
+func (b *DualWriteBackend) Compact() error {
+	for _, backend := range []HashBackend{b.old, b.next} {
+		if c, ok := backend.(storageCompactor); ok {
+			if err := c.Compact(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// LockMigrations takes the migration lock of the old backend, if it has one
+func (b *DualWriteBackend) LockMigrations(owner string) (func() error, error) {
+	if l, ok := b.old.(migrationLocker); ok {
+		return l.LockMigrations(owner)
+	}
+	return func() error { return nil }, nil
+}
+
+// PutStats saves the statistics snapshot of the instance to the old backend and then to the new one
+func (b *DualWriteBackend) PutStats(snap statsSnapshot) error {
+	if store, ok := b.old.(statsSnapshotStore); ok {
+		if err := store.PutStats(snap); err != nil {
+			return err
+		}
+	}
+	if err := b.next.(statsSnapshotStore).PutStats(snap); err != nil {
+		logf(logLevelWarn, "Storage migration: Error while saving the statistics snapshot: %v\n", err)
+	}
+	return nil
+}
+
+// ListStats returns the statistics snapshots saved in the old backend
+func (b *DualWriteBackend) ListStats() ([]statsSnapshot, error) {
+	if store, ok := b.old.(statsSnapshotStore); ok {
+		return store.ListStats()
+	}
+	return nil, nil
+}
+
+// PutKey saves the API key to the old backend and then to the new one
+func (b *DualWriteBackend) PutKey(key apiKey) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.old.(apiKeyStore).PutKey(key); err != nil {
+		return err
+	}
+	if err := b.next.(apiKeyStore).PutKey(key); err != nil {
+		logf(logLevelWarn, "Storage migration: Error while saving API key %s: %v\n", key.ID, err)
+	}
+	return nil
+}
+
+// GetKey returns the API key saved in the old backend
+func (b *DualWriteBackend) GetKey(id string) (apiKey, bool, error) {
+	return b.old.(apiKeyStore).GetKey(id)
+}
+
+// ListKeys returns the API keys saved in the old backend
+func (b *DualWriteBackend) ListKeys() ([]apiKey, error) {
+	return b.old.(apiKeyStore).ListKeys()
+}
+
+// PutMeta saves the value as the named document in the old backend and then in the new one
+func (b *DualWriteBackend) PutMeta(name string, v interface{}) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.old.(metadataStore).PutMeta(name, v); err != nil {
+		return err
+	}
+	if err := b.next.(metadataStore).PutMeta(name, v); err != nil {
+		logf(logLevelWarn, "Storage migration: Error while saving %s: %v\n", name, err)
+	}
+	return nil
+}
+
+// GetMeta loads the named document from the old backend into v
+func (b *DualWriteBackend) GetMeta(name string, v interface{}) (bool, error) {
+	return b.old.(metadataStore).GetMeta(name, v)
+}
+
+// GetIdempotency returns the record from the old backend
+func (b *DualWriteBackend) GetIdempotency(key string) (idempotencyRecord, bool, error) {
+	return b.old.(idempotencyStore).GetIdempotency(key)
+}
+
+// ClaimIdempotency saves the record in the old backend and, once claimed, in the new one
+func (b *DualWriteBackend) ClaimIdempotency(rec idempotencyRecord) (idempotencyRecord, bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	existing, claimed, err := b.old.(idempotencyStore).ClaimIdempotency(rec)
+	if err != nil || !claimed {
+		return existing, claimed, err
+	}
+	if _, _, err := b.next.(idempotencyStore).ClaimIdempotency(rec); err != nil {
+		logf(logLevelWarn, "Storage migration: Error while saving the idempotency record: %v\n", err)
+	}
+	return existing, true, nil
+}
+
+// ExpireIdempotency removes the expired records from both backends, returning the number removed from the old one
+func (b *DualWriteBackend) ExpireIdempotency(now time.Time) (int, error) {
+	if _, err := b.next.(idempotencyStore).ExpireIdempotency(now); err != nil {
+		logf(logLevelWarn, "Storage migration: Error while expiring the idempotency records: %v\n", err)
+	}
+	return b.old.(idempotencyStore).ExpireIdempotency(now)
+}
+
+// Close stops the backfill and closes both backends, returning the first error
+func (b *DualWriteBackend) Close() error {
+	close(b.done)
+	b.wg.Wait()
+	err := b.old.Close()
+	if nextErr := b.next.Close(); err == nil {
+		err = nextErr
+	}
+	return err
+}
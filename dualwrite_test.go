@@ -0,0 +1,157 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// failingBackend is a memory backend whose record writes and deletions fail
+type failingBackend struct {
+	*MemoryBackend
+}
+
+var errBackendDown = errors.New("backend down")
+
+func (b failingBackend) Put(uint64, hashRecord) error { return errBackendDown }
+
+func (b failingBackend) Delete(uint64) (bool, error) { return false, errBackendDown }
+
+// waitBackfilled waits for the backfill of the migration to complete
+func waitBackfilled(t *testing.T, b *DualWriteBackend) MigrationStatus {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		status := b.Status()
+		if status.BackfillErr != "" {
+			t.Fatalf("backfill failed: %s", status.BackfillErr)
+		}
+		if status.Backfilled {
+			return status
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("backfill not completed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestDualWriteBackendBackfill(t *testing.T) {
+	created := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	for _, tt := range []struct {
+		name      string
+		old       func(t *testing.T) HashBackend
+		wantExtra bool // whether the record found in the new backend only is kept
+	}{
+		{name: "durable", old: func(t *testing.T) HashBackend { return newTestFileBackend(t) }, wantExtra: false},
+		{name: "memory", old: func(t *testing.T) HashBackend { return NewMemoryBackend() }, wantExtra: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			old, next := tt.old(t), newTestFileBackend(t)
+			// 1 is in both, 2 in the old backend only, 3 differs and 4 is in the new backend only
+			for _, w := range []struct {
+				backend HashBackend
+				id      uint64
+				hash    string
+			}{
+				{old, 1, "same"}, {next, 1, "same"},
+				{old, 2, "missing"},
+				{old, 3, "old"}, {next, 3, "stale"},
+				{next, 4, "extra"},
+			} {
+				if err := w.backend.Put(w.id, hashRecord{Hash: w.hash, Created: created}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			key := apiKey{ID: "k1", Scopes: []string{scopeHashWrite}, SecretHash: "s", Created: created}
+			if err := old.(apiKeyStore).PutKey(key); err != nil {
+				t.Fatal(err)
+			}
+			if err := old.(metadataStore).PutMeta("doc", map[string]int{"v": 1}); err != nil {
+				t.Fatal(err)
+			}
+			if _, _, err := old.(idempotencyStore).ClaimIdempotency(testIdempotencyRecord("i1", 2, time.Hour)); err != nil {
+				t.Fatal(err)
+			}
+
+			b := NewDualWriteBackend(old, next, "file:test")
+			defer b.Close()
+			status := waitBackfilled(t, b)
+			for kind, want := range map[string]uint64{divergenceMissing: 1, divergenceMismatched: 1, divergenceExtra: 1, divergenceWriteFailed: 0, divergenceReadFallback: 0} {
+				if status.Divergence[kind] != want {
+					t.Errorf("divergence %s = %d, want %d", kind, status.Divergence[kind], want)
+				}
+			}
+			for id, want := range map[uint64]string{1: "same", 2: "missing", 3: "old"} {
+				if rec, ok, err := next.Get(id); err != nil || !ok || rec.Hash != want {
+					t.Errorf("record %d in the new backend = %q, %v, %v, want %q", id, rec.Hash, ok, err, want)
+				}
+			}
+			if _, ok, err := next.Get(4); err != nil || ok != tt.wantExtra {
+				t.Errorf("extra record kept = %v, %v, want %v", ok, err, tt.wantExtra)
+			}
+
+			if got, ok, err := next.GetKey("k1"); err != nil || !ok || got.SecretHash != key.SecretHash {
+				t.Errorf("API key in the new backend = %+v, %v, %v", got, ok, err)
+			}
+			var doc map[string]int
+			if ok, err := next.GetMeta("doc", &doc); err != nil || !ok || doc["v"] != 1 {
+				t.Errorf("metadata in the new backend = %v, %v, %v", doc, ok, err)
+			}
+			if rec, ok, err := next.GetIdempotency("i1"); err != nil || !ok || rec.ID != 2 {
+				t.Errorf("idempotency record in the new backend = hash %d, %v, %v", rec.ID, ok, err)
+			}
+		})
+	}
+}
+
+func TestDualWriteBackendDivergence(t *testing.T) {
+	rec := hashRecord{Hash: "h", Created: time.Now().UTC()}
+	for _, tt := range []struct {
+		name string
+		// run performs the operation on the backend whose old backend is empty and whose new one fails
+		// its writes but holds the record 9
+		run      func(b *DualWriteBackend) error
+		wantKind string
+	}{
+		{name: "put", run: func(b *DualWriteBackend) error { return b.Put(1, rec) }, wantKind: divergenceWriteFailed},
+		{name: "batch", run: func(b *DualWriteBackend) error { return b.PutBatch(map[uint64]hashRecord{1: rec}, true) }, wantKind: divergenceWriteFailed},
+		{name: "delete", run: func(b *DualWriteBackend) error { _, err := b.Delete(1); return err }, wantKind: divergenceWriteFailed},
+		{name: "read fallback", run: func(b *DualWriteBackend) error {
+			got, ok, err := b.Get(9)
+			if err == nil && (!ok || got.Hash != "h") {
+				err = errors.New("record of the new backend not served")
+			}
+			return err
+		}, wantKind: divergenceReadFallback},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			old, next := NewMemoryBackend(), failingBackend{NewMemoryBackend()}
+			if err := next.MemoryBackend.Put(9, rec); err != nil {
+				t.Fatal(err)
+			}
+			b := NewDualWriteBackend(old, next, "file:test")
+			defer b.Close()
+			before := waitBackfilled(t, b).Divergence
+
+			// The failures of the new backend are not the caller's
+			if err := tt.run(b); err != nil {
+				t.Fatal(err)
+			}
+			after := b.Status().Divergence
+			for _, kind := range divergenceKinds {
+				want := before[kind]
+				if kind == tt.wantKind {
+					want++
+				}
+				if after[kind] != want {
+					t.Errorf("divergence %s = %d, want %d", kind, after[kind], want)
+				}
+			}
+			if tt.wantKind == divergenceWriteFailed && tt.name != "delete" {
+				if _, ok, err := old.Get(1); err != nil || !ok {
+					t.Errorf("record not stored in the old backend: %v, %v", ok, err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var (
+	// ErrNotFound is returned when the record does not exist, has expired or has been deleted
+	ErrNotFound = errors.New("not found")
+	// ErrPending is returned when the hash calculation has not completed yet
+	ErrPending = errors.New("hash calculation is pending")
+	// ErrQueueFull is returned when there are too many pending hash calculations
+	ErrQueueFull = errors.New("hash queue is full")
+	// ErrPolicyViolation is returned when the request breaks the rules of the service,
+	// such as a missing password or an invalid expiration
+	ErrPolicyViolation = errors.New("policy violation")
+	// ErrReadOnly is returned when modifying the storage of a read-only replica
+	ErrReadOnly = errors.New("storage is read-only")
+	// ErrMalformedRequest is returned when the request body or form cannot be decoded
+	ErrMalformedRequest = errors.New("malformed request")
+	// ErrForbidden is returned when the caller may not make the request, whatever its parameters
+	ErrForbidden = errors.New("forbidden")
+	// ErrNotImplemented is returned when the request needs a feature not enabled on the instance
+	ErrNotImplemented = errors.New("not enabled")
+	// ErrIdempotencyMismatch is returned when an idempotency key is reused for a different request
+	ErrIdempotencyMismatch = errors.New("idempotency key reused for a different request")
+	// ErrUpstream is returned when a service the request depends on, such as the identity provider, fails
+	ErrUpstream = errors.New("upstream service failed")
+)
+
+// purgedError is returned when the record has been purged by the retention while its tombstone
+// is kept. It wraps ErrNotFound, so that it is not found for the callers not telling the purged records apart
+type purgedError struct {
+	Purged time.Time
+}
+
+func (e *purgedError) Error() string {
+	return "purged at " + e.Purged.Format(time.RFC3339)
+}
+
+func (e *purgedError) Unwrap() error {
+	return ErrNotFound
+}
+
+// policyViolation returns the error wrapping ErrPolicyViolation with the message shown to the client
+func policyViolation(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s", ErrPolicyViolation, fmt.Sprintf(format, args...))
+}
+
+// malformedRequest returns the error wrapping ErrMalformedRequest with the decoding error
+func malformedRequest(err error) error {
+	return fmt.Errorf("%w: %v", ErrMalformedRequest, err)
+}
+
+// forbidden returns the error wrapping ErrForbidden with the reason, which is logged only
+func forbidden(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s", ErrForbidden, fmt.Sprintf(format, args...))
+}
+
+// notImplemented returns the error wrapping ErrNotImplemented with the feature missing, which is logged only
+func notImplemented(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s", ErrNotImplemented, fmt.Sprintf(format, args...))
+}
+
+// upstreamError returns the error wrapping ErrUpstream with the failure of the service, which is logged only
+func upstreamError(service string, err error) error {
+	return fmt.Errorf("%w: %s: %v", ErrUpstream, service, err)
+}
+
+// writeError maps the error returned by the storage, the queue or the request handling to the HTTP
+// response, the only place deciding the status of the errors. The handler name prefixes the logged message
+func (s *HashService) writeError(w http.ResponseWriter, r *http.Request, handler string, err error) {
+	var idErr *hashIDError
+	var purged *purgedError
+	var lockout *lockoutError
+	switch {
+	case errors.As(err, &idErr):
+		logf(logLevelInfo, "%s: Bad request: %v\n", handler, err)
+		w.Header().Set("X-Error-Code", idErr.Code)
+		http.Error(w, "Bad request: "+idErr.Message, http.StatusBadRequest)
+	case errors.Is(err, ErrPolicyViolation), errors.Is(err, ErrMalformedRequest):
+		logf(logLevelInfo, "%s: Bad request: %v\n", handler, err)
+		http.Error(w, "Bad request: "+err.Error(), http.StatusBadRequest)
+	case errors.Is(err, ErrUnauthenticated):
+		logf(logLevelInfo, "%s: Unauthorized (%v %v)\n", handler, r.Method, r.URL)
+		w.Header().Set("WWW-Authenticate", `Bearer realm="password-hash-service"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	case errors.Is(err, ErrForbidden), errors.Is(err, ErrOIDC):
+		logf(logLevelWarn, "%s: Forbidden (%v): %v\n", handler, r.URL.Path, err)
+		http.Error(w, "Forbidden", http.StatusForbidden)
+	case errors.Is(err, ErrIdempotencyMismatch):
+		logf(logLevelInfo, "%s: Unprocessable entity: %v\n", handler, err)
+		http.Error(w, "Idempotency key reused for a different request", http.StatusUnprocessableEntity)
+	case errors.Is(err, ErrNotImplemented):
+		logf(logLevelInfo, "%s: Not implemented: %v\n", handler, err)
+		http.Error(w, "Not implemented", http.StatusNotImplemented)
+	case errors.Is(err, ErrPending):
+		// The pending calculations are reported as not found, so that the clients keep polling
+		logf(logLevelInfo, "%s: Not found (%v): %v\n", handler, r.URL, err)
+		http.Error(w, "Not found", http.StatusNotFound)
+	case errors.As(err, &purged):
+		logf(logLevelInfo, "%s: Gone (%v): %v\n", handler, r.URL, err)
+		w.Header().Set("X-Purged-At", purged.Purged.Format(time.RFC3339))
+		http.Error(w, "Gone: purged by the retention at "+purged.Purged.Format(time.RFC3339), http.StatusGone)
+	case errors.As(err, &lockout):
+		logf(logLevelInfo, "%s: Too many requests: %v\n", handler, err)
+		w.Header().Set("Retry-After", strconv.FormatInt(int64(time.Until(lockout.Until)/time.Second)+1, 10))
+		http.Error(w, "Too many requests: too many failed verifications", http.StatusTooManyRequests)
+	case errors.Is(err, ErrNotFound):
+		logf(logLevelInfo, "%s: Not found (%v)\n", handler, r.URL)
+		http.Error(w, "Not found", http.StatusNotFound)
+	case errors.Is(err, ErrReadOnly):
+		logf(logLevelInfo, "%s: Method %v not allowed on a replica\n", handler, r.Method)
+		http.Error(w, "Method not allowed on a read-only replica", http.StatusMethodNotAllowed)
+	case errors.Is(err, ErrPeerUnavailable), errors.Is(err, ErrUpstream):
+		logf(logLevelWarn, "%s: Bad gateway: %v\n", handler, err)
+		http.Error(w, "Bad gateway", http.StatusBadGateway)
+	case errors.Is(err, ErrQueueFull):
+		logf(logLevelWarn, "%s: Service unavailable: %v\n", handler, err)
+		s.writeThrottled(w, http.StatusServiceUnavailable, "Service unavailable")
+	default:
+		logf(logLevelError, "%s: Storage error: %v\n", handler, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"hash"
+	mathrand "math/rand"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// experimentControlArm is the name of the arm hashing the passwords as usual
+const experimentControlArm = "control"
+
+// experimentSaltSize is the size of the random salt of the PBKDF2 hashes calculated by the experiment arms
+const experimentSaltSize = 16
+
+// experimentArm is a share of the traffic hashed with alternate parameters. The control arm has no prf
+type experimentArm struct {
+	name       string
+	percent    float64
+	prfName    string
+	prf        func() hash.Hash
+	iterations int
+
+	hashes        *Counter
+	verifications *Counter
+	failures      *Counter
+	// hashMicros and verifyMicros accumulate the time spent, reported in seconds
+	hashMicros   uint64
+	verifyMicros uint64
+}
+
+// HashExperiment routes a percentage of the hash calculations to the arms hashing the passwords
+// with PBKDF2 at alternate cost parameters, recording the latency and the failures of every arm
+type HashExperiment struct {
+	name    string
+	arms    []*experimentArm
+	control *experimentArm
+}
+
+// parseExperimentArms parses the arms given as "arm=percent:prf:iterations;arm=...", e.g.
+// "fast=5:sha256:100000;slow=5:sha512:600000". The rest of the traffic goes to the control arm
+func parseExperimentArms(v string) ([]*experimentArm, error) {
+	var arms []*experimentArm
+	var total float64
+	seen := map[string]bool{experimentControlArm: true}
+	for _, entry := range strings.Split(v, ";") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		i := strings.Index(entry, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid experiment arm %q", entry)
+		}
+		arm := &experimentArm{name: strings.TrimSpace(entry[:i])}
+		if seen[arm.name] {
+			return nil, fmt.Errorf("duplicate experiment arm %q", arm.name)
+		}
+		seen[arm.name] = true
+		parts := strings.Split(entry[i+1:], ":")
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("experiment arm %s: expected percent:prf:iterations", arm.name)
+		}
+		var err error
+		if arm.percent, err = strconv.ParseFloat(parts[0], 64); err != nil || arm.percent <= 0 {
+			return nil, fmt.Errorf("experiment arm %s: invalid percentage %q", arm.name, parts[0])
+		}
+		arm.prfName = parts[1]
+		var ok bool
+		if arm.prf, ok = pbkdf2PRF(arm.prfName); !ok {
+			return nil, fmt.Errorf("experiment arm %s: unsupported PBKDF2 function %q", arm.name, parts[1])
+		}
+		if arm.iterations, err = strconv.Atoi(parts[2]); err != nil || arm.iterations < 1 {
+			return nil, fmt.Errorf("experiment arm %s: invalid iteration count %q", arm.name, parts[2])
+		}
+		total += arm.percent
+		arms = append(arms, arm)
+	}
+	if total > 100 {
+		return nil, fmt.Errorf("experiment arms take %g%% of the traffic", total)
+	}
+	return arms, nil
+}
+
+// NewHashExperiment constructs a new instance of the experiment with the arms given as parsed by parseExperimentArms
+func NewHashExperiment(name, arms string) (*HashExperiment, error) {
+	parsed, err := parseExperimentArms(arms)
+	if err != nil {
+		return nil, err
+	}
+	e := &HashExperiment{name: name, arms: parsed, control: &experimentArm{name: experimentControlArm}}
+	for _, arm := range append([]*experimentArm{e.control}, parsed...) {
+		arm := arm
+		labels := []string{"experiment", name, "arm", arm.name}
+		arm.hashes = metrics.NewCounter("phs_experiment_hashes_total", "Number of hashes calculated by the experiment arm", labels...)
+		arm.verifications = metrics.NewCounter("phs_experiment_verifications_total", "Number of passwords verified against the hashes of the experiment arm", labels...)
+		arm.failures = metrics.NewCounter("phs_experiment_failures_total", "Number of failed writes and verifications of the hashes of the experiment arm", labels...)
+		metrics.NewCounterFunc("phs_experiment_hash_seconds_total", "Time spent calculating the hashes of the experiment arm", func() float64 {
+			return float64(atomic.LoadUint64(&arm.hashMicros)) / 1e6
+		}, labels...)
+		metrics.NewCounterFunc("phs_experiment_verify_seconds_total", "Time spent verifying the passwords against the hashes of the experiment arm", func() float64 {
+			return float64(atomic.LoadUint64(&arm.verifyMicros)) / 1e6
+		}, labels...)
+	}
+	return e, nil
+}
+
+// pick randomly selects the arm of a new hash calculation
+func (e *HashExperiment) pick() *experimentArm {
+	p := mathrand.Float64() * 100
+	for _, arm := range e.arms {
+		if p < arm.percent {
+			return arm
+		}
+		p -= arm.percent
+	}
+	return e.control
+}
+
+// arm returns the arm the record has been calculated by, or nil if calculated outside of the experiment
+func (e *HashExperiment) arm(rec hashRecord) *experimentArm {
+	if rec.Arm == experimentControlArm {
+		return e.control
+	}
+	for _, arm := range e.arms {
+		if arm.name == rec.Arm {
+			return arm
+		}
+	}
+	return nil
+}
+
+// Calculate hashes the password by the arm picked for it, or a randomly picked one, returning the hash, its algorithm and the arm.
+// The control arm calculates the usual hash with no algorithm set
+func (e *HashExperiment) Calculate(a *experimentArm, pw string) (encoded, algorithm, arm string) {
+	if a == nil {
+		a = e.pick()
+	}
+	start := time.Now()
+	if a.prf == nil {
+		encoded = calculateHash(pw)
+	} else {
+		salt := make([]byte, experimentSaltSize)
+		rand.Read(salt)
+		key := pbkdf2Key([]byte(pw), salt, a.iterations, a.prf().Size(), a.prf)
+		// Verified as any imported PBKDF2 hash
+		encoded = encodePBKDF2(a.prfName, a.iterations, salt, key)
+		algorithm = algorithmPBKDF2
+	}
+	atomic.AddUint64(&a.hashMicros, uint64(time.Since(start)/time.Microsecond))
+	a.hashes.Inc()
+	return encoded, algorithm, a.name
+}
+
+// RecordVerification accounts the verification of a password against the record
+func (e *HashExperiment) RecordVerification(rec hashRecord, elapsed time.Duration, err error) {
+	a := e.arm(rec)
+	if a == nil {
+		return
+	}
+	atomic.AddUint64(&a.verifyMicros, uint64(elapsed/time.Microsecond))
+	a.verifications.Inc()
+	if err != nil {
+		a.failures.Inc()
+	}
+}
+
+// RecordWriteFailure accounts the failed write of the record
+func (e *HashExperiment) RecordWriteFailure(rec hashRecord) {
+	if a := e.arm(rec); a != nil {
+		a.failures.Inc()
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"strconv"
+	"strings"
+)
+
+// Algorithms of the imported password hashes. The hashes calculated by the service have no algorithm set
+const (
+	algorithmBcrypt = "bcrypt"
+	algorithmArgon2 = "argon2"
+	algorithmPBKDF2 = "pbkdf2"
+)
+
+// ErrUnsupportedHash is returned for the imported hashes in an unknown or malformed format
+var ErrUnsupportedHash = errors.New("unsupported password hash format")
+
+// detectHashAlgorithm returns the algorithm of the encoded hash, checking that it can be verified
+func detectHashAlgorithm(encoded string) (string, error) {
+	var algorithm string
+	switch {
+	case strings.HasPrefix(encoded, "$2a$"), strings.HasPrefix(encoded, "$2b$"), strings.HasPrefix(encoded, "$2y$"):
+		algorithm = algorithmBcrypt
+	case strings.HasPrefix(encoded, "$argon2"):
+		algorithm = algorithmArgon2
+	case strings.HasPrefix(encoded, "$pbkdf2-"), strings.HasPrefix(encoded, "pbkdf2_"):
+		algorithm = algorithmPBKDF2
+		if _, err := parsePBKDF2(encoded); err != nil {
+			return "", err
+		}
+	default:
+		return "", ErrUnsupportedHash
+	}
+	if !externalHashSupported(algorithm) {
+		return "", fmt.Errorf("%s hashes are not supported by this build", algorithm)
+	}
+	return algorithm, nil
+}
+
+// verifyExternalHash checks the password against the imported hash
+func verifyExternalHash(algorithm, encoded, pw string) (bool, error) {
+	if algorithm == algorithmPBKDF2 {
+		return verifyPBKDF2(encoded, pw)
+	}
+	return verifyXCryptoHash(algorithm, encoded, pw)
+}
+
+// pbkdf2Hash is a parsed PBKDF2 hash
+type pbkdf2Hash struct {
+	prf        func() hash.Hash
+	iterations int
+	salt       []byte
+	key        []byte
+}
+
+// parsePBKDF2 parses the PBKDF2 hash either in the passlib format
+// ($pbkdf2-sha256$iterations$salt$key, adapted base64) or in the Django format
+// (pbkdf2_sha256$iterations$salt$key, raw salt and standard base64 key)
+func parsePBKDF2(encoded string) (*pbkdf2Hash, error) {
+	django := !strings.HasPrefix(encoded, "$")
+	parts := strings.Split(strings.TrimPrefix(encoded, "$"), "$")
+	if len(parts) != 4 {
+		return nil, ErrUnsupportedHash
+	}
+	name := strings.TrimPrefix(strings.TrimPrefix(parts[0], "pbkdf2-"), "pbkdf2_")
+
+	h := &pbkdf2Hash{}
+	switch name {
+	case "sha1":
+		h.prf = sha1.New
+	case "sha256":
+		h.prf = sha256.New
+	case "sha512":
+		h.prf = sha512.New
+	default:
+		return nil, ErrUnsupportedHash
+	}
+	var err error
+	if h.iterations, err = strconv.Atoi(parts[1]); err != nil || h.iterations < 1 {
+		return nil, ErrUnsupportedHash
+	}
+	if django {
+		h.salt = []byte(parts[2])
+		h.key, err = base64.StdEncoding.DecodeString(parts[3])
+	} else {
+		// The adapted base64 uses . instead of + and no padding
+		if h.salt, err = base64.RawStdEncoding.DecodeString(strings.Replace(parts[2], ".", "+", -1)); err != nil {
+			return nil, ErrUnsupportedHash
+		}
+		h.key, err = base64.RawStdEncoding.DecodeString(strings.Replace(parts[3], ".", "+", -1))
+	}
+	if err != nil || len(h.key) == 0 {
+		return nil, ErrUnsupportedHash
+	}
+	return h, nil
+}
+
+// encodePBKDF2 encodes the PBKDF2 hash in the passlib format
+func encodePBKDF2(prfName string, iterations int, salt, key []byte) string {
+	// The adapted base64 uses . instead of + and no padding
+	encode := func(b []byte) string { return strings.Replace(base64.RawStdEncoding.EncodeToString(b), "+", ".", -1) }
+	return "$pbkdf2-" + prfName + "$" + strconv.Itoa(iterations) + "$" + encode(salt) + "$" + encode(key)
+}
+
+// pbkdf2PRF returns the pseudorandom function of the PBKDF2 hashes calculated by the service
+func pbkdf2PRF(name string) (func() hash.Hash, bool) {
+	switch name {
+	case "sha256":
+		return sha256.New, true
+	case "sha512":
+		return sha512.New, true
+	}
+	return nil, false
+}
+
+// verifyPBKDF2 checks the password against the PBKDF2 hash
+func verifyPBKDF2(encoded, pw string) (bool, error) {
+	h, err := parsePBKDF2(encoded)
+	if err != nil {
+		return false, err
+	}
+	key := pbkdf2Key([]byte(pw), h.salt, h.iterations, len(h.key), h.prf)
+	return subtle.ConstantTimeCompare(key, h.key) == 1, nil
+}
+
+// pbkdf2Key derives the key from the password as specified by RFC 8018
+func pbkdf2Key(pw, salt []byte, iterations, keyLen int, prf func() hash.Hash) []byte {
+	mac := hmac.New(prf, pw)
+	size := mac.Size()
+	blocks := (keyLen + size - 1) / size
+	key := make([]byte, 0, blocks*size)
+	u := make([]byte, size)
+	t := make([]byte, size)
+	var counter [4]byte
+	for block := 1; block <= blocks; block++ {
+		mac.Reset()
+		mac.Write(salt)
+		binary.BigEndian.PutUint32(counter[:], uint32(block))
+		mac.Write(counter[:])
+		u = mac.Sum(u[:0])
+		copy(t, u)
+		for i := 1; i < iterations; i++ {
+			mac.Reset()
+			mac.Write(u)
+			u = mac.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		key = append(key, t...)
+	}
+	return key[:keyLen]
+}
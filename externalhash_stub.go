@@ -0,0 +1,22 @@
+//go:build !xcrypto
+// +build !xcrypto
+
+package main
+
+import "fmt"
+
+// externalHashSupported checks whether the imported hashes of the algorithm can be verified.
+// PBKDF2 is implemented with the standard library, bcrypt and argon2 require golang.org/x/crypto
+func externalHashSupported(algorithm string) bool {
+	return algorithm == algorithmPBKDF2
+}
+
+// verifyXCryptoHash reports that the binary was built without golang.org/x/crypto
+func verifyXCryptoHash(algorithm, encoded, pw string) (bool, error) {
+	return false, fmt.Errorf("%s support is not compiled in, rebuild with -tags xcrypto", algorithm)
+}
+
+// generateBcrypt reports that the binary was built without golang.org/x/crypto
+func generateBcrypt(pw string, cost int) (string, error) {
+	return "", fmt.Errorf("%s support is not compiled in, rebuild with -tags xcrypto", algorithmBcrypt)
+}
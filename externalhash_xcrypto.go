@@ -0,0 +1,73 @@
+//go:build xcrypto
+// +build xcrypto
+
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// externalHashSupported checks whether the imported hashes of the algorithm can be verified
+func externalHashSupported(algorithm string) bool {
+	return true
+}
+
+// verifyXCryptoHash checks the password against the bcrypt or argon2 hash
+func verifyXCryptoHash(algorithm, encoded, pw string) (bool, error) {
+	switch algorithm {
+	case algorithmBcrypt:
+		err := bcrypt.CompareHashAndPassword([]byte(encoded), []byte(pw))
+		if err == bcrypt.ErrMismatchedHashAndPassword {
+			return false, nil
+		}
+		return err == nil, err
+	case algorithmArgon2:
+		return verifyArgon2(encoded, pw)
+	default:
+		return false, ErrUnsupportedHash
+	}
+}
+
+// verifyArgon2 checks the password against the argon2i or argon2id hash in the PHC format
+// ($argon2id$v=19$m=65536,t=3,p=4$salt$key)
+func verifyArgon2(encoded, pw string) (bool, error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[2] != "v=19" {
+		return false, ErrUnsupportedHash
+	}
+	var memory, time uint32
+	var threads uint8
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &time, &threads); err != nil {
+		return false, ErrUnsupportedHash
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false, ErrUnsupportedHash
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return false, ErrUnsupportedHash
+	}
+	var derived []byte
+	switch parts[1] {
+	case "argon2id":
+		derived = argon2.IDKey([]byte(pw), salt, time, memory, threads, uint32(len(key)))
+	case "argon2i":
+		derived = argon2.Key([]byte(pw), salt, time, memory, threads, uint32(len(key)))
+	default:
+		return false, ErrUnsupportedHash
+	}
+	return subtle.ConstantTimeCompare(derived, key) == 1, nil
+}
+
+// generateBcrypt hashes the password with bcrypt at the cost
+func generateBcrypt(pw string, cost int) (string, error) {
+	encoded, err := bcrypt.GenerateFromPassword([]byte(pw), cost)
+	return string(encoded), err
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// routeClasses are the classes of the public routes sharing the concurrency limit
+var routeClasses = []string{"hash_write", "hash_read", "verify", "admin", "other"}
+
+// routeClass returns the class of the request, so that e.g. the polling of GET /hash/{id}
+// and the admissions of POST /hash are queued separately
+func routeClass(r *http.Request) string {
+	switch {
+	case r.URL.Path == hashRoutePath && r.Method == http.MethodPost:
+		return "hash_write"
+	case strings.HasPrefix(r.URL.Path, hashRoutePath+"/"):
+		return "hash_read"
+	case r.URL.Path == verifyRoutePath:
+		return "verify"
+	case strings.HasPrefix(r.URL.Path, "/admin/") || r.URL.Path == shutdownRoutePath:
+		return "admin"
+	default:
+		return "other"
+	}
+}
+
+// parseRouteValues parses the per class values given as class=value separated by commas
+func parseRouteValues(spec string) (map[string]int, error) {
+	values := make(map[string]int)
+	for _, pair := range strings.Split(spec, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		i := strings.Index(pair, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("route value %q is not class=value", pair)
+		}
+		class := pair[:i]
+		known := false
+		for _, c := range routeClasses {
+			known = known || c == class
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown route class %q, expected one of %s", class, strings.Join(routeClasses, ", "))
+		}
+		v, err := strconv.Atoi(pair[i+1:])
+		if err != nil || v < 1 {
+			return nil, fmt.Errorf("value of the route class %q must be a positive integer", class)
+		}
+		values[class] = v
+	}
+	return values, nil
+}
+
+// routeWaiter is a request queued for a slot
+type routeWaiter struct {
+	ready   chan struct{}
+	granted bool
+}
+
+// routeQueue is the state of a route class in the scheduler
+type routeQueue struct {
+	name     string
+	weight   float64
+	cap      int
+	inFlight int
+	waiters  []*routeWaiter
+	// vtime is the virtual time of the class: the slots granted to it divided by its weight
+	vtime float64
+
+	queued     *Counter
+	shed       *Counter
+	waitMicros *Counter
+}
+
+// routeScheduler admits the public requests within the global and the per route class limits of
+// the concurrently served requests. The requests over a limit wait up to the queue timeout, and the
+// freed slots go to the waiting class with the least service relative to its weight (start-time
+// fair queueing), so that a storm of requests of one class cannot starve the others
+type routeScheduler struct {
+	mu       sync.Mutex
+	max      int
+	inFlight int
+	timeout  time.Duration
+	classes  map[string]*routeQueue
+	// vclock is the virtual time of the last granted slot, the idle classes catch up with it
+	vclock float64
+}
+
+// newRouteScheduler constructs a new instance of the scheduler serving up to max requests at once (0 is unlimited)
+func newRouteScheduler(max int, weights, caps map[string]int, timeout time.Duration) *routeScheduler {
+	s := &routeScheduler{max: max, timeout: timeout, classes: make(map[string]*routeQueue)}
+	for _, name := range routeClasses {
+		q := &routeQueue{name: name, weight: 1, cap: caps[name]}
+		if w, ok := weights[name]; ok {
+			q.weight = float64(w)
+		}
+		q.queued = metrics.NewCounter("phs_route_requests_queued_total", "Number of requests which waited for a slot", "route", name)
+		q.shed = metrics.NewCounter("phs_route_requests_shed_total", "Number of requests rejected over the concurrency limits", "route", name)
+		q.waitMicros = &Counter{}
+		metrics.NewCounterFunc("phs_route_queue_seconds_total", "Time the requests spent waiting for a slot", func() float64 {
+			return float64(q.waitMicros.Value()) / 1e6
+		}, "route", name)
+		metrics.NewGaugeFunc("phs_route_requests_in_flight", "Number of requests being served", func() float64 {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			return float64(q.inFlight)
+		}, "route", name)
+		metrics.NewGaugeFunc("phs_route_queue_length", "Number of requests waiting for a slot", func() float64 {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			return float64(len(q.waiters))
+		}, "route", name)
+		s.classes[name] = q
+	}
+	return s
+}
+
+// InFlight returns the number of the requests being served
+func (s *routeScheduler) InFlight() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.inFlight
+}
+
+// available checks whether the class may take a slot. The caller must hold the lock
+func (s *routeScheduler) available(q *routeQueue) bool {
+	return (s.max == 0 || s.inFlight < s.max) && (q.cap == 0 || q.inFlight < q.cap)
+}
+
+// grant gives a slot to the class. The caller must hold the lock
+func (s *routeScheduler) grant(q *routeQueue) {
+	s.inFlight++
+	q.inFlight++
+	if q.vtime < s.vclock {
+		q.vtime = s.vclock
+	}
+	s.vclock = q.vtime
+	q.vtime += 1 / q.weight
+}
+
+// Acquire takes a slot for the request of the class, waiting up to the queue timeout, and reports
+// whether it got one. The slot must be returned with Release
+func (s *routeScheduler) Acquire(r *http.Request, class string) bool {
+	q := s.classes[class]
+	s.mu.Lock()
+	// The requests already waiting in the class go first
+	if len(q.waiters) == 0 && s.available(q) {
+		s.grant(q)
+		s.mu.Unlock()
+		return true
+	}
+	if s.timeout <= 0 {
+		s.mu.Unlock()
+		return false
+	}
+	waiter := &routeWaiter{ready: make(chan struct{})}
+	if len(q.waiters) == 0 && q.vtime < s.vclock {
+		// A class idle until now does not get the service it did not ask for
+		q.vtime = s.vclock
+	}
+	q.waiters = append(q.waiters, waiter)
+	s.mu.Unlock()
+	q.queued.Inc()
+
+	start := time.Now()
+	timer := time.NewTimer(s.timeout)
+	defer timer.Stop()
+	select {
+	case <-waiter.ready:
+	case <-timer.C:
+	case <-r.Context().Done():
+	}
+	q.waitMicros.Add(uint64(time.Since(start) / time.Microsecond))
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if waiter.granted {
+		return true
+	}
+	for i, w := range q.waiters {
+		if w == waiter {
+			q.waiters = append(q.waiters[:i], q.waiters[i+1:]...)
+			break
+		}
+	}
+	return false
+}
+
+// Release returns the slot of the class and hands the freed slots over to the waiting requests
+func (s *routeScheduler) Release(class string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.inFlight--
+	s.classes[class].inFlight--
+	for {
+		var next *routeQueue
+		for _, name := range routeClasses {
+			q := s.classes[name]
+			if len(q.waiters) == 0 || !s.available(q) {
+				continue
+			}
+			if next == nil || q.vtime < next.vtime {
+				next = q
+			}
+		}
+		if next == nil {
+			return
+		}
+		waiter := next.waiters[0]
+		next.waiters = next.waiters[1:]
+		waiter.granted = true
+		close(waiter.ready)
+		s.grant(next)
+	}
+}
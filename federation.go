@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// ErrPeerUnavailable is returned when the federation peer owning the record cannot verify it
+var ErrPeerUnavailable = errors.New("federation peer unavailable")
+
+// federationPeer is a deployment owning a part of the namespace: the identifiers of a range,
+// or the records of a tenant not found locally
+type federationPeer struct {
+	url    string
+	lo, hi uint64
+	tenant string
+
+	requests *Counter
+	failures *Counter
+}
+
+// parseFederationPeers parses the peers given as range:lo-hi=url or tenant:name=url separated by semicolons
+func parseFederationPeers(spec string) ([]*federationPeer, error) {
+	var peers []*federationPeer
+	for _, entry := range strings.Split(spec, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		i := strings.Index(entry, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("federation peer %q lacks the URL", entry)
+		}
+		owner, rawURL := entry[:i], strings.TrimSuffix(entry[i+1:], "/")
+		if u, err := url.Parse(rawURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("federation peer URL %q must be an absolute http or https URL", rawURL)
+		}
+		peer := &federationPeer{url: rawURL}
+		switch {
+		case strings.HasPrefix(owner, "range:"):
+			bounds := strings.SplitN(strings.TrimPrefix(owner, "range:"), "-", 2)
+			var errLo, errHi error
+			if len(bounds) == 2 {
+				peer.lo, errLo = strconv.ParseUint(bounds[0], 10, 64)
+				peer.hi, errHi = strconv.ParseUint(bounds[1], 10, 64)
+			}
+			if len(bounds) != 2 || errLo != nil || errHi != nil || peer.lo > peer.hi {
+				return nil, fmt.Errorf("invalid federation range %q", owner)
+			}
+			for _, other := range peers {
+				if other.tenant == "" && peer.lo <= other.hi && other.lo <= peer.hi {
+					return nil, fmt.Errorf("federation range %q overlaps another one", owner)
+				}
+			}
+		case strings.HasPrefix(owner, "tenant:") && len(owner) > len("tenant:"):
+			peer.tenant = strings.TrimPrefix(owner, "tenant:")
+		default:
+			return nil, fmt.Errorf("federation peer %q must be owned by a range: or a tenant:", entry)
+		}
+		peers = append(peers, peer)
+	}
+	return peers, nil
+}
+
+// Federation verifies the passwords of the records owned by the peer deployments, so that several
+// deployments can be consolidated into one namespace gradually
+type Federation struct {
+	peers  []*federationPeer
+	token  string
+	client *http.Client
+}
+
+// NewFederation constructs a new instance of the federation client of the configured peers
+func NewFederation(cfg *Config) (*Federation, error) {
+	peers, err := parseFederationPeers(cfg.FederationPeers)
+	if err != nil {
+		return nil, err
+	}
+	for _, peer := range peers {
+		peer.requests = metrics.NewCounter("phs_federation_requests_total", "Number of the verifications proxied to the federation peers", "peer", peer.url)
+		peer.failures = metrics.NewCounter("phs_federation_failures_total", "Number of the verifications the federation peers failed", "peer", peer.url)
+	}
+	return &Federation{peers: peers, token: cfg.FederationToken, client: &http.Client{Timeout: cfg.FederationTimeout}}, nil
+}
+
+// rangeOwner returns the peer owning the identifier by its range, if any
+func (f *Federation) rangeOwner(id uint64) *federationPeer {
+	for _, peer := range f.peers {
+		if peer.tenant == "" && peer.lo <= id && id <= peer.hi {
+			return peer
+		}
+	}
+	return nil
+}
+
+// tenantOwner returns the peer owning the records of the tenant missing locally, if any
+func (f *Federation) tenantOwner(tenant string) *federationPeer {
+	for _, peer := range f.peers {
+		if tenant != "" && peer.tenant == tenant {
+			return peer
+		}
+	}
+	return nil
+}
+
+// Verify checks the password against the record of the peer
+func (f *Federation) Verify(peer *federationPeer, id uint64, pw string) (bool, error) {
+	peer.requests.Inc()
+	form := url.Values{"id": {strconv.FormatUint(id, 10)}, "password": {pw}}
+	req, err := http.NewRequest(http.MethodPost, peer.url+verifyRoutePath, strings.NewReader(form.Encode()))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if f.token != "" {
+		req.Header.Set("Authorization", "Bearer "+f.token)
+	}
+	resp, err := f.client.Do(req)
+	if err != nil {
+		peer.failures.Inc()
+		return false, fmt.Errorf("%w: %s: %v", ErrPeerUnavailable, peer.url, err)
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		var result verifyResult
+		if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+			peer.failures.Inc()
+			return false, fmt.Errorf("%w: %s: %v", ErrPeerUnavailable, peer.url, err)
+		}
+		return result.Match, nil
+	case http.StatusNotFound:
+		return false, ErrNotFound
+	default:
+		peer.failures.Inc()
+		return false, fmt.Errorf("%w: %s: %s", ErrPeerUnavailable, peer.url, resp.Status)
+	}
+}
+
+// verifyFederated checks the password against the record, asking the peer owning its identifier range,
+// or the peer of the tenant when the record is not found locally
+func (s *HashService) verifyFederated(tenant string, id uint64, pw string) (bool, error) {
+	if s.federation == nil {
+		return s.storage.VerifyPassword(id, pw)
+	}
+	if peer := s.federation.rangeOwner(id); peer != nil {
+		return s.federation.Verify(peer, id, pw)
+	}
+	match, err := s.storage.VerifyPassword(id, pw)
+	if errors.Is(err, ErrNotFound) {
+		if peer := s.federation.tenantOwner(tenant); peer != nil {
+			return s.federation.Verify(peer, id, pw)
+		}
+	}
+	return match, err
+}
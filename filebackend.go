@@ -0,0 +1,300 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	recordFileExt    = ".json"
+	recordTempPrefix = ".tmp-"
+	statsSnapshotDir = "stats"
+	apiKeyDir        = "keys"
+)
+
+// FileBackend keeps every password hash record in its own file.
+// The files are spread over 256 shard directories to keep the directories small
+type FileBackend struct {
+	dir string
+	// compression is the algorithm compressing the written records and statistics snapshots
+	compression    string
+	mu             sync.Mutex
+	lastCompaction time.Time
+}
+
+// NewFileBackend constructs a new instance of the filesystem storage backend rooted at dir.
+// The records are compressed with the compression algorithm, the existing files are read
+// whatever algorithm they have been written with
+func NewFileBackend(dir, compression string) (*FileBackend, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &FileBackend{dir: dir, compression: compression}, nil
+}
+
+// isShardDir checks whether the directory entry is one of the record shard directories
+func isShardDir(info os.FileInfo) bool {
+	if !info.IsDir() || len(info.Name()) != 2 {
+		return false
+	}
+	_, err := strconv.ParseUint(info.Name(), 16, 8)
+	return err == nil
+}
+
+// shardDir returns the directory holding the record with the given identifier
+func (b *FileBackend) shardDir(id uint64) string {
+	return filepath.Join(b.dir, fmt.Sprintf("%02x", id%256))
+}
+
+// recordPath returns the name of the file holding the record with the given identifier
+func (b *FileBackend) recordPath(id uint64) string {
+	return filepath.Join(b.shardDir(id), strconv.FormatUint(id, 10)+recordFileExt)
+}
+
+// Put stores the record under the given identifier
+func (b *FileBackend) Put(id uint64, rec hashRecord) error {
+	return b.writeCompressed(b.shardDir(id), b.recordPath(id), rec)
+}
+
+// encode serializes the value as JSON compressed with the configured algorithm
+func (b *FileBackend) encode(v interface{}) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return compressRecord(b.compression, data)
+}
+
+// writeCompressed stores the value as compressed JSON in the file, see writeFileAtomic
+func (b *FileBackend) writeCompressed(dir string, path string, v interface{}) error {
+	data, err := b.encode(v)
+	if err != nil {
+		return err
+	}
+	return writeDataAtomic(dir, path, data)
+}
+
+// readCompressed reads the value from the file written by writeCompressed
+func readCompressed(path string, v interface{}) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if data, err = decompressRecord(data); err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// writeFileAtomic stores the value as JSON in the file. The value is written
+// to a temporary file in dir first and then atomically renamed
+func writeFileAtomic(dir string, path string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return writeDataAtomic(dir, path, data)
+}
+
+// writeDataAtomic stores the data in the file, see writeFileAtomic
+func writeDataAtomic(dir string, path string, data []byte) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(dir, recordTempPrefix)
+	if os.IsNotExist(err) {
+		// The empty shard directory has been removed by the compaction in the meantime
+		if err = os.MkdirAll(dir, 0700); err == nil {
+			tmp, err = ioutil.TempFile(dir, recordTempPrefix)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
+
+// Get returns the record stored under the given identifier
+func (b *FileBackend) Get(id uint64) (rec hashRecord, ok bool, err error) {
+	err = readCompressed(b.recordPath(id), &rec)
+	if os.IsNotExist(err) {
+		return rec, false, nil
+	}
+	if err != nil {
+		return rec, false, fmt.Errorf("record %d: %v", id, err)
+	}
+	return rec, true, nil
+}
+
+// Delete removes the record stored under the given identifier
+func (b *FileBackend) Delete(id uint64) (ok bool, err error) {
+	err = os.Remove(b.recordPath(id))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Scan calls fn for every stored record
+func (b *FileBackend) Scan(fn func(id uint64, rec hashRecord) error) error {
+	return b.walk(func(id uint64, path string) error {
+		rec, ok, err := b.Get(id)
+		if err != nil || !ok {
+			// The record has been deleted in the meantime
+			return err
+		}
+		return fn(id, rec)
+	})
+}
+
+// walk calls fn for every record file in the backend
+func (b *FileBackend) walk(fn func(id uint64, path string) error) error {
+	shards, err := ioutil.ReadDir(b.dir)
+	if err != nil {
+		return err
+	}
+	for _, shard := range shards {
+		if !isShardDir(shard) {
+			continue
+		}
+		shardPath := filepath.Join(b.dir, shard.Name())
+		files, err := ioutil.ReadDir(shardPath)
+		if err != nil {
+			return err
+		}
+		for _, f := range files {
+			name := f.Name()
+			if !strings.HasSuffix(name, recordFileExt) {
+				continue
+			}
+			id, err := strconv.ParseUint(strings.TrimSuffix(name, recordFileExt), 10, 64)
+			if err != nil {
+				continue
+			}
+			if err := fn(id, filepath.Join(shardPath, name)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// PutStats saves the statistics snapshot of the instance
+func (b *FileBackend) PutStats(snap statsSnapshot) error {
+	dir := filepath.Join(b.dir, statsSnapshotDir)
+	return b.writeCompressed(dir, filepath.Join(dir, url.PathEscape(snap.Instance)+recordFileExt), snap)
+}
+
+// ListStats returns the last saved statistics snapshots of all the instances
+func (b *FileBackend) ListStats() ([]statsSnapshot, error) {
+	dir := filepath.Join(b.dir, statsSnapshotDir)
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var snaps []statsSnapshot
+	for _, f := range files {
+		if !strings.HasSuffix(f.Name(), recordFileExt) {
+			continue
+		}
+		var snap statsSnapshot
+		if err := readCompressed(filepath.Join(dir, f.Name()), &snap); err != nil {
+			return nil, fmt.Errorf("statistics snapshot %s: %v", f.Name(), err)
+		}
+		snaps = append(snaps, snap)
+	}
+	return snaps, nil
+}
+
+// PutKey saves the API key
+func (b *FileBackend) PutKey(key apiKey) error {
+	dir := filepath.Join(b.dir, apiKeyDir)
+	return writeFileAtomic(dir, filepath.Join(dir, url.PathEscape(key.ID)+recordFileExt), key)
+}
+
+// GetKey returns the API key with the given identifier
+func (b *FileBackend) GetKey(id string) (key apiKey, ok bool, err error) {
+	data, err := ioutil.ReadFile(filepath.Join(b.dir, apiKeyDir, url.PathEscape(id)+recordFileExt))
+	if os.IsNotExist(err) {
+		return key, false, nil
+	}
+	if err != nil {
+		return key, false, err
+	}
+	if err := json.Unmarshal(data, &key); err != nil {
+		return key, false, fmt.Errorf("API key %s: %v", id, err)
+	}
+	return key, true, nil
+}
+
+// ListKeys returns all the saved API keys
+func (b *FileBackend) ListKeys() ([]apiKey, error) {
+	files, err := ioutil.ReadDir(filepath.Join(b.dir, apiKeyDir))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var keys []apiKey
+	for _, f := range files {
+		id, err := url.PathUnescape(strings.TrimSuffix(f.Name(), recordFileExt))
+		if err != nil || !strings.HasSuffix(f.Name(), recordFileExt) {
+			continue
+		}
+		key, ok, err := b.GetKey(id)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+// Ping checks whether the storage directory is accessible
+func (b *FileBackend) Ping() error {
+	info, err := os.Stat(b.dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", b.dir)
+	}
+	return nil
+}
+
+// Close releases the resources held by the backend
+func (b *FileBackend) Close() error {
+	return nil
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"hash"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// bcryptMaxCost is the highest cost accepted by bcrypt
+const bcryptMaxCost = 31
+
+// HardeningSchedule hashes the new passwords with PBKDF2 or bcrypt at a cost raised on a schedule,
+// e.g. by one bcrypt cost every 12 months, keeping the hashes aligned with the hardware improvements
+type HardeningSchedule struct {
+	algorithm string
+	prfName   string
+	prf       func() hash.Hash
+	// base is the iterations or the cost from the start, raised every every months by adding add,
+	// or multiplying by factor if add is 0, up to max
+	base   int
+	start  time.Time
+	add    int
+	factor float64
+	every  int
+	max    int
+
+	// current is the parameter the last hash was calculated with, to log the changes
+	current int64
+}
+
+// parseHardeningSchedule parses the schedule given as comma separated key=value pairs:
+// algorithm=pbkdf2,prf=sha512,iterations=210000,start=2026-01-01,step=x2,every=24,max=10000000 or
+// algorithm=bcrypt,cost=12,start=2026-01-01,step=+1,every=12,max=16
+func parseHardeningSchedule(spec string) (*HardeningSchedule, error) {
+	h := &HardeningSchedule{prfName: "sha512"}
+	for _, pair := range strings.Split(spec, ",") {
+		i := strings.Index(pair, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("hardening schedule entry %q is not key=value", pair)
+		}
+		key, value := strings.TrimSpace(pair[:i]), strings.TrimSpace(pair[i+1:])
+		var err error
+		switch key {
+		case "algorithm":
+			h.algorithm = value
+		case "prf":
+			h.prfName = value
+		case "iterations", "cost":
+			h.base, err = strconv.Atoi(value)
+		case "start":
+			h.start, err = time.Parse("2006-01-02", value)
+		case "step":
+			switch {
+			case strings.HasPrefix(value, "+"):
+				h.add, err = strconv.Atoi(value[1:])
+				if err == nil && h.add < 1 {
+					err = fmt.Errorf("step %q must raise the cost", value)
+				}
+			case strings.HasPrefix(value, "x"):
+				h.factor, err = strconv.ParseFloat(value[1:], 64)
+				if err == nil && h.factor <= 1 {
+					err = fmt.Errorf("step %q must raise the cost", value)
+				}
+			default:
+				err = fmt.Errorf("step %q must be +N or xF", value)
+			}
+		case "every":
+			h.every, err = strconv.Atoi(value)
+		case "max":
+			h.max, err = strconv.Atoi(value)
+		default:
+			err = fmt.Errorf("unknown key %q", key)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("hardening schedule: %v", err)
+		}
+	}
+	switch h.algorithm {
+	case algorithmPBKDF2:
+		var ok bool
+		if h.prf, ok = pbkdf2PRF(h.prfName); !ok {
+			return nil, fmt.Errorf("hardening schedule: unknown PRF %q", h.prfName)
+		}
+		if h.base < 1 {
+			return nil, fmt.Errorf("hardening schedule: iterations must be positive")
+		}
+	case algorithmBcrypt:
+		if !externalHashSupported(algorithmBcrypt) {
+			return nil, fmt.Errorf("hardening schedule: %s support is not compiled in, rebuild with -tags xcrypto", algorithmBcrypt)
+		}
+		if h.max == 0 || h.max > bcryptMaxCost {
+			h.max = bcryptMaxCost
+		}
+		if h.base < 4 || h.base > h.max {
+			return nil, fmt.Errorf("hardening schedule: cost must be from 4 to %d", h.max)
+		}
+	default:
+		return nil, fmt.Errorf("hardening schedule: algorithm must be %s or %s", algorithmPBKDF2, algorithmBcrypt)
+	}
+	if h.start.IsZero() || h.every < 1 || (h.add == 0 && h.factor == 0) {
+		return nil, fmt.Errorf("hardening schedule requires the start, the step and the positive every (months)")
+	}
+	if h.max != 0 && h.max < h.base {
+		return nil, fmt.Errorf("hardening schedule: max must not be below the initial cost")
+	}
+	return h, nil
+}
+
+// parameter returns the name of the scheduled parameter
+func (h *HardeningSchedule) parameter() string {
+	if h.algorithm == algorithmBcrypt {
+		return "cost"
+	}
+	return "iterations"
+}
+
+// Effective returns the parameter in effect at the time, and when it is raised next,
+// or the zero time once it reaches the maximum
+func (h *HardeningSchedule) Effective(now time.Time) (value int, next time.Time) {
+	months := (now.Year()-h.start.Year())*12 + int(now.Month()-h.start.Month())
+	if h.start.AddDate(0, months, 0).After(now) {
+		months--
+	}
+	value = h.base
+	steps := 0
+	if months > 0 {
+		steps = months / h.every
+	}
+	for i := 0; i < steps; i++ {
+		if h.add > 0 {
+			value += h.add
+		} else if raised := int(float64(value) * h.factor); raised > value {
+			value = raised
+		} else {
+			value++
+		}
+		if h.max != 0 && value >= h.max {
+			return h.max, time.Time{}
+		}
+	}
+	return value, h.start.AddDate(0, (steps+1)*h.every, 0)
+}
+
+// Calculate hashes the password with the parameter in effect, returning the hash and its algorithm
+func (h *HardeningSchedule) Calculate(pw string) (encoded, algorithm string, err error) {
+	value, _ := h.Effective(time.Now())
+	if previous := atomic.SwapInt64(&h.current, int64(value)); previous != int64(value) && previous != 0 {
+		logf(logLevelInfo, "Hardening: New hashes use %s %s %d, up from %d\n", h.algorithm, h.parameter(), value, previous)
+	}
+	if h.algorithm == algorithmBcrypt {
+		encoded, err = generateBcrypt(pw, value)
+		return encoded, algorithmBcrypt, err
+	}
+	salt := make([]byte, experimentSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return "", "", err
+	}
+	key := pbkdf2Key([]byte(pw), salt, value, h.prf().Size(), h.prf)
+	return encodePBKDF2(h.prfName, value, salt, key), algorithmPBKDF2, nil
+}
+
+// NewHardeningSchedule constructs the schedule, logging and exposing the parameter in effect
+func NewHardeningSchedule(spec string) (*HardeningSchedule, error) {
+	h, err := parseHardeningSchedule(spec)
+	if err != nil {
+		return nil, err
+	}
+	value, next := h.Effective(time.Now())
+	atomic.StoreInt64(&h.current, int64(value))
+	if next.IsZero() {
+		logf(logLevelInfo, "Hardening: New hashes use %s %s %d, the maximum\n", h.algorithm, h.parameter(), value)
+	} else {
+		logf(logLevelInfo, "Hardening: New hashes use %s %s %d, raised next on %s\n", h.algorithm, h.parameter(), value, next.Format("2006-01-02"))
+	}
+	metrics.NewGaugeFunc("phs_hash_parameter", "Parameter of the hashing algorithm in effect for the new hashes", func() float64 {
+		value, _ := h.Effective(time.Now())
+		return float64(value)
+	}, "algorithm", h.algorithm, "parameter", h.parameter())
+	metrics.NewGaugeFunc("phs_hash_parameter_next_change_timestamp_seconds", "Time when the hashing parameter is raised next, 0 once it reaches the maximum", func() float64 {
+		if _, next := h.Effective(time.Now()); !next.IsZero() {
+			return float64(next.Unix())
+		}
+		return 0
+	}, "algorithm", h.algorithm, "parameter", h.parameter())
+	return h, nil
+}
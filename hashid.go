@@ -0,0 +1,65 @@
+package main
+
+import (
+	"strconv"
+)
+
+// maxHashPathLength bounds the length of the /hash/{id} paths. The longest identifier has 20 digits
+const maxHashPathLength = 64
+
+// Codes of the malformed hash identifier errors
+const (
+	idErrMissing  = "id_missing"
+	idErrSigned   = "id_signed"
+	idErrSyntax   = "id_syntax"
+	idErrOverflow = "id_overflow"
+	idErrZero     = "id_zero"
+)
+
+// hashIDError describes why the hash identifier is malformed. The code tells the cases apart
+type hashIDError struct {
+	Code    string
+	Message string
+}
+
+// Error returns the message along with the code
+func (e *hashIDError) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+// parseHashID parses the decimal hash identifier sent by the client.
+// Unlike strconv.ParseUint, it tells the signed and the too large identifiers from the other malformed ones
+func parseHashID(v string) (uint64, error) {
+	if v == "" {
+		return 0, &hashIDError{Code: idErrMissing, Message: "missing identifier"}
+	}
+	if v[0] == '+' || v[0] == '-' {
+		return 0, &hashIDError{Code: idErrSigned, Message: "identifier must not have a sign"}
+	}
+	for i := 0; i < len(v); i++ {
+		if v[i] < '0' || v[i] > '9' {
+			return 0, &hashIDError{Code: idErrSyntax, Message: "identifier must be a decimal number"}
+		}
+	}
+	u, err := strconv.ParseUint(v, 10, 64)
+	if err != nil {
+		return 0, &hashIDError{Code: idErrOverflow, Message: "identifier exceeds " + strconv.FormatUint(1<<64-1, 10)}
+	}
+	return u, validateHashID(u)
+}
+
+// validateHashID checks the identifier sent by the client
+func validateHashID(u uint64) error {
+	if u == 0 {
+		return &hashIDError{Code: idErrZero, Message: "identifiers start at 1"}
+	}
+	return nil
+}
+
+// truncatePath shortens the path for logging
+func truncatePath(path string) string {
+	if len(path) > maxHashPathLength {
+		return path[:maxHashPathLength] + "..."
+	}
+	return path
+}
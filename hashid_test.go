@@ -0,0 +1,70 @@
+package main
+
+import (
+	"errors"
+	"math/big"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// expectedHashIDCode classifies the identifier independently of parseHashID, "" if it is valid
+func expectedHashIDCode(v string) string {
+	switch {
+	case v == "":
+		return idErrMissing
+	case v[0] == '+' || v[0] == '-':
+		return idErrSigned
+	case strings.Trim(v, "0123456789") != "":
+		return idErrSyntax
+	}
+	n, _ := new(big.Int).SetString(v, 10)
+	switch {
+	case n.BitLen() > 64:
+		return idErrOverflow
+	case n.Sign() == 0:
+		return idErrZero
+	}
+	return ""
+}
+
+func FuzzParseHashID(f *testing.F) {
+	for _, seed := range []string{
+		"", "1", "+1", "-1", "0", "000", "007", "1a", " 1", "1 ", "٣",
+		"18446744073709551615", "18446744073709551616",
+		strings.Repeat("9", maxHashPathLength), strings.Repeat("0", maxHashPathLength) + "1",
+	} {
+		f.Add(seed)
+	}
+	codes := map[string]bool{idErrMissing: true, idErrSigned: true, idErrSyntax: true, idErrOverflow: true, idErrZero: true}
+	f.Fuzz(func(t *testing.T, v string) {
+		u, err := parseHashID(v)
+		want := expectedHashIDCode(v)
+		if err == nil {
+			if want != "" {
+				t.Fatalf("parseHashID(%q) = %d, want %s", v, u, want)
+			}
+			s := strconv.FormatUint(u, 10)
+			if trimmed := strings.TrimLeft(v, "0"); s != trimmed {
+				t.Fatalf("parseHashID(%q) = %d, which formats as %q", v, u, s)
+			}
+			if again, err := parseHashID(s); err != nil || again != u {
+				t.Fatalf("parseHashID(%q) = %d, %v after parsing %q as %d", s, again, err, v, u)
+			}
+			return
+		}
+		if u != 0 {
+			t.Fatalf("parseHashID(%q) = %d along with %v", v, u, err)
+		}
+		var idErr *hashIDError
+		if !errors.As(err, &idErr) {
+			t.Fatalf("parseHashID(%q) returned %T, want *hashIDError", err, err)
+		}
+		if !codes[idErr.Code] {
+			t.Fatalf("parseHashID(%q) returned the unknown code %q", v, idErr.Code)
+		}
+		if idErr.Code != want {
+			t.Fatalf("parseHashID(%q) returned %s, want %s", v, idErr.Code, want)
+		}
+	})
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// hashParamsSuffix ends the path of the hash parameters route, /hash/{id}/params
+const hashParamsSuffix = "/params"
+
+// hashParams describes how the hash has been calculated, without the digest itself, so that the
+// lower-trust callers can run the client-side verification flows. The salt is base64 encoded,
+// but for bcrypt, whose salt is given in its own encoding as found in the hash
+type hashParams struct {
+	Algorithm  string `json:"algorithm"`
+	Salt       string `json:"salt,omitempty"`
+	PRF        string `json:"prf,omitempty"`
+	Iterations int    `json:"iterations,omitempty"`
+	Cost       int    `json:"cost,omitempty"`
+	Memory     int    `json:"memory,omitempty"`
+	Time       int    `json:"time,omitempty"`
+	Threads    int    `json:"threads,omitempty"`
+}
+
+// recordParams returns the parameters of the hash of the record
+func recordParams(rec hashRecord) (hashParams, error) {
+	switch rec.Algorithm {
+	case "":
+		// The hashes calculated by the service are unsalted SHA512
+		return hashParams{Algorithm: "sha512"}, nil
+	case algorithmPBKDF2:
+		h, err := parsePBKDF2(rec.Hash)
+		if err != nil {
+			return hashParams{}, err
+		}
+		prf := strings.TrimPrefix(strings.TrimPrefix(strings.SplitN(strings.TrimPrefix(rec.Hash, "$"), "$", 2)[0], "pbkdf2-"), "pbkdf2_")
+		return hashParams{
+			Algorithm:  algorithmPBKDF2,
+			Salt:       base64.StdEncoding.EncodeToString(h.salt),
+			PRF:        prf,
+			Iterations: h.iterations,
+		}, nil
+	case algorithmBcrypt:
+		// $2b$10$<22 characters of salt><31 characters of digest>
+		parts := strings.Split(rec.Hash, "$")
+		if len(parts) != 4 || len(parts[3]) != 53 {
+			return hashParams{}, ErrUnsupportedHash
+		}
+		cost, err := strconv.Atoi(parts[2])
+		if err != nil {
+			return hashParams{}, ErrUnsupportedHash
+		}
+		return hashParams{Algorithm: algorithmBcrypt, Salt: parts[3][:22], Cost: cost}, nil
+	case algorithmArgon2:
+		// $argon2id$v=19$m=65536,t=3,p=4$<salt>$<digest>
+		parts := strings.Split(rec.Hash, "$")
+		if len(parts) != 6 {
+			return hashParams{}, ErrUnsupportedHash
+		}
+		p := hashParams{Algorithm: parts[1]}
+		if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.Memory, &p.Time, &p.Threads); err != nil {
+			return hashParams{}, ErrUnsupportedHash
+		}
+		salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+		if err != nil {
+			return hashParams{}, ErrUnsupportedHash
+		}
+		p.Salt = base64.StdEncoding.EncodeToString(salt)
+		return p, nil
+	}
+	return hashParams{}, ErrUnsupportedHash
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Health statuses of the subsystems, in the order of their gravity
+const (
+	healthOK       = "ok"
+	healthDegraded = "degraded"
+	healthFailing  = "failing"
+)
+
+// healthPingTimeout bounds the storage round trip of the verbose health check
+const healthPingTimeout = time.Second
+
+// healthState remembers the outcome of the last operations of a subsystem, such as its writes or deliveries
+type healthState struct {
+	mu        sync.Mutex
+	lastOK    time.Time
+	lastErr   error
+	lastErrAt time.Time
+}
+
+// Record records the outcome of an operation, nil for a success
+func (h *healthState) Record(err error) {
+	now := time.Now().UTC()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if err != nil {
+		h.lastErr, h.lastErrAt = err, now
+	} else {
+		h.lastOK = now
+	}
+}
+
+// report returns the health of the subsystem, failing if its last operation failed.
+// The last error is reported even once the subsystem has recovered
+func (h *healthState) report(name string) subsystemHealth {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	sub := subsystemHealth{Name: name, Status: healthOK}
+	if h.lastErr != nil {
+		at := h.lastErrAt
+		sub.LastError, sub.LastErrorAt = h.lastErr.Error(), &at
+		if h.lastOK.Before(h.lastErrAt) {
+			sub.Status = healthFailing
+		}
+	}
+	return sub
+}
+
+// subsystemHealth is the health of a subsystem reported by the verbose health check
+type subsystemHealth struct {
+	Name        string     `json:"name"`
+	Status      string     `json:"status"`
+	Detail      string     `json:"detail,omitempty"`
+	LastError   string     `json:"last_error,omitempty"`
+	LastErrorAt *time.Time `json:"last_error_at,omitempty"`
+}
+
+// healthReport is the verbose health check response, its status is the worst of the subsystems
+type healthReport struct {
+	Status     string            `json:"status"`
+	Subsystems []subsystemHealth `json:"subsystems"`
+}
+
+// worseHealth returns the graver of the statuses
+func worseHealth(a, b string) string {
+	if a == healthFailing || b == healthFailing {
+		return healthFailing
+	}
+	if a == healthDegraded || b == healthDegraded {
+		return healthDegraded
+	}
+	return healthOK
+}
+
+// health reports the health of the subsystems of the instance: the storage and the queue always,
+// the replication, the audit log and the request mirroring when configured
+func (s *HashService) health(now time.Time) healthReport {
+	subsystems := []subsystemHealth{s.storageHealth(), s.queueHealth()}
+	if s.shipper != nil {
+		sub := s.shipper.health.report("replication")
+		lag := s.shipper.Lag(now)
+		sub.Detail = fmt.Sprintf("%d records pending, lag %v", s.shipper.Pending(), lag.Round(time.Millisecond))
+		if sub.Status == healthOK && lag > 10*s.cfg.ReplicationInterval {
+			sub.Status = healthDegraded
+		}
+		subsystems = append(subsystems, sub)
+	}
+	if s.audit != nil {
+		sub := s.audit.health.report("audit")
+		sub.Detail = "sinks " + strings.Join(s.audit.names, ", ")
+		subsystems = append(subsystems, sub)
+		if h := s.audit.forwarder(); h != nil {
+			sub := h.health.report("audit_delivery")
+			sub.Detail = fmt.Sprintf("%d events buffered", len(h.events))
+			if sub.Status == healthOK && len(h.events) >= cap(h.events)/2 {
+				sub.Status = healthDegraded
+			}
+			subsystems = append(subsystems, sub)
+		}
+	}
+	if s.mirror != nil {
+		sub := s.mirror.health.report("mirror")
+		sub.Detail = "mirroring to " + s.mirror.target
+		// The mirrored requests are a best effort, so their failures only degrade the instance
+		if sub.Status == healthFailing {
+			sub.Status = healthDegraded
+		}
+		subsystems = append(subsystems, sub)
+	}
+	report := healthReport{Status: healthOK, Subsystems: subsystems}
+	for _, sub := range subsystems {
+		report.Status = worseHealth(report.Status, sub.Status)
+	}
+	return report
+}
+
+// storageHealth pings the storage, failing if it is unreachable, and reports the last failed write.
+// A storage reachable again after a failed write is degraded until the next write succeeds
+func (s *HashService) storageHealth() subsystemHealth {
+	sub := s.storage.health.report("storage")
+	if sub.Status == healthFailing {
+		sub.Status = healthDegraded
+	}
+	start := time.Now()
+	ping := make(chan error, 1)
+	go func() { ping <- s.storage.Ping() }()
+	var err error
+	select {
+	case err = <-ping:
+	case <-time.After(healthPingTimeout):
+		err = fmt.Errorf("ping timed out after %v", healthPingTimeout)
+	}
+	if err != nil {
+		at := time.Now().UTC()
+		sub.Status, sub.LastError, sub.LastErrorAt = healthFailing, err.Error(), &at
+		return sub
+	}
+	sub.Detail = fmt.Sprintf("%s backend, ping %.1f ms", s.cfg.StorageBackend, float64(time.Since(start))/float64(time.Millisecond))
+	return sub
+}
+
+// queueHealth reports the pending jobs of the worker pools, failing once the shared pool is full
+// and degraded once any pool is 90% full or a dedicated one is full
+func (s *HashService) queueHealth() subsystemHealth {
+	sub := subsystemHealth{Name: "queue", Status: healthOK}
+	var details []string
+	for _, p := range s.storage.PoolUsage() {
+		details = append(details, fmt.Sprintf("%s %d/%d", p.Name, p.Pending, p.QueueSize))
+		switch {
+		case p.Pending >= p.QueueSize && p.Name == s.storage.shared.name:
+			sub.Status = healthFailing
+		case p.Pending*10 >= p.QueueSize*9:
+			sub.Status = worseHealth(sub.Status, healthDegraded)
+		}
+	}
+	sub.Detail = strings.Join(details, ", ")
+	return sub
+}
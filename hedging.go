@@ -0,0 +1,66 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// maxHedgedRequests bounds the number of request identifiers remembered by the hedge tracker
+const maxHedgedRequests = 100000
+
+// seenRequest is a request identifier remembered by the hedge tracker
+type seenRequest struct {
+	id   string
+	seen time.Time
+}
+
+// HedgeTracker recognizes the hedged attempts of the same read request by their request
+// identifier, so that they are accounted once. The identifiers are remembered for the
+// hedge window, and at most maxHedgedRequests of them
+type HedgeTracker struct {
+	mu     sync.Mutex
+	window time.Duration
+	seen   map[string]struct{}
+	order  []seenRequest
+
+	reads  *Counter
+	hedged *Counter
+}
+
+// NewHedgeTracker constructs a new instance of the hedge tracker remembering the requests for the window
+func NewHedgeTracker(window time.Duration) *HedgeTracker {
+	return &HedgeTracker{
+		window: window,
+		seen:   make(map[string]struct{}),
+		reads:  metrics.NewCounter("phs_hash_reads_total", "Number of hash reads, counting the hedged attempts of a request once"),
+		hedged: metrics.NewCounter("phs_hash_hedged_reads_total", "Number of hash read attempts recognized as hedged duplicates"),
+	}
+}
+
+// Track accounts the read request and reports whether it duplicates an earlier attempt.
+// The requests without an identifier are never considered duplicates
+func (t *HedgeTracker) Track(requestID string) (duplicate bool) {
+	if requestID == "" {
+		t.reads.Inc()
+		return false
+	}
+	now := time.Now()
+	t.mu.Lock()
+	for len(t.order) > 0 && (now.Sub(t.order[0].seen) >= t.window || len(t.order) >= maxHedgedRequests) {
+		delete(t.seen, t.order[0].id)
+		t.order = t.order[1:]
+	}
+	_, duplicate = t.seen[requestID]
+	if !duplicate {
+		t.seen[requestID] = struct{}{}
+		t.order = append(t.order, seenRequest{id: requestID, seen: now})
+	}
+	t.mu.Unlock()
+
+	if duplicate {
+		t.hedged.Inc()
+	} else {
+		t.reads.Inc()
+	}
+	return duplicate
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// idempotencyDir is the directory of the file backend holding the idempotency records
+const idempotencyDir = "idempotency"
+
+// idempotencyRecord remembers the hash created by a request carrying an idempotency key.
+// The fingerprint identifies the request parameters, so that a key reused for a different
+// request is recognized
+type idempotencyRecord struct {
+	Key         string    `json:"key"`
+	Fingerprint string    `json:"fingerprint"`
+	ID          uint64    `json:"id"`
+	Created     time.Time `json:"created"`
+	Expires     time.Time `json:"expires"`
+}
+
+// idempotencyStore is implemented by the backends able to keep the idempotency records,
+// shared by all the instances using the backend and surviving the restarts
+type idempotencyStore interface {
+	// GetIdempotency returns the unexpired record with the given key
+	GetIdempotency(key string) (rec idempotencyRecord, ok bool, err error)
+	// ClaimIdempotency saves the record unless an unexpired record with the same key exists,
+	// in which case the existing record is returned
+	ClaimIdempotency(rec idempotencyRecord) (existing idempotencyRecord, claimed bool, err error)
+	// ExpireIdempotency removes the records expired by now and returns their number
+	ExpireIdempotency(now time.Time) (int, error)
+}
+
+// idempotencyLister is implemented by the idempotency stores able to list their unexpired records,
+// which the storage migration copies to the new backend
+type idempotencyLister interface {
+	ListIdempotency(now time.Time) ([]idempotencyRecord, error)
+}
+
+// idempotencyFingerprint returns the fingerprint of the hash creation request parameters.
+// The password is covered only by the HMAC keyed with the secret: the records are readable in the backend
+// along with their key, so a plain digest of the password would let their reader guess it at one SHA-256 per guess
+func idempotencyFingerprint(secret []byte, key, pw string, salt *callerSalt, ttl, retain time.Duration) string {
+	params := fmt.Sprintf("%s:%d", key, ttl)
+	if salt != nil {
+		params += ":" + salt.String()
+	}
+	if retain > 0 {
+		params += fmt.Sprintf(":retain=%d", retain)
+	}
+	if len(secret) == 0 {
+		sum := sha256.Sum256([]byte(params))
+		return hex.EncodeToString(sum[:])
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(params + ":" + pw))
+	return "hmac:" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// scopedIdempotencyKey scopes the key sent by the client to the tenant, or the API key, of the request
+func scopedIdempotencyKey(r *http.Request, key string) string {
+	if k := requestAPIKey(r); k != nil {
+		if k.Tenant != "" {
+			return "tenant:" + k.Tenant + ":" + key
+		}
+		return "key:" + k.ID + ":" + key
+	}
+	return ":" + key
+}
+
+// runIdempotencyExpiry periodically removes the expired idempotency records until done is closed
+func runIdempotencyExpiry(store idempotencyStore, interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			n, err := store.ExpireIdempotency(time.Now())
+			if err != nil {
+				logf(logLevelError, "Error while expiring idempotency keys: %v\n", err)
+			} else if n > 0 {
+				logf(logLevelDebug, "Expired %d idempotency keys\n", n)
+			}
+		}
+	}
+}
+
+// GetIdempotency returns the unexpired record with the given key
+func (b *MemoryBackend) GetIdempotency(key string) (idempotencyRecord, bool, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	rec, ok := b.idempotency[key]
+	return rec, ok && time.Now().Before(rec.Expires), nil
+}
+
+// ClaimIdempotency saves the record unless an unexpired record with the same key exists
+func (b *MemoryBackend) ClaimIdempotency(rec idempotencyRecord) (idempotencyRecord, bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if existing, ok := b.idempotency[rec.Key]; ok && time.Now().Before(existing.Expires) {
+		return existing, false, nil
+	}
+	b.idempotency[rec.Key] = rec
+	return rec, true, nil
+}
+
+// ExpireIdempotency removes the records expired by now
+func (b *MemoryBackend) ExpireIdempotency(now time.Time) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	n := 0
+	for key, rec := range b.idempotency {
+		if !now.Before(rec.Expires) {
+			delete(b.idempotency, key)
+			n++
+		}
+	}
+	return n, nil
+}
+
+// ListIdempotency returns the records unexpired by now
+func (b *MemoryBackend) ListIdempotency(now time.Time) ([]idempotencyRecord, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	var recs []idempotencyRecord
+	for _, rec := range b.idempotency {
+		if now.Before(rec.Expires) {
+			recs = append(recs, rec)
+		}
+	}
+	return recs, nil
+}
+
+// idempotencyPath returns the name of the file holding the record with the given key.
+// The keys are hashed, since they are chosen by the clients
+func (b *FileBackend) idempotencyPath(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(b.dir, idempotencyDir, hex.EncodeToString(sum[:])+recordFileExt)
+}
+
+// readIdempotency reads the idempotency record file
+func readIdempotency(path string) (rec idempotencyRecord, err error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return rec, err
+	}
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return rec, fmt.Errorf("idempotency record %s: %v", filepath.Base(path), err)
+	}
+	return rec, nil
+}
+
+// GetIdempotency returns the unexpired record with the given key
+func (b *FileBackend) GetIdempotency(key string) (idempotencyRecord, bool, error) {
+	rec, err := readIdempotency(b.idempotencyPath(key))
+	if os.IsNotExist(err) {
+		return rec, false, nil
+	}
+	if err != nil {
+		return rec, false, err
+	}
+	return rec, time.Now().Before(rec.Expires), nil
+}
+
+// maxClaimAttempts bounds the attempts of claiming a key whose expired record is being replaced
+const maxClaimAttempts = 10
+
+// removeExpiredIdempotency removes the record file if it has expired by now, and returns whether it did.
+// The record is read again and removed under a lock file, so that the record claimed in the meantime by
+// another instance is never removed. Nothing is removed while another instance holds the lock. The lock
+// file has the temporary prefix, so that the lock abandoned by a crashed instance is removed as stale
+func removeExpiredIdempotency(dir, path string, now time.Time) (bool, error) {
+	lock := filepath.Join(dir, recordTempPrefix+"lock-"+filepath.Base(path))
+	f, err := os.OpenFile(lock, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if os.IsExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	f.Close()
+	defer os.Remove(lock)
+	rec, err := readIdempotency(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil || now.Before(rec.Expires) {
+		return false, err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	return true, nil
+}
+
+// ClaimIdempotency saves the record unless an unexpired record with the same key exists.
+// The record is written to a temporary file first and then hard linked to its name,
+// which fails if another instance has claimed the key in the meantime. An expired record
+// not removed yet is replaced, see removeExpiredIdempotency
+func (b *FileBackend) ClaimIdempotency(rec idempotencyRecord) (idempotencyRecord, bool, error) {
+	dir := filepath.Join(b.dir, idempotencyDir)
+	path := b.idempotencyPath(rec.Key)
+	suffix, err := randomString(8, hex.EncodeToString)
+	if err != nil {
+		return rec, false, err
+	}
+	tmp := filepath.Join(dir, recordTempPrefix+suffix)
+	if err := writeFileAtomic(dir, tmp, rec); err != nil {
+		return rec, false, err
+	}
+	defer os.Remove(tmp)
+
+	for attempt := 0; attempt < maxClaimAttempts; attempt++ {
+		err := os.Link(tmp, path)
+		if err == nil {
+			return rec, true, nil
+		}
+		if !os.IsExist(err) {
+			return rec, false, err
+		}
+		existing, err := readIdempotency(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return rec, false, err
+		}
+		now := time.Now()
+		if now.Before(existing.Expires) {
+			return existing, false, nil
+		}
+		removed, err := removeExpiredIdempotency(dir, path, now)
+		if err != nil {
+			return rec, false, err
+		}
+		if !removed {
+			// Another instance is replacing the expired record
+			time.Sleep(time.Millisecond)
+		}
+	}
+	return rec, false, fmt.Errorf("idempotency key %q: too many concurrent claims", rec.Key)
+}
+
+// ExpireIdempotency removes the records expired by now along with the abandoned temporary files
+func (b *FileBackend) ExpireIdempotency(now time.Time) (int, error) {
+	dir := filepath.Join(b.dir, idempotencyDir)
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, f := range files {
+		path := filepath.Join(dir, f.Name())
+		if strings.HasPrefix(f.Name(), recordTempPrefix) {
+			if now.Sub(f.ModTime()) > staleTempAge {
+				os.Remove(path)
+			}
+			continue
+		}
+		if !strings.HasSuffix(f.Name(), recordFileExt) {
+			continue
+		}
+		rec, err := readIdempotency(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return n, err
+		}
+		if !now.Before(rec.Expires) {
+			removed, err := removeExpiredIdempotency(dir, path, now)
+			if err != nil {
+				return n, err
+			}
+			if removed {
+				n++
+			}
+		}
+	}
+	return n, nil
+}
+
+// ListIdempotency returns the records unexpired by now
+func (b *FileBackend) ListIdempotency(now time.Time) ([]idempotencyRecord, error) {
+	files, err := ioutil.ReadDir(filepath.Join(b.dir, idempotencyDir))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var recs []idempotencyRecord
+	for _, f := range files {
+		if strings.HasPrefix(f.Name(), recordTempPrefix) || !strings.HasSuffix(f.Name(), recordFileExt) {
+			continue
+		}
+		rec, err := readIdempotency(filepath.Join(b.dir, idempotencyDir, f.Name()))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if now.Before(rec.Expires) {
+			recs = append(recs, rec)
+		}
+	}
+	return recs, nil
+}
+
+// GetIdempotency returns the record from the cold tier
+func (b *TieredBackend) GetIdempotency(key string) (idempotencyRecord, bool, error) {
+	return b.cold.(idempotencyStore).GetIdempotency(key)
+}
+
+// ClaimIdempotency saves the record in the cold tier
+func (b *TieredBackend) ClaimIdempotency(rec idempotencyRecord) (idempotencyRecord, bool, error) {
+	return b.cold.(idempotencyStore).ClaimIdempotency(rec)
+}
+
+// ExpireIdempotency removes the expired records from the cold tier
+func (b *TieredBackend) ExpireIdempotency(now time.Time) (int, error) {
+	return b.cold.(idempotencyStore).ExpireIdempotency(now)
+}
+
+// ListIdempotency returns the records of the cold tier unexpired by now
+func (b *TieredBackend) ListIdempotency(now time.Time) ([]idempotencyRecord, error) {
+	return b.cold.(idempotencyLister).ListIdempotency(now)
+}
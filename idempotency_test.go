@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestFileBackend returns a file backend rooted at a temporary directory
+func newTestFileBackend(t *testing.T) *FileBackend {
+	b, err := NewFileBackend(t.TempDir(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// testIdempotencyRecord returns the record claiming the key for the hash, expiring after ttl
+func testIdempotencyRecord(key string, id uint64, ttl time.Duration) idempotencyRecord {
+	now := time.Now().UTC()
+	return idempotencyRecord{Key: key, Fingerprint: fmt.Sprintf("fp-%d", id), ID: id, Created: now, Expires: now.Add(ttl)}
+}
+
+func TestFileBackendClaimIdempotency(t *testing.T) {
+	for _, tt := range []struct {
+		name        string
+		existing    time.Duration // TTL of the record claimed first, 0 if none
+		wantClaimed bool
+		wantID      uint64
+	}{
+		{name: "new key", wantClaimed: true, wantID: 2},
+		{name: "unexpired", existing: time.Hour, wantClaimed: false, wantID: 1},
+		{name: "expired", existing: -time.Second, wantClaimed: true, wantID: 2},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTestFileBackend(t)
+			if tt.existing != 0 {
+				if _, claimed, err := b.ClaimIdempotency(testIdempotencyRecord("k", 1, tt.existing)); err != nil || !claimed {
+					t.Fatalf("first claim = %v, %v", claimed, err)
+				}
+			}
+			got, claimed, err := b.ClaimIdempotency(testIdempotencyRecord("k", 2, time.Hour))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if claimed != tt.wantClaimed || got.ID != tt.wantID {
+				t.Fatalf("claim = hash %d, claimed %v, want hash %d, claimed %v", got.ID, claimed, tt.wantID, tt.wantClaimed)
+			}
+			stored, ok, err := b.GetIdempotency("k")
+			if err != nil || !ok || stored.ID != tt.wantID {
+				t.Fatalf("GetIdempotency = hash %d, %v, %v, want hash %d", stored.ID, ok, err, tt.wantID)
+			}
+		})
+	}
+}
+
+func TestFileBackendClaimIdempotencyRace(t *testing.T) {
+	const claimers = 8
+	for _, tt := range []struct {
+		name     string
+		existing time.Duration // TTL of the record claimed before the race, 0 if none
+	}{
+		{name: "new key"},
+		{name: "expired", existing: -time.Second},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTestFileBackend(t)
+			for round := 0; round < 50; round++ {
+				key := fmt.Sprintf("k%d", round)
+				if tt.existing != 0 {
+					if _, _, err := b.ClaimIdempotency(testIdempotencyRecord(key, 1000, tt.existing)); err != nil {
+						t.Fatal(err)
+					}
+				}
+				var wg sync.WaitGroup
+				results := make([]idempotencyRecord, claimers)
+				won := make([]bool, claimers)
+				errs := make([]error, claimers)
+				for i := 0; i < claimers; i++ {
+					wg.Add(1)
+					go func(i int) {
+						defer wg.Done()
+						results[i], won[i], errs[i] = b.ClaimIdempotency(testIdempotencyRecord(key, uint64(i+1), time.Hour))
+					}(i)
+				}
+				wg.Wait()
+
+				var winners []uint64
+				for i := 0; i < claimers; i++ {
+					if errs[i] != nil {
+						t.Fatalf("round %d: claim %d: %v", round, i+1, errs[i])
+					}
+					if won[i] {
+						winners = append(winners, results[i].ID)
+					}
+				}
+				if len(winners) != 1 {
+					t.Fatalf("round %d: claimed by %v, want a single winner", round, winners)
+				}
+				for i := 0; i < claimers; i++ {
+					if results[i].ID != winners[0] {
+						t.Fatalf("round %d: claim %d returned hash %d, want the winner %d", round, i+1, results[i].ID, winners[0])
+					}
+				}
+				if stored, ok, err := b.GetIdempotency(key); err != nil || !ok || stored.ID != winners[0] {
+					t.Fatalf("round %d: GetIdempotency = hash %d, %v, %v, want %d", round, stored.ID, ok, err, winners[0])
+				}
+			}
+		})
+	}
+}
+
+func TestFileBackendExpireIdempotency(t *testing.T) {
+	b := newTestFileBackend(t)
+	for _, rec := range []idempotencyRecord{
+		testIdempotencyRecord("expired", 1, -time.Second),
+		testIdempotencyRecord("live", 2, time.Hour),
+	} {
+		if _, _, err := b.ClaimIdempotency(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dir := filepath.Join(b.dir, idempotencyDir)
+	stale := filepath.Join(dir, recordTempPrefix+"stale")
+	if err := ioutil.WriteFile(stale, []byte("{}"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-2 * staleTempAge)
+	if err := os.Chtimes(stale, old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := b.ExpireIdempotency(time.Now())
+	if err != nil || n != 1 {
+		t.Fatalf("ExpireIdempotency = %d, %v, want 1", n, err)
+	}
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Fatalf("stale temporary file kept: %v", err)
+	}
+	if _, ok, _ := b.GetIdempotency("expired"); ok {
+		t.Fatal("expired record still found")
+	}
+	if rec, ok, err := b.GetIdempotency("live"); err != nil || !ok || rec.ID != 2 {
+		t.Fatalf("live record = hash %d, %v, %v", rec.ID, ok, err)
+	}
+	// The expired key may be claimed again right away
+	if rec, claimed, err := b.ClaimIdempotency(testIdempotencyRecord("expired", 3, time.Hour)); err != nil || !claimed || rec.ID != 3 {
+		t.Fatalf("claim after expiry = hash %d, %v, %v", rec.ID, claimed, err)
+	}
+}
+
+func TestIdempotencyFingerprint(t *testing.T) {
+	secret := []byte("0123456789abcdef")
+	base := idempotencyFingerprint(secret, "k", "angryMonkey", nil, time.Hour, 0)
+	for _, tt := range []struct {
+		name   string
+		secret []byte
+		pw     string
+		ttl    time.Duration
+		retain time.Duration
+		same   bool
+	}{
+		{name: "same request", secret: secret, pw: "angryMonkey", ttl: time.Hour, same: true},
+		{name: "other password", secret: secret, pw: "calmMonkey", ttl: time.Hour},
+		{name: "other ttl", secret: secret, pw: "angryMonkey", ttl: time.Minute},
+		{name: "retain", secret: secret, pw: "angryMonkey", ttl: time.Hour, retain: time.Hour},
+		{name: "other secret", secret: []byte("fedcba9876543210"), pw: "angryMonkey", ttl: time.Hour},
+	} {
+		got := idempotencyFingerprint(tt.secret, "k", tt.pw, nil, tt.ttl, tt.retain)
+		if (got == base) != tt.same {
+			t.Errorf("%s: fingerprint equal = %v, want %v", tt.name, got == base, tt.same)
+		}
+	}
+	// Without a secret the fingerprint must not depend on the password, so it cannot be used to guess it
+	if idempotencyFingerprint(nil, "k", "angryMonkey", nil, time.Hour, 0) != idempotencyFingerprint(nil, "k", "calmMonkey", nil, time.Hour, 0) {
+		t.Error("fingerprint without a secret depends on the password")
+	}
+}
@@ -0,0 +1,20 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"time"
+)
+
+// randomJitter returns a random duration below max. The crypto/rand source keeps it
+// unpredictable, so that the jitter cannot be filtered out by the clients
+func randomJitter(max time.Duration) time.Duration {
+	if max <= 0 {
+		return 0
+	}
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return max / 2
+	}
+	return time.Duration(binary.LittleEndian.Uint64(b[:]) % uint64(max))
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// throughputWindow is the longest rolling window of the hash calculation throughput
+const throughputWindow = 15 * time.Minute
+
+// The phases of a hash calculation timed separately, so that the configured delay does not pass for
+// the cost of the calculations: the delay before the job is queued, the hash delay and its jitter,
+// the wait in the queue of the worker pool and the calculation itself
+const (
+	phaseDelay = iota
+	phaseQueueWait
+	phaseCompute
+	jobPhaseCount
+)
+
+// jobPhaseNames are the names of the phases in the metrics
+var jobPhaseNames = [jobPhaseCount]string{"delay", "queue_wait", "compute"}
+
+// JobStats accumulates the timing of the hash calculations
+type JobStats struct {
+	mu           sync.Mutex
+	completed    uint64
+	queueWaitSum durationSum
+	hashTimeSum  durationSum
+	delaySum     durationSum
+	// completions counts the completed calculations per second over the throughput window
+	completions [int(throughputWindow / time.Second)]uint32
+	lastSecond  int64
+	// phaseMicros sums the phases of the calculations completed per second over the throughput window,
+	// and phaseTotals since the start, in microseconds
+	phaseMicros [int(throughputWindow / time.Second)][jobPhaseCount]uint64
+	phaseTotals [jobPhaseCount]uint64
+}
+
+// JobPhases are the average durations of the phases of the calculations completed within a window,
+// in microseconds
+type JobPhases struct {
+	Completed uint64 `json:"completed"`
+	Delay     uint64 `json:"delay"`
+	QueueWait uint64 `json:"queue_wait"`
+	Compute   uint64 `json:"compute"`
+}
+
+// DetailedStats represents the detailed hash calculation statistics.
+// The durations are reported in microseconds, the throughput in hashes per second.
+// The average queue wait includes the average delay, the phases exclude it from the queue wait
+type DetailedStats struct {
+	Pending             int                  `json:"pending"`
+	Completed           uint64               `json:"completed"`
+	AverageQueueWait    uint64               `json:"average_queue_wait"`
+	AverageHashDuration uint64               `json:"average_hash_duration"`
+	AverageDelay        uint64               `json:"average_delay"`
+	Throughput          map[string]float64   `json:"throughput"`
+	Phases              map[string]JobPhases `json:"phases"`
+	Warmup              *HashStats           `json:"warmup,omitempty"`
+}
+
+// NewJobStats constructs a new instance of the hash calculation statistics
+func NewJobStats() *JobStats {
+	s := &JobStats{}
+	for phase, name := range jobPhaseNames {
+		phase := phase
+		metrics.NewCounterFunc("phs_job_phase_seconds_total", "Time the completed hash calculations spent in the phase", func() float64 {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			return float64(s.phaseTotals[phase]) / 1e6
+		}, "phase", name)
+	}
+	metrics.NewCounterFunc("phs_jobs_completed_total", "Number of completed hash calculations", func() float64 {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return float64(s.completed)
+	})
+	return s
+}
+
+// Record accounts the calculation enqueued, queued to its worker pool once delayed, started
+// and completed at the given times
+func (s *JobStats) Record(enqueued, queued, started, completed time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.completed++
+	s.queueWaitSum.add(started.Sub(enqueued))
+	s.hashTimeSum.add(completed.Sub(started))
+	s.delaySum.add(queued.Sub(enqueued))
+	s.advance(completed.Unix())
+	sec := completed.Unix() % int64(len(s.completions))
+	s.completions[sec]++
+	for phase, d := range [jobPhaseCount]time.Duration{queued.Sub(enqueued), started.Sub(queued), completed.Sub(started)} {
+		if d < 0 {
+			d = 0
+		}
+		s.phaseMicros[sec][phase] += uint64(d / time.Microsecond)
+		s.phaseTotals[phase] += uint64(d / time.Microsecond)
+	}
+}
+
+// advance clears the per-second buckets which went out of the window by now.
+// Must be called with the lock held
+func (s *JobStats) advance(now int64) {
+	if now <= s.lastSecond {
+		return
+	}
+	n := int64(len(s.completions))
+	from := s.lastSecond + 1
+	if now-from >= n {
+		from = now - n + 1
+	}
+	for sec := from; sec <= now; sec++ {
+		s.completions[sec%n] = 0
+		s.phaseMicros[sec%n] = [jobPhaseCount]uint64{}
+	}
+	s.lastSecond = now
+}
+
+// completedWithin returns the number of calculations completed within the last period
+// along with the average durations of their phases. Must be called with the lock held
+func (s *JobStats) completedWithin(now int64, period time.Duration) JobPhases {
+	n := int64(len(s.completions))
+	var completed uint64
+	var sums [jobPhaseCount]uint64
+	for sec := now - int64(period/time.Second) + 1; sec <= now; sec++ {
+		completed += uint64(s.completions[sec%n])
+		for phase := range sums {
+			sums[phase] += s.phaseMicros[sec%n][phase]
+		}
+	}
+	phases := JobPhases{Completed: completed}
+	if completed > 0 {
+		phases.Delay = sums[phaseDelay] / completed
+		phases.QueueWait = sums[phaseQueueWait] / completed
+		phases.Compute = sums[phaseCompute] / completed
+	}
+	return phases
+}
+
+// Detailed returns the detailed statistics given the current number of pending calculations
+func (s *JobStats) Detailed(pending int) DetailedStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now().Unix()
+	s.advance(now)
+
+	stats := DetailedStats{Pending: pending, Completed: s.completed, Throughput: make(map[string]float64), Phases: make(map[string]JobPhases)}
+	stats.AverageQueueWait = s.queueWaitSum.average(s.completed)
+	stats.AverageHashDuration = s.hashTimeSum.average(s.completed)
+	stats.AverageDelay = s.delaySum.average(s.completed)
+	for name, period := range map[string]time.Duration{"1m": time.Minute, "5m": 5 * time.Minute, "15m": 15 * time.Minute} {
+		phases := s.completedWithin(now, period)
+		stats.Throughput[name] = float64(phases.Completed) / period.Seconds()
+		stats.Phases[name] = phases
+	}
+	return stats
+}
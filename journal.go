@@ -0,0 +1,114 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	mathrand "math/rand"
+	"sync"
+	"time"
+)
+
+// journalEvent is a single step of the request lifecycle
+type journalEvent struct {
+	Name string    `json:"name"`
+	Time time.Time `json:"time"`
+	// OffsetNs is the monotonic time elapsed since the handler entry, in nanoseconds
+	OffsetNs int64 `json:"offset_ns"`
+}
+
+// journalRecord represents the journaled lifecycle of a request
+type journalRecord struct {
+	RequestID string         `json:"request_id"`
+	HashID    uint64         `json:"hash_id,omitempty"`
+	Events    []journalEvent `json:"events"`
+}
+
+// journalEntry records the lifecycle of a single sampled request.
+// The methods are safe to call on a nil entry, which stands for a request not being sampled
+type journalEntry struct {
+	mu     sync.Mutex
+	start  time.Time
+	record journalRecord
+}
+
+// Record appends the lifecycle event to the entry
+func (e *journalEntry) Record(name string) {
+	if e == nil {
+		return
+	}
+	now := time.Now()
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.record.Events = append(e.record.Events, journalEvent{Name: name, Time: now.UTC(), OffsetNs: now.Sub(e.start).Nanoseconds()})
+}
+
+// SetHashID associates the entry with the password hash record
+func (e *journalEntry) SetHashID(id uint64) {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.record.HashID = id
+}
+
+// snapshot returns a copy of the journaled lifecycle
+func (e *journalEntry) snapshot() journalRecord {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	rec := e.record
+	rec.Events = append([]journalEvent(nil), e.record.Events...)
+	return rec
+}
+
+// Journal keeps the lifecycles of the sampled requests for debugging.
+// The oldest entries are dropped once the journal is full
+type Journal struct {
+	mu         sync.Mutex
+	sampleRate float64
+	size       int
+	entries    map[string]*journalEntry
+	order      []string
+}
+
+// NewJournal constructs a new request journal sampling the given share of the requests
+func NewJournal(sampleRate float64, size int) *Journal {
+	return &Journal{sampleRate: sampleRate, size: size, entries: make(map[string]*journalEntry)}
+}
+
+// Start begins journaling the request if it is sampled and returns its entry, or nil otherwise
+func (j *Journal) Start(requestID string) *journalEntry {
+	if j == nil || mathrand.Float64() >= j.sampleRate {
+		return nil
+	}
+	entry := &journalEntry{start: time.Now(), record: journalRecord{RequestID: requestID}}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if _, ok := j.entries[requestID]; !ok {
+		j.order = append(j.order, requestID)
+	}
+	j.entries[requestID] = entry
+	for len(j.order) > j.size {
+		delete(j.entries, j.order[0])
+		j.order = j.order[1:]
+	}
+	return entry
+}
+
+// Get returns the journaled lifecycle of the request
+func (j *Journal) Get(requestID string) (journalRecord, bool) {
+	j.mu.Lock()
+	entry, ok := j.entries[requestID]
+	j.mu.Unlock()
+	if !ok {
+		return journalRecord{}, false
+	}
+	return entry.snapshot(), true
+}
+
+// newRequestID generates a random request identifier
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// latencyWindowSize is the number of the latest request latencies the lame duck period is sized from
+const latencyWindowSize = 1024
+
+// latencyWindow keeps the latencies of the latest requests
+type latencyWindow struct {
+	mu      sync.Mutex
+	samples [latencyWindowSize]time.Duration
+	n       int
+}
+
+// Observe records the latency of a request, replacing the oldest one once the window is full
+func (l *latencyWindow) Observe(d time.Duration) {
+	l.mu.Lock()
+	l.samples[l.n%latencyWindowSize] = d
+	l.n++
+	l.mu.Unlock()
+}
+
+// Percentile returns the p-th percentile of the recorded latencies, 0 if none have been recorded
+func (l *latencyWindow) Percentile(p float64) time.Duration {
+	l.mu.Lock()
+	n := l.n
+	if n > latencyWindowSize {
+		n = latencyWindowSize
+	}
+	samples := make([]time.Duration, n)
+	copy(samples, l.samples[:n])
+	l.mu.Unlock()
+	if n == 0 {
+		return 0
+	}
+	sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+	i := int(p/100*float64(n)+0.5) - 1
+	if i < 0 {
+		i = 0
+	}
+	if i >= n {
+		i = n - 1
+	}
+	return samples[i]
+}
+
+// lameDuckDelay returns the time to keep serving while reporting not ready before shutting down: the
+// shutdown delay, extended by the configured multiple of the p99 latency of the latest requests, so
+// that the requests routed to the instance before the load balancer notices are served to the end
+func (s *HashService) lameDuckDelay() time.Duration {
+	delay := s.cfg.ShutdownDelay
+	if s.cfg.ShutdownDelayP99Multiple > 0 {
+		delay += time.Duration(s.cfg.ShutdownDelayP99Multiple * float64(s.latencies.Percentile(99)))
+		if delay > s.cfg.ShutdownDelayMax {
+			delay = s.cfg.ShutdownDelayMax
+		}
+	}
+	return delay
+}
+
+// trackLatency records the latencies of the public requests. During the lame duck period the responses
+// carry Connection: close, so that the clients reconnect through the load balancer to the other instances
+func (s *HashService) trackLatency(next http.Handler) http.Handler {
+	metrics.NewGaugeFunc("phs_request_latency_p99_seconds", "99th percentile of the latency of the latest public requests", func() float64 {
+		return s.latencies.Percentile(99).Seconds()
+	})
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&s.shuttingDown) != 0 {
+			w.Header().Set("Connection", "close")
+		}
+		if isOpsRoute(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		start := time.Now()
+		next.ServeHTTP(w, r)
+		s.latencies.Observe(time.Since(start))
+	})
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// firstForwarded returns the first value of the forwarded header, set by the proxy closest to the client
+func firstForwarded(r *http.Request, name string) string {
+	v := r.Header.Get(name)
+	if i := strings.IndexByte(v, ','); i >= 0 {
+		v = v[:i]
+	}
+	return strings.TrimSpace(v)
+}
+
+// absoluteURL returns the URL of the path as seen by the client. It is based on the configured
+// external URL, if any, or else on the request, honoring the X-Forwarded-Proto, X-Forwarded-Host
+// and X-Forwarded-Prefix headers of the trusted proxies
+func (s *HashService) absoluteURL(r *http.Request, path string) string {
+	if s.cfg.ExternalURL != "" {
+		return strings.TrimSuffix(s.cfg.ExternalURL, "/") + path
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	host := r.Host
+	prefix := ""
+	if s.cfg.TrustForwardedHeaders {
+		if proto := strings.ToLower(firstForwarded(r, "X-Forwarded-Proto")); proto == "http" || proto == "https" {
+			scheme = proto
+		}
+		if fwdHost := firstForwarded(r, "X-Forwarded-Host"); fwdHost != "" {
+			host = fwdHost
+		}
+		prefix = strings.TrimSuffix(firstForwarded(r, "X-Forwarded-Prefix"), "/")
+		if prefix != "" && !strings.HasPrefix(prefix, "/") {
+			prefix = "/" + prefix
+		}
+	}
+	return scheme + "://" + host + prefix + path
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// maxTrackedIdentities bounds the number of identities whose failed verifications are counted.
+// The counts are cleared when exceeded
+const maxTrackedIdentities = 100000
+
+// verifyBudgetWindow is the window of the verification budget
+const verifyBudgetWindow = time.Hour
+
+// identityAttempts counts the failed verifications of an identity in the current window
+type identityAttempts struct {
+	windowStart time.Time
+	failures    int
+}
+
+// identityLockout is a lockout of an identity which has used up its verification budget
+type identityLockout struct {
+	Identity string    `json:"identity"`
+	Failures int       `json:"failures"`
+	Since    time.Time `json:"since"`
+	Until    time.Time `json:"until"`
+}
+
+// lockoutError is returned for the verifications of a locked out identity
+type lockoutError struct {
+	Until time.Time
+}
+
+func (e *lockoutError) Error() string {
+	return "identity locked out until " + e.Until.Format(time.RFC3339)
+}
+
+// LockoutList counts the failed password verifications of each identity, e.g. a user, and locks
+// the identity out once they reach the budget within an hour, whichever source they come from
+type LockoutList struct {
+	mu       sync.Mutex
+	budget   int
+	duration time.Duration
+	attempts map[string]*identityAttempts
+	lockouts map[string]identityLockout
+
+	lockedOut *Counter
+	rejected  *Counter
+}
+
+// NewLockoutList constructs a new instance of the lockout list locking the identities out
+// for the duration once their failed verifications reach the budget within an hour
+func NewLockoutList(budget int, duration time.Duration) *LockoutList {
+	l := &LockoutList{
+		budget:    budget,
+		duration:  duration,
+		attempts:  make(map[string]*identityAttempts),
+		lockouts:  make(map[string]identityLockout),
+		lockedOut: metrics.NewCounter("phs_verify_lockouts_total", "Number of identities locked out for failing too many verifications"),
+		rejected:  metrics.NewCounter("phs_verify_locked_requests_total", "Number of verifications rejected because their identity is locked out"),
+	}
+	metrics.NewGaugeFunc("phs_verify_lockouts_active", "Number of identities currently locked out", func() float64 {
+		return float64(len(l.List(time.Now())))
+	})
+	return l
+}
+
+// verifyIdentity returns the identity whose verifications of the hash are throttled, the given one
+// or else the hash identifier, scoped to the tenant, if any
+func verifyIdentity(tenant, identity string, id uint64) string {
+	if identity == "" {
+		identity = "hash:" + strconv.FormatUint(id, 10)
+	}
+	if tenant != "" {
+		return "tenant:" + tenant + ":" + identity
+	}
+	return identity
+}
+
+// Check returns lockoutError if the identity is locked out
+func (l *LockoutList) Check(identity string, now time.Time) error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	lockout, ok := l.lockouts[identity]
+	if !ok {
+		return nil
+	}
+	if !now.Before(lockout.Until) {
+		delete(l.lockouts, identity)
+		return nil
+	}
+	l.rejected.Inc()
+	return &lockoutError{Until: lockout.Until}
+}
+
+// Record counts the verification of the identity, locking the identity out once its failed verifications
+// reach the budget. A successful verification clears the count
+func (l *LockoutList) Record(identity string, match bool, now time.Time) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if match {
+		delete(l.attempts, identity)
+		return
+	}
+	a, ok := l.attempts[identity]
+	if !ok || now.Sub(a.windowStart) >= verifyBudgetWindow {
+		if !ok && len(l.attempts) >= maxTrackedIdentities {
+			l.attempts = make(map[string]*identityAttempts)
+		}
+		a = &identityAttempts{windowStart: now}
+		l.attempts[identity] = a
+	}
+	a.failures++
+	if a.failures < l.budget {
+		return
+	}
+	lockout := identityLockout{
+		Identity: identity,
+		Failures: a.failures,
+		Since:    now.UTC(),
+		Until:    now.Add(l.duration).UTC(),
+	}
+	l.lockouts[identity] = lockout
+	delete(l.attempts, identity)
+	l.lockedOut.Inc()
+	logf(logLevelWarn, "Locked out %s until %v: %d failed verifications within %v\n", identity, lockout.Until.Format(time.RFC3339), a.failures, verifyBudgetWindow)
+}
+
+// List returns the active lockouts ordered by their start
+func (l *LockoutList) List(now time.Time) []identityLockout {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	lockouts := make([]identityLockout, 0, len(l.lockouts))
+	for identity, lockout := range l.lockouts {
+		if !now.Before(lockout.Until) {
+			delete(l.lockouts, identity)
+			continue
+		}
+		lockouts = append(lockouts, lockout)
+	}
+	sort.Slice(lockouts, func(i, j int) bool { return lockouts[i].Since.Before(lockouts[j].Since) })
+	return lockouts
+}
+
+// Unlock lifts the lockout of the identity and clears its failed verifications.
+// It returns ErrNotFound if the identity is not locked out
+func (l *LockoutList) Unlock(identity string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.attempts, identity)
+	if _, ok := l.lockouts[identity]; !ok {
+		return ErrNotFound
+	}
+	delete(l.lockouts, identity)
+	logf(logLevelInfo, "Unlocked %s\n", identity)
+	return nil
+}
+
+// verifyThrottled verifies the password of the identity against the hash unless the identity is locked out,
+// counting the failed verification towards its budget
+func (s *HashService) verifyThrottled(tenant, identity string, u uint64, pw string) (bool, error) {
+	identity = verifyIdentity(tenant, identity, u)
+	if err := s.lockouts.Check(identity, time.Now()); err != nil {
+		return false, err
+	}
+	match, err := s.verifyFederated(tenant, u, pw)
+	if err != nil {
+		return false, err
+	}
+	s.lockouts.Record(identity, match, time.Now())
+	return match, nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+)
+
+// maxRecentLogLines is the number of the last log lines kept for the diagnostics
+const maxRecentLogLines = 1000
+
+// Log levels in increasing order of severity
+const (
+	logLevelDebug = iota
+	logLevelInfo
+	logLevelWarn
+	logLevelError
+)
+
+var logLevelNames = map[string]int{
+	"debug": logLevelDebug,
+	"info":  logLevelInfo,
+	"warn":  logLevelWarn,
+	"error": logLevelError,
+}
+
+// currentLogLevel is the minimal level of the messages being written to the log
+var currentLogLevel = logLevelInfo
+
+// parseLogLevel converts the log level name into its numeric value
+func parseLogLevel(name string) (int, error) {
+	level, ok := logLevelNames[strings.ToLower(name)]
+	if !ok {
+		return 0, fmt.Errorf("unknown log level %q", name)
+	}
+	return level, nil
+}
+
+// logf writes the message to the log if its level is enabled
+func logf(level int, format string, v ...interface{}) {
+	if level < currentLogLevel {
+		return
+	}
+	log.Printf(format, v...)
+}
+
+// logRing keeps the last lines written to the log
+type logRing struct {
+	mu    sync.Mutex
+	lines []string
+	next  int
+}
+
+// recentLogs holds the last lines of the log, see main
+var recentLogs = &logRing{lines: make([]string, 0, maxRecentLogLines)}
+
+// Write remembers the lines written to the log, dropping the oldest ones
+func (l *logRing) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, line := range strings.SplitAfter(string(p), "\n") {
+		if line == "" {
+			continue
+		}
+		if len(l.lines) < cap(l.lines) {
+			l.lines = append(l.lines, line)
+			continue
+		}
+		l.lines[l.next] = line
+		l.next = (l.next + 1) % len(l.lines)
+	}
+	return len(p), nil
+}
+
+// Lines returns the remembered lines, the oldest first
+func (l *logRing) Lines() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append(append([]string(nil), l.lines[l.next:]...), l.lines[:l.next]...)
+}
@@ -1,15 +1,39 @@
-package main
-
-import (
-	"flag"
-)
-
-var httpAddr = flag.String("addr", ":8080", "HTTP listen address")
-
-func main() {
-	flag.Parse()
-
-	svc := NewHashService(httpAddr)
-
-	svc.Run()
-}
+package main
+
+import (
+	"flag"
+	"io"
+	"log"
+	"os"
+)
+
+func main() {
+	// The smoke test runs against an instance started elsewhere
+	if len(os.Args) > 1 && os.Args[1] == "smoke" {
+		os.Exit(runSmoke(os.Args[2:]))
+	}
+	// The bootstrap provisions the initial admin key in the storage of a new instance
+	if len(os.Args) > 1 && os.Args[1] == "bootstrap" {
+		os.Exit(runBootstrap(os.Args[2:]))
+	}
+	// The migrations of the storage can be applied ahead of the rollout of a new version
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		os.Exit(runMigrate(os.Args[2:]))
+	}
+
+	// The last lines of the log are included in the diagnostics bundle
+	log.SetOutput(io.MultiWriter(os.Stderr, recentLogs))
+
+	cfg, err := LoadConfig(flag.CommandLine, os.Args[1:])
+	if err != nil {
+		log.Fatalf("Configuration error: %v\n", err)
+	}
+	currentLogLevel, _ = parseLogLevel(cfg.LogLevel)
+
+	svc, err := NewHashService(cfg)
+	if err != nil {
+		log.Fatalf("Failed to start the service: %v\n", err)
+	}
+
+	svc.Run()
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// metaDir is the directory of the file backend holding the service metadata
+const metaDir = "meta"
+
+// metadataStore is implemented by the backends able to keep small named documents
+// of the service metadata, such as the replication state, next to the records
+type metadataStore interface {
+	// PutMeta saves the value as the named document
+	PutMeta(name string, v interface{}) error
+	// GetMeta loads the named document into v
+	GetMeta(name string, v interface{}) (ok bool, err error)
+}
+
+// metadataLister is implemented by the metadata stores able to list their documents,
+// which the storage migration copies to the new backend
+type metadataLister interface {
+	ListMeta() ([]string, error)
+}
+
+// PutMeta saves the value as the named document
+func (b *MemoryBackend) PutMeta(name string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.meta[name] = data
+	return nil
+}
+
+// GetMeta loads the named document into v
+func (b *MemoryBackend) GetMeta(name string, v interface{}) (bool, error) {
+	b.mu.RLock()
+	data, ok := b.meta[name]
+	b.mu.RUnlock()
+	if !ok {
+		return false, nil
+	}
+	return true, json.Unmarshal(data, v)
+}
+
+// ListMeta returns the names of the documents
+func (b *MemoryBackend) ListMeta() ([]string, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	names := make([]string, 0, len(b.meta))
+	for name := range b.meta {
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// PutMeta saves the value as the named document
+func (b *FileBackend) PutMeta(name string, v interface{}) error {
+	dir := filepath.Join(b.dir, metaDir)
+	return writeFileAtomic(dir, filepath.Join(dir, url.PathEscape(name)+recordFileExt), v)
+}
+
+// GetMeta loads the named document into v
+func (b *FileBackend) GetMeta(name string, v interface{}) (bool, error) {
+	data, err := ioutil.ReadFile(filepath.Join(b.dir, metaDir, url.PathEscape(name)+recordFileExt))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, json.Unmarshal(data, v)
+}
+
+// ListMeta returns the names of the documents
+func (b *FileBackend) ListMeta() ([]string, error) {
+	files, err := ioutil.ReadDir(filepath.Join(b.dir, metaDir))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, f := range files {
+		if strings.HasPrefix(f.Name(), recordTempPrefix) || !strings.HasSuffix(f.Name(), recordFileExt) {
+			continue
+		}
+		name, err := url.PathUnescape(strings.TrimSuffix(f.Name(), recordFileExt))
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// PutMeta saves the value as the named document in the cold tier
+func (b *TieredBackend) PutMeta(name string, v interface{}) error {
+	return b.cold.(metadataStore).PutMeta(name, v)
+}
+
+// GetMeta loads the named document from the cold tier into v
+func (b *TieredBackend) GetMeta(name string, v interface{}) (bool, error) {
+	return b.cold.(metadataStore).GetMeta(name, v)
+}
+
+// ListMeta returns the names of the documents of the cold tier
+func (b *TieredBackend) ListMeta() ([]string, error) {
+	return b.cold.(metadataLister).ListMeta()
+}
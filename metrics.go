@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Counter is a monotonically increasing metric value
+type Counter struct {
+	v uint64
+}
+
+// Inc increments the counter by one
+func (c *Counter) Inc() {
+	atomic.AddUint64(&c.v, 1)
+}
+
+// Add increments the counter by n
+func (c *Counter) Add(n uint64) {
+	atomic.AddUint64(&c.v, n)
+}
+
+// Value returns the current counter value
+func (c *Counter) Value() uint64 {
+	return atomic.LoadUint64(&c.v)
+}
+
+// metricSeries is a single labeled time series of the metric family
+type metricSeries struct {
+	labels string
+	value  func() float64
+}
+
+// metricFamily groups the series sharing the metric name
+type metricFamily struct {
+	name   string
+	help   string
+	typ    string
+	series []metricSeries
+}
+
+// MetricsRegistry keeps the service metrics and renders them in the Prometheus text format
+type MetricsRegistry struct {
+	mu       sync.Mutex
+	families map[string]*metricFamily
+}
+
+// NewMetricsRegistry constructs a new empty metrics registry
+func NewMetricsRegistry() *MetricsRegistry {
+	return &MetricsRegistry{families: make(map[string]*metricFamily)}
+}
+
+// metrics is the registry of the service metrics exposed on the metrics route
+var metrics = NewMetricsRegistry()
+
+// NewCounter registers a new counter. The labels are given as name/value pairs
+func (r *MetricsRegistry) NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{}
+	r.register(name, help, "counter", labels, func() float64 { return float64(c.Value()) })
+	return c
+}
+
+// NewGaugeFunc registers a gauge reporting the value returned by fn.
+// The labels are given as name/value pairs
+func (r *MetricsRegistry) NewGaugeFunc(name, help string, fn func() float64, labels ...string) {
+	r.register(name, help, "gauge", labels, fn)
+}
+
+// NewCounterFunc registers a counter reporting the value returned by fn.
+// The labels are given as name/value pairs
+func (r *MetricsRegistry) NewCounterFunc(name, help string, fn func() float64, labels ...string) {
+	r.register(name, help, "counter", labels, fn)
+}
+
+func (r *MetricsRegistry) register(name, help, typ string, labels []string, fn func() float64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	f, ok := r.families[name]
+	if !ok {
+		f = &metricFamily{name: name, help: help, typ: typ}
+		r.families[name] = f
+	}
+	f.series = append(f.series, metricSeries{labels: formatMetricLabels(labels), value: fn})
+}
+
+// formatMetricLabels renders the name/value label pairs
+func formatMetricLabels(labels []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	parts := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		parts = append(parts, labels[i]+"="+strconv.Quote(labels[i+1]))
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+// formatMetricValue renders the sample value
+func formatMetricValue(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// WriteTo renders all the registered metrics in the Prometheus text format
+func (r *MetricsRegistry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	names := make([]string, 0, len(r.families))
+	for name := range r.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	families := make([]metricFamily, 0, len(names))
+	for _, name := range names {
+		families = append(families, *r.families[name])
+	}
+	r.mu.Unlock()
+
+	var written int64
+	for _, f := range families {
+		n, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", f.name, f.help, f.name, f.typ)
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+		for _, s := range f.series {
+			n, err := fmt.Fprintf(w, "%s%s %s\n", f.name, s.labels, formatMetricValue(s.value()))
+			written += int64(n)
+			if err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Migration settings not exposed in the configuration
+const (
+	// schemaMetaName is the name of the metadata document recording the applied migrations
+	schemaMetaName = "schema"
+	// migrationLockFile is the file of the file backend held while the migrations are applied
+	migrationLockFile = "migrate.lock"
+	// migrationLockTTL is the age after which the lock of an instance which died migrating is taken over.
+	// The holder refreshes the lock three times within it
+	migrationLockTTL = time.Minute
+	// migrationLockPoll is the interval of the attempts to take the lock held by another instance
+	migrationLockPoll = time.Second
+)
+
+// errMigrationLocked is returned while another instance holds the migration lock
+var errMigrationLocked = errors.New("migrations locked by another instance")
+
+// migration is a versioned change of the storage format. The migrations must tolerate being
+// interrupted and applied again, as the version is recorded only once a migration completes
+type migration struct {
+	version int
+	name    string
+	apply   func(backend HashBackend) error
+}
+
+// migrations lists the storage migrations in the order of their versions
+var migrations = []migration{
+	{version: 1, name: "backfill_record_timing", apply: backfillRecordTiming},
+}
+
+// schemaVersion is the storage format version of this build
+func schemaVersion() int {
+	return migrations[len(migrations)-1].version
+}
+
+// schemaRecord records the migrations applied to the storage
+type schemaRecord struct {
+	Version int                `json:"version"`
+	Applied []appliedMigration `json:"applied,omitempty"`
+}
+
+// appliedMigration records when and by which instance a migration was applied
+type appliedMigration struct {
+	Version  int       `json:"version"`
+	Name     string    `json:"name"`
+	Applied  time.Time `json:"applied"`
+	Instance string    `json:"instance"`
+}
+
+// migrationLocker is implemented by the backends shared by several instances, which must not migrate them at once
+type migrationLocker interface {
+	// LockMigrations takes the migration lock on behalf of the owner, returning errMigrationLocked
+	// while another instance holds it. The returned function releases the lock
+	LockMigrations(owner string) (unlock func() error, err error)
+}
+
+// pendingMigrations returns the migrations not applied to the storage yet. A storage migrated by
+// a newer build is rejected, as this build cannot tell the format of its records
+func pendingMigrations(backend HashBackend) (schemaRecord, []migration, error) {
+	var schema schemaRecord
+	if _, err := backend.(metadataStore).GetMeta(schemaMetaName, &schema); err != nil {
+		return schema, nil, err
+	}
+	if schema.Version > schemaVersion() {
+		return schema, nil, fmt.Errorf("storage schema version %d is newer than version %d of this build", schema.Version, schemaVersion())
+	}
+	var pending []migration
+	for _, m := range migrations {
+		if m.version > schema.Version {
+			pending = append(pending, m)
+		}
+	}
+	return schema, pending, nil
+}
+
+// migrateStorage applies the pending migrations under the migration lock, waiting for another
+// instance applying them, and returns those applied by this instance
+func migrateStorage(backend HashBackend, instance string) ([]migration, error) {
+	if _, pending, err := pendingMigrations(backend); err != nil || len(pending) == 0 {
+		return nil, err
+	}
+	if locker, ok := backend.(migrationLocker); ok {
+		for waited := false; ; waited = true {
+			unlock, err := locker.LockMigrations(instance)
+			if err == nil {
+				defer unlock()
+				break
+			}
+			if err != errMigrationLocked {
+				return nil, err
+			}
+			if !waited {
+				logf(logLevelInfo, "Waiting for the storage migrations applied by another instance\n")
+			}
+			time.Sleep(migrationLockPoll)
+		}
+	}
+	// Another instance may have applied the migrations while this one waited for the lock
+	schema, pending, err := pendingMigrations(backend)
+	if err != nil {
+		return nil, err
+	}
+	for i, m := range pending {
+		logf(logLevelInfo, "Applying the storage migration %d (%s)\n", m.version, m.name)
+		start := time.Now()
+		if err := m.apply(backend); err != nil {
+			return pending[:i], fmt.Errorf("migration %d (%s): %v", m.version, m.name, err)
+		}
+		schema.Version = m.version
+		schema.Applied = append(schema.Applied, appliedMigration{Version: m.version, Name: m.name, Applied: time.Now().UTC(), Instance: instance})
+		if err := backend.(metadataStore).PutMeta(schemaMetaName, schema); err != nil {
+			return pending[:i], err
+		}
+		logf(logLevelInfo, "Applied the storage migration %d (%s) in %v\n", m.version, m.name, time.Since(start).Round(time.Millisecond))
+	}
+	return pending, nil
+}
+
+// LockMigrations takes the migration lock by creating the lock file, taking over the lock files
+// not refreshed within the lock TTL. The lock file is refreshed until the lock is released
+func (b *FileBackend) LockMigrations(owner string) (func() error, error) {
+	path := filepath.Join(b.dir, migrationLockFile)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if os.IsExist(err) {
+		info, statErr := os.Stat(path)
+		if statErr != nil || time.Since(info.ModTime()) < migrationLockTTL {
+			return nil, errMigrationLocked
+		}
+		logf(logLevelWarn, "Taking over the stale migration lock %s\n", path)
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		f, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if os.IsExist(err) {
+			return nil, errMigrationLocked
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(f, "%s\n", owner)
+	if err := f.Close(); err != nil {
+		os.Remove(path)
+		return nil, err
+	}
+
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(migrationLockTTL / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case now := <-ticker.C:
+				if err := os.Chtimes(path, now, now); err != nil {
+					logf(logLevelError, "Error while refreshing the migration lock: %v\n", err)
+				}
+			}
+		}
+	}()
+	return func() error {
+		close(done)
+		return os.Remove(path)
+	}, nil
+}
+
+// LockMigrations takes the migration lock of the cold tier
+func (b *TieredBackend) LockMigrations(owner string) (func() error, error) {
+	if locker, ok := b.cold.(migrationLocker); ok {
+		return locker.LockMigrations(owner)
+	}
+	return func() error { return nil }, nil
+}
+
+// backfillRecordTiming sets the enqueued and started times of the records stored before they
+// were recorded to the creation time, so that the detailed statistics do not see them as instant
+func backfillRecordTiming(backend HashBackend) error {
+	updates := make(map[uint64]hashRecord)
+	err := backend.Scan(func(id uint64, rec hashRecord) error {
+		if rec.Enqueued.IsZero() || rec.Started.IsZero() {
+			if rec.Enqueued.IsZero() {
+				rec.Enqueued = rec.Created
+			}
+			if rec.Started.IsZero() {
+				rec.Started = rec.Created
+			}
+			updates[id] = rec
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for id, rec := range updates {
+		if err := backend.Put(id, rec); err != nil {
+			return err
+		}
+	}
+	logf(logLevelInfo, "Backfilled the timing of %d records\n", len(updates))
+	return nil
+}
+
+// runMigrate runs the migrate subcommand and returns the exit code. It applies the pending migrations
+// to the storage of the configuration, or only lists them with -dry-run
+func runMigrate(args []string) int {
+	fs := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	dryRun := fs.Bool("dry-run", false, "List the pending migrations without applying them")
+	cfg, err := LoadConfig(fs, args)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "migrate: %v\n", err)
+		return 2
+	}
+	backend, err := NewHashBackend(cfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "migrate: %v\n", err)
+		return 1
+	}
+	defer backend.Close()
+	schema, pending, err := pendingMigrations(backend)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "migrate: %v\n", err)
+		return 1
+	}
+	fmt.Printf("Storage schema version %d, this build %d\n", schema.Version, schemaVersion())
+	if *dryRun {
+		for _, m := range pending {
+			fmt.Printf("Pending: %d %s\n", m.version, m.name)
+		}
+		return 0
+	}
+	applied, err := migrateStorage(backend, cfg.InstanceID)
+	for _, m := range applied {
+		fmt.Printf("Applied: %d %s\n", m.version, m.name)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "migrate: %v\n", err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	mathrand "math/rand"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Mirroring settings not exposed in the configuration
+const (
+	// maxMirroredBody is the largest request body mirrored, the larger requests are served but not mirrored
+	maxMirroredBody = 1 << 20
+	// maxMirrorsInFlight bounds the mirrored requests sent at once, the requests beyond it are not mirrored
+	maxMirrorsInFlight = 64
+	// mirrorTimeout bounds a mirrored request
+	mirrorTimeout = 10 * time.Second
+	// mirroredHeader marks the mirrored requests, so that the target can tell them from its own traffic
+	mirroredHeader = "X-PHS-Mirrored"
+)
+
+// hopHeaders are the hop-by-hop headers not copied to the mirrored requests
+var hopHeaders = []string{"Connection", "Keep-Alive", "Proxy-Authorization", "Te", "Trailer", "Transfer-Encoding", "Upgrade"}
+
+// credentialHeaders carry the credentials of the clients, copied to the mirrored requests only if enabled
+var credentialHeaders = []string{"Authorization", "X-API-Key", "Cookie"}
+
+// RequestMirror copies a share of the POST /hash requests, with their bodies, to a secondary
+// instance, e.g. a canary build, ignoring its responses
+type RequestMirror struct {
+	target  string
+	percent float64
+	client  *http.Client
+	slots   chan struct{}
+	// credentials allows copying the credentials of the clients to the target
+	credentials bool
+
+	sent    *Counter
+	failed  *Counter
+	dropped *Counter
+	// health remembers the outcome of the last mirrored request
+	health healthState
+}
+
+// NewRequestMirror constructs a new instance of the mirror sending percent of the requests to the base URL.
+// The credentials of the clients are stripped from the mirrored requests unless credentials is set
+func NewRequestMirror(baseURL string, percent float64, credentials bool) *RequestMirror {
+	const help = "Number of the requests mirrored to the secondary target"
+	return &RequestMirror{
+		target:      strings.TrimSuffix(baseURL, "/"),
+		percent:     percent,
+		client:      &http.Client{Timeout: mirrorTimeout},
+		slots:       make(chan struct{}, maxMirrorsInFlight),
+		credentials: credentials,
+		sent:        metrics.NewCounter("phs_mirrored_requests_total", help, "result", "sent"),
+		failed:      metrics.NewCounter("phs_mirrored_requests_total", help, "result", "failed"),
+		dropped:     metrics.NewCounter("phs_mirrored_requests_total", help, "result", "dropped"),
+	}
+}
+
+// Mirror sends a copy of the request, if sampled, in the background. The body of the request is
+// read and replaced with an identical one, so that the request can still be served
+func (m *RequestMirror) Mirror(r *http.Request) {
+	if r.Method != http.MethodPost || r.URL.Path != hashRoutePath || mathrand.Float64()*100 >= m.percent {
+		return
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxMirroredBody+1))
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+	if err != nil || len(body) > maxMirroredBody {
+		m.dropped.Inc()
+		return
+	}
+	req, err := http.NewRequest(r.Method, m.target+r.URL.RequestURI(), bytes.NewReader(body))
+	if err != nil {
+		m.failed.Inc()
+		return
+	}
+	req.Header = r.Header.Clone()
+	for _, name := range hopHeaders {
+		req.Header.Del(name)
+	}
+	if !m.credentials {
+		for _, name := range credentialHeaders {
+			req.Header.Del(name)
+		}
+	}
+	req.Header.Set(mirroredHeader, "1")
+	req.Header.Set("X-Forwarded-For", requestSource(r))
+	select {
+	case m.slots <- struct{}{}:
+	default:
+		m.dropped.Inc()
+		return
+	}
+	go func() {
+		defer func() { <-m.slots }()
+		resp, err := m.client.Do(req)
+		m.health.Record(err)
+		if err != nil {
+			logf(logLevelDebug, "Mirror: %v\n", err)
+			m.failed.Inc()
+			return
+		}
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		m.sent.Inc()
+	}()
+}
+
+// mirrorRequests mirrors the sampled requests before serving them
+func (s *HashService) mirrorRequests(m *RequestMirror, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m.Mirror(r)
+		next.ServeHTTP(w, r)
+	})
+}
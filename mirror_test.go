@@ -0,0 +1,105 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// mirroredRequest is the request received by the mirror target
+type mirroredRequest struct {
+	body   string
+	header http.Header
+}
+
+func TestRequestMirrorKeepsBody(t *testing.T) {
+	received := make(chan mirroredRequest, 1)
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		received <- mirroredRequest{body: string(body), header: r.Header}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer target.Close()
+
+	for _, tt := range []struct {
+		name        string
+		body        string
+		credentials bool
+		mirrored    bool
+	}{
+		{name: "form", body: "password=angryMonkey", mirrored: true},
+		{name: "empty", body: "", mirrored: true},
+		{name: "credentials", body: "password=angryMonkey&ttl=60", credentials: true, mirrored: true},
+		{name: "largest", body: "password=" + strings.Repeat("a", maxMirroredBody-len("password=")), mirrored: true},
+		{name: "too large", body: "password=" + strings.Repeat("a", maxMirroredBody), mirrored: false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			m := NewRequestMirror(target.URL, 100, tt.credentials)
+			r := httptest.NewRequest(http.MethodPost, hashRoutePath, strings.NewReader(tt.body))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			r.Header.Set("X-API-Key", "prod.secret")
+			r.Header.Set("Authorization", "Bearer prod.secret")
+			r.Header.Set("Cookie", oidcSessionCookie+"=session")
+			r.Header.Set("Idempotency-Key", "k1")
+			m.Mirror(r)
+
+			served, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				t.Fatalf("reading the served body: %v", err)
+			}
+			if string(served) != tt.body {
+				t.Fatalf("served body of %d bytes, want the original %d bytes", len(served), len(tt.body))
+			}
+			if err := r.Body.Close(); err != nil {
+				t.Fatalf("closing the served body: %v", err)
+			}
+
+			select {
+			case got := <-received:
+				if !tt.mirrored {
+					t.Fatalf("request of %d bytes mirrored", len(tt.body))
+				}
+				if got.body != tt.body {
+					t.Fatalf("mirrored body of %d bytes, want %d bytes", len(got.body), len(tt.body))
+				}
+				if got.header.Get(mirroredHeader) != "1" || got.header.Get("Idempotency-Key") != "k1" {
+					t.Fatalf("mirrored headers %v lack the mirror mark or the idempotency key", got.header)
+				}
+				for _, name := range credentialHeaders {
+					if copied := got.header.Get(name) != ""; copied != tt.credentials {
+						t.Errorf("header %s copied = %v, want %v", name, copied, tt.credentials)
+					}
+				}
+			case <-time.After(time.Second):
+				if tt.mirrored {
+					t.Fatalf("request not mirrored")
+				}
+			}
+		})
+	}
+}
+
+func TestRequestMirrorSkipsOtherRequests(t *testing.T) {
+	m := NewRequestMirror("http://127.0.0.1:1", 100, false)
+	for _, tt := range []struct {
+		method, path string
+	}{
+		{http.MethodGet, hashRoutePath},
+		{http.MethodPost, verifyRoutePath},
+		{http.MethodPost, hashRoutePath + "/1"},
+	} {
+		body := "password=angryMonkey"
+		r := httptest.NewRequest(tt.method, tt.path, strings.NewReader(body))
+		original := r.Body
+		m.Mirror(r)
+		if r.Body != original {
+			t.Errorf("%s %s: body replaced although not mirrored", tt.method, tt.path)
+		}
+		if served, _ := ioutil.ReadAll(r.Body); string(served) != body {
+			t.Errorf("%s %s: served body %q, want %q", tt.method, tt.path, served, body)
+		}
+	}
+}
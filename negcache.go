@@ -0,0 +1,75 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// maxNegativeCacheSize bounds the number of identifiers remembered by the negative cache.
+// The cache is cleared when exceeded
+const maxNegativeCacheSize = 100000
+
+// negativeCache remembers for a short time the identifiers not found in the storage,
+// so that polling the pending or mistyped identifiers does not reach the backend
+type negativeCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[uint64]time.Time
+	// invalidations counts the stored records, so that a lookup racing with a store is not cached
+	invalidations uint64
+	hits          *Counter
+}
+
+// newNegativeCache constructs a new instance of the cache remembering the identifiers for the ttl
+func newNegativeCache(ttl time.Duration) *negativeCache {
+	return &negativeCache{
+		ttl:     ttl,
+		entries: make(map[uint64]time.Time),
+		hits:    metrics.NewCounter("phs_negative_cache_hits_total", "Number of hash lookups answered by the cache of the identifiers not found"),
+	}
+}
+
+// Contains checks whether the identifier has been recently not found
+func (c *negativeCache) Contains(id uint64, now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	expires, ok := c.entries[id]
+	if !ok {
+		return false
+	}
+	if !now.Before(expires) {
+		delete(c.entries, id)
+		return false
+	}
+	c.hits.Inc()
+	return true
+}
+
+// Generation returns the number of the invalidations so far, to be passed to Add
+func (c *negativeCache) Generation() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.invalidations
+}
+
+// Add remembers that the identifier has not been found by the lookup started at the generation,
+// unless a record has been stored since
+func (c *negativeCache) Add(id uint64, now time.Time, generation uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.invalidations != generation {
+		return
+	}
+	if len(c.entries) >= maxNegativeCacheSize {
+		c.entries = make(map[uint64]time.Time)
+	}
+	c.entries[id] = now.Add(c.ttl)
+}
+
+// Invalidate forgets the identifier once its record is stored
+func (c *negativeCache) Invalidate(id uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.invalidations++
+	delete(c.entries, id)
+}
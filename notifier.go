@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// maxWatchAge bounds the time a calculation is watched. The watchers of a calculation pending
+// for longer are sent errWatchExpired, so that they stop waiting
+const maxWatchAge = time.Hour
+
+// maxHashWait bounds the time GET /hash/{id}?wait= holds the request for a pending calculation
+const maxHashWait = 30 * time.Second
+
+// errWatchExpired is sent to the watchers of a calculation still pending after maxWatchAge
+var errWatchExpired = errors.New("the calculation did not complete in time")
+
+// jobSubscription receives on C the completions of the calculations it watches, see HashStorage.WaitPending
+type jobSubscription struct {
+	C  <-chan jobCompletion
+	ch chan jobCompletion
+	// refs counts the watches of the subscription not released yet, the registry holds the subscription
+	// until it is closed and they are all released. A stalled subscription has let a completion drop for
+	// want of room, so its watches are released by the collection. They are guarded by the storage lock
+	refs    int
+	closed  bool
+	stalled bool
+}
+
+// jobNotifier holds the subscriptions watching a pending calculation
+type jobNotifier struct {
+	subs  []*jobSubscription
+	since time.Time
+}
+
+// notifierRegistry holds the notifiers of the watched calculations. The subscriptions are released by
+// reference counting rather than by scanning the notifiers, and the notifiers left behind are collected
+// periodically. It is guarded by the storage lock
+type notifierRegistry struct {
+	notifiers map[uint64]*jobNotifier
+	// watches and subscriptions count the registered watches and the subscriptions held
+	watches       int
+	subscriptions int
+	collected     map[string]*Counter
+	// waits counts the waits for a pending calculation by their outcome
+	waits map[string]*Counter
+}
+
+// newNotifierRegistry constructs a new instance of the registry, exporting its size through the storage
+func newNotifierRegistry(s *HashStorage) *notifierRegistry {
+	n := &notifierRegistry{notifiers: make(map[uint64]*jobNotifier), collected: make(map[string]*Counter), waits: make(map[string]*Counter)}
+	help := "Number of watches of the pending calculations dropped by the periodic collection"
+	for _, reason := range []string{"closed", "stalled", "orphaned", "expired"} {
+		n.collected[reason] = metrics.NewCounter("phs_notifier_collected_total", help, "reason", reason)
+	}
+	help = "Number of the lookups waiting for a pending calculation, by how the wait ended"
+	for _, outcome := range []string{"completed", "timeout", "abandoned"} {
+		n.waits[outcome] = metrics.NewCounter("phs_hash_waits_total", help, "outcome", outcome)
+	}
+	metrics.NewGaugeFunc("phs_notifier_watches", "Number of watches of the pending calculations", func() float64 {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return float64(n.watches)
+	})
+	metrics.NewGaugeFunc("phs_notifier_jobs", "Number of pending calculations being watched", func() float64 {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return float64(len(n.notifiers))
+	})
+	metrics.NewGaugeFunc("phs_notifier_subscriptions", "Number of subscriptions to the completions held, the closed ones until their watches are released", func() float64 {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return float64(n.subscriptions)
+	})
+	return n
+}
+
+// watch adds the subscription to the notifier of the calculation
+func (n *notifierRegistry) watch(id uint64, sub *jobSubscription, now time.Time) {
+	notifier, ok := n.notifiers[id]
+	if !ok {
+		notifier = &jobNotifier{since: now}
+		n.notifiers[id] = notifier
+	}
+	notifier.subs = append(notifier.subs, sub)
+	sub.refs++
+	n.watches++
+}
+
+// release releases a watch of the subscription, and the closed subscription along with its last watch
+func (n *notifierRegistry) release(sub *jobSubscription) {
+	sub.refs--
+	n.watches--
+	if sub.refs == 0 && sub.closed {
+		n.subscriptions--
+	}
+}
+
+// notify sends the completion of the calculation to the subscriptions watching it and drops its notifier.
+// A subscription without room for the completion is marked stalled
+func (n *notifierRegistry) notify(id uint64, err error) {
+	notifier, ok := n.notifiers[id]
+	if !ok {
+		return
+	}
+	delete(n.notifiers, id)
+	for _, sub := range notifier.subs {
+		n.release(sub)
+		if sub.closed {
+			continue
+		}
+		select {
+		case sub.ch <- jobCompletion{ID: id, Err: err}:
+		default:
+			sub.stalled = true
+			logf(logLevelWarn, "Dropped the completion of hash %d for a watcher without room\n", id)
+		}
+	}
+}
+
+// collect drops the watches of the closed and the stalled subscriptions, and the notifiers of the calculations
+// no longer pending, whose completion was missed, or pending for longer than maxWatchAge. It returns the
+// orphaned notifiers, whose watchers the caller sends the outcome found in the storage
+func (n *notifierRegistry) collect(now time.Time, pending func(id uint64) bool) map[uint64][]*jobSubscription {
+	orphaned := make(map[uint64][]*jobSubscription)
+	for id, notifier := range n.notifiers {
+		live := notifier.subs[:0]
+		for _, sub := range notifier.subs {
+			switch {
+			case sub.closed:
+				n.release(sub)
+				n.collected["closed"].Inc()
+			case sub.stalled:
+				n.release(sub)
+				n.collected["stalled"].Inc()
+			default:
+				live = append(live, sub)
+			}
+		}
+		notifier.subs = live
+		switch {
+		case len(live) == 0:
+			delete(n.notifiers, id)
+		case !pending(id):
+			orphaned[id] = live
+			n.collected["orphaned"].Add(uint64(len(live)))
+			for _, sub := range live {
+				n.release(sub)
+			}
+			delete(n.notifiers, id)
+		case now.Sub(notifier.since) >= maxWatchAge:
+			n.collected["expired"].Add(uint64(len(live)))
+			n.notify(id, errWatchExpired)
+		}
+	}
+	return orphaned
+}
+
+// Subscribe opens a subscription to the completions of the calculations with room for size of them.
+// It must be closed with Unsubscribe once its receiver is done
+func (s *HashStorage) Subscribe(size int) *jobSubscription {
+	ch := make(chan jobCompletion, size)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.notifiers.subscriptions++
+	return &jobSubscription{C: ch, ch: ch}
+}
+
+// Unsubscribe closes the subscription. Its watches left are released as their calculations complete,
+// or by the periodic collection, whichever comes first
+func (s *HashStorage) Unsubscribe(sub *jobSubscription) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if sub.closed {
+		return
+	}
+	sub.closed = true
+	if sub.refs == 0 {
+		s.notifiers.subscriptions--
+	}
+}
+
+// Watch registers the subscription to receive the completion of the pending hash calculation. It returns
+// false if the calculation is not pending, e.g. it has completed already. The completion is sent
+// while holding the lock, so the subscription must have room for the completions of all its watches
+func (s *HashStorage) Watch(id uint64, sub *jobSubscription) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.pending[id]; !ok || sub.closed {
+		return false
+	}
+	s.notifiers.watch(id, sub, time.Now())
+	return true
+}
+
+// WaitPending waits until the hash calculation pending on this instance completes, the client goes away
+// or the timeout passes, whichever comes first. It returns at once unless the calculation is pending here.
+// The watch is released on return, so the clients going away leave nothing behind
+func (s *HashStorage) WaitPending(ctx context.Context, id uint64, timeout time.Duration) {
+	sub := s.Subscribe(1)
+	defer s.Unsubscribe(sub)
+	if !s.Watch(id, sub) {
+		return
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-sub.C:
+		s.notifiers.waits["completed"].Inc()
+	case <-timer.C:
+		s.notifiers.waits["timeout"].Inc()
+	case <-ctx.Done():
+		s.notifiers.waits["abandoned"].Inc()
+	}
+}
+
+// notifyLocked sends the completion of the hash calculation to its watchers. The caller must hold the lock
+func (s *HashStorage) notifyLocked(id uint64, err error) {
+	s.notifiers.notify(id, err)
+}
+
+// collectNotifiers collects the watches left behind, sending the watchers of the calculations
+// whose completion was missed their outcome as found in the storage
+func (s *HashStorage) collectNotifiers(now time.Time) {
+	s.mu.Lock()
+	orphaned := s.notifiers.collect(now, func(id uint64) bool {
+		_, ok := s.pending[id]
+		return ok
+	})
+	s.mu.Unlock()
+	for id, subs := range orphaned {
+		_, err := s.GetRecord(id)
+		for _, sub := range subs {
+			select {
+			case sub.ch <- jobCompletion{ID: id, Err: err}:
+			default:
+			}
+		}
+	}
+}
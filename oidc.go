@@ -0,0 +1,398 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+const (
+	oidcSessionCookie = "phs_session"
+	oidcStateCookie   = "phs_oidc_state"
+	// oidcLoginTimeout limits the time between the login redirect and the callback
+	oidcLoginTimeout = 10 * time.Minute
+)
+
+// ErrOIDC is returned when the identity provider response cannot be trusted
+var ErrOIDC = errors.New("OIDC authentication failed")
+
+// oidcProvider is the identity provider metadata taken from its discovery document
+type oidcProvider struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// oidcSession is the signed in admin user
+type oidcSession struct {
+	key     apiKey
+	expires time.Time
+}
+
+// OIDCAuthenticator signs the admin users in with the OIDC authorization code flow.
+// The groups of the user are mapped to the API key scopes. The sessions are kept in
+// memory, so the users sign in to every instance separately and again after a restart
+type OIDCAuthenticator struct {
+	issuer       string
+	clientID     string
+	clientSecret string
+	redirectURL  string
+	groupsClaim  string
+	groupScopes  map[string][]string
+	sessionTTL   time.Duration
+	client       *http.Client
+
+	mu       sync.Mutex
+	provider *oidcProvider
+	keys     map[string]*rsa.PublicKey
+	sessions map[string]oidcSession
+}
+
+// NewOIDCAuthenticator constructs a new instance of the OIDC authenticator from the configuration.
+// The provider discovery document is fetched on the first sign in
+func NewOIDCAuthenticator(cfg *Config) (*OIDCAuthenticator, error) {
+	groupScopes, err := parseGroupScopes(cfg.OIDCGroupScopes)
+	if err != nil {
+		return nil, err
+	}
+	return &OIDCAuthenticator{
+		issuer:       strings.TrimSuffix(cfg.OIDCIssuer, "/"),
+		clientID:     cfg.OIDCClientID,
+		clientSecret: cfg.OIDCClientSecret,
+		redirectURL:  cfg.OIDCRedirectURL,
+		groupsClaim:  cfg.OIDCGroupsClaim,
+		groupScopes:  groupScopes,
+		sessionTTL:   cfg.OIDCSessionTTL,
+		client:       &http.Client{Timeout: 10 * time.Second},
+		keys:         make(map[string]*rsa.PublicKey),
+		sessions:     make(map[string]oidcSession),
+	}, nil
+}
+
+// parseGroupScopes parses the group to scopes mapping given as "group=scope,scope;group=scope"
+func parseGroupScopes(v string) (map[string][]string, error) {
+	mapping := make(map[string][]string)
+	for _, entry := range strings.Split(v, ";") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		i := strings.LastIndex(entry, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid group mapping %q", entry)
+		}
+		scopes := parseScopes(entry[i+1:])
+		if err := validateScopes(scopes); err != nil {
+			return nil, fmt.Errorf("group %q: %v", entry[:i], err)
+		}
+		group := strings.TrimSpace(entry[:i])
+		mapping[group] = append(mapping[group], scopes...)
+	}
+	return mapping, nil
+}
+
+// discover returns the provider metadata, fetching its discovery document if needed
+func (a *OIDCAuthenticator) discover() (*oidcProvider, error) {
+	a.mu.Lock()
+	provider := a.provider
+	a.mu.Unlock()
+	if provider != nil {
+		return provider, nil
+	}
+	provider = &oidcProvider{}
+	if err := a.getJSON(a.issuer+"/.well-known/openid-configuration", provider); err != nil {
+		return nil, err
+	}
+	if strings.TrimSuffix(provider.Issuer, "/") != a.issuer {
+		return nil, fmt.Errorf("discovery document issuer %q does not match %q", provider.Issuer, a.issuer)
+	}
+	a.mu.Lock()
+	a.provider = provider
+	a.mu.Unlock()
+	return provider, nil
+}
+
+// getJSON fetches and decodes the JSON document
+func (a *OIDCAuthenticator) getJSON(u string, v interface{}) error {
+	resp, err := a.client.Get(u)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", u, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// Begin starts the sign in of the user, who returns to the next path afterwards.
+// It returns the provider URL the user is redirected to along with the login state
+// to be kept in a cookie until the callback
+func (a *OIDCAuthenticator) Begin(next string) (loginURL, loginState string, err error) {
+	provider, err := a.discover()
+	if err != nil {
+		return "", "", err
+	}
+	state, err := randomString(16, hex.EncodeToString)
+	if err != nil {
+		return "", "", err
+	}
+	nonce, err := randomString(16, hex.EncodeToString)
+	if err != nil {
+		return "", "", err
+	}
+	q := url.Values{}
+	q.Set("response_type", "code")
+	q.Set("client_id", a.clientID)
+	q.Set("redirect_uri", a.redirectURL)
+	q.Set("scope", "openid profile email")
+	q.Set("state", state)
+	q.Set("nonce", nonce)
+	sep := "?"
+	if strings.Contains(provider.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	loginState = state + "." + nonce + "." + base64.RawURLEncoding.EncodeToString([]byte(localPath(next)))
+	return provider.AuthorizationEndpoint + sep + q.Encode(), loginState, nil
+}
+
+// Finish completes the sign in given the login state and the callback parameters.
+// It returns the new session identifier, the signed in user and the path to return to
+func (a *OIDCAuthenticator) Finish(loginState, state, code string) (sessionID string, key *apiKey, next string, err error) {
+	parts := strings.Split(loginState, ".")
+	if len(parts) != 3 || state != parts[0] || code == "" {
+		return "", nil, "", fmt.Errorf("%w: invalid state", ErrOIDC)
+	}
+	sessionID, key, err = a.exchange(code, parts[1])
+	if err != nil {
+		return "", nil, "", err
+	}
+	b, _ := base64.RawURLEncoding.DecodeString(parts[2])
+	return sessionID, key, localPath(string(b)), nil
+}
+
+// localPath returns the path to return to after the sign in if it stays within the service, else "".
+// The backslashes and the control characters are rejected, since the browsers take "/\host" for "//host"
+func localPath(next string) string {
+	if strings.Contains(next, "\\") || strings.IndexFunc(next, unicode.IsControl) >= 0 {
+		return ""
+	}
+	u, err := url.Parse(next)
+	if err != nil || u.Scheme != "" || u.Host != "" || u.User != nil || !strings.HasPrefix(u.Path, "/") || strings.HasPrefix(next, "//") {
+		return ""
+	}
+	return next
+}
+
+// exchange redeems the authorization code, verifies the ID token and starts a new session.
+// It returns the session identifier along with the signed in user
+func (a *OIDCAuthenticator) exchange(code, nonce string) (string, *apiKey, error) {
+	provider, err := a.discover()
+	if err != nil {
+		return "", nil, err
+	}
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", a.redirectURL)
+	req, err := http.NewRequest(http.MethodPost, provider.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(a.clientID), url.QueryEscape(a.clientSecret))
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return "", nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", nil, fmt.Errorf("%w: token endpoint: %s", ErrOIDC, resp.Status)
+	}
+	var tokens struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tokens); err != nil {
+		return "", nil, err
+	}
+	claims, err := a.verify(provider, tokens.IDToken)
+	if err != nil {
+		return "", nil, err
+	}
+	if n, _ := claims["nonce"].(string); n != nonce {
+		return "", nil, fmt.Errorf("%w: nonce mismatch", ErrOIDC)
+	}
+
+	subject, _ := claims["sub"].(string)
+	key := apiKey{ID: "oidc:" + subject, Created: time.Now().UTC()}
+	key.Name, _ = claims["email"].(string)
+	groups, _ := claims[a.groupsClaim].([]interface{})
+	for _, g := range groups {
+		if group, ok := g.(string); ok {
+			key.Scopes = append(key.Scopes, a.groupScopes[group]...)
+		}
+	}
+	if len(key.Scopes) == 0 {
+		return "", nil, fmt.Errorf("%w: user %s is not a member of any mapped group", ErrOIDC, subject)
+	}
+	expires := key.Created.Add(a.sessionTTL)
+	key.Expires = &expires
+
+	sessionID, err := randomString(32, hex.EncodeToString)
+	if err != nil {
+		return "", nil, err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := time.Now()
+	for id, session := range a.sessions {
+		if now.After(session.expires) {
+			delete(a.sessions, id)
+		}
+	}
+	a.sessions[hashKeySecret(sessionID)] = oidcSession{key: key, expires: expires}
+	return sessionID, &key, nil
+}
+
+// Session returns the signed in user of the session, if it has not expired
+func (a *OIDCAuthenticator) Session(sessionID string) (*apiKey, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	session, ok := a.sessions[hashKeySecret(sessionID)]
+	if !ok || time.Now().After(session.expires) {
+		return nil, false
+	}
+	return &session.key, true
+}
+
+// Logout ends the session
+func (a *OIDCAuthenticator) Logout(sessionID string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.sessions, hashKeySecret(sessionID))
+}
+
+// verify checks the RS256 signature, the issuer, the audience and the expiration
+// of the ID token and returns its claims
+func (a *OIDCAuthenticator) verify(provider *oidcProvider, token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("%w: malformed ID token", ErrOIDC)
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, err
+	}
+	if header.Alg != "RS256" {
+		return nil, fmt.Errorf("%w: unsupported ID token algorithm %q", ErrOIDC, header.Alg)
+	}
+	pub, err := a.publicKey(provider, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed ID token signature", ErrOIDC)
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], sig); err != nil {
+		return nil, fmt.Errorf("%w: invalid ID token signature", ErrOIDC)
+	}
+
+	var claims map[string]interface{}
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	if iss, _ := claims["iss"].(string); strings.TrimSuffix(iss, "/") != a.issuer {
+		return nil, fmt.Errorf("%w: unexpected issuer %q", ErrOIDC, iss)
+	}
+	if !audienceContains(claims["aud"], a.clientID) {
+		return nil, fmt.Errorf("%w: unexpected audience", ErrOIDC)
+	}
+	if exp, _ := claims["exp"].(float64); time.Now().Unix() >= int64(exp) {
+		return nil, fmt.Errorf("%w: ID token expired", ErrOIDC)
+	}
+	return claims, nil
+}
+
+// publicKey returns the provider signing key, refetching the key set for unknown key identifiers
+func (a *OIDCAuthenticator) publicKey(provider *oidcProvider, kid string) (*rsa.PublicKey, error) {
+	a.mu.Lock()
+	pub, ok := a.keys[kid]
+	a.mu.Unlock()
+	if ok {
+		return pub, nil
+	}
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := a.getJSON(provider.JWKSURI, &set); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]*rsa.PublicKey)
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" {
+			continue
+		}
+		n, errN := base64.RawURLEncoding.DecodeString(k.N)
+		e, errE := base64.RawURLEncoding.DecodeString(k.E)
+		if errN != nil || errE != nil {
+			continue
+		}
+		keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+	a.mu.Lock()
+	a.keys = keys
+	a.mu.Unlock()
+	if pub, ok = keys[kid]; !ok {
+		return nil, fmt.Errorf("%w: unknown signing key %q", ErrOIDC, kid)
+	}
+	return pub, nil
+}
+
+// decodeJWTPart decodes the base64url encoded JSON part of the token
+func decodeJWTPart(part string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return fmt.Errorf("%w: malformed ID token", ErrOIDC)
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("%w: malformed ID token", ErrOIDC)
+	}
+	return nil
+}
+
+// audienceContains checks whether the aud claim, either a string or a list, contains the client
+func audienceContains(aud interface{}, clientID string) bool {
+	switch v := aud.(type) {
+	case string:
+		return v == clientID
+	case []interface{}:
+		for _, a := range v {
+			if a == clientID {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,10 @@
+package main
+
+import (
+	_ "embed"
+)
+
+// openAPISpec is the OpenAPI document describing the HTTP API, served at /openapi.json
+//
+//go:embed openapi.json
+var openAPISpec []byte
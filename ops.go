@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net"
+	"net/http"
+)
+
+// opsRoutePaths are the routes of the health checks and the statistics, which are served
+// even when the public requests are being shed, and on the ops listener if configured
+var opsRoutePaths = []string{healthzRoutePath, readyzRoutePath, statsRoutePath, statsDetailedPath, metricsRoutePath}
+
+// isOpsRoute checks whether the request is routed to one of the ops routes
+func isOpsRoute(r *http.Request) bool {
+	for _, path := range opsRoutePaths {
+		if r.URL.Path == path {
+			return true
+		}
+	}
+	return false
+}
+
+// limitConcurrency sheds the requests beyond the configured number of the concurrently served ones,
+// in total and per route class, with 503 Service Unavailable once they wait for the queue timeout.
+// The ops routes are always served
+func (s *HashService) limitConcurrency(next http.Handler) http.Handler {
+	// The configuration has been validated
+	weights, _ := parseRouteValues(s.cfg.RouteWeights)
+	caps, _ := parseRouteValues(s.cfg.RouteCaps)
+	scheduler := newRouteScheduler(s.cfg.MaxConcurrentRequests, weights, caps, s.cfg.QueueTimeout)
+	shed := metrics.NewCounter("phs_http_requests_shed_total", "Number of requests rejected because of too many concurrent requests")
+	metrics.NewGaugeFunc("phs_http_requests_in_flight", "Number of public requests being served", func() float64 {
+		return float64(scheduler.InFlight())
+	})
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isOpsRoute(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		class := routeClass(r)
+		if !scheduler.Acquire(r, class) {
+			shed.Inc()
+			scheduler.classes[class].shed.Inc()
+			logf(logLevelWarn, "Service unavailable: too many concurrent %s requests (%v)\n", class, r.URL)
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "Service unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		defer scheduler.Release(class)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// startOps serves the ops routes registered in the handler on the ops listener
+func (s *HashService) startOps(handler http.Handler) error {
+	lis, err := net.Listen("tcp", s.cfg.OpsAddr)
+	if err != nil {
+		return err
+	}
+	s.listeners.Set("ops", lis.Addr().String())
+	s.opsSrv = &http.Server{Handler: s.recoverPanics(handler)}
+	go func() {
+		if err := s.opsSrv.Serve(lis); err != http.ErrServerClosed {
+			logf(logLevelError, "Ops server: %v\n", err)
+		}
+	}()
+	logf(logLevelInfo, "Serving health checks and statistics on %s\n", s.cfg.OpsAddr)
+	return nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime/debug"
+	"strings"
+)
+
+// maxPanicBodyCapture is the most of the request body kept to be scrubbed from the panic reports
+const maxPanicBodyCapture = 1 << 20
+
+// panicSecretFields are the form and query fields whose values are always scrubbed from the panic
+// reports, whatever their length
+var panicSecretFields = []string{"password", "passwords[]", "salt", "token", "secret"}
+
+// minPanicSecretLen is the length from which the values of the other fields are scrubbed, the shorter
+// ones such as the record identifiers would mangle the addresses in the stack trace instead
+const minPanicSecretLen = 4
+
+var panicsTotal = metrics.NewCounter("phs_panics_total", "Number of panics recovered, reported with the request data scrubbed")
+
+// bodyRecorder keeps a copy of the request body read by the handler, so that it can be scrubbed
+// from the panic report, whatever the handler did with it
+type bodyRecorder struct {
+	io.ReadCloser
+	data []byte
+}
+
+// Read reads from the body, keeping up to maxPanicBodyCapture bytes
+func (b *bodyRecorder) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if room := maxPanicBodyCapture - len(b.data); room > 0 {
+		if room > n {
+			room = n
+		}
+		b.data = append(b.data, p[:room]...)
+	}
+	return n, err
+}
+
+// requestSecrets returns the data submitted with the request that a panic report must not carry:
+// the raw body, and the values of the form fields of the body and the query, decoded
+func requestSecrets(r *http.Request, body []byte) []string {
+	var secrets []string
+	if len(body) > 0 {
+		secrets = append(secrets, string(body))
+	}
+	values := r.URL.Query()
+	if form, err := url.ParseQuery(string(body)); err == nil {
+		for k, v := range form {
+			values[k] = append(values[k], v...)
+		}
+	}
+	for _, name := range panicSecretFields {
+		secrets = append(secrets, values[name]...)
+		delete(values, name)
+	}
+	for _, v := range values {
+		for _, value := range v {
+			if len(value) >= minPanicSecretLen {
+				secrets = append(secrets, value)
+			}
+		}
+	}
+	return secrets
+}
+
+// scrubPanic formats the panic report of the value and the stack with the secrets and the password
+// fields replaced by redactedValue. The longest secrets go first, so that the body is redacted
+// as a whole before the values it contains
+func scrubPanic(p interface{}, stack []byte, secrets []string) string {
+	report := fmt.Sprintf("%v\n%s", p, stack)
+	for done := false; !done; {
+		done = true
+		longest := -1
+		for i, secret := range secrets {
+			if secret != "" && strings.Contains(report, secret) && (longest < 0 || len(secret) > len(secrets[longest])) {
+				longest = i
+			}
+		}
+		if longest >= 0 {
+			report = strings.Replace(report, secrets[longest], redactedValue, -1)
+			done = false
+		}
+	}
+	return logSecretPattern.ReplaceAllString(report, "$1="+redactedValue)
+}
+
+// recoverPanics recovers the panics of the handlers and logs them scrubbed of the request data,
+// rather than letting the HTTP server log the panic value verbatim. All the routes go through it,
+// so a handler cannot leak the submitted passwords in a stack dump
+func (s *HashService) recoverPanics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body *bodyRecorder
+		if r.Body != nil && r.Body != http.NoBody {
+			body = &bodyRecorder{ReadCloser: r.Body}
+			r.Body = body
+		}
+		defer func() {
+			p := recover()
+			if p == nil {
+				return
+			}
+			if p == http.ErrAbortHandler {
+				// The deliberate aborts, e.g. of the proxied responses, are not logged by the server either
+				panic(p)
+			}
+			panicsTotal.Inc()
+			var data []byte
+			if body != nil {
+				data = body.data
+			}
+			logf(logLevelError, "%s %s: Panic: %s\n", r.Method, r.URL.Path, scrubPanic(p, debug.Stack(), requestSecrets(r, data)))
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// crashScrubbed reports the panic of a background goroutine scrubbed of the secrets and exits the
+// process, as the runtime would after printing the panic value verbatim. It is deferred as
+// defer func() { crashScrubbed(recover(), secrets) }()
+func crashScrubbed(p interface{}, secrets ...string) {
+	if p == nil {
+		return
+	}
+	logf(logLevelError, "Panic: %s\n", scrubPanic(p, debug.Stack(), secrets))
+	os.Exit(2)
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// algorithmSHA512 names the legacy hash calculated by the service, whose records have no algorithm set
+const algorithmSHA512 = "sha512"
+
+// workerPool is a set of workers calculating the hashes of one or more algorithms from their own queue,
+// so that the saturation of one pool does not hold the jobs of the others
+type workerPool struct {
+	name      string
+	workers   int
+	queueSize int
+	jobs      chan hashJob
+	// pending is the number of the jobs queued or being calculated, guarded by the storage lock
+	pending int
+}
+
+// parseAlgorithmPools parses the dedicated pools given as "algorithm=workers:queue;...",
+// e.g. "bcrypt=2:1000;pbkdf2=4:5000". Only the algorithms calculated by the service may be given
+func parseAlgorithmPools(v string) (map[string]*workerPool, error) {
+	pools := make(map[string]*workerPool)
+	for _, entry := range strings.Split(v, ";") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		i := strings.Index(entry, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("invalid algorithm pool %q", entry)
+		}
+		name := strings.TrimSpace(entry[:i])
+		switch name {
+		case algorithmSHA512, algorithmPBKDF2, algorithmBcrypt:
+		default:
+			return nil, fmt.Errorf("algorithm pool %s: the service does not calculate such hashes", name)
+		}
+		if _, ok := pools[name]; ok {
+			return nil, fmt.Errorf("duplicate algorithm pool %q", name)
+		}
+		parts := strings.Split(entry[i+1:], ":")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("algorithm pool %s: expected workers:queue", name)
+		}
+		workers, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+		if err != nil || workers < 1 {
+			return nil, fmt.Errorf("algorithm pool %s: invalid number of workers %q", name, parts[0])
+		}
+		queueSize, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+		if err != nil || queueSize < 1 {
+			return nil, fmt.Errorf("algorithm pool %s: invalid queue size %q", name, parts[1])
+		}
+		pools[name] = &workerPool{name: name, workers: workers, queueSize: queueSize}
+	}
+	return pools, nil
+}
+
+// startPools starts the workers of the shared pool and of the dedicated pools of the algorithms
+func (s *HashStorage) startPools(cfg *Config) error {
+	pools, err := parseAlgorithmPools(cfg.AlgorithmPools)
+	if err != nil {
+		return err
+	}
+	s.shared = &workerPool{name: "shared", workers: cfg.Workers, queueSize: cfg.QueueSize}
+	s.pools = pools
+	for _, p := range append(s.poolList(), s.shared) {
+		p := p
+		p.jobs = make(chan hashJob, p.queueSize)
+		for i := 0; i < p.workers; i++ {
+			s.workersWg.Add(1)
+			go s.worker(p)
+		}
+		metrics.NewGaugeFunc("phs_pool_pending_jobs", "Number of hash calculations queued or running in the worker pool", func() float64 {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			return float64(p.pending)
+		}, "pool", p.name)
+		metrics.NewGaugeFunc("phs_pool_workers", "Number of workers of the worker pool", func() float64 {
+			return float64(p.workers)
+		}, "pool", p.name)
+		if p != s.shared {
+			logf(logLevelInfo, "Hashes with %s calculated by %d workers queueing up to %d\n", p.name, p.workers, p.queueSize)
+		}
+	}
+	return nil
+}
+
+// poolUsage reports the pending jobs of a worker pool
+type poolUsage struct {
+	Name      string
+	Pending   int
+	QueueSize int
+	Workers   int
+}
+
+// PoolUsage reports the pending jobs of the shared pool followed by those of the dedicated pools
+func (s *HashStorage) PoolUsage() []poolUsage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	usage := []poolUsage{{Name: s.shared.name, Pending: s.shared.pending, QueueSize: s.shared.queueSize, Workers: s.shared.workers}}
+	for _, p := range s.poolList() {
+		usage = append(usage, poolUsage{Name: p.name, Pending: p.pending, QueueSize: p.queueSize, Workers: p.workers})
+	}
+	return usage
+}
+
+// poolList returns the dedicated pools ordered by their names
+func (s *HashStorage) poolList() []*workerPool {
+	list := make([]*workerPool, 0, len(s.pools))
+	for _, p := range s.pools {
+		list = append(list, p)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].name < list[j].name })
+	return list
+}
+
+// poolOf returns the pool calculating the hashes of the algorithm, the shared one unless dedicated
+func (s *HashStorage) poolOf(algorithm string) *workerPool {
+	if p, ok := s.pools[algorithm]; ok {
+		return p
+	}
+	return s.shared
+}
+
+// closePools stops the workers of all the pools once they have drained their queues
+func (s *HashStorage) closePools() {
+	for _, p := range append(s.poolList(), s.shared) {
+		close(p.jobs)
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// configProfilePrefix starts the configuration file keys defining the profiles
+const configProfilePrefix = "profile."
+
+// configProfile is a named set of settings applied on top of the profile it inherits.
+// The profiles inheriting none are applied on top of the defaults
+type configProfile struct {
+	inherits string
+	settings map[string]string
+	// keys keeps the order of the settings, so that the errors are reported deterministically
+	keys []string
+}
+
+// set adds the setting to the profile, replacing the previous value if any
+func (p *configProfile) set(key, value string) {
+	if _, ok := p.settings[key]; !ok {
+		p.keys = append(p.keys, key)
+	}
+	p.settings[key] = value
+}
+
+// newConfigProfile constructs the profile inheriting the given one with the settings
+// listed as key and value pairs
+func newConfigProfile(inherits string, kv ...string) *configProfile {
+	p := &configProfile{inherits: inherits, settings: make(map[string]string)}
+	for i := 0; i+1 < len(kv); i += 2 {
+		p.set(kv[i], kv[i+1])
+	}
+	return p
+}
+
+// builtinConfigProfiles returns the profiles available without a configuration file
+func builtinConfigProfiles() map[string]*configProfile {
+	return map[string]*configProfile{
+		// dev serves the hashes right away without authentication for the local iteration
+		"dev": newConfigProfile("",
+			"hash_delay", "0s",
+			"auth", "false",
+			"storage_backend", "memory",
+			"log_level", "debug",
+		),
+		// prod keeps the records and the API keys on the disk and drains the traffic on shutdown
+		"prod": newConfigProfile("",
+			"auth", "true",
+			"storage_backend", "file",
+			"shutdown_delay", "5s",
+			"log_level", "info",
+		),
+		"staging": newConfigProfile("prod",
+			"log_level", "debug",
+		),
+	}
+}
+
+// isProfileEntry checks whether the configuration file entry defines a profile
+func isProfileEntry(e configEntry) bool {
+	return strings.HasPrefix(e.key, configProfilePrefix)
+}
+
+// addProfileEntry adds the "profile.<name>.<key>: value" configuration file entry to the profiles.
+// The "profile.<name>.inherits" key names the inherited profile
+func addProfileEntry(profiles map[string]*configProfile, e configEntry) error {
+	parts := strings.SplitN(strings.TrimPrefix(e.key, configProfilePrefix), ".", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return fmt.Errorf("%s: expected \"profile.<name>.<key>\"", e.pos)
+	}
+	name, key := parts[0], parts[1]
+	p, ok := profiles[name]
+	if !ok {
+		p = newConfigProfile("")
+		profiles[name] = p
+	}
+	if key == "inherits" {
+		p.inherits = e.value
+		return nil
+	}
+	if _, ok := findConfigSetting(key); !ok {
+		return fmt.Errorf("%s: unknown setting %q", e.pos, key)
+	}
+	p.set(key, e.value)
+	return nil
+}
+
+// applyConfigProfile applies the settings of the named profile, after those of the profiles it inherits
+func applyConfigProfile(c *Config, profiles map[string]*configProfile, name string) error {
+	var chain []*configProfile
+	seen := make(map[string]bool)
+	for n := name; n != ""; n = profiles[n].inherits {
+		if seen[n] {
+			return fmt.Errorf("profile %q inherits itself", n)
+		}
+		seen[n] = true
+		if _, ok := profiles[n]; !ok {
+			return fmt.Errorf("unknown profile %q", n)
+		}
+		chain = append(chain, profiles[n])
+	}
+	for i := len(chain) - 1; i >= 0; i-- {
+		for _, key := range chain[i].keys {
+			cs, _ := findConfigSetting(key)
+			if err := cs.set(c, chain[i].settings[key]); err != nil {
+				return fmt.Errorf("profile %q: %s: %v", name, key, err)
+			}
+		}
+	}
+	return nil
+}
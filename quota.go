@@ -0,0 +1,73 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"time"
+)
+
+// quotaInfo reports the limits of the caller on the quota route
+type quotaInfo struct {
+	KeyID     string          `json:"key_id,omitempty"`
+	Tenant    string          `json:"tenant,omitempty"`
+	Scopes    []string        `json:"scopes,omitempty"`
+	Expires   *time.Time      `json:"expires,omitempty"`
+	RateLimit *rateLimitQuota `json:"rate_limit,omitempty"`
+	Records   *recordsQuota   `json:"records,omitempty"`
+}
+
+// rateLimitQuota is the state of the rate limit bucket of the caller
+type rateLimitQuota struct {
+	// Limit and Burst are the configured requests per second and the bucket size
+	Limit float64 `json:"limit"`
+	Burst int     `json:"burst"`
+	// Remaining is the number of the requests the caller may send right away
+	Remaining int `json:"remaining"`
+	// NextRequest is when the next request is allowed if none remain, Reset when the bucket is full again
+	NextRequest time.Time `json:"next_request"`
+	Reset       time.Time `json:"reset"`
+	// Shared is set when the bucket is kept in Redis for all the replicas, rather than by this instance
+	Shared bool `json:"shared"`
+}
+
+// recordsQuota counts the records of the tenant of the caller on this instance
+type recordsQuota struct {
+	Created  uint64 `json:"created"`
+	Verified uint64 `json:"verified"`
+	Deleted  uint64 `json:"deleted"`
+	// Stored is the number of the records created less those deleted; the expired records are not subtracted
+	Stored uint64 `json:"stored"`
+}
+
+// quota returns the limits of the caller of the request
+func (s *HashService) quota(r *http.Request, now time.Time) quotaInfo {
+	var info quotaInfo
+	key := requestAPIKey(r)
+	if key != nil {
+		info.KeyID, info.Tenant, info.Scopes, info.Expires = key.ID, key.Tenant, key.Scopes, key.Expires
+	}
+	if s.limiter != nil {
+		tokens, shared := s.limiter.Remaining(rateLimitClient(r), now)
+		q := &rateLimitQuota{
+			Limit:     s.limiter.rate,
+			Burst:     int(s.limiter.burst),
+			Remaining: int(math.Floor(tokens)),
+			Reset:     now.Add(time.Duration((s.limiter.burst - tokens) / s.limiter.rate * float64(time.Second))).UTC(),
+			Shared:    shared,
+		}
+		q.NextRequest = now.UTC()
+		if tokens < 1 {
+			q.NextRequest = now.Add(time.Duration((1 - tokens) / s.limiter.rate * float64(time.Second))).UTC()
+		}
+		info.RateLimit = q
+	}
+	if s.tenants != nil && info.Tenant != "" {
+		counts := s.tenants.Get(info.Tenant)[info.Tenant]
+		q := &recordsQuota{Created: counts.Created, Verified: counts.Verified, Deleted: counts.Deleted}
+		if counts.Created > counts.Deleted {
+			q.Stored = counts.Created - counts.Deleted
+		}
+		info.Records = q
+	}
+	return info
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"crypto/tls"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Rate limiter settings not exposed in the configuration
+const (
+	// rateLimitRedisPrefix prefixes the keys of the token buckets in Redis
+	rateLimitRedisPrefix = "phs:ratelimit:"
+	// rateLimitRetryInterval is the time the limiter keeps to the local buckets after a Redis failure
+	rateLimitRetryInterval = 5 * time.Second
+)
+
+// rateLimitScript takes a token from the bucket in Redis, refilling it at ARGV[1] tokens per second
+// up to ARGV[2] tokens. The time of the Redis server is used, so that the replicas agree on it
+const rateLimitScript = `
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local t = redis.call('TIME')
+local now = tonumber(t[1]) + tonumber(t[2]) / 1000000
+local b = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+local tokens = tonumber(b[1]) or burst
+local ts = tonumber(b[2]) or now
+tokens = math.min(burst, tokens + math.max(0, now - ts) * rate)
+local allowed = 0
+if tokens >= 1 then
+  tokens = tokens - 1
+  allowed = 1
+end
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'ts', tostring(now))
+redis.call('PEXPIRE', KEYS[1], math.ceil(burst / rate * 1000) + 1000)
+return allowed
+`
+
+// rateLimitPeekScript returns the tokens left in the bucket in Redis, refilled up to the current time
+const rateLimitPeekScript = `
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local t = redis.call('TIME')
+local now = tonumber(t[1]) + tonumber(t[2]) / 1000000
+local b = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+local tokens = tonumber(b[1]) or burst
+local ts = tonumber(b[2]) or now
+return tostring(math.min(burst, tokens + math.max(0, now - ts) * rate))
+`
+
+// tokenBucket is a local token bucket
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// RateLimiter limits the requests of every API key, or of every client address without the
+// authentication, with token buckets. The buckets are kept in Redis, if configured, so that the
+// limits hold across the replicas and the restarts, and locally while Redis is unavailable
+type RateLimiter struct {
+	rate  float64
+	burst float64
+	redis *redisClient
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+	// fallbackUntil is the time until which the local buckets are used after a Redis failure
+	fallbackUntil time.Time
+	fallback      int32
+
+	limited     *Counter
+	redisErrors *Counter
+}
+
+// NewRateLimiter constructs a new instance of the limiter allowing rate requests per second with
+// bursts of up to burst requests, keeping the buckets in the Redis server at redisAddr unless empty,
+// connected to with redisTLS if set
+func NewRateLimiter(rate float64, burst int, redisAddr string, redisTimeout time.Duration, redisTLS *tls.Config) (*RateLimiter, error) {
+	l := &RateLimiter{
+		rate:        rate,
+		burst:       float64(burst),
+		buckets:     make(map[string]*tokenBucket),
+		limited:     metrics.NewCounter("phs_rate_limited_requests_total", "Number of requests rejected by the rate limiter"),
+		redisErrors: metrics.NewCounter("phs_rate_limit_redis_errors_total", "Number of failed Redis calls of the rate limiter"),
+	}
+	if redisAddr != "" {
+		var err error
+		if l.redis, err = newRedisClient(redisAddr, redisTimeout, redisTLS); err != nil {
+			return nil, err
+		}
+		metrics.NewGaugeFunc("phs_rate_limit_fallback", "Whether the rate limiter uses the local buckets because Redis is unavailable (1) or not (0)", func() float64 {
+			return float64(atomic.LoadInt32(&l.fallback))
+		})
+	}
+	return l, nil
+}
+
+// Allow takes a token from the bucket of the client, reporting whether the request may proceed
+func (l *RateLimiter) Allow(client string, now time.Time) bool {
+	if l.redis != nil && !l.fallingBack(now) {
+		reply, err := l.redis.Do("EVAL", rateLimitScript, "1", rateLimitRedisPrefix+client,
+			strconv.FormatFloat(l.rate, 'g', -1, 64), strconv.FormatFloat(l.burst, 'g', -1, 64))
+		if err == nil {
+			allowed, ok := reply.(int64)
+			if ok {
+				return allowed == 1
+			}
+			err = errRedisProtocol
+		}
+		l.redisErrors.Inc()
+		l.startFallback(now, err)
+	}
+	return l.allowLocal(client, now)
+}
+
+// Remaining returns the tokens left in the bucket of the client without taking any, and whether
+// they come from the buckets shared in Redis
+func (l *RateLimiter) Remaining(client string, now time.Time) (tokens float64, shared bool) {
+	if l.redis != nil && !l.fallingBack(now) {
+		reply, err := l.redis.Do("EVAL", rateLimitPeekScript, "1", rateLimitRedisPrefix+client,
+			strconv.FormatFloat(l.rate, 'g', -1, 64), strconv.FormatFloat(l.burst, 'g', -1, 64))
+		if err == nil {
+			s, ok := reply.(string)
+			if !ok {
+				err = errRedisProtocol
+			} else if tokens, err = strconv.ParseFloat(s, 64); err == nil {
+				return tokens, true
+			}
+		}
+		l.redisErrors.Inc()
+		l.startFallback(now, err)
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b, ok := l.buckets[client]
+	if !ok {
+		return l.burst, false
+	}
+	return math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate), false
+}
+
+// fallingBack checks whether the local buckets are used, ending the fallback once the retry interval passes
+func (l *RateLimiter) fallingBack(now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.fallbackUntil.IsZero() {
+		return false
+	}
+	if now.Before(l.fallbackUntil) {
+		return true
+	}
+	l.fallbackUntil = time.Time{}
+	atomic.StoreInt32(&l.fallback, 0)
+	logf(logLevelInfo, "Rate limiter: Retrying Redis\n")
+	return false
+}
+
+// startFallback switches to the local buckets for the retry interval
+func (l *RateLimiter) startFallback(now time.Time, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.fallbackUntil.IsZero() {
+		logf(logLevelWarn, "Rate limiter: Falling back to the local limits: %v\n", err)
+	}
+	l.fallbackUntil = now.Add(rateLimitRetryInterval)
+	atomic.StoreInt32(&l.fallback, 1)
+}
+
+// allowLocal takes a token from the local bucket of the client
+func (l *RateLimiter) allowLocal(client string, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b, ok := l.buckets[client]
+	if !ok {
+		if len(l.buckets) >= maxTrackedSources {
+			l.buckets = make(map[string]*tokenBucket)
+		}
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[client] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// RetryAfter returns the seconds until the next token of an empty bucket
+func (l *RateLimiter) RetryAfter() string {
+	return strconv.Itoa(int(math.Ceil(1 / l.rate)))
+}
+
+// rateLimitClient returns the bucket of the request: that of its API key, or of its source without the authentication
+func rateLimitClient(r *http.Request) string {
+	if key := requestAPIKey(r); key != nil {
+		return "key:" + key.ID
+	}
+	return "source:" + requestSource(r)
+}
+
+// limitRate rejects the requests exceeding the rate limit of their API key, or of their
+// source without the authentication, with 429 Too Many Requests. The ops routes are not limited
+func (s *HashService) limitRate(w http.ResponseWriter, r *http.Request) bool {
+	if s.limiter == nil || isOpsRoute(r) {
+		return true
+	}
+	client := rateLimitClient(r)
+	if s.limiter.Allow(client, time.Now()) {
+		return true
+	}
+	s.limiter.limited.Inc()
+	logf(logLevelDebug, "Too many requests: %s exceeded the rate limit (%v)\n", client, r.URL)
+	w.Header().Set("Retry-After", s.limiter.RetryAfter())
+	http.Error(w, "Too many requests", http.StatusTooManyRequests)
+	return false
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// version is the version of the binary, set with -ldflags "-X main.version=..."
+var version = ""
+
+// binaryVersion returns the version of the binary, falling back to the module version
+func binaryVersion() string {
+	if version != "" {
+		return version
+	}
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" {
+		return info.Main.Version
+	}
+	return "(devel)"
+}
+
+// readiness describes the started instance in the readiness file
+type readiness struct {
+	PID        int               `json:"pid"`
+	Instance   string            `json:"instance"`
+	Version    string            `json:"version"`
+	Addresses  map[string]string `json:"addresses"`
+	ConfigHash string            `json:"config_hash"`
+	// Role is primary, replica, or standby until the standby promotes itself
+	Role    string    `json:"role"`
+	Started time.Time `json:"started"`
+}
+
+// listenerAddrs holds the addresses the listeners are bound to, by the listener name
+type listenerAddrs struct {
+	mu    sync.Mutex
+	addrs map[string]string
+}
+
+// Set records the address the listener is bound to
+func (l *listenerAddrs) Set(name, addr string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.addrs == nil {
+		l.addrs = make(map[string]string)
+	}
+	l.addrs[name] = addr
+}
+
+// All returns the addresses by the listener name
+func (l *listenerAddrs) All() map[string]string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	addrs := make(map[string]string, len(l.addrs))
+	for name, addr := range l.addrs {
+		addrs[name] = addr
+	}
+	return addrs
+}
+
+// configHash returns the SHA256 of the redacted configuration, telling whether two instances run
+// with the same settings. The secrets are redacted, so the hash does not allow guessing them
+func configHash(cfg *Config) string {
+	settings := cfg.Redacted()
+	keys := make([]string, 0, len(settings))
+	for key := range settings {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	h := sha256.New()
+	for _, key := range keys {
+		h.Write([]byte(key + "=" + settings[key] + "\n"))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// role returns the role of the instance reported in the readiness file
+func (s *HashService) role() string {
+	switch {
+	case !s.isReplica():
+		return "primary"
+	case s.cfg.StandbyOf != "":
+		return "standby"
+	default:
+		return "replica"
+	}
+}
+
+// readiness describes the instance in the readiness file
+func (s *HashService) readiness() readiness {
+	return readiness{
+		PID:        os.Getpid(),
+		Instance:   s.cfg.InstanceID,
+		Version:    binaryVersion(),
+		Addresses:  s.listeners.All(),
+		ConfigHash: configHash(s.cfg),
+		Role:       s.role(),
+		Started:    s.storage.Recovery().Started,
+	}
+}
+
+// announceStartup logs the startup banner and writes the readiness file, if configured,
+// once all the listeners are bound
+func (s *HashService) announceStartup() error {
+	ready := s.readiness()
+	names := make([]string, 0, len(ready.Addresses))
+	for name, addr := range ready.Addresses {
+		names = append(names, name+"="+addr)
+	}
+	sort.Strings(names)
+	logf(logLevelInfo, "Password hash service %s started (pid %d, config %.12s) as %s on %s\n",
+		ready.Version, ready.PID, ready.ConfigHash, ready.Role, strings.Join(names, " "))
+	return s.register(ready)
+}
+
+// register writes the readiness file and sends the readiness document to the registration URL, if configured
+func (s *HashService) register(ready readiness) error {
+	if s.cfg.RegistrationURL != "" {
+		// The instance keeps serving if the registry is down, the registration is retried on the next change
+		if err := putRegistration(s.cfg.RegistrationURL, ready); err != nil {
+			logf(logLevelWarn, "Registration at %s: %v\n", s.cfg.RegistrationURL, err)
+		}
+	}
+	if s.cfg.ReadinessFile == "" {
+		return nil
+	}
+	return writeFileAtomic(filepath.Dir(s.cfg.ReadinessFile), s.cfg.ReadinessFile, ready)
+}
+
+// putRegistration PUTs the readiness document to the service registry
+func putRegistration(registryURL string, ready readiness) error {
+	body, err := json.Marshal(ready)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPut, registryURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("registry answered %s", resp.Status)
+	}
+	return nil
+}
+
+// removeReadinessFile removes the readiness file, if configured, once the instance stops serving
+func (s *HashService) removeReadinessFile() {
+	if s.cfg.ReadinessFile == "" {
+		return
+	}
+	if err := os.Remove(s.cfg.ReadinessFile); err != nil && !os.IsNotExist(err) {
+		logf(logLevelWarn, "Error while removing the readiness file: %v\n", err)
+	}
+}
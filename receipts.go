@@ -0,0 +1,171 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// receiptKey is a key of the receipts published for their verification
+type receiptKey struct {
+	id  string
+	pub ed25519.PublicKey
+}
+
+// receiptClaims are the claims signed by a submission receipt
+type receiptClaims struct {
+	Issuer string `json:"iss"`
+	// ID is the identifier of the accepted hash, Tenant the tenant it was accepted for, if any
+	ID     uint64 `json:"id"`
+	Tenant string `json:"tenant,omitempty"`
+	// IssuedAt is the time the request was accepted, in seconds since the epoch
+	IssuedAt int64 `json:"iat"`
+	// RequestHash is the digest of the request, see receiptRequestHash
+	RequestHash string `json:"request_hash"`
+}
+
+// ReceiptSigner signs the receipts proving the acceptance of the hash requests as compact JWS
+// with Ed25519 (EdDSA), which the clients can verify against the published keys
+type ReceiptSigner struct {
+	issuer string
+	key    ed25519.PrivateKey
+	// keys are the published keys, the signing one first followed by the retired ones
+	keys []receiptKey
+}
+
+// NewReceiptSigner constructs a new instance of the signer from the comma separated key files,
+// the first key signing the receipts and the others only published to verify the older ones
+func NewReceiptSigner(cfg *Config) (*ReceiptSigner, error) {
+	s := &ReceiptSigner{issuer: cfg.InstanceID}
+	for i, file := range strings.Split(cfg.ReceiptKeys, ",") {
+		key, err := loadEd25519Key(strings.TrimSpace(file))
+		if err != nil {
+			return nil, err
+		}
+		pub := key.Public().(ed25519.PublicKey)
+		if i == 0 {
+			s.key = key
+		}
+		s.keys = append(s.keys, receiptKey{id: receiptKeyID(pub), pub: pub})
+	}
+	logf(logLevelInfo, "Signing the receipts with the key %s\n", s.keys[0].id)
+	return s, nil
+}
+
+// loadEd25519Key loads the Ed25519 private key from the PKCS#8 PEM file,
+// as generated by openssl genpkey -algorithm ed25519
+func loadEd25519Key(file string) (ed25519.PrivateKey, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found in %s", file)
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	key, ok := parsed.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: not an Ed25519 key", file)
+	}
+	return key, nil
+}
+
+// receiptKeyID derives the key identifier from the public key, so that it needs no configuration
+func receiptKeyID(pub ed25519.PublicKey) string {
+	sum := sha256.Sum256(pub)
+	return base64.RawURLEncoding.EncodeToString(sum[:8])
+}
+
+// Sign returns the receipt of the hash accepted at the given time for the tenant
+func (s *ReceiptSigner) Sign(id uint64, tenant string, accepted time.Time, requestHash string) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": "EdDSA", "kid": s.keys[0].id, "typ": "phs-receipt+jwt"})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(receiptClaims{Issuer: s.issuer, ID: id, Tenant: tenant, IssuedAt: accepted.Unix(), RequestHash: requestHash})
+	if err != nil {
+		return "", err
+	}
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(ed25519.Sign(s.key, []byte(signed))), nil
+}
+
+// JWKS returns the published keys as a JSON Web Key Set
+func (s *ReceiptSigner) JWKS() map[string]interface{} {
+	keys := make([]map[string]string, 0, len(s.keys))
+	for _, k := range s.keys {
+		keys = append(keys, map[string]string{
+			"kty": "OKP",
+			"crv": "Ed25519",
+			"alg": "EdDSA",
+			"use": "sig",
+			"kid": k.id,
+			"x":   base64.RawURLEncoding.EncodeToString(k.pub),
+		})
+	}
+	return map[string]interface{}{"keys": keys}
+}
+
+// receiptRequestHash returns the digest of the hash request covered by its receipt: the hex SHA-256 of
+// the request line, the idempotency key and the sorted form fields, each on its own line.
+// The passwords are left out, since a fast digest of them would let the holder of the receipt guess them
+func receiptRequestHash(r *http.Request) string {
+	form := url.Values{}
+	for name, values := range r.Form {
+		if name != "password" && name != "passwords[]" {
+			form[name] = values
+		}
+	}
+	canonical := strings.Join([]string{
+		r.Method + " " + r.URL.Path,
+		"idempotency-key=" + url.QueryEscape(r.Header.Get("Idempotency-Key")),
+		form.Encode(),
+	}, "\n")
+	sum := sha256.Sum256([]byte(canonical))
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// wantsReceipt reports whether the request asks for the receipts of its hashes with the receipt field.
+// It returns an error if it does while no receipt key is configured
+func (s *HashService) wantsReceipt(r *http.Request) (bool, error) {
+	v := r.FormValue("receipt")
+	if v == "" {
+		return false, nil
+	}
+	want, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, policyViolation("invalid receipt %q", v)
+	}
+	if want && s.receipts == nil {
+		return false, policyViolation("receipts are not enabled")
+	}
+	return want, nil
+}
+
+// signReceipts signs the receipts of the hashes accepted by the request at the given time
+func (s *HashService) signReceipts(r *http.Request, ids []hashIdentifier, accepted time.Time) error {
+	requestHash := receiptRequestHash(r)
+	for i := range ids {
+		receipt, err := s.receipts.Sign(ids[i].ID, contextTenant(r.Context()), accepted, requestHash)
+		if err != nil {
+			return err
+		}
+		ids[i].Receipt = receipt
+	}
+	return nil
+}
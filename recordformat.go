@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// recordFormatVersion is the version of the encoding of the records written by this build.
+// A change of the encoding gets a new version and a decoder of the previous one in recordDecoders,
+// so that the records stored by the earlier builds are read as they are, without rewriting them
+const recordFormatVersion = 1
+
+// recordFields has the fields of hashRecord without its JSON methods
+type recordFields hashRecord
+
+// recordDecoders decode the records of every format version up to the current one
+var recordDecoders = map[int]func(data []byte) (hashRecord, error){
+	// The records written before the versioning have no format field, and their layout is that of version 1
+	0: decodeRecordV1,
+	1: decodeRecordV1,
+}
+
+// recordFormatError is returned for the records written by a newer build in a format unknown to this one
+type recordFormatError struct {
+	version int
+}
+
+func (e recordFormatError) Error() string {
+	return fmt.Sprintf("record format version %d is newer than version %d of this build", e.version, recordFormatVersion)
+}
+
+// MarshalJSON encodes the record in the current format
+func (rec hashRecord) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Format int `json:"format"`
+		recordFields
+	}{recordFormatVersion, recordFields(rec)})
+}
+
+// UnmarshalJSON decodes the record with the decoder of its format version
+func (rec *hashRecord) UnmarshalJSON(data []byte) error {
+	var header struct {
+		Format int `json:"format"`
+	}
+	if err := json.Unmarshal(data, &header); err != nil {
+		return err
+	}
+	decode, ok := recordDecoders[header.Format]
+	if !ok {
+		if header.Format > recordFormatVersion {
+			return recordFormatError{header.Format}
+		}
+		return fmt.Errorf("invalid record format version %d", header.Format)
+	}
+	decoded, err := decode(data)
+	if err != nil {
+		return err
+	}
+	*rec = decoded
+	return nil
+}
+
+// decodeRecordV1 decodes the records of version 1
+func decodeRecordV1(data []byte) (hashRecord, error) {
+	var fields recordFields
+	err := json.Unmarshal(data, &fields)
+	return hashRecord(fields), err
+}
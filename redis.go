@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// redisClient is a minimal client of the Redis protocol (RESP2) over a single connection,
+// enough to run the scripts of the rate limiter without an external dependency
+type redisClient struct {
+	mu       sync.Mutex
+	addr     string
+	password string
+	db       int
+	timeout  time.Duration
+	conn     net.Conn
+	rd       *bufio.Reader
+	// tls, if set, secures the connection
+	tls *tls.Config
+}
+
+// newRedisClient constructs a new instance of the client of the server given as host:port
+// or as a redis[s]://[:password@]host:port[/db] URL. The connection is established on first use,
+// over TLS with the rediss scheme or the given TLS configuration
+func newRedisClient(addr string, timeout time.Duration, tlsConfig *tls.Config) (*redisClient, error) {
+	c := &redisClient{addr: addr, timeout: timeout, tls: tlsConfig}
+	if strings.HasPrefix(addr, "redis://") || strings.HasPrefix(addr, "rediss://") {
+		u, err := url.Parse(addr)
+		if err != nil {
+			return nil, err
+		}
+		c.addr = u.Host
+		if u.Scheme == "rediss" && c.tls == nil {
+			c.tls = &tls.Config{}
+		}
+		if u.User != nil {
+			c.password, _ = u.User.Password()
+		}
+		if db := strings.TrimPrefix(u.Path, "/"); db != "" {
+			if c.db, err = strconv.Atoi(db); err != nil {
+				return nil, fmt.Errorf("invalid Redis database %q", db)
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(c.addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Redis address %q", c.addr)
+	}
+	if c.tls != nil && c.tls.ServerName == "" {
+		c.tls = c.tls.Clone()
+		c.tls.ServerName = host
+	}
+	return c, nil
+}
+
+// Do sends the command and returns its reply: a string, an int64, nil or a []interface{}.
+// The error replies of the server are returned as errors. The connection is dropped on
+// the network errors and reestablished by the next command
+func (c *redisClient) Do(args ...string) (interface{}, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn == nil {
+		if err := c.connect(); err != nil {
+			return nil, err
+		}
+	}
+	reply, err := c.do(args...)
+	if _, ok := err.(redisError); err != nil && !ok {
+		c.conn.Close()
+		c.conn = nil
+	}
+	return reply, err
+}
+
+// connect dials the server, completing the TLS handshake within the timeout too,
+// authenticating and selecting the database if configured
+func (c *redisClient) connect() error {
+	var conn net.Conn
+	var err error
+	if c.tls != nil {
+		conn, err = tls.DialWithDialer(&net.Dialer{Timeout: c.timeout}, "tcp", c.addr, c.tls)
+	} else {
+		conn, err = net.DialTimeout("tcp", c.addr, c.timeout)
+	}
+	if err != nil {
+		return err
+	}
+	c.conn = conn
+	c.rd = bufio.NewReader(conn)
+	if c.password != "" {
+		_, err = c.do("AUTH", c.password)
+	}
+	if err == nil && c.db != 0 {
+		_, err = c.do("SELECT", strconv.Itoa(c.db))
+	}
+	if err != nil {
+		conn.Close()
+		c.conn = nil
+	}
+	return err
+}
+
+// do writes the command and reads the reply within the timeout
+func (c *redisClient) do(args ...string) (interface{}, error) {
+	c.conn.SetDeadline(time.Now().Add(c.timeout))
+	var b strings.Builder
+	b.WriteString("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, arg := range args {
+		b.WriteString("$" + strconv.Itoa(len(arg)) + "\r\n" + arg + "\r\n")
+	}
+	if _, err := c.conn.Write([]byte(b.String())); err != nil {
+		return nil, err
+	}
+	return c.readReply()
+}
+
+// redisError is an error reply of the server
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+// errRedisProtocol is returned for the replies which cannot be parsed
+var errRedisProtocol = errors.New("redis: protocol error")
+
+// readReply reads a single reply
+func (c *redisClient) readReply() (interface{}, error) {
+	line, err := c.rd.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || !strings.HasSuffix(line, "\r\n") {
+		return nil, errRedisProtocol
+	}
+	kind, payload := line[0], line[1:len(line)-2]
+	switch kind {
+	case '+':
+		return payload, nil
+	case '-':
+		return nil, redisError(payload)
+	case ':':
+		n, err := strconv.ParseInt(payload, 10, 64)
+		if err != nil {
+			return nil, errRedisProtocol
+		}
+		return n, nil
+	case '$':
+		n, err := strconv.Atoi(payload)
+		if err != nil {
+			return nil, errRedisProtocol
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(c.rd, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(payload)
+		if err != nil {
+			return nil, errRedisProtocol
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		items := make([]interface{}, n)
+		var replyErr error
+		for i := range items {
+			// The error items are read through, so that the stream stays in sync
+			items[i], err = c.readReply()
+			if _, ok := err.(redisError); ok && replyErr == nil {
+				replyErr = err
+			} else if err != nil && !ok {
+				return nil, err
+			}
+		}
+		if replyErr != nil {
+			return nil, replyErr
+		}
+		return items, nil
+	}
+	return nil, errRedisProtocol
+}
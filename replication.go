@@ -0,0 +1,389 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// replicationBatchSize is the maximal number of records shipped in a single request
+	replicationBatchSize = 500
+	// maxReplicationOutbox bounds the completed records waiting to be shipped. When exceeded,
+	// the outbox is dropped and the shipper catches up by scanning the storage instead
+	maxReplicationOutbox = 100000
+)
+
+// replicationToken identifies the position of a record in the completion order.
+// The records are ordered by their completion time and then by their identifiers
+type replicationToken struct {
+	Created time.Time
+	ID      uint64
+}
+
+// before checks whether the record at the token position precedes the one at the other position
+func (t replicationToken) before(other replicationToken) bool {
+	return t.Created.Before(other.Created) || (t.Created.Equal(other.Created) && t.ID < other.ID)
+}
+
+// String encodes the token as an opaque resume token
+func (t replicationToken) String() string {
+	if t.Created.IsZero() {
+		return ""
+	}
+	return strconv.FormatInt(t.Created.UnixNano(), 10) + "-" + strconv.FormatUint(t.ID, 10)
+}
+
+// parseReplicationToken decodes the resume token. The empty token precedes all the records
+func parseReplicationToken(v string) (replicationToken, error) {
+	if v == "" {
+		return replicationToken{}, nil
+	}
+	parts := strings.SplitN(v, "-", 2)
+	if len(parts) != 2 {
+		return replicationToken{}, fmt.Errorf("invalid resume token %q", v)
+	}
+	nanos, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return replicationToken{}, fmt.Errorf("invalid resume token %q", v)
+	}
+	id, err := strconv.ParseUint(parts[1], 10, 64)
+	if err != nil {
+		return replicationToken{}, fmt.Errorf("invalid resume token %q", v)
+	}
+	return replicationToken{Created: time.Unix(0, nanos).UTC(), ID: id}, nil
+}
+
+// replicatedRecord is a completed record shipped to the peer
+type replicatedRecord struct {
+	ID     uint64     `json:"id"`
+	Record hashRecord `json:"record"`
+}
+
+// token returns the position of the record in the completion order
+func (r replicatedRecord) token() replicationToken {
+	return replicationToken{Created: r.Record.Created, ID: r.ID}
+}
+
+// replicationBatch is a request shipping the records to the peer.
+// The token is the resume token of the last record
+type replicationBatch struct {
+	Source  string             `json:"source"`
+	Token   string             `json:"token"`
+	Records []replicatedRecord `json:"records"`
+}
+
+// replicationStatus reports the resume token of the source acknowledged by the peer
+type replicationStatus struct {
+	Source string `json:"source"`
+	Token  string `json:"token"`
+}
+
+// loadCertPool reads the PEM encoded CA certificates
+func loadCertPool(file string) (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in %s", file)
+	}
+	return pool, nil
+}
+
+// ReplicationShipper asynchronously ships the completed records to a peer instance over mTLS.
+// On start, and whenever the outbox overflows, it asks the peer for the resume token and
+// catches up by scanning the storage for the records completed after it
+type ReplicationShipper struct {
+	mu       sync.Mutex
+	peer     string
+	source   string
+	client   *http.Client
+	backend  HashBackend
+	interval time.Duration
+	outbox   []replicatedRecord
+	resync   bool
+	// acked is the position of the last record acknowledged by the peer
+	acked replicationToken
+
+	shipped  *Counter
+	failures *Counter
+	// health remembers the outcome of the last shipping
+	health healthState
+}
+
+// NewReplicationShipper constructs a new instance of the shipper of the records stored in the backend
+func NewReplicationShipper(cfg *Config, backend HashBackend) (*ReplicationShipper, error) {
+	cert, err := tls.LoadX509KeyPair(cfg.ReplicationCert, cfg.ReplicationKey)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}}
+	if cfg.ReplicationCA != "" {
+		if tlsConfig.RootCAs, err = loadCertPool(cfg.ReplicationCA); err != nil {
+			return nil, err
+		}
+	}
+	s := &ReplicationShipper{
+		peer:     strings.TrimSuffix(cfg.ReplicationPeer, "/"),
+		source:   cfg.InstanceID,
+		client:   &http.Client{Timeout: 30 * time.Second, Transport: &http.Transport{TLSClientConfig: tlsConfig}},
+		backend:  backend,
+		interval: cfg.ReplicationInterval,
+		resync:   true,
+		shipped:  metrics.NewCounter("phs_replication_shipped_total", "Number of records shipped to the replication peer"),
+		failures: metrics.NewCounter("phs_replication_failures_total", "Number of failed replication requests"),
+	}
+	metrics.NewGaugeFunc("phs_replication_pending_records", "Number of completed records waiting to be shipped", func() float64 {
+		return float64(s.Pending())
+	})
+	metrics.NewGaugeFunc("phs_replication_lag_seconds", "Age of the oldest completed record not shipped yet", func() float64 {
+		return s.Lag(time.Now()).Seconds()
+	})
+	return s, nil
+}
+
+// Pending returns the number of completed records waiting to be shipped
+func (s *ReplicationShipper) Pending() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.outbox)
+}
+
+// Lag returns the age of the oldest completed record not shipped yet, or 0 if all have been shipped
+func (s *ReplicationShipper) Lag(now time.Time) time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.outbox) == 0 {
+		return 0
+	}
+	return now.Sub(s.outbox[0].Record.Created)
+}
+
+// Enqueue schedules the completed record for shipping
+func (s *ReplicationShipper) Enqueue(id uint64, rec hashRecord) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.resync {
+		// The catch-up scan picks the record up
+		return
+	}
+	if len(s.outbox) >= maxReplicationOutbox {
+		logf(logLevelWarn, "Replication outbox overflow, catching up from the storage\n")
+		s.outbox = nil
+		s.resync = true
+		return
+	}
+	s.outbox = append(s.outbox, replicatedRecord{ID: id, Record: rec})
+}
+
+// Run ships the records every interval until done is closed. The pending records are shipped on exit
+func (s *ReplicationShipper) Run(done <-chan struct{}) {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			s.ship()
+			return
+		case <-ticker.C:
+			s.ship()
+		}
+	}
+}
+
+// ship catches up if needed and ships all the pending records in batches
+func (s *ReplicationShipper) ship() {
+	s.mu.Lock()
+	resync := s.resync
+	s.mu.Unlock()
+	if resync {
+		if err := s.catchUp(); err != nil {
+			s.health.Record(err)
+			s.failures.Inc()
+			logf(logLevelError, "Replication catch-up failed: %v\n", err)
+			return
+		}
+	}
+	for {
+		s.mu.Lock()
+		n := len(s.outbox)
+		if n > replicationBatchSize {
+			n = replicationBatchSize
+		}
+		batch := append([]replicatedRecord(nil), s.outbox[:n]...)
+		s.mu.Unlock()
+		if len(batch) == 0 {
+			return
+		}
+		err := s.send(batch)
+		s.health.Record(err)
+		if err != nil {
+			s.failures.Inc()
+			logf(logLevelError, "Replication to %s failed: %v\n", s.peer, err)
+			return
+		}
+		s.mu.Lock()
+		// The outbox may have been dropped by an overflow in the meantime
+		if !s.resync && len(s.outbox) >= n {
+			s.outbox = s.outbox[n:]
+		}
+		if last := batch[len(batch)-1].token(); s.acked.before(last) {
+			s.acked = last
+		}
+		s.mu.Unlock()
+		s.shipped.Add(uint64(len(batch)))
+	}
+}
+
+// catchUp replaces the outbox with the stored records completed after the resume token of the peer
+func (s *ReplicationShipper) catchUp() error {
+	// The records completed from now on are queued, while the scan below finds the earlier ones
+	s.mu.Lock()
+	s.outbox = nil
+	s.resync = false
+	s.mu.Unlock()
+
+	token, err := s.fetchToken()
+	if err == nil {
+		var pending []replicatedRecord
+		err = s.backend.Scan(func(id uint64, rec hashRecord) error {
+			r := replicatedRecord{ID: id, Record: rec}
+			if token.before(r.token()) {
+				pending = append(pending, r)
+			}
+			return nil
+		})
+		if err == nil {
+			sort.Slice(pending, func(i, j int) bool { return pending[i].token().before(pending[j].token()) })
+			s.mu.Lock()
+			s.outbox = append(pending, s.outbox...)
+			s.acked = token
+			s.mu.Unlock()
+			logf(logLevelInfo, "Replication to %s resumes with %d records\n", s.peer, len(pending))
+			return nil
+		}
+	}
+	s.mu.Lock()
+	s.resync = true
+	s.mu.Unlock()
+	return err
+}
+
+// fetchToken asks the peer for the resume token of this instance
+func (s *ReplicationShipper) fetchToken() (replicationToken, error) {
+	resp, err := s.client.Get(s.peer + replicationStatusRoutePath + "?source=" + url.QueryEscape(s.source))
+	if err != nil {
+		return replicationToken{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return replicationToken{}, fmt.Errorf("peer status: %s", resp.Status)
+	}
+	var status replicationStatus
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return replicationToken{}, err
+	}
+	return parseReplicationToken(status.Token)
+}
+
+// send ships the batch of records to the peer
+func (s *ReplicationShipper) send(records []replicatedRecord) error {
+	batch := replicationBatch{Source: s.source, Token: records[len(records)-1].token().String(), Records: records}
+	body, err := json.Marshal(batch)
+	if err != nil {
+		return err
+	}
+	resp, err := s.client.Post(s.peer+replicationRecordsRoutePath, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("peer: %s", resp.Status)
+	}
+	return nil
+}
+
+// ReplicationReceiver applies the records shipped by the peers and keeps their resume tokens
+type ReplicationReceiver struct {
+	mu        sync.Mutex
+	storage   *HashStorage
+	meta      metadataStore
+	tokens    map[string]string
+	applied   *Counter
+	conflicts *Counter
+}
+
+// NewReplicationReceiver constructs a new instance of the receiver applying the records to the storage.
+// The resume tokens are persisted in the metadata store
+func NewReplicationReceiver(storage *HashStorage, meta metadataStore) *ReplicationReceiver {
+	return &ReplicationReceiver{
+		storage:   storage,
+		meta:      meta,
+		tokens:    make(map[string]string),
+		applied:   metrics.NewCounter("phs_replication_applied_total", "Number of records received from the replication peers"),
+		conflicts: metrics.NewCounter("phs_replication_conflicts_total", "Number of received records conflicting with a different record stored under the same identifier"),
+	}
+}
+
+// replicationMetaName returns the name of the metadata document keeping the resume token of the source
+func replicationMetaName(source string) string {
+	return "replication-" + source
+}
+
+// Token returns the resume token of the last batch applied from the source
+func (r *ReplicationReceiver) Token(source string) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if token, ok := r.tokens[source]; ok {
+		return token, nil
+	}
+	var status replicationStatus
+	if _, err := r.meta.GetMeta(replicationMetaName(source), &status); err != nil {
+		return "", err
+	}
+	r.tokens[source] = status.Token
+	return status.Token, nil
+}
+
+// Apply stores the shipped records and advances the resume token of the source
+func (r *ReplicationReceiver) Apply(batch replicationBatch) error {
+	if batch.Source == "" {
+		return errors.New("missing replication source")
+	}
+	if _, err := parseReplicationToken(batch.Token); err != nil {
+		return err
+	}
+	for _, rec := range batch.Records {
+		conflict, err := r.storage.ApplyReplicated(rec.ID, rec.Record)
+		if err != nil {
+			return err
+		}
+		if conflict {
+			r.conflicts.Inc()
+			logf(logLevelWarn, "Replicated hash %d from %s conflicts with a local record\n", rec.ID, batch.Source)
+		}
+	}
+	r.applied.Add(uint64(len(batch.Records)))
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.meta.PutMeta(replicationMetaName(batch.Source), replicationStatus{Source: batch.Source, Token: batch.Token}); err != nil {
+		return err
+	}
+	r.tokens[batch.Source] = batch.Token
+	return nil
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// newTestStorage returns the storage over the backend, with the default settings changed by configure if set
+func newTestStorage(t *testing.T, backend HashBackend, configure func(cfg *Config)) *HashStorage {
+	cfg := DefaultConfig()
+	cfg.HashDelay = 0
+	if configure != nil {
+		configure(cfg)
+	}
+	s, err := NewHashStorage(backend, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestParseReplicationToken(t *testing.T) {
+	created := time.Date(2024, 5, 1, 12, 0, 0, 123, time.UTC)
+	for _, tt := range []struct {
+		token   string
+		want    replicationToken
+		wantErr bool
+	}{
+		{token: "", want: replicationToken{}},
+		{token: replicationToken{Created: created, ID: 42}.String(), want: replicationToken{Created: created, ID: 42}},
+		{token: "42", wantErr: true},
+		{token: "x-42", wantErr: true},
+		{token: "1714564800000000123-x", wantErr: true},
+		{token: "1714564800000000123--1", wantErr: true},
+	} {
+		got, err := parseReplicationToken(tt.token)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseReplicationToken(%q) error = %v, want error %v", tt.token, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && (!got.Created.Equal(tt.want.Created) || got.ID != tt.want.ID) {
+			t.Errorf("parseReplicationToken(%q) = %+v, want %+v", tt.token, got, tt.want)
+		}
+	}
+}
+
+func TestReplicationReceiverApply(t *testing.T) {
+	earlier := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	later := earlier.Add(time.Minute)
+	// The shipped records come from the region 2, the local ones are numbered in the region 0
+	shipped := uint64(2)<<regionShift + 7
+
+	for _, tt := range []struct {
+		name         string
+		local        *hashRecord // record stored under the shipped identifier before the batch, if any
+		shipped      hashRecord
+		want         string // hash stored once the batch is applied
+		wantConflict bool
+	}{
+		{name: "new record", shipped: hashRecord{Hash: "remote", Created: earlier}, want: "remote"},
+		{name: "shipped again", local: &hashRecord{Hash: "remote", Created: earlier}, shipped: hashRecord{Hash: "remote", Created: earlier}, want: "remote"},
+		{name: "local older", local: &hashRecord{Hash: "local", Created: earlier}, shipped: hashRecord{Hash: "remote", Created: later}, want: "remote", wantConflict: true},
+		{name: "local newer", local: &hashRecord{Hash: "local", Created: later}, shipped: hashRecord{Hash: "remote", Created: earlier}, want: "local", wantConflict: true},
+		{name: "tie broken by the hash", local: &hashRecord{Hash: "a", Created: earlier}, shipped: hashRecord{Hash: "b", Created: earlier}, want: "b", wantConflict: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			backend := NewMemoryBackend()
+			if tt.local != nil {
+				if err := backend.Put(shipped, *tt.local); err != nil {
+					t.Fatal(err)
+				}
+			}
+			storage := newTestStorage(t, backend, nil)
+			r := NewReplicationReceiver(storage, backend)
+			conflicts := r.conflicts.Value()
+
+			unclaimed := later.Add(time.Hour)
+			rec := tt.shipped
+			rec.Unclaimed = &unclaimed
+			batch := replicationBatch{Source: "eu", Records: []replicatedRecord{{ID: shipped, Record: rec}}}
+			batch.Token = batch.Records[0].token().String()
+			if err := r.Apply(batch); err != nil {
+				t.Fatal(err)
+			}
+
+			stored, ok, err := backend.Get(shipped)
+			if err != nil || !ok {
+				t.Fatalf("shipped record not stored: %v", err)
+			}
+			if stored.Hash != tt.want {
+				t.Fatalf("stored hash %q, want %q", stored.Hash, tt.want)
+			}
+			if tt.want == "remote" && stored.Unclaimed != nil {
+				t.Fatal("claim deadline of the shipping region kept on the copy")
+			}
+			if got := r.conflicts.Value() - conflicts; (got == 1) != tt.wantConflict {
+				t.Fatalf("counted %d conflicts, want conflict %v", got, tt.wantConflict)
+			}
+			// The resume token survives the restart of the receiver
+			token, err := NewReplicationReceiver(storage, backend).Token("eu")
+			if err != nil || token != batch.Token {
+				t.Fatalf("token after restart = %q, %v, want %q", token, err, batch.Token)
+			}
+			if storage.currentKey != 0 {
+				t.Fatalf("local numbering moved to %d by a record of another region", storage.currentKey)
+			}
+		})
+	}
+}
+
+func TestReplicationReceiverRejectsBatch(t *testing.T) {
+	backend := NewMemoryBackend()
+	r := NewReplicationReceiver(newTestStorage(t, backend, nil), backend)
+	good := replicationBatch{Source: "eu", Token: replicationToken{Created: time.Now().UTC(), ID: 1}.String()}
+	if err := r.Apply(good); err != nil {
+		t.Fatal(err)
+	}
+	record := []replicatedRecord{{ID: 2, Record: hashRecord{Hash: "h", Created: time.Now().UTC()}}}
+	for _, tt := range []struct {
+		name  string
+		batch replicationBatch
+	}{
+		{name: "missing source", batch: replicationBatch{Token: good.Token, Records: record}},
+		{name: "invalid token", batch: replicationBatch{Source: "eu", Token: "bogus", Records: record}},
+	} {
+		if err := r.Apply(tt.batch); err == nil {
+			t.Errorf("%s: batch applied", tt.name)
+		}
+		if token, _ := r.Token("eu"); token != good.Token {
+			t.Errorf("%s: token moved to %q", tt.name, token)
+		}
+		if _, ok, _ := backend.Get(2); ok {
+			t.Errorf("%s: record of the rejected batch stored", tt.name)
+		}
+	}
+}
+
+func TestApplyReplicatedContinuesLocalNumbering(t *testing.T) {
+	backend := NewMemoryBackend()
+	storage := newTestStorage(t, backend, nil)
+	// A record calculated by this region before a failover comes back from the peer
+	if _, err := storage.ApplyReplicated(41, hashRecord{Hash: "h", Created: time.Now().UTC()}); err != nil {
+		t.Fatal(err)
+	}
+	u, err := storage.AddPassword("angryMonkey", nil, 0, 0, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u != 42 {
+		t.Fatalf("new hash numbered %d, want 42", u)
+	}
+}
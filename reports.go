@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// usageReportRow holds the usage of a tenant over the period of the report
+type usageReportRow struct {
+	Tenant       string  `json:"tenant"`
+	Requests     uint64  `json:"requests"`
+	Created      uint64  `json:"created"`
+	Verified     uint64  `json:"verified"`
+	Deleted      uint64  `json:"deleted"`
+	AvgLatencyMs float64 `json:"avg_latency_ms"`
+}
+
+// usageReport is the usage of the tenants over the UTC days from From to To, both included
+type usageReport struct {
+	From    string           `json:"from"`
+	To      string           `json:"to"`
+	Tenants []usageReportRow `json:"tenants"`
+}
+
+// parseReportPeriod parses the from and to days of the report, by default the current month up to today
+func parseReportPeriod(from, to string, now time.Time) (time.Time, time.Time, error) {
+	now = now.UTC()
+	first := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	last := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	var err error
+	if from != "" {
+		if first, err = time.Parse(tenantDayLayout, from); err != nil {
+			return first, last, policyViolation("invalid from %q, expected YYYY-MM-DD", from)
+		}
+	}
+	if to != "" {
+		if last, err = time.Parse(tenantDayLayout, to); err != nil {
+			return first, last, policyViolation("invalid to %q, expected YYYY-MM-DD", to)
+		}
+	}
+	if last.Before(first) {
+		return first, last, policyViolation("to %s is before from %s", last.Format(tenantDayLayout), first.Format(tenantDayLayout))
+	}
+	return first, last, nil
+}
+
+// usageReport aggregates the usage of the tenant, or of all the tenants if tenant is empty, over the period
+func (s *HashService) usageReport(tenant string, from, to time.Time) usageReport {
+	report := usageReport{From: from.Format(tenantDayLayout), To: to.Format(tenantDayLayout), Tenants: []usageReportRow{}}
+	for name, counts := range s.tenants.Period(tenant, from, to) {
+		row := usageReportRow{Tenant: name, Requests: counts.Requests, Created: counts.Created, Verified: counts.Verified, Deleted: counts.Deleted}
+		if counts.Requests > 0 {
+			row.AvgLatencyMs = float64(counts.LatencyMicros) / float64(counts.Requests) / 1000
+		}
+		report.Tenants = append(report.Tenants, row)
+	}
+	sort.Slice(report.Tenants, func(i, j int) bool { return report.Tenants[i].Tenant < report.Tenants[j].Tenant })
+	return report
+}
+
+// writeUsageCSV writes the report as CSV with a header line and a line per tenant
+func writeUsageCSV(w io.Writer, report usageReport) error {
+	out := csv.NewWriter(w)
+	out.Write([]string{"tenant", "from", "to", "requests", "created", "verified", "deleted", "avg_latency_ms"})
+	for _, row := range report.Tenants {
+		out.Write([]string{
+			row.Tenant, report.From, report.To,
+			strconv.FormatUint(row.Requests, 10),
+			strconv.FormatUint(row.Created, 10),
+			strconv.FormatUint(row.Verified, 10),
+			strconv.FormatUint(row.Deleted, 10),
+			strconv.FormatFloat(row.AvgLatencyMs, 'f', 3, 64),
+		})
+	}
+	out.Flush()
+	return out.Error()
+}
+
+// usageReportFilename returns the name of the downloaded CSV report
+func usageReportFilename(report usageReport) string {
+	return fmt.Sprintf("usage-%s-%s.csv", report.From, report.To)
+}
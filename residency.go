@@ -0,0 +1,427 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// residencyConfig maps the tenants to the regions keeping their records, and the regions to their storage directories
+type residencyConfig struct {
+	dirs    map[string]string
+	tenants map[string]string
+}
+
+// parseResidency parses the regions given as name=dir and the tenants given as tenant=region, both separated by semicolons
+func parseResidency(regions, tenants string) (residencyConfig, error) {
+	cfg := residencyConfig{dirs: map[string]string{}, tenants: map[string]string{}}
+	for _, part := range strings.Split(regions, ";") {
+		if part = strings.TrimSpace(part); part == "" {
+			continue
+		}
+		i := strings.IndexByte(part, '=')
+		if i <= 0 || i == len(part)-1 {
+			return cfg, fmt.Errorf("residency region %q must be given as name=dir", part)
+		}
+		name, dir := strings.TrimSpace(part[:i]), filepath.Clean(strings.TrimSpace(part[i+1:]))
+		if _, ok := cfg.dirs[name]; ok {
+			return cfg, fmt.Errorf("residency region %q given twice", name)
+		}
+		for other, otherDir := range cfg.dirs {
+			if otherDir == dir {
+				return cfg, fmt.Errorf("residency regions %q and %q share the directory %s", other, name, dir)
+			}
+		}
+		cfg.dirs[name] = dir
+	}
+	for _, part := range strings.Split(tenants, ";") {
+		if part = strings.TrimSpace(part); part == "" {
+			continue
+		}
+		i := strings.IndexByte(part, '=')
+		if i <= 0 || i == len(part)-1 {
+			return cfg, fmt.Errorf("tenant residency %q must be given as tenant=region", part)
+		}
+		tenant, region := strings.TrimSpace(part[:i]), strings.TrimSpace(part[i+1:])
+		if _, ok := cfg.dirs[region]; !ok {
+			return cfg, fmt.Errorf("tenant %q is bound to the unknown residency region %q", tenant, region)
+		}
+		if _, ok := cfg.tenants[tenant]; ok {
+			return cfg, fmt.Errorf("tenant %q bound to a residency region twice", tenant)
+		}
+		cfg.tenants[tenant] = region
+	}
+	return cfg, nil
+}
+
+// ResidencyBackend keeps the records of the tenants bound to a region in the backend of that region, and
+// all the others in the home backend, which also keeps the API keys and the metadata. A record goes to the
+// backend of the tenant it was created for, so the records of a resident tenant are never written elsewhere.
+// The regions of the records are remembered as they are written and scanned; the records not known, e.g.
+// written by another instance since, are looked up in the home backend first and then in the regions
+type ResidencyBackend struct {
+	home    HashBackend
+	regions map[string]HashBackend
+	// names lists the regions in a stable order
+	names   []string
+	tenants map[string]string
+	mu      sync.RWMutex
+	located map[uint64]string
+	// misplaced holds the regions of the records found by the scans outside of the backend of their tenant,
+	// which are moved once written again
+	misplaced map[uint64]string
+	writes    map[string]*Counter
+}
+
+// NewResidencyBackend constructs the backend routing the records of the tenants to the file backends of
+// their regions. The file backends of the regions are closed along with the home backend
+func NewResidencyBackend(home HashBackend, residency residencyConfig, compression string) (*ResidencyBackend, error) {
+	b := &ResidencyBackend{
+		home:      home,
+		regions:   make(map[string]HashBackend),
+		tenants:   residency.tenants,
+		located:   make(map[uint64]string),
+		misplaced: make(map[uint64]string),
+		writes:    make(map[string]*Counter),
+	}
+	for name := range residency.dirs {
+		b.names = append(b.names, name)
+	}
+	sort.Strings(b.names)
+	const help = "Number of records written to the storage of the residency region"
+	b.writes[""] = metrics.NewCounter("phs_residency_writes_total", help, "region", "home")
+	for _, name := range b.names {
+		region, err := NewFileBackend(residency.dirs[name], compression)
+		if err != nil {
+			for _, opened := range b.regions {
+				opened.Close()
+			}
+			return nil, fmt.Errorf("residency region %s: %v", name, err)
+		}
+		b.regions[name] = region
+		b.writes[name] = metrics.NewCounter("phs_residency_writes_total", help, "region", name)
+	}
+	for tenant, region := range b.tenants {
+		logf(logLevelInfo, "Residency: Records of tenant %q kept in region %s at %s\n", tenant, region, residency.dirs[region])
+	}
+	metrics.NewGaugeFunc("phs_residency_misplaced_records", "Number of records found outside of the storage of the residency region of their tenant", func() float64 {
+		b.mu.RLock()
+		defer b.mu.RUnlock()
+		return float64(len(b.misplaced))
+	})
+	return b, nil
+}
+
+// residencyOf returns the residency region keeping the records of the tenant, empty for the home storage
+func (s *HashService) residencyOf(tenant string) string {
+	if b, ok := s.storage.backend.(*ResidencyBackend); ok {
+		return b.regionOfTenant(tenant)
+	}
+	return ""
+}
+
+// regionOfTenant returns the residency region of the tenant, empty for the home backend
+func (b *ResidencyBackend) regionOfTenant(tenant string) string {
+	return b.tenants[tenant]
+}
+
+// backend returns the backend of the region, the home backend if empty
+func (b *ResidencyBackend) backend(region string) HashBackend {
+	if region == "" {
+		return b.home
+	}
+	return b.regions[region]
+}
+
+// Put stores the record in the backend of the region of its tenant
+func (b *ResidencyBackend) Put(id uint64, rec hashRecord) error {
+	region := b.regionOfTenant(rec.Tenant)
+	if err := b.backend(region).Put(id, rec); err != nil {
+		return err
+	}
+	b.writes[region].Inc()
+	b.locate(id, region)
+	return b.unmisplace(id, region)
+}
+
+// PutBatch stores the records in the backends of the regions of their tenants, a batch per backend
+func (b *ResidencyBackend) PutBatch(recs map[uint64]hashRecord, durable bool) error {
+	batches := make(map[string]map[uint64]hashRecord)
+	for id, rec := range recs {
+		region := b.regionOfTenant(rec.Tenant)
+		if batches[region] == nil {
+			batches[region] = make(map[uint64]hashRecord)
+		}
+		batches[region][id] = rec
+	}
+	for region, batch := range batches {
+		if err := putBatch(b.backend(region), batch, durable); err != nil {
+			return err
+		}
+		b.writes[region].Add(uint64(len(batch)))
+		for id := range batch {
+			b.locate(id, region)
+			if err := b.unmisplace(id, region); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// unmisplace removes the misplaced copy of the record written to the backend of its region, if any
+func (b *ResidencyBackend) unmisplace(id uint64, region string) error {
+	b.mu.Lock()
+	where, ok := b.misplaced[id]
+	delete(b.misplaced, id)
+	b.mu.Unlock()
+	if !ok || where == region {
+		return nil
+	}
+	_, err := b.backend(where).Delete(id)
+	return err
+}
+
+// locate remembers the region of the record, only those outside of the home backend are kept
+func (b *ResidencyBackend) locate(id uint64, region string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if region == "" {
+		delete(b.located, id)
+	} else {
+		b.located[id] = region
+	}
+}
+
+// lookup returns the region of the record if known
+func (b *ResidencyBackend) lookup(id uint64) (string, bool) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	region, ok := b.located[id]
+	return region, ok
+}
+
+// Get returns the record from the backend of its region, looking for it in all of them if not known
+func (b *ResidencyBackend) Get(id uint64) (hashRecord, bool, error) {
+	if region, ok := b.lookup(id); ok {
+		return b.regions[region].Get(id)
+	}
+	rec, ok, err := b.home.Get(id)
+	if ok || err != nil {
+		return rec, ok, err
+	}
+	for _, name := range b.names {
+		if rec, ok, err = b.regions[name].Get(id); ok || err != nil {
+			if ok {
+				b.locate(id, name)
+			}
+			return rec, ok, err
+		}
+	}
+	return hashRecord{}, false, nil
+}
+
+// Delete removes the record from the backend of its region, looking for it in all of them if not known,
+// along with its misplaced copy, if any
+func (b *ResidencyBackend) Delete(id uint64) (bool, error) {
+	b.mu.Lock()
+	where, stray := b.misplaced[id]
+	delete(b.misplaced, id)
+	b.mu.Unlock()
+	ok, err := b.deleteLocated(id)
+	if stray && err == nil {
+		var deleted bool
+		if deleted, err = b.backend(where).Delete(id); deleted {
+			ok = true
+		}
+	}
+	return ok, err
+}
+
+// deleteLocated removes the record from the backend of its region, looking for it in all of them if not known
+func (b *ResidencyBackend) deleteLocated(id uint64) (bool, error) {
+	if region, ok := b.lookup(id); ok {
+		b.locate(id, "")
+		return b.regions[region].Delete(id)
+	}
+	ok, err := b.home.Delete(id)
+	if ok || err != nil {
+		return ok, err
+	}
+	for _, name := range b.names {
+		if ok, err = b.regions[name].Delete(id); ok || err != nil {
+			return ok, err
+		}
+	}
+	return false, nil
+}
+
+// Scan calls fn for every record stored in the home backend and in the regions. The records stored
+// outside of the backend of their tenant, e.g. written before the tenant was bound to its region, are
+// served where they are but counted and reported, and moved to their region once written again
+func (b *ResidencyBackend) Scan(fn func(id uint64, rec hashRecord) error) error {
+	misplaced := make(map[uint64]string)
+	counts := make(map[string]int)
+	scan := func(region string) error {
+		return b.backend(region).Scan(func(id uint64, rec hashRecord) error {
+			if region != "" {
+				b.locate(id, region)
+			}
+			if b.regionOfTenant(rec.Tenant) != region {
+				misplaced[id] = region
+				counts[rec.Tenant]++
+			}
+			return fn(id, rec)
+		})
+	}
+	if err := scan(""); err != nil {
+		return err
+	}
+	for _, name := range b.names {
+		if err := scan(name); err != nil {
+			return err
+		}
+	}
+	for tenant, n := range counts {
+		region := b.regionOfTenant(tenant)
+		if region == "" {
+			region = "home"
+		}
+		logf(logLevelWarn, "Residency: %d records of tenant %q are stored outside of its region %s\n", n, tenant, region)
+	}
+	b.mu.Lock()
+	b.misplaced = misplaced
+	b.mu.Unlock()
+	return nil
+}
+
+// Ping checks whether the home backend and the regions are reachable
+func (b *ResidencyBackend) Ping() error {
+	for _, region := range append([]string{""}, b.names...) {
+		if p, ok := b.backend(region).(storagePinger); ok {
+			if err := p.Ping(); err != nil {
+				if region == "" {
+					return err
+				}
+				return fmt.Errorf("residency region %s: %v", region, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Usage reports the usage of the home backend added up with that of the regions
+func (b *ResidencyBackend) Usage() (StorageUsage, error) {
+	r, ok := b.home.(storageUsageReporter)
+	if !ok {
+		return StorageUsage{}, errors.New("storage backend does not report its usage")
+	}
+	usage, err := r.Usage()
+	if err != nil {
+		return usage, err
+	}
+	for _, name := range b.names {
+		regional, err := b.regions[name].(storageUsageReporter).Usage()
+		if err != nil {
+			return usage, fmt.Errorf("residency region %s: %v", name, err)
+		}
+		usage.Records += regional.Records
+		usage.LogicalBytes += regional.LogicalBytes
+		usage.DiskBytes += regional.DiskBytes
+	}
+	if usage.DiskBytes > 0 {
+		usage.Fragmentation = 1 - float64(usage.LogicalBytes)/float64(usage.DiskBytes)
+	}
+	return usage, nil
+}
+
+// Compact compacts the home backend and the regions requiring it
+func (b *ResidencyBackend) Compact() error {
+	for _, region := range append([]string{""}, b.names...) {
+		if c, ok := b.backend(region).(storageCompactor); ok {
+			if err := c.Compact(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// LockMigrations takes the migration lock of the home backend, if it has one
+func (b *ResidencyBackend) LockMigrations(owner string) (func() error, error) {
+	if l, ok := b.home.(migrationLocker); ok {
+		return l.LockMigrations(owner)
+	}
+	return func() error { return nil }, nil
+}
+
+// PutStats saves the statistics snapshot of the instance to the home backend
+func (b *ResidencyBackend) PutStats(snap statsSnapshot) error {
+	if store, ok := b.home.(statsSnapshotStore); ok {
+		return store.PutStats(snap)
+	}
+	return nil
+}
+
+// ListStats returns the statistics snapshots saved in the home backend
+func (b *ResidencyBackend) ListStats() ([]statsSnapshot, error) {
+	if store, ok := b.home.(statsSnapshotStore); ok {
+		return store.ListStats()
+	}
+	return nil, nil
+}
+
+// PutKey saves the API key to the home backend
+func (b *ResidencyBackend) PutKey(key apiKey) error {
+	return b.home.(apiKeyStore).PutKey(key)
+}
+
+// GetKey returns the API key saved in the home backend
+func (b *ResidencyBackend) GetKey(id string) (apiKey, bool, error) {
+	return b.home.(apiKeyStore).GetKey(id)
+}
+
+// ListKeys returns the API keys saved in the home backend
+func (b *ResidencyBackend) ListKeys() ([]apiKey, error) {
+	return b.home.(apiKeyStore).ListKeys()
+}
+
+// PutMeta saves the value as the named document in the home backend
+func (b *ResidencyBackend) PutMeta(name string, v interface{}) error {
+	return b.home.(metadataStore).PutMeta(name, v)
+}
+
+// GetMeta loads the named document from the home backend into v
+func (b *ResidencyBackend) GetMeta(name string, v interface{}) (bool, error) {
+	return b.home.(metadataStore).GetMeta(name, v)
+}
+
+// GetIdempotency returns the record from the home backend
+func (b *ResidencyBackend) GetIdempotency(key string) (idempotencyRecord, bool, error) {
+	return b.home.(idempotencyStore).GetIdempotency(key)
+}
+
+// ClaimIdempotency saves the record in the home backend
+func (b *ResidencyBackend) ClaimIdempotency(rec idempotencyRecord) (idempotencyRecord, bool, error) {
+	return b.home.(idempotencyStore).ClaimIdempotency(rec)
+}
+
+// ExpireIdempotency removes the expired records from the home backend
+func (b *ResidencyBackend) ExpireIdempotency(now time.Time) (int, error) {
+	return b.home.(idempotencyStore).ExpireIdempotency(now)
+}
+
+// Close closes the home backend and the regions, returning the first error
+func (b *ResidencyBackend) Close() error {
+	firstErr := b.home.Close()
+	for _, name := range b.names {
+		if err := b.regions[name].Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseResidency(t *testing.T) {
+	for _, tt := range []struct {
+		name             string
+		regions, tenants string
+		wantTenants      map[string]string
+		wantErr          bool
+	}{
+		{name: "none", wantTenants: map[string]string{}},
+		{name: "bound", regions: "eu=/data/eu; us=/data/us;", tenants: "acme=eu;globex = us", wantTenants: map[string]string{"acme": "eu", "globex": "us"}},
+		{name: "region without dir", regions: "eu=", wantErr: true},
+		{name: "region without name", regions: "=/data/eu", wantErr: true},
+		{name: "region twice", regions: "eu=/data/eu;eu=/data/eu2", wantErr: true},
+		{name: "shared dir", regions: "eu=/data/eu;us=/data/./eu", wantErr: true},
+		{name: "unknown region", regions: "eu=/data/eu", tenants: "acme=us", wantErr: true},
+		{name: "tenant twice", regions: "eu=/data/eu;us=/data/us", tenants: "acme=eu;acme=us", wantErr: true},
+		{name: "tenant without region", regions: "eu=/data/eu", tenants: "acme", wantErr: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := parseResidency(tt.regions, tt.tenants)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseResidency error = %v, want error %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if len(cfg.tenants) != len(tt.wantTenants) {
+				t.Fatalf("tenants %v, want %v", cfg.tenants, tt.wantTenants)
+			}
+			for tenant, region := range tt.wantTenants {
+				if cfg.tenants[tenant] != region {
+					t.Fatalf("tenant %q in region %q, want %q", tenant, cfg.tenants[tenant], region)
+				}
+			}
+		})
+	}
+}
+
+// testResidency is a residency backend over the file backends of a temporary directory. The backends of
+// the home and the regions are opened separately too, to check where the records land
+type testResidency struct {
+	dir     string
+	cfg     residencyConfig
+	home    *FileBackend
+	regions map[string]*FileBackend
+}
+
+// newTestResidency returns the home and the regions eu and us, binding acme to eu and globex to us
+func newTestResidency(t *testing.T) *testResidency {
+	dir := t.TempDir()
+	cfg, err := parseResidency("eu="+filepath.Join(dir, "eu")+";us="+filepath.Join(dir, "us"), "acme=eu;globex=us")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &testResidency{dir: dir, cfg: cfg, regions: make(map[string]*FileBackend)}
+	for name, path := range map[string]string{"": filepath.Join(dir, "home"), "eu": filepath.Join(dir, "eu"), "us": filepath.Join(dir, "us")} {
+		b, err := NewFileBackend(path, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if name == "" {
+			r.home = b
+		} else {
+			r.regions[name] = b
+		}
+	}
+	return r
+}
+
+// open returns a new residency backend, which knows the regions of the records only from its own writes and scans
+func (r *testResidency) open(t *testing.T) *ResidencyBackend {
+	home, err := NewFileBackend(filepath.Join(r.dir, "home"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := NewResidencyBackend(home, r.cfg, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { b.Close() })
+	return b
+}
+
+// where returns the backends holding the record, "home" for the home backend
+func (r *testResidency) where(t *testing.T, id uint64) []string {
+	var found []string
+	for _, name := range []string{"", "eu", "us"} {
+		b := r.home
+		if name != "" {
+			b = r.regions[name]
+		}
+		_, ok, err := b.Get(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok {
+			if name == "" {
+				name = "home"
+			}
+			found = append(found, name)
+		}
+	}
+	return found
+}
+
+func TestResidencyBackendRouting(t *testing.T) {
+	for _, tt := range []struct {
+		tenant string
+		want   string
+	}{
+		{tenant: "acme", want: "eu"},
+		{tenant: "globex", want: "us"},
+		{tenant: "initech", want: "home"},
+		{tenant: "", want: "home"},
+	} {
+		t.Run(tt.want+"/"+tt.tenant, func(t *testing.T) {
+			r := newTestResidency(t)
+			rec := hashRecord{Hash: "h-" + tt.tenant, Tenant: tt.tenant, Created: time.Now().UTC()}
+			// Single writes and batched writes are routed alike
+			if err := r.open(t).Put(1, rec); err != nil {
+				t.Fatal(err)
+			}
+			if err := r.open(t).PutBatch(map[uint64]hashRecord{2: rec}, true); err != nil {
+				t.Fatal(err)
+			}
+			for _, id := range []uint64{1, 2} {
+				if got := r.where(t, id); len(got) != 1 || got[0] != tt.want {
+					t.Fatalf("record %d stored in %v, want only %s", id, got, tt.want)
+				}
+				// Another instance finds the record without knowing its region
+				got, ok, err := r.open(t).Get(id)
+				if err != nil || !ok || got.Hash != rec.Hash {
+					t.Fatalf("record %d = %+v, %v, %v from a new instance", id, got, ok, err)
+				}
+			}
+			deleted, err := r.open(t).Delete(1)
+			if err != nil || !deleted {
+				t.Fatalf("Delete = %v, %v", deleted, err)
+			}
+			if got := r.where(t, 1); len(got) != 0 {
+				t.Fatalf("deleted record still stored in %v", got)
+			}
+		})
+	}
+}
+
+func TestResidencyBackendMovesMisplacedRecords(t *testing.T) {
+	r := newTestResidency(t)
+	// Written to the home backend before acme was bound to eu
+	rec := hashRecord{Hash: "h", Tenant: "acme", Created: time.Now().UTC()}
+	if err := r.home.Put(1, rec); err != nil {
+		t.Fatal(err)
+	}
+	b := r.open(t)
+	var scanned int
+	if err := b.Scan(func(uint64, hashRecord) error { scanned++; return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if scanned != 1 || len(b.misplaced) != 1 {
+		t.Fatalf("scanned %d records, %d misplaced, want 1 and 1", scanned, len(b.misplaced))
+	}
+	// The misplaced record is served where it is
+	if got, ok, err := b.Get(1); err != nil || !ok || got.Hash != "h" {
+		t.Fatalf("misplaced record = %+v, %v, %v", got, ok, err)
+	}
+	// and moved to its region once written again
+	if err := b.Put(1, rec); err != nil {
+		t.Fatal(err)
+	}
+	if got := r.where(t, 1); len(got) != 1 || got[0] != "eu" {
+		t.Fatalf("rewritten record stored in %v, want only eu", got)
+	}
+	if len(b.misplaced) != 0 {
+		t.Fatalf("%d records still misplaced", len(b.misplaced))
+	}
+}
+
+func TestResidencyBackendDeletesMisplacedCopy(t *testing.T) {
+	r := newTestResidency(t)
+	rec := hashRecord{Hash: "h", Tenant: "acme", Created: time.Now().UTC()}
+	// A stray copy in the home backend along with the record in its region
+	for _, b := range []*FileBackend{r.home, r.regions["eu"]} {
+		if err := b.Put(1, rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b := r.open(t)
+	if err := b.Scan(func(uint64, hashRecord) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if deleted, err := b.Delete(1); err != nil || !deleted {
+		t.Fatalf("Delete = %v, %v", deleted, err)
+	}
+	if got := r.where(t, 1); len(got) != 0 {
+		t.Fatalf("deleted record still stored in %v", got)
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"net/http"
+	"strconv"
+)
+
+// Bounds of the salts supplied by the callers
+const (
+	minCallerSaltSize      = 8
+	maxCallerSaltSize      = 64
+	maxCallerSaltIteration = 10000000
+)
+
+// callerSalt is the salt supplied by the caller along with the PBKDF2 parameters, so that the service
+// recomputes the hashes matching the ones stored by an external system
+type callerSalt struct {
+	salt       []byte
+	prfName    string
+	prf        func() hash.Hash
+	iterations int
+}
+
+// parseCallerSalt parses the salt, prf and iterations fields of the form. It returns nil without
+// the salt field. The salt is base64 encoded and must be of a reasonable length and entropy
+func parseCallerSalt(r *http.Request) (*callerSalt, error) {
+	v := r.FormValue("salt")
+	if v == "" {
+		return nil, nil
+	}
+	salt, err := base64.StdEncoding.DecodeString(v)
+	if err != nil {
+		if salt, err = base64.RawStdEncoding.DecodeString(v); err != nil {
+			return nil, policyViolation("salt is not base64 encoded")
+		}
+	}
+	if len(salt) < minCallerSaltSize || len(salt) > maxCallerSaltSize {
+		return nil, policyViolation("salt must be %d to %d bytes long", minCallerSaltSize, maxCallerSaltSize)
+	}
+	// A random salt has few repeated bytes, the constant or repeating patterns have many
+	distinct := make(map[byte]bool)
+	for _, b := range salt {
+		distinct[b] = true
+	}
+	if 2*len(distinct) < len(salt) {
+		return nil, policyViolation("salt has too little entropy")
+	}
+
+	c := &callerSalt{salt: salt, prfName: r.FormValue("prf")}
+	if c.prfName == "" {
+		c.prfName = "sha512"
+	}
+	var ok bool
+	if c.prf, ok = pbkdf2PRF(c.prfName); !ok {
+		return nil, policyViolation("unsupported prf %q", c.prfName)
+	}
+	iterations := r.FormValue("iterations")
+	if c.iterations, err = strconv.Atoi(iterations); err != nil || c.iterations < 1 || c.iterations > maxCallerSaltIteration {
+		return nil, policyViolation("iterations must be 1 to %d", maxCallerSaltIteration)
+	}
+	return c, nil
+}
+
+// Hash calculates the PBKDF2 hash of the password in the passlib format
+func (c *callerSalt) Hash(pw string) string {
+	key := pbkdf2Key([]byte(pw), c.salt, c.iterations, c.prf().Size(), c.prf)
+	return encodePBKDF2(c.prfName, c.iterations, c.salt, key)
+}
+
+// String describes the parameters for the idempotency fingerprint
+func (c *callerSalt) String() string {
+	return fmt.Sprintf("%s:%d:%s", c.prfName, c.iterations, base64.StdEncoding.EncodeToString(c.salt))
+}
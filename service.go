@@ -1,195 +1,1798 @@
-package main
-
-import (
-	"context"
-	"encoding/json"
-	"log"
-	"net/http"
-	"strconv"
-	"strings"
-	"sync"
-	"time"
-)
-
-const (
-	hashRoutePath     = "/hash"
-	statsRoutePath    = "/stats"
-	shutdownRoutePath = "/shutdown"
-)
-
-// HashService represents the password hashing service implementation
-type HashService struct {
-	srv             http.Server
-	idleConnsClosed chan struct{}
-	once            sync.Once
-	storage         *HashStorage
-	stats           *HashStatsStorage
-}
-
-// NewHashService constructs a new instance of the password hashing service
-func NewHashService(httpAddr *string) *HashService {
-	hashService := &HashService{}
-	hashService.srv = http.Server{Addr: *httpAddr}
-	hashService.idleConnsClosed = make(chan struct{})
-	hashService.storage = NewHashStorage()
-	hashService.stats = NewHashStatsStorage()
-	return hashService
-}
-
-// Grecefully shut down the server
-func (s *HashService) initiateShutdown() {
-	// We received a shutdown command, shut down. Make sure we call it only once.
-	s.once.Do(func() {
-		go func() {
-			if err := s.srv.Shutdown(context.Background()); err != nil {
-				// Error from closing listeners, or context timeout:
-				log.Printf("HTTP server Shutdown: %v\n", err)
-			}
-			close(s.idleConnsClosed)
-		}()
-	})
-}
-
-// Helper structs for returning JSON
-type hashIdentifier struct {
-	ID uint64 `json:"id"`
-}
-type hashValue struct {
-	Hash string `json:"hash"`
-}
-
-// Run executes the password hashing service
-func (s *HashService) Run() {
-	// The handler for the web service root - always returns StatusNotFound
-	homeHandler := func(w http.ResponseWriter, r *http.Request) {
-		log.Printf("homeHandler: Not found (%v)\n", r.URL)
-		http.Error(w, "Not found", http.StatusNotFound)
-	}
-
-	// The handler for the the new password hash creation calls
-	hashPostHandler := func(w http.ResponseWriter, r *http.Request) {
-		switch r.Method {
-		case http.MethodPost:
-			startTime := time.Now()
-			defer s.stats.Update(startTime)
-			if r.URL.Path != hashRoutePath {
-				log.Printf("hashPostHandler: Not found (%v)\n", r.URL)
-				http.Error(w, "Not found", http.StatusNotFound)
-				return
-			}
-			if err := r.ParseForm(); err != nil {
-				log.Printf("hashPostHandler: Bad request: %v\n", err)
-				http.Error(w, "Bad request", http.StatusBadRequest)
-				return
-			}
-			pw := r.FormValue("password")
-			if pw == "" {
-				log.Println("hashPostHandler: Bad request: missing password")
-				http.Error(w, "Bad request", http.StatusBadRequest)
-				return
-			}
-			u := s.storage.AddPassword(pw)
-			val := hashIdentifier{ID: u}
-			w.Header().Set("Location", hashRoutePath+"/"+strconv.FormatUint(u, 10))
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusCreated)
-			json.NewEncoder(w).Encode(val)
-			break
-		default:
-			log.Printf("hashPostHandler: Method %v not allowed\n", r.Method)
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-			break
-		}
-	}
-
-	// The handler for the the password hash retrieval calls
-	hashGetHandler := func(w http.ResponseWriter, r *http.Request) {
-		switch r.Method {
-		case http.MethodGet:
-			parts := strings.Split(r.URL.Path, "/")
-			if len(parts) != 3 || parts[0] != "" || "/"+parts[1] != hashRoutePath {
-				log.Printf("hashGetHandler: Not found (%v)\n", r.URL)
-				http.Error(w, "Not found", http.StatusNotFound)
-				return
-			}
-			u, err := strconv.ParseUint(parts[2], 10, 64)
-			if err != nil {
-				log.Printf("hashGetHandler: Bad request: %v\n", err)
-				http.Error(w, "Bad request", http.StatusBadRequest)
-				return
-			}
-			hash, ok := s.storage.GetPasswordHash(u)
-			if !ok {
-				log.Printf("hashGetHandler: Not found (%v)\n", r.URL)
-				http.Error(w, "Not found", http.StatusNotFound)
-				return
-			}
-			val := hashValue{Hash: hash}
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusOK)
-			json.NewEncoder(w).Encode(val)
-			break
-		default:
-			log.Printf("hashGetHandler: Method %v not allowed\n", r.Method)
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-			break
-		}
-	}
-
-	// The handler for the the statistics retrieval calls
-	statsHandler := func(w http.ResponseWriter, r *http.Request) {
-		switch r.Method {
-		case http.MethodGet:
-			if r.URL.Path != statsRoutePath {
-				log.Printf("statsHandler: Not found (%v)\n", r.URL)
-				http.Error(w, "Not found", http.StatusNotFound)
-				return
-			}
-			stats := s.stats.GetCurrentStats()
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusOK)
-			json.NewEncoder(w).Encode(stats)
-			break
-		default:
-			log.Printf("statsHandler: Method %v not allowed\n", r.Method)
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-			break
-		}
-	}
-
-	// The handler for the the graceful shutdown calls
-	shutdownHandler := func(w http.ResponseWriter, r *http.Request) {
-		switch r.Method {
-		case http.MethodPost:
-			if r.URL.Path != shutdownRoutePath {
-				log.Printf("shutdownHandler: Not found (%v)\n", r.URL)
-				http.Error(w, "Not found", http.StatusNotFound)
-				return
-			}
-			s.initiateShutdown()
-			w.WriteHeader(http.StatusOK)
-			w.Write([]byte("OK"))
-			break
-		default:
-			log.Printf("shutdownHandler: Method %v not allowed\n", r.Method)
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-			break
-		}
-	}
-
-	// Initialize route handlers
-	http.HandleFunc("/", homeHandler)
-	http.HandleFunc(hashRoutePath, hashPostHandler)
-	http.HandleFunc(hashRoutePath+"/", hashGetHandler)
-	http.HandleFunc(statsRoutePath, statsHandler)
-	http.HandleFunc(shutdownRoutePath, shutdownHandler)
-
-	// Begin listening for incoming connections
-	if err := s.srv.ListenAndServe(); err != http.ErrServerClosed {
-		// Error starting or closing listener:
-		log.Fatalf("HTTP server ListenAndServe: %v\n", err)
-	}
-
-	// Wait for graceful shutdown
-	<-s.idleConnsClosed
-}
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	hashRoutePath      = "/hash"
+	verifyRoutePath    = "/verify"
+	statsRoutePath     = "/stats"
+	statsDetailedPath  = "/stats/detailed"
+	statsTenantsPath   = "/stats/tenants"
+	statsHistoryPath   = "/stats/history"
+	statsPushRoutePath = "/stats/push"
+	shutdownRoutePath  = "/shutdown"
+	metricsRoutePath   = "/metrics"
+	healthzRoutePath   = "/healthz"
+	readyzRoutePath    = "/readyz"
+	openAPIRoutePath   = "/openapi.json"
+	quotaRoutePath     = "/quota"
+	receiptKeysPath    = "/receipts/keys"
+	statusRoutePath    = "/status"
+
+	adminStorageRoutePath = "/admin/storage"
+	adminJournalRoutePath = "/admin/journal/"
+	adminKeysRoutePath    = "/admin/keys"
+	adminCapacityPath     = "/admin/capacity"
+	adminImportRoutePath  = "/admin/import"
+	adminRecoveryPath     = "/admin/recovery"
+	adminBansPath         = "/admin/bans"
+	adminLockoutsPath     = "/admin/lockouts"
+	adminDiagnosticsPath  = "/admin/diagnostics"
+	adminDoctorPath       = "/admin/doctor"
+	adminReportsUsagePath = "/admin/reports/usage"
+	adminMaintenancePath  = "/admin/maintenance"
+
+	authLoginRoutePath    = "/auth/login"
+	authCallbackRoutePath = "/auth/callback"
+	authLogoutRoutePath   = "/auth/logout"
+
+	replicationStatusRoutePath  = "/replication/status"
+	replicationRecordsRoutePath = "/replication/records"
+)
+
+// HashService represents the password hashing service implementation
+type HashService struct {
+	cfg             *Config
+	srv             http.Server
+	opsSrv          *http.Server
+	idleConnsClosed chan struct{}
+	once            sync.Once
+	storage         *HashStorage
+	stats           *HashStatsStorage
+	snapshots       statsSnapshotStore
+	journal         *Journal
+	hedges          *HedgeTracker
+	bans            *BanList
+	lockouts        *LockoutList
+	idempotency     idempotencyStore
+	keys            *KeyManager
+	tenants         *TenantCounters
+	oidc            *OIDCAuthenticator
+	replication     *ReplicationReceiver
+	// primary forwards the strongly consistent reads of a replica to the primary, nil unless configured
+	primary *httputil.ReverseProxy
+	// federation verifies the records owned by the peer deployments, nil unless configured
+	federation *Federation
+	// limiter limits the request rate of the clients, nil unless configured
+	limiter *RateLimiter
+	// receipts signs the receipts of the accepted hash requests, nil unless a receipt key is configured
+	receipts *ReceiptSigner
+	// audit records the security relevant requests, nil unless a sink is configured
+	audit *AuditLog
+	// shipper and mirror, if set, ship the records to the replication peer and mirror the requests
+	shipper *ReplicationShipper
+	mirror  *RequestMirror
+	// shutdownHooks holds the cleanup of the embedding application, see OnShutdown
+	shutdownHooks shutdownHooks
+	// latencies holds the latencies of the latest public requests, which size the lame duck period
+	latencies latencyWindow
+	// listeners holds the addresses the listeners are bound to, for the readiness file
+	listeners    listenerAddrs
+	shuttingDown int32
+	// promoted is set once a standby replica has promoted itself, see runStandby
+	promoted int32
+	// backgroundWg tracks the background tasks finishing their work on shutdown
+	backgroundWg sync.WaitGroup
+	// statusCache holds the public status page, see statusPage
+	statusCache statusCache
+}
+
+// NewHashService constructs a new instance of the password hashing service
+func NewHashService(cfg *Config) (*HashService, error) {
+	backend, err := NewHashBackend(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.AutoMigrate {
+		if _, err := migrateStorage(backend, cfg.InstanceID); err != nil {
+			return nil, err
+		}
+	} else if _, pending, err := pendingMigrations(backend); err != nil {
+		return nil, err
+	} else if len(pending) > 0 {
+		return nil, fmt.Errorf("%d storage migrations pending, run the migrate subcommand", len(pending))
+	}
+	hashService := &HashService{cfg: cfg}
+	hashService.srv = http.Server{Addr: cfg.Addr}
+	hashService.idleConnsClosed = make(chan struct{})
+	hashService.storage, err = NewHashStorage(backend, cfg)
+	if err != nil {
+		return nil, err
+	}
+	hashService.stats = NewHashStatsStorage(cfg.WarmupDuration, cfg.WarmupCount)
+	hashService.stats.history = newStatsHistory()
+	hashService.snapshots, _ = backend.(statsSnapshotStore)
+	if cfg.Aggregator {
+		hashService.snapshots = NewStatsAggregator()
+	}
+	hashService.keys = NewKeyManager(backend.(apiKeyStore), cfg.AdminKey, cfg.Replica)
+	// The tenants are those of the API keys, so there is nothing to count without the authentication
+	if cfg.AuthEnabled {
+		if hashService.tenants, err = NewTenantCounters(backend.(metadataStore), cfg.InstanceID); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.IdempotencyWindow > 0 {
+		hashService.idempotency, _ = backend.(idempotencyStore)
+		if hashService.idempotency != nil && cfg.IdempotencySecret == "" {
+			logf(logLevelInfo, "The idempotency keys reused with a different password are not recognized without an idempotency secret\n")
+		}
+	}
+	if cfg.HedgeWindow > 0 {
+		hashService.hedges = NewHedgeTracker(cfg.HedgeWindow)
+	}
+	if cfg.BanThreshold > 0 {
+		hashService.bans = NewBanList(cfg.BanThreshold, cfg.BanWindow, cfg.BanDuration)
+	}
+	if cfg.VerifyBudget > 0 {
+		hashService.lockouts = NewLockoutList(cfg.VerifyBudget, cfg.VerifyLockout)
+	}
+	if cfg.ReceiptKeys != "" {
+		if hashService.receipts, err = NewReceiptSigner(cfg); err != nil {
+			return nil, fmt.Errorf("receipt keys: %v", err)
+		}
+	}
+	if cfg.Replica && cfg.PrimaryURL != "" {
+		if hashService.primary, err = newPrimaryProxy(cfg.PrimaryURL); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.FederationPeers != "" {
+		if hashService.federation, err = NewFederation(cfg); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.RateLimit > 0 {
+		redisTLS, err := backendClientConfig(cfg, "redis")
+		if err != nil {
+			return nil, fmt.Errorf("redis TLS: %v", err)
+		}
+		hashService.limiter, err = NewRateLimiter(cfg.RateLimit, cfg.RateLimitBurst, cfg.RateLimitRedis, cfg.RateLimitRedisTimeout, redisTLS)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if cfg.OIDCIssuer != "" {
+		if hashService.oidc, err = NewOIDCAuthenticator(cfg); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.JournalRate > 0 {
+		hashService.journal = NewJournal(cfg.JournalRate, cfg.JournalSize)
+	}
+	if hashService.audit, err = NewAuditLog(cfg); err != nil {
+		return nil, err
+	}
+	// The replication peers authenticate with the client certificates issued by the configured CA
+	if cfg.ReplicationClientCA != "" {
+		pool, err := loadCertPool(cfg.ReplicationClientCA)
+		if err != nil {
+			return nil, err
+		}
+		hashService.srv.TLSConfig = &tls.Config{ClientCAs: pool, ClientAuth: tls.VerifyClientCertIfGiven}
+		hashService.replication = NewReplicationReceiver(hashService.storage, backend.(metadataStore))
+	}
+	var shipper *ReplicationShipper
+	if cfg.ReplicationPeer != "" {
+		if shipper, err = NewReplicationShipper(cfg, backend); err != nil {
+			return nil, err
+		}
+		hashService.storage.onComplete = shipper.Enqueue
+		hashService.shipper = shipper
+		hashService.runInBackground(func() { shipper.Run(hashService.idleConnsClosed) })
+	}
+	registerQueueMetrics(hashService.storage)
+	if alerts := NewAlertEvaluator(cfg, hashService.storage, shipper); !alerts.Empty() {
+		hashService.runInBackground(func() { alerts.Run(hashService.idleConnsClosed) })
+	}
+
+	// The replica must not modify the storage maintained by the primary instance
+	if !cfg.Replica {
+		hashService.startPrimaryTasks()
+	}
+	if cfg.StandbyOf != "" {
+		hashService.runInBackground(func() { hashService.runStandby(hashService.idleConnsClosed) })
+	}
+	return hashService, nil
+}
+
+// startPrimaryTasks starts the background maintenance of the storage by the instance writing it
+func (s *HashService) startPrimaryTasks() {
+	if c, ok := s.storage.backend.(storageCompactor); ok && s.cfg.Compaction > 0 {
+		s.runInBackground(func() { runCompaction(c, s.cfg.Compaction, s.idleConnsClosed) })
+	}
+	if s.tenants != nil {
+		s.runInBackground(func() { s.tenants.Run(s.idleConnsClosed) })
+	}
+	if s.idempotency != nil {
+		s.runInBackground(func() {
+			runIdempotencyExpiry(s.idempotency, s.cfg.ReaperInterval, s.idleConnsClosed)
+		})
+	}
+	if s.snapshots != nil && s.cfg.StatsSnapshot > 0 && !s.cfg.Aggregator {
+		s.runInBackground(func() {
+			runStatsSnapshots(s.snapshots, s.cfg.InstanceID, s.stats, s.cfg.StatsSnapshot, s.idleConnsClosed)
+		})
+	}
+	if s.cfg.StatsPushURL != "" {
+		pusher := newStatsPusher(s.cfg.StatsPushURL, s.cfg.StatsPushToken)
+		s.runInBackground(func() {
+			runStatsSnapshots(pusher, s.cfg.InstanceID, s.stats, s.cfg.StatsSnapshot, s.idleConnsClosed)
+		})
+	}
+}
+
+// runInBackground runs the task which the service waits for on shutdown
+func (s *HashService) runInBackground(task func()) {
+	s.backgroundWg.Add(1)
+	go func() {
+		defer s.backgroundWg.Done()
+		task()
+	}()
+}
+
+// currentStats returns the statistics of this instance, or of the whole cluster if requested.
+// The cluster statistics are combined from the snapshots saved by the instances to the shared storage,
+// or pushed to the aggregator, with the live statistics of this instance. A replica and the aggregator
+// always report the cluster statistics
+func (s *HashService) currentStats(cluster bool) (HashStats, error) {
+	clusterOnly := s.isReplica() || s.cfg.Aggregator
+	if !cluster && !clusterOnly {
+		return s.stats.GetCurrentStats(), nil
+	}
+	if s.snapshots == nil {
+		return HashStats{}, errClusterStatsUnavailable
+	}
+	snaps, err := s.snapshots.ListStats()
+	if err != nil {
+		return HashStats{}, err
+	}
+	var all []HashStats
+	for _, snap := range snaps {
+		if snap.Instance != s.cfg.InstanceID || clusterOnly {
+			all = append(all, snap.HashStats)
+		}
+	}
+	if !clusterOnly {
+		all = append(all, s.stats.GetCurrentStats())
+	}
+	return aggregateStats(all), nil
+}
+
+// formatMillis formats the duration as fractional milliseconds
+func formatMillis(d time.Duration) string {
+	return strconv.FormatFloat(float64(d)/float64(time.Millisecond), 'f', 3, 64)
+}
+
+// Grecefully shut down the server
+func (s *HashService) initiateShutdown() {
+	// We received a shutdown command, shut down. Make sure we call it only once.
+	s.once.Do(func() {
+		// Report not ready right away so that the load balancer stops routing the traffic
+		atomic.StoreInt32(&s.shuttingDown, 1)
+		delay := s.lameDuckDelay()
+		if delay > 0 {
+			logf(logLevelInfo, "Shutting down in %v, reporting not ready meanwhile\n", delay)
+		}
+		go func() {
+			time.Sleep(delay)
+			if err := s.srv.Shutdown(context.Background()); err != nil {
+				// Error from closing listeners, or context timeout:
+				logf(logLevelError, "HTTP server Shutdown: %v\n", err)
+			}
+			// The probes are answered until the public requests are drained
+			if s.opsSrv != nil {
+				s.opsSrv.Shutdown(context.Background())
+			}
+			close(s.idleConnsClosed)
+		}()
+	})
+}
+
+// checkReadiness returns the reason why the service cannot accept the traffic, if any
+func (s *HashService) checkReadiness() string {
+	if atomic.LoadInt32(&s.shuttingDown) != 0 {
+		return "shutting down"
+	}
+	if s.storage.Saturated() {
+		return "hash queue is full"
+	}
+	if err := s.storage.Ping(); err != nil {
+		return "storage unavailable: " + err.Error()
+	}
+	return ""
+}
+
+// authenticate returns the API key authenticating the request. Without a key, the session
+// of the admin user signed in with OIDC is accepted
+func (s *HashService) authenticate(r *http.Request) (*apiKey, error) {
+	token := requestToken(r)
+	if token == "" && s.oidc != nil {
+		if cookie, err := r.Cookie(oidcSessionCookie); err == nil {
+			if key, ok := s.oidc.Session(cookie.Value); ok {
+				return key, nil
+			}
+		}
+	}
+	return s.keys.Authenticate(token)
+}
+
+// authorize wraps the handler requiring an API key when the authentication is enabled.
+// The key must grant the scope mapped to the request method. The methods missing
+// from the scopes only require a valid key
+func (s *HashService) authorize(scopes map[string]string, handler http.HandlerFunc) http.HandlerFunc {
+	if s.audit != nil {
+		handler = s.audited(scopes, handler)
+	}
+	if !s.cfg.AuthEnabled {
+		if s.limiter == nil {
+			return handler
+		}
+		return func(w http.ResponseWriter, r *http.Request) {
+			if s.limitRate(w, r) {
+				handler(w, r)
+			}
+		}
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		key, err := s.authenticate(r)
+		if err != nil {
+			s.writeError(w, r, "authorize", err)
+			if err == ErrUnauthenticated {
+				s.auditRequest(r, nil, http.StatusUnauthorized)
+			}
+			return
+		}
+		if scope, ok := scopes[r.Method]; ok && !key.HasScope(scope) {
+			s.writeError(w, r, "authorize", forbidden("key %v lacks scope %v", key.ID, scope))
+			s.auditRequest(r, key, http.StatusForbidden)
+			return
+		}
+		r = r.WithContext(context.WithValue(r.Context(), requestKey{}, key))
+		if s.limitRate(w, r) {
+			start := time.Now()
+			handler(w, r)
+			latency := uint64(time.Since(start) / time.Microsecond)
+			s.tenants.Add(r, func(c *tenantCounts) { c.Requests++; c.LatencyMicros += latency })
+		}
+	}
+}
+
+// replayIdempotent replies to a retry of the request with the hash created by the first attempt.
+// The key reused for a request with different parameters is rejected
+func (s *HashService) replayIdempotent(w http.ResponseWriter, r *http.Request, rec idempotencyRecord, fingerprint string, receipt bool) {
+	if subtle.ConstantTimeCompare([]byte(rec.Fingerprint), []byte(fingerprint)) != 1 {
+		s.writeError(w, r, "hashPostHandler", ErrIdempotencyMismatch)
+		return
+	}
+	logf(logLevelDebug, "hashPostHandler: Replaying hash %d\n", rec.ID)
+	val := []hashIdentifier{{ID: rec.ID}}
+	if s.cfg.Sync && mayReadHashes(r) {
+		if stored, err := s.storage.GetRecord(rec.ID); err == nil {
+			val[0].Hash = stored.Hash
+		}
+	}
+	// The receipt of a replay proves the acceptance of the first request
+	if receipt {
+		if err := s.signReceipts(r, val, rec.Created); err != nil {
+			s.writeError(w, r, "hashPostHandler", err)
+			return
+		}
+	}
+	w.Header().Set("Idempotent-Replayed", "true")
+	w.Header().Set("Location", s.absoluteURL(r, hashRoutePath+"/"+strconv.FormatUint(rec.ID, 10)))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(val[0])
+}
+
+// addPassword queues the hash calculation for the tenant, or calculates the hash right away in the synchronous mode.
+// The queued hash is purged after the retain period unless fetched before, the synchronous one is returned at once
+func (s *HashService) addPassword(pw string, salt *callerSalt, ttl, retain time.Duration, tenant string, journal *journalEntry) (hashIdentifier, error) {
+	if s.cfg.Sync {
+		u, rec, err := s.storage.AddPasswordSync(pw, salt, ttl, tenant, journal)
+		return hashIdentifier{ID: u, Hash: rec.Hash}, err
+	}
+	u, err := s.storage.AddPassword(pw, salt, ttl, retain, tenant, journal)
+	return hashIdentifier{ID: u}, err
+}
+
+// addPasswords queues the hash calculations of the passwords submitted in one form and responds
+// with their identifiers in the submission order. Either all the calculations are queued or none
+func (s *HashService) addPasswords(w http.ResponseWriter, r *http.Request, passwords []string, ttl, retain time.Duration, receipt bool) {
+	ids := make([]hashIdentifier, 0, len(passwords))
+	for _, pw := range passwords {
+		val, err := s.addPassword(pw, nil, ttl, retain, contextTenant(r.Context()), nil)
+		if err != nil {
+			for _, id := range ids {
+				s.storage.DeletePassword(id.ID)
+			}
+			s.writeError(w, r, "hashPostHandler", err)
+			return
+		}
+		if !mayReadHashes(r) {
+			val.Hash = ""
+		}
+		ids = append(ids, val)
+	}
+	if receipt {
+		if err := s.signReceipts(r, ids, time.Now()); err != nil {
+			s.writeError(w, r, "hashPostHandler", err)
+			return
+		}
+	}
+	s.tenants.Add(r, func(c *tenantCounts) { c.Created += uint64(len(ids)) })
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(ids)
+}
+
+// secureCookies checks whether the session cookies are restricted to HTTPS
+func (s *HashService) secureCookies() bool {
+	return s.cfg.TLSCertFile != "" || strings.HasPrefix(s.cfg.OIDCRedirectURL, "https://")
+}
+
+// errClusterStatsUnavailable is returned when the cluster statistics are requested without a shared storage backend
+var errClusterStatsUnavailable = notImplemented("cluster statistics require a persistent storage backend")
+
+// maxImportSize limits the size of the hash import request body
+const maxImportSize = 64 << 20
+
+// maxFormPasswords limits the number of passwords submitted in one form
+const maxFormPasswords = 100
+
+// Helper structs for returning JSON
+type hashIdentifier struct {
+	ID uint64 `json:"id"`
+	// Hash is returned in the synchronous mode only
+	Hash string `json:"hash,omitempty"`
+	// Receipt is the signed proof of the acceptance of the hash, if asked for
+	Receipt string `json:"receipt,omitempty"`
+}
+type hashValue struct {
+	Hash string `json:"hash"`
+}
+type verifyResult struct {
+	Match bool `json:"match"`
+}
+
+// importLine is a single hash of the import request
+type importLine struct {
+	Hash string `json:"hash"`
+	// Ref is an opaque reference echoed back, e.g. the user identifier in the other system
+	Ref       string `json:"ref,omitempty"`
+	ExpiresIn uint32 `json:"expires_in,omitempty"`
+	// Tenant is the tenant the hash is imported for, by default that of the importing API key
+	Tenant string `json:"tenant,omitempty"`
+}
+
+// importResult reports the outcome of importing a single hash
+type importResult struct {
+	Line  int    `json:"line"`
+	Ref   string `json:"ref,omitempty"`
+	ID    uint64 `json:"id,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// importReport represents the outcome of the hash import request
+type importReport struct {
+	Imported int            `json:"imported"`
+	Failed   int            `json:"failed"`
+	Results  []importResult `json:"results"`
+}
+
+// Run executes the password hashing service
+func (s *HashService) Run() {
+	// The handler for the web service root - always returns StatusNotFound
+	homeHandler := func(w http.ResponseWriter, r *http.Request) {
+		logf(logLevelInfo, "homeHandler: Not found (%v)\n", r.URL)
+		http.Error(w, "Not found", http.StatusNotFound)
+	}
+
+	// The handler for the the new password hash creation calls
+	hashPostHandler := func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPost:
+			startTime := time.Now()
+			defer s.stats.Update(startTime)
+			var journal *journalEntry
+			if s.journal != nil {
+				requestID := r.Header.Get("X-Request-ID")
+				if requestID == "" {
+					requestID = newRequestID()
+				}
+				w.Header().Set("X-Request-ID", requestID)
+				journal = s.journal.Start(requestID)
+				journal.Record("handler_entry")
+			}
+			if r.URL.Path != hashRoutePath {
+				logf(logLevelInfo, "hashPostHandler: Not found (%v)\n", r.URL)
+				http.Error(w, "Not found", http.StatusNotFound)
+				return
+			}
+			if err := r.ParseForm(); err != nil {
+				s.writeError(w, r, "hashPostHandler", malformedRequest(err))
+				return
+			}
+			// Several passwords may be submitted at once as repeated password or passwords[] fields
+			passwords := r.Form["password"]
+			if len(passwords) == 0 {
+				passwords = r.Form["passwords[]"]
+			}
+			if len(passwords) > maxFormPasswords {
+				s.writeError(w, r, "hashPostHandler", policyViolation("more than %d passwords", maxFormPasswords))
+				return
+			}
+			for _, pw := range passwords {
+				if pw == "" {
+					s.writeError(w, r, "hashPostHandler", policyViolation("empty password"))
+					return
+				}
+			}
+			if len(passwords) == 0 {
+				s.writeError(w, r, "hashPostHandler", policyViolation("missing password"))
+				return
+			}
+			var ttl time.Duration
+			if v := r.FormValue("expires_in"); v != "" {
+				secs, err := strconv.ParseUint(v, 10, 32)
+				if err != nil || secs == 0 {
+					s.writeError(w, r, "hashPostHandler", policyViolation("invalid expires_in %q", v))
+					return
+				}
+				ttl = time.Duration(secs) * time.Second
+			}
+			var retain time.Duration
+			if v := r.FormValue("retain_unclaimed"); v != "" {
+				secs, err := strconv.ParseUint(v, 10, 32)
+				if err != nil || secs == 0 {
+					s.writeError(w, r, "hashPostHandler", policyViolation("invalid retain_unclaimed %q", v))
+					return
+				}
+				retain = time.Duration(secs) * time.Second
+			}
+			receipt, err := s.wantsReceipt(r)
+			if err != nil {
+				s.writeError(w, r, "hashPostHandler", err)
+				return
+			}
+			salt, err := parseCallerSalt(r)
+			if err != nil {
+				s.writeError(w, r, "hashPostHandler", err)
+				return
+			}
+			if salt != nil {
+				if key := requestAPIKey(r); !s.cfg.CallerSalts || key == nil || !key.HasScope(scopeHashSalt) {
+					s.writeError(w, r, "hashPostHandler", forbidden("caller salt not allowed"))
+					return
+				}
+			}
+			if len(passwords) > 1 {
+				if salt != nil {
+					s.writeError(w, r, "hashPostHandler", policyViolation("salt with several passwords"))
+					return
+				}
+				if r.Header.Get("Idempotency-Key") != "" {
+					s.writeError(w, r, "hashPostHandler", policyViolation("idempotency key with several passwords"))
+					return
+				}
+				s.addPasswords(w, r, passwords, ttl, retain, receipt)
+				return
+			}
+			pw := passwords[0]
+			// The retries of the request with the same idempotency key return the hash created first
+			var idem idempotencyRecord
+			if key := r.Header.Get("Idempotency-Key"); key != "" && s.idempotency != nil {
+				idem.Key = scopedIdempotencyKey(r, key)
+				idem.Fingerprint = idempotencyFingerprint([]byte(s.cfg.IdempotencySecret), idem.Key, pw, salt, ttl, retain)
+				existing, ok, err := s.idempotency.GetIdempotency(idem.Key)
+				if err != nil {
+					s.writeError(w, r, "hashPostHandler", err)
+					return
+				}
+				if ok {
+					s.replayIdempotent(w, r, existing, idem.Fingerprint, receipt)
+					return
+				}
+			}
+			val, err := s.addPassword(pw, salt, ttl, retain, contextTenant(r.Context()), journal)
+			if err != nil {
+				s.writeError(w, r, "hashPostHandler", err)
+				return
+			}
+			u := val.ID
+			if !mayReadHashes(r) {
+				val.Hash = ""
+			}
+			accepted := time.Now().UTC()
+			if idem.Key != "" {
+				idem.ID = u
+				idem.Created = accepted
+				idem.Expires = idem.Created.Add(s.cfg.IdempotencyWindow)
+				existing, claimed, err := s.idempotency.ClaimIdempotency(idem)
+				if err != nil {
+					// The hash has been created, so a failure here must not make the client retry
+					logf(logLevelError, "hashPostHandler: Error while saving idempotency key: %v\n", err)
+				} else if !claimed {
+					// A concurrent retry has won, so cancel this calculation in favor of its hash
+					s.storage.DeletePassword(u)
+					s.replayIdempotent(w, r, existing, idem.Fingerprint, receipt)
+					return
+				}
+			}
+			if receipt {
+				ids := []hashIdentifier{val}
+				if err := s.signReceipts(r, ids, accepted); err != nil {
+					s.writeError(w, r, "hashPostHandler", err)
+					return
+				}
+				val = ids[0]
+			}
+			s.tenants.Add(r, func(c *tenantCounts) { c.Created++ })
+			w.Header().Set("Location", s.absoluteURL(r, hashRoutePath+"/"+strconv.FormatUint(u, 10)))
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(val)
+			break
+		default:
+			logf(logLevelInfo, "hashPostHandler: Method %v not allowed\n", r.Method)
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			break
+		}
+	}
+
+	// The handler for the the password hash retrieval and removal calls
+	hashIDHandler := func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodDelete {
+			logf(logLevelInfo, "hashIDHandler: Method %v not allowed\n", r.Method)
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if len(r.URL.Path) > maxHashPathLength {
+			logf(logLevelInfo, "hashIDHandler: URI too long (%v)\n", truncatePath(r.URL.Path))
+			http.Error(w, "URI too long", http.StatusRequestURITooLong)
+			return
+		}
+		path := r.URL.Path
+		params := strings.HasSuffix(path, hashParamsSuffix)
+		if params {
+			if r.Method != http.MethodGet {
+				logf(logLevelInfo, "hashIDHandler: Method %v not allowed\n", r.Method)
+				http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			path = strings.TrimSuffix(path, hashParamsSuffix)
+		}
+		parts := strings.Split(path, "/")
+		if len(parts) != 3 || parts[0] != "" || "/"+parts[1] != hashRoutePath {
+			logf(logLevelInfo, "hashIDHandler: Not found (%v)\n", r.URL)
+			http.Error(w, "Not found", http.StatusNotFound)
+			return
+		}
+		u, err := parseHashID(parts[2])
+		if err != nil {
+			s.writeError(w, r, "hashIDHandler", err)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			if s.routeRead(w, r, "hashIDHandler") {
+				return
+			}
+			if s.hedges != nil && s.hedges.Track(r.Header.Get("X-Request-ID")) {
+				logf(logLevelDebug, "hashIDHandler: Hedged duplicate of request %v\n", r.Header.Get("X-Request-ID"))
+			}
+			// The client may wait for a pending calculation rather than poll for it
+			if v := r.URL.Query().Get("wait"); v != "" {
+				wait, err := time.ParseDuration(v)
+				if err != nil || wait <= 0 || wait > maxHashWait {
+					s.writeError(w, r, "hashIDHandler", policyViolation("wait must be a duration up to %v", maxHashWait))
+					return
+				}
+				s.storage.WaitPending(r.Context(), u, wait)
+			}
+			// The parameters do not reveal the hash, so fetching them leaves the hash unclaimed
+			get := s.storage.ClaimRecord
+			if params {
+				get = s.storage.GetRecord
+			}
+			rec, err := get(u)
+			if err != nil {
+				s.writeError(w, r, "hashIDHandler", err)
+				return
+			}
+			if params {
+				p, err := recordParams(rec)
+				if err != nil {
+					s.writeError(w, r, "hashIDHandler", err)
+					return
+				}
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusOK)
+				json.NewEncoder(w).Encode(p)
+				break
+			}
+			// Let the client tooling tell the server queueing and the calculation from the network time
+			if s.cfg.TimingHeaders || r.Header.Get("X-Debug-Timing") != "" {
+				w.Header().Set("X-Queue-Wait-Ms", formatMillis(rec.Started.Sub(rec.Enqueued)))
+				w.Header().Set("X-Processing-Ms", formatMillis(rec.Created.Sub(rec.Started)))
+			}
+			val := hashValue{Hash: rec.Hash}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			json.NewEncoder(w).Encode(val)
+			break
+		case http.MethodDelete:
+			if err := s.storage.DeletePassword(u); err != nil {
+				s.writeError(w, r, "hashIDHandler", err)
+				return
+			}
+			s.tenants.Add(r, func(c *tenantCounts) { c.Deleted++ })
+			w.WriteHeader(http.StatusNoContent)
+			break
+		}
+	}
+
+	// The handler for the password verification calls
+	verifyHandler := func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPost:
+			if r.URL.Path != verifyRoutePath {
+				logf(logLevelInfo, "verifyHandler: Not found (%v)\n", r.URL)
+				http.Error(w, "Not found", http.StatusNotFound)
+				return
+			}
+			if s.routeRead(w, r, "verifyHandler") {
+				return
+			}
+			if err := r.ParseForm(); err != nil {
+				s.writeError(w, r, "verifyHandler", malformedRequest(err))
+				return
+			}
+			u, err := parseHashID(r.FormValue("id"))
+			if err != nil {
+				s.writeError(w, r, "verifyHandler", err)
+				return
+			}
+			pw := r.FormValue("password")
+			if pw == "" {
+				s.writeError(w, r, "verifyHandler", policyViolation("missing password"))
+				return
+			}
+			var tenant string
+			if key := requestAPIKey(r); key != nil {
+				tenant = key.Tenant
+			}
+			match, err := s.verifyThrottled(tenant, r.FormValue("identity"), u, pw)
+			if err != nil {
+				s.writeError(w, r, "verifyHandler", err)
+				return
+			}
+			s.tenants.Add(r, func(c *tenantCounts) { c.Verified++ })
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			json.NewEncoder(w).Encode(verifyResult{Match: match})
+			break
+		default:
+			logf(logLevelInfo, "verifyHandler: Method %v not allowed\n", r.Method)
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			break
+		}
+	}
+
+	// The handler for the quota introspection calls
+	quotaHandler := func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			if r.URL.Path != quotaRoutePath {
+				logf(logLevelInfo, "quotaHandler: Not found (%v)\n", r.URL)
+				http.Error(w, "Not found", http.StatusNotFound)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Cache-Control", "no-store")
+			w.WriteHeader(http.StatusOK)
+			json.NewEncoder(w).Encode(s.quota(r, time.Now()))
+			break
+		default:
+			logf(logLevelInfo, "quotaHandler: Method %v not allowed\n", r.Method)
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			break
+		}
+	}
+
+	// The handler for the the statistics retrieval calls
+	statsHandler := func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			if r.URL.Path != statsRoutePath {
+				logf(logLevelInfo, "statsHandler: Not found (%v)\n", r.URL)
+				http.Error(w, "Not found", http.StatusNotFound)
+				return
+			}
+			var cluster bool
+			switch scope := r.URL.Query().Get("scope"); scope {
+			case "", "local":
+			case "cluster":
+				cluster = true
+			default:
+				s.writeError(w, r, "statsHandler", policyViolation("unknown scope %q", scope))
+				return
+			}
+			stats, err := s.currentStats(cluster)
+			if err != nil {
+				s.writeError(w, r, "statsHandler", err)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			json.NewEncoder(w).Encode(stats)
+			break
+		default:
+			logf(logLevelInfo, "statsHandler: Method %v not allowed\n", r.Method)
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			break
+		}
+	}
+
+	// The handler for the the detailed statistics retrieval calls
+	statsDetailedHandler := func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			if r.URL.Path != statsDetailedPath {
+				logf(logLevelInfo, "statsDetailedHandler: Not found (%v)\n", r.URL)
+				http.Error(w, "Not found", http.StatusNotFound)
+				return
+			}
+			stats := s.storage.DetailedStats()
+			if s.cfg.WarmupDuration > 0 || s.cfg.WarmupCount > 0 {
+				warmup := s.stats.GetWarmupStats()
+				stats.Warmup = &warmup
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			json.NewEncoder(w).Encode(stats)
+			break
+		default:
+			logf(logLevelInfo, "statsDetailedHandler: Method %v not allowed\n", r.Method)
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			break
+		}
+	}
+
+	// The handler for the history of the statistics of this instance, e.g. ?since=6h&resolution=1m
+	statsHistoryHandler := func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			logf(logLevelInfo, "statsHistoryHandler: Method %v not allowed\n", r.Method)
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		since, resolution := time.Hour, time.Duration(0)
+		var err error
+		if v := r.URL.Query().Get("since"); v != "" {
+			if since, err = time.ParseDuration(v); err != nil || since <= 0 {
+				s.writeError(w, r, "statsHistoryHandler", policyViolation("invalid since %q", v))
+				return
+			}
+		}
+		if v := r.URL.Query().Get("resolution"); v != "" {
+			if resolution, err = time.ParseDuration(v); err != nil || resolution <= 0 {
+				s.writeError(w, r, "statsHistoryHandler", policyViolation("invalid resolution %q", v))
+				return
+			}
+		}
+		now := time.Now()
+		points, resolution, err := s.stats.history.Query(now.Add(-since), now, resolution)
+		if err != nil {
+			s.writeError(w, r, "statsHistoryHandler", err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(struct {
+			Resolution string         `json:"resolution"`
+			Points     []historyPoint `json:"points"`
+		}{resolution.String(), points})
+	}
+
+	// The handler for the per-tenant operation totals. The keys without the admin scope
+	// only see the totals of their own tenant
+	statsTenantsHandler := func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			logf(logLevelInfo, "statsTenantsHandler: Method %v not allowed\n", r.Method)
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if r.URL.Path != statsTenantsPath {
+			logf(logLevelInfo, "statsTenantsHandler: Not found (%v)\n", r.URL)
+			http.Error(w, "Not found", http.StatusNotFound)
+			return
+		}
+		if s.tenants == nil {
+			s.writeError(w, r, "statsTenantsHandler", notImplemented("tenant counters require the authentication"))
+			return
+		}
+		tenant := r.URL.Query().Get("tenant")
+		if key := requestAPIKey(r); !key.HasScope(scopeAdmin) {
+			if key.Tenant == "" {
+				s.writeError(w, r, "statsTenantsHandler", forbidden("key %v has no tenant", key.ID))
+				return
+			}
+			tenant = key.Tenant
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(s.tenants.Get(tenant))
+	}
+
+	// The handler for the the graceful shutdown calls
+	shutdownHandler := func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPost:
+			if r.URL.Path != shutdownRoutePath {
+				logf(logLevelInfo, "shutdownHandler: Not found (%v)\n", r.URL)
+				http.Error(w, "Not found", http.StatusNotFound)
+				return
+			}
+			s.initiateShutdown()
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte("OK"))
+			break
+		default:
+			logf(logLevelInfo, "shutdownHandler: Method %v not allowed\n", r.Method)
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			break
+		}
+	}
+
+	// The handler for the Prometheus metrics scraping calls
+	metricsHandler := func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			if r.URL.Path != metricsRoutePath {
+				logf(logLevelInfo, "metricsHandler: Not found (%v)\n", r.URL)
+				http.Error(w, "Not found", http.StatusNotFound)
+				return
+			}
+			w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+			w.WriteHeader(http.StatusOK)
+			metrics.WriteTo(w)
+			break
+		default:
+			logf(logLevelInfo, "metricsHandler: Method %v not allowed\n", r.Method)
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			break
+		}
+	}
+
+	// The handler for the storage usage report calls
+	adminStorageHandler := func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			if r.URL.Path != adminStorageRoutePath {
+				logf(logLevelInfo, "adminStorageHandler: Not found (%v)\n", r.URL)
+				http.Error(w, "Not found", http.StatusNotFound)
+				return
+			}
+			usage, err := s.storage.Usage()
+			if err != nil {
+				s.writeError(w, r, "adminStorageHandler", err)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			json.NewEncoder(w).Encode(usage)
+			break
+		default:
+			logf(logLevelInfo, "adminStorageHandler: Method %v not allowed\n", r.Method)
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			break
+		}
+	}
+
+	// The handler for the calls importing the hashes calculated by another system.
+	// The body holds a JSON object per line
+	adminImportHandler := func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPost:
+			if r.URL.Path != adminImportRoutePath {
+				logf(logLevelInfo, "adminImportHandler: Not found (%v)\n", r.URL)
+				http.Error(w, "Not found", http.StatusNotFound)
+				return
+			}
+			report := importReport{Results: []importResult{}}
+			dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxImportSize))
+			for line := 1; dec.More(); line++ {
+				var in importLine
+				if err := dec.Decode(&in); err != nil {
+					s.writeError(w, r, "adminImportHandler", malformedRequest(fmt.Errorf("line %d: %v", line, err)))
+					return
+				}
+				result := importResult{Line: line, Ref: in.Ref}
+				tenant := in.Tenant
+				if tenant == "" {
+					tenant = contextTenant(r.Context())
+				}
+				u, err := s.storage.ImportHash(in.Hash, time.Duration(in.ExpiresIn)*time.Second, tenant)
+				if err == ErrReadOnly {
+					s.writeError(w, r, "adminImportHandler", err)
+					return
+				}
+				if err != nil {
+					result.Error = err.Error()
+					report.Failed++
+				} else {
+					result.ID = u
+					report.Imported++
+				}
+				report.Results = append(report.Results, result)
+			}
+			logf(logLevelInfo, "adminImportHandler: Imported %d hashes, %d failed\n", report.Imported, report.Failed)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			json.NewEncoder(w).Encode(report)
+			break
+		default:
+			logf(logLevelInfo, "adminImportHandler: Method %v not allowed\n", r.Method)
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			break
+		}
+	}
+
+	// The handler for the startup recovery report calls
+	adminRecoveryHandler := func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			if r.URL.Path != adminRecoveryPath {
+				logf(logLevelInfo, "adminRecoveryHandler: Not found (%v)\n", r.URL)
+				http.Error(w, "Not found", http.StatusNotFound)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			json.NewEncoder(w).Encode(s.storage.Recovery())
+			break
+		default:
+			logf(logLevelInfo, "adminRecoveryHandler: Method %v not allowed\n", r.Method)
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			break
+		}
+	}
+
+	// The handler for the call producing the diagnostics bundle
+	adminDiagnosticsHandler := func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPost:
+			now := time.Now()
+			var buf bytes.Buffer
+			if err := s.writeDiagnostics(&buf, now); err != nil {
+				s.writeError(w, r, "adminDiagnosticsHandler", err)
+				return
+			}
+			logf(logLevelInfo, "adminDiagnosticsHandler: Produced the diagnostics bundle of %d bytes\n", buf.Len())
+			name := "phs-diagnostics-" + s.cfg.InstanceID + "-" + now.UTC().Format("20060102T150405Z") + ".tar.gz"
+			w.Header().Set("Content-Type", "application/gzip")
+			w.Header().Set("Content-Disposition", `attachment; filename="`+name+`"`)
+			w.WriteHeader(http.StatusOK)
+			w.Write(buf.Bytes())
+			break
+		default:
+			logf(logLevelInfo, "adminDiagnosticsHandler: Method %v not allowed\n", r.Method)
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			break
+		}
+	}
+
+	// The handler for the calls listing and lifting the bans of the sources
+	adminBansHandler := func(w http.ResponseWriter, r *http.Request) {
+		if s.bans == nil {
+			s.writeError(w, r, "adminBansHandler", notImplemented("bans are disabled"))
+			return
+		}
+		source := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, adminBansPath), "/")
+		switch {
+		case r.URL.Path == adminBansPath && r.Method == http.MethodGet:
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			json.NewEncoder(w).Encode(s.bans.List(time.Now()))
+		case source != "" && r.Method == http.MethodDelete:
+			if err := s.bans.Lift(source); err != nil {
+				s.writeError(w, r, "adminBansHandler", err)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		case r.URL.Path == adminBansPath || source != "":
+			logf(logLevelInfo, "adminBansHandler: Method %v not allowed\n", r.Method)
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		default:
+			logf(logLevelInfo, "adminBansHandler: Not found (%v)\n", r.URL)
+			http.Error(w, "Not found", http.StatusNotFound)
+		}
+	}
+
+	// The handler for the usage report calls, answered as JSON or as a CSV download
+	adminReportsUsageHandler := func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			if r.URL.Path != adminReportsUsagePath {
+				logf(logLevelInfo, "adminReportsUsageHandler: Not found (%v)\n", r.URL)
+				http.Error(w, "Not found", http.StatusNotFound)
+				return
+			}
+			if s.tenants == nil {
+				s.writeError(w, r, "adminReportsUsageHandler", notImplemented("tenant counters require the authentication"))
+				return
+			}
+			query := r.URL.Query()
+			from, to, err := parseReportPeriod(query.Get("from"), query.Get("to"), time.Now())
+			if err != nil {
+				s.writeError(w, r, "adminReportsUsageHandler", err)
+				return
+			}
+			report := s.usageReport(query.Get("tenant"), from, to)
+			switch query.Get("format") {
+			case "", "json":
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusOK)
+				json.NewEncoder(w).Encode(report)
+			case "csv":
+				w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+				w.Header().Set("Content-Disposition", `attachment; filename="`+usageReportFilename(report)+`"`)
+				w.WriteHeader(http.StatusOK)
+				if err := writeUsageCSV(w, report); err != nil {
+					logf(logLevelInfo, "adminReportsUsageHandler: Error while writing the report: %v\n", err)
+				}
+			default:
+				s.writeError(w, r, "adminReportsUsageHandler", policyViolation("unsupported format %q", query.Get("format")))
+			}
+			break
+		default:
+			logf(logLevelInfo, "adminReportsUsageHandler: Method %v not allowed\n", r.Method)
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			break
+		}
+	}
+
+	// The handler for the calls listing the identities locked out of the verifications and unlocking them
+	adminLockoutsHandler := func(w http.ResponseWriter, r *http.Request) {
+		if s.lockouts == nil {
+			s.writeError(w, r, "adminLockoutsHandler", notImplemented("verification budget is disabled"))
+			return
+		}
+		identity := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, adminLockoutsPath), "/")
+		switch {
+		case r.URL.Path == adminLockoutsPath && r.Method == http.MethodGet:
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			json.NewEncoder(w).Encode(s.lockouts.List(time.Now()))
+		case identity != "" && r.Method == http.MethodDelete:
+			if err := s.lockouts.Unlock(identity); err != nil {
+				s.writeError(w, r, "adminLockoutsHandler", err)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		case r.URL.Path == adminLockoutsPath || identity != "":
+			logf(logLevelInfo, "adminLockoutsHandler: Method %v not allowed\n", r.Method)
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		default:
+			logf(logLevelInfo, "adminLockoutsHandler: Not found (%v)\n", r.URL)
+			http.Error(w, "Not found", http.StatusNotFound)
+		}
+	}
+
+	// The handler for the capacity planning report calls
+	adminCapacityHandler := func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			if r.URL.Path != adminCapacityPath {
+				logf(logLevelInfo, "adminCapacityHandler: Not found (%v)\n", r.URL)
+				http.Error(w, "Not found", http.StatusNotFound)
+				return
+			}
+			var target float64
+			if v := r.URL.Query().Get("target"); v != "" {
+				var err error
+				if target, err = strconv.ParseFloat(v, 64); err != nil || target <= 0 {
+					s.writeError(w, r, "adminCapacityHandler", policyViolation("invalid target %q", v))
+					return
+				}
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			json.NewEncoder(w).Encode(s.capacityReport(target))
+			break
+		default:
+			logf(logLevelInfo, "adminCapacityHandler: Method %v not allowed\n", r.Method)
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			break
+		}
+	}
+
+	// The handler for the doctor calls
+	adminDoctorHandler := func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			if r.URL.Path != adminDoctorPath {
+				logf(logLevelInfo, "adminDoctorHandler: Not found (%v)\n", r.URL)
+				http.Error(w, "Not found", http.StatusNotFound)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			json.NewEncoder(w).Encode(s.doctor(time.Now()))
+			break
+		default:
+			logf(logLevelInfo, "adminDoctorHandler: Method %v not allowed\n", r.Method)
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			break
+		}
+	}
+
+	// The handler for the OpenAPI document calls
+	openAPIHandler := func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			w.Write(openAPISpec)
+			break
+		default:
+			logf(logLevelInfo, "openAPIHandler: Method %v not allowed\n", r.Method)
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			break
+		}
+	}
+
+	// The handler for the public keys verifying the receipts
+	receiptKeysHandler := func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Cache-Control", "max-age=3600")
+			w.WriteHeader(http.StatusOK)
+			json.NewEncoder(w).Encode(s.receipts.JWKS())
+			break
+		default:
+			logf(logLevelInfo, "receiptKeysHandler: Method %v not allowed\n", r.Method)
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			break
+		}
+	}
+
+	// The handler for the public status page calls, answered as HTML or as JSON
+	statusHandler := func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead:
+			if r.URL.Path != statusRoutePath {
+				logf(logLevelInfo, "statusHandler: Not found (%v)\n", r.URL)
+				http.Error(w, "Not found", http.StatusNotFound)
+				return
+			}
+			report := s.statusPage(time.Now())
+			format := r.URL.Query().Get("format")
+			if format == "" && strings.Contains(r.Header.Get("Accept"), "application/json") {
+				format = "json"
+			}
+			w.Header().Set("Cache-Control", "max-age=5")
+			switch format {
+			case "json":
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusOK)
+				json.NewEncoder(w).Encode(report)
+			case "", "html":
+				w.Header().Set("Content-Type", "text/html; charset=utf-8")
+				w.WriteHeader(http.StatusOK)
+				if err := statusTemplate.Execute(w, report); err != nil {
+					logf(logLevelInfo, "statusHandler: Error while writing the page: %v\n", err)
+				}
+			default:
+				s.writeError(w, r, "statusHandler", policyViolation("invalid format %q", format))
+			}
+			break
+		default:
+			logf(logLevelInfo, "statusHandler: Method %v not allowed\n", r.Method)
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			break
+		}
+	}
+
+	// The handler for the maintenance notice calls, shown on the status page
+	adminMaintenanceHandler := func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != adminMaintenancePath {
+			logf(logLevelInfo, "adminMaintenanceHandler: Not found (%v)\n", r.URL)
+			http.Error(w, "Not found", http.StatusNotFound)
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			notice, err := s.maintenanceNotice()
+			if err != nil {
+				s.writeError(w, r, "adminMaintenanceHandler", err)
+				return
+			}
+			if notice == nil {
+				s.writeError(w, r, "adminMaintenanceHandler", ErrNotFound)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			json.NewEncoder(w).Encode(notice.at(time.Now()))
+		case http.MethodPost:
+			if err := r.ParseForm(); err != nil {
+				s.writeError(w, r, "adminMaintenanceHandler", malformedRequest(err))
+				return
+			}
+			notice, err := parseMaintenanceNotice(r.FormValue("message"), r.FormValue("starts"), r.FormValue("ends"))
+			if err == nil {
+				err = s.setMaintenanceNotice(&notice)
+			}
+			if err != nil {
+				s.writeError(w, r, "adminMaintenanceHandler", err)
+				return
+			}
+			logf(logLevelInfo, "adminMaintenanceHandler: Maintenance notice set: %s\n", notice.Message)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			json.NewEncoder(w).Encode(notice.at(time.Now()))
+		case http.MethodDelete:
+			if err := s.setMaintenanceNotice(nil); err != nil {
+				s.writeError(w, r, "adminMaintenanceHandler", err)
+				return
+			}
+			logf(logLevelInfo, "adminMaintenanceHandler: Maintenance notice cleared\n")
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			logf(logLevelInfo, "adminMaintenanceHandler: Method %v not allowed\n", r.Method)
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+
+	// The handler for the verbose health check calls, reporting the subsystems to the keys reading the statistics
+	healthzVerboseHandler := s.authorize(map[string]string{http.MethodGet: scopeStatsRead, http.MethodHead: scopeStatsRead}, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(s.health(time.Now()))
+	})
+
+	// The handler for the liveness probe calls
+	healthzHandler := func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead:
+			if r.URL.Path != healthzRoutePath {
+				logf(logLevelInfo, "healthzHandler: Not found (%v)\n", r.URL)
+				http.Error(w, "Not found", http.StatusNotFound)
+				return
+			}
+			// The liveness stays binary for the probes, the subsystems are reported on demand
+			if verbose, _ := strconv.ParseBool(r.URL.Query().Get("verbose")); verbose {
+				healthzVerboseHandler(w, r)
+				break
+			}
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte("OK"))
+			break
+		default:
+			logf(logLevelInfo, "healthzHandler: Method %v not allowed\n", r.Method)
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			break
+		}
+	}
+
+	// The handler for the readiness probe calls
+	readyzHandler := func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead:
+			if r.URL.Path != readyzRoutePath {
+				logf(logLevelInfo, "readyzHandler: Not found (%v)\n", r.URL)
+				http.Error(w, "Not found", http.StatusNotFound)
+				return
+			}
+			if reason := s.checkReadiness(); reason != "" {
+				logf(logLevelDebug, "readyzHandler: Not ready: %v\n", reason)
+				http.Error(w, "Not ready: "+reason, http.StatusServiceUnavailable)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte("OK"))
+			break
+		default:
+			logf(logLevelInfo, "readyzHandler: Method %v not allowed\n", r.Method)
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			break
+		}
+	}
+
+	// The handler for the request journal retrieval calls
+	adminJournalHandler := func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			requestID := strings.TrimPrefix(r.URL.Path, adminJournalRoutePath)
+			if s.journal == nil || requestID == "" || strings.Contains(requestID, "/") {
+				s.writeError(w, r, "adminJournalHandler", ErrNotFound)
+				return
+			}
+			entry, ok := s.journal.Get(requestID)
+			if !ok {
+				s.writeError(w, r, "adminJournalHandler", ErrNotFound)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			json.NewEncoder(w).Encode(entry)
+			break
+		default:
+			logf(logLevelInfo, "adminJournalHandler: Method %v not allowed\n", r.Method)
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			break
+		}
+	}
+
+	// The handler for the API key management calls
+	adminKeysHandler := func(w http.ResponseWriter, r *http.Request) {
+		// The path is either the collection, a single key or the rotation of a single key
+		var id, action string
+		if rest := strings.TrimPrefix(r.URL.Path, adminKeysRoutePath); rest != "" {
+			parts := strings.Split(rest, "/")
+			if parts[0] != "" || parts[1] == "" || len(parts) > 3 || (len(parts) == 3 && parts[2] != "rotate") {
+				logf(logLevelInfo, "adminKeysHandler: Not found (%v)\n", r.URL)
+				http.Error(w, "Not found", http.StatusNotFound)
+				return
+			}
+			id = parts[1]
+			if len(parts) == 3 {
+				action = parts[2]
+			}
+		}
+
+		var info apiKeyInfo
+		var err error
+		status := http.StatusOK
+		switch {
+		case id == "" && r.Method == http.MethodGet:
+			infos, err := s.keys.List()
+			if err != nil {
+				s.writeError(w, r, "adminKeysHandler", err)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			json.NewEncoder(w).Encode(infos)
+			return
+		case id == "" && r.Method == http.MethodPost:
+			if err := r.ParseForm(); err != nil {
+				s.writeError(w, r, "adminKeysHandler", malformedRequest(err))
+				return
+			}
+			scopes := parseScopes(r.FormValue("scopes"))
+			if err := validateScopes(scopes); err != nil {
+				s.writeError(w, r, "adminKeysHandler", err)
+				return
+			}
+			var ttl time.Duration
+			if v := r.FormValue("expires_in"); v != "" {
+				secs, err := strconv.ParseUint(v, 10, 32)
+				if err != nil || secs == 0 {
+					s.writeError(w, r, "adminKeysHandler", policyViolation("invalid expires_in %q", v))
+					return
+				}
+				ttl = time.Duration(secs) * time.Second
+			}
+			info, err = s.keys.Create(r.FormValue("name"), r.FormValue("tenant"), scopes, ttl)
+			status = http.StatusCreated
+		case id != "" && action == "" && r.Method == http.MethodGet:
+			info, err = s.keys.Get(id)
+		case id != "" && action == "" && r.Method == http.MethodDelete:
+			err = s.keys.Revoke(id)
+			status = http.StatusNoContent
+		case action == "rotate" && r.Method == http.MethodPost:
+			info, err = s.keys.Rotate(id)
+		default:
+			logf(logLevelInfo, "adminKeysHandler: Method %v not allowed\n", r.Method)
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err != nil {
+			s.writeError(w, r, "adminKeysHandler", err)
+			return
+		}
+		if status == http.StatusNoContent {
+			w.WriteHeader(status)
+			return
+		}
+		if status == http.StatusCreated {
+			w.Header().Set("Location", s.absoluteURL(r, adminKeysRoutePath+"/"+info.ID))
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(info)
+	}
+
+	// The handler for the admin user sign in calls, redirecting to the OIDC provider
+	authLoginHandler := func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			logf(logLevelInfo, "authLoginHandler: Method %v not allowed\n", r.Method)
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		loginURL, loginState, err := s.oidc.Begin(r.URL.Query().Get("next"))
+		if err != nil {
+			s.writeError(w, r, "authLoginHandler", upstreamError("OIDC provider", err))
+			return
+		}
+		// The state cookie has to survive the cross-site redirect back from the provider
+		http.SetCookie(w, &http.Cookie{Name: oidcStateCookie, Value: loginState, Path: authCallbackRoutePath,
+			MaxAge: int(oidcLoginTimeout / time.Second), HttpOnly: true, Secure: s.secureCookies(), SameSite: http.SameSiteLaxMode})
+		http.Redirect(w, r, loginURL, http.StatusFound)
+	}
+
+	// The handler for the OIDC provider redirects back after the admin user signs in
+	authCallbackHandler := func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			logf(logLevelInfo, "authCallbackHandler: Method %v not allowed\n", r.Method)
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var loginState string
+		if cookie, err := r.Cookie(oidcStateCookie); err == nil {
+			loginState = cookie.Value
+		}
+		http.SetCookie(w, &http.Cookie{Name: oidcStateCookie, Path: authCallbackRoutePath, MaxAge: -1})
+		q := r.URL.Query()
+		sessionID, key, next, err := s.oidc.Finish(loginState, q.Get("state"), q.Get("code"))
+		if errors.Is(err, ErrOIDC) {
+			s.writeError(w, r, "authCallbackHandler", err)
+			s.auditRequest(r, nil, http.StatusForbidden)
+			return
+		}
+		if err != nil {
+			s.writeError(w, r, "authCallbackHandler", upstreamError("OIDC provider", err))
+			return
+		}
+		logf(logLevelInfo, "authCallbackHandler: %v signed in with scopes %v\n", key.ID, key.Scopes)
+		s.auditRequest(r, key, http.StatusOK)
+		http.SetCookie(w, &http.Cookie{Name: oidcSessionCookie, Value: sessionID, Path: "/",
+			MaxAge: int(s.cfg.OIDCSessionTTL / time.Second), HttpOnly: true, Secure: s.secureCookies(), SameSite: http.SameSiteStrictMode})
+		if next != "" {
+			http.Redirect(w, r, next, http.StatusFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(key.info())
+	}
+
+	// The handler for the admin user sign out calls
+	authLogoutHandler := func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			logf(logLevelInfo, "authLogoutHandler: Method %v not allowed\n", r.Method)
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if cookie, err := r.Cookie(oidcSessionCookie); err == nil {
+			if key, ok := s.oidc.Session(cookie.Value); ok {
+				s.auditRequest(r, key, http.StatusNoContent)
+			}
+			s.oidc.Logout(cookie.Value)
+		}
+		http.SetCookie(w, &http.Cookie{Name: oidcSessionCookie, Path: "/", MaxAge: -1})
+		w.WriteHeader(http.StatusNoContent)
+	}
+
+	// The handler for the calls of the replication peers, which must present a verified client certificate
+	replicationHandler := func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+			logf(logLevelInfo, "replicationHandler: Client certificate required\n")
+			http.Error(w, "Client certificate required", http.StatusForbidden)
+			return
+		}
+		switch {
+		case r.URL.Path == replicationStatusRoutePath && r.Method == http.MethodGet:
+			source := r.URL.Query().Get("source")
+			if source == "" {
+				s.writeError(w, r, "replicationHandler", policyViolation("missing source"))
+				return
+			}
+			token, err := s.replication.Token(source)
+			if err != nil {
+				s.writeError(w, r, "replicationHandler", err)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			json.NewEncoder(w).Encode(replicationStatus{Source: source, Token: token})
+		case r.URL.Path == replicationRecordsRoutePath && r.Method == http.MethodPost:
+			var batch replicationBatch
+			if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxImportSize)).Decode(&batch); err != nil {
+				s.writeError(w, r, "replicationHandler", malformedRequest(err))
+				return
+			}
+			if err := s.replication.Apply(batch); err != nil {
+				s.writeError(w, r, "replicationHandler", fmt.Errorf("applying records from %s: %w", batch.Source, err))
+				return
+			}
+			logf(logLevelDebug, "replicationHandler: Applied %d records from %s\n", len(batch.Records), batch.Source)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			logf(logLevelInfo, "replicationHandler: Method %v not allowed\n", r.Method)
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+
+	// The handler for the statistics snapshots pushed to the aggregator by the instances
+	statsPushHandler := func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPost:
+			var snap statsSnapshot
+			if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&snap); err != nil {
+				s.writeError(w, r, "statsPushHandler", malformedRequest(err))
+				return
+			}
+			if snap.Instance == "" {
+				s.writeError(w, r, "statsPushHandler", policyViolation("missing instance"))
+				return
+			}
+			if err := s.snapshots.PutStats(snap); err != nil {
+				s.writeError(w, r, "statsPushHandler", err)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+			break
+		default:
+			logf(logLevelInfo, "statsPushHandler: Method %v not allowed\n", r.Method)
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			break
+		}
+	}
+
+	// The scopes required by the calls of each route when the authentication is enabled
+	adminScopes := map[string]string{http.MethodGet: scopeAdmin, http.MethodPost: scopeAdmin, http.MethodDelete: scopeAdmin}
+	statsScopes := map[string]string{http.MethodGet: scopeStatsRead}
+
+	// Initialize route handlers
+	http.HandleFunc("/", homeHandler)
+	http.HandleFunc(hashRoutePath, s.authorize(map[string]string{http.MethodPost: scopeHashWrite}, hashPostHandler))
+	hashIDRoute := s.authorize(map[string]string{http.MethodGet: scopeHashRead, http.MethodDelete: scopeHashDelete}, hashIDHandler)
+	hashParamsRoute := s.authorize(map[string]string{http.MethodGet: scopeHashParams}, hashIDHandler)
+	http.HandleFunc(hashRoutePath+"/", func(w http.ResponseWriter, r *http.Request) {
+		// The parameters are available to the keys which may not read the hashes themselves
+		if strings.HasSuffix(r.URL.Path, hashParamsSuffix) {
+			hashParamsRoute(w, r)
+			return
+		}
+		hashIDRoute(w, r)
+	})
+	http.HandleFunc(verifyRoutePath, s.authorize(map[string]string{http.MethodPost: scopeHashVerify}, verifyHandler))
+	// Any API key may read its own quota
+	http.HandleFunc(quotaRoutePath, s.authorize(nil, quotaHandler))
+	http.HandleFunc(statsRoutePath, s.authorize(statsScopes, statsHandler))
+	http.HandleFunc(statsDetailedPath, s.authorize(statsScopes, statsDetailedHandler))
+	http.HandleFunc(statsTenantsPath, s.authorize(statsScopes, statsTenantsHandler))
+	http.HandleFunc(statsHistoryPath, s.authorize(statsScopes, statsHistoryHandler))
+	if s.cfg.Aggregator {
+		http.HandleFunc(statsPushRoutePath, s.authorize(map[string]string{http.MethodPost: scopeStatsPush}, statsPushHandler))
+	}
+	http.HandleFunc(shutdownRoutePath, s.authorize(adminScopes, shutdownHandler))
+	http.HandleFunc(metricsRoutePath, s.authorize(statsScopes, metricsHandler))
+	http.HandleFunc(adminStorageRoutePath, s.authorize(adminScopes, adminStorageHandler))
+	http.HandleFunc(adminJournalRoutePath, s.authorize(adminScopes, adminJournalHandler))
+	http.HandleFunc(adminImportRoutePath, s.authorize(adminScopes, adminImportHandler))
+	http.HandleFunc(adminCapacityPath, s.authorize(adminScopes, adminCapacityHandler))
+	http.HandleFunc(adminRecoveryPath, s.authorize(adminScopes, adminRecoveryHandler))
+	http.HandleFunc(adminBansPath, s.authorize(adminScopes, adminBansHandler))
+	http.HandleFunc(adminDiagnosticsPath, s.authorize(adminScopes, adminDiagnosticsHandler))
+	http.HandleFunc(adminDoctorPath, s.authorize(adminScopes, adminDoctorHandler))
+	http.HandleFunc(adminReportsUsagePath, s.authorize(adminScopes, adminReportsUsageHandler))
+	http.HandleFunc(adminMaintenancePath, s.authorize(adminScopes, adminMaintenanceHandler))
+	http.HandleFunc(adminBansPath+"/", s.authorize(adminScopes, adminBansHandler))
+	http.HandleFunc(adminLockoutsPath, s.authorize(adminScopes, adminLockoutsHandler))
+	http.HandleFunc(adminLockoutsPath+"/", s.authorize(adminScopes, adminLockoutsHandler))
+	http.HandleFunc(adminKeysRoutePath, s.authorize(adminScopes, adminKeysHandler))
+	http.HandleFunc(adminKeysRoutePath+"/", s.authorize(adminScopes, adminKeysHandler))
+	if s.oidc != nil {
+		http.HandleFunc(authLoginRoutePath, authLoginHandler)
+		http.HandleFunc(authCallbackRoutePath, authCallbackHandler)
+		http.HandleFunc(authLogoutRoutePath, authLogoutHandler)
+	}
+	if s.replication != nil {
+		http.HandleFunc(replicationStatusRoutePath, replicationHandler)
+		http.HandleFunc(replicationRecordsRoutePath, replicationHandler)
+	}
+	if s.receipts != nil {
+		http.HandleFunc(receiptKeysPath, receiptKeysHandler)
+	}
+	http.HandleFunc(openAPIRoutePath, openAPIHandler)
+	http.HandleFunc(statusRoutePath, statusHandler)
+	http.HandleFunc(healthzRoutePath, healthzHandler)
+	http.HandleFunc(readyzRoutePath, readyzHandler)
+
+	// Serve the health checks and the statistics on the reserved listener too,
+	// so that they are not queued behind the public requests
+	if s.cfg.OpsAddr != "" {
+		ops := http.NewServeMux()
+		ops.HandleFunc(healthzRoutePath, healthzHandler)
+		ops.HandleFunc(readyzRoutePath, readyzHandler)
+		ops.HandleFunc(statsRoutePath, s.authorize(statsScopes, statsHandler))
+		ops.HandleFunc(statsDetailedPath, s.authorize(statsScopes, statsDetailedHandler))
+		ops.HandleFunc(statsHistoryPath, s.authorize(statsScopes, statsHistoryHandler))
+		ops.HandleFunc(metricsRoutePath, s.authorize(statsScopes, metricsHandler))
+		if err := s.startOps(ops); err != nil {
+			log.Fatalf("Ops server: %v\n", err)
+		}
+	}
+	var handler http.Handler = http.DefaultServeMux
+	if s.cfg.MirrorURL != "" {
+		s.mirror = NewRequestMirror(s.cfg.MirrorURL, s.cfg.MirrorPercent, s.cfg.MirrorCredentials)
+		handler = s.mirrorRequests(s.mirror, handler)
+	}
+	if routes, _ := parseDeprecatedRoutes(s.cfg.DeprecatedRoutes); len(routes) > 0 {
+		handler = s.deprecateRoutes(routes, handler)
+	}
+	if s.bans != nil {
+		handler = s.banSources(handler)
+	}
+	if s.cfg.MaxConcurrentRequests > 0 || s.cfg.RouteCaps != "" {
+		handler = s.limitConcurrency(handler)
+	}
+	handler = s.trackLatency(handler)
+	s.srv.Handler = s.recoverPanics(handler)
+
+	// Begin listening for incoming connections
+	lis, err := net.Listen("tcp", s.cfg.Addr)
+	if err != nil {
+		log.Fatalf("HTTP server Listen: %v\n", err)
+	}
+	s.listeners.Set("http", lis.Addr().String())
+	if err := s.announceStartup(); err != nil {
+		log.Fatalf("Readiness file: %v\n", err)
+	}
+	if s.cfg.TLSCertFile != "" {
+		err = s.srv.ServeTLS(lis, s.cfg.TLSCertFile, s.cfg.TLSKeyFile)
+	} else {
+		err = s.srv.Serve(lis)
+	}
+	s.removeReadinessFile()
+	if err != http.ErrServerClosed {
+		// Error starting or closing listener:
+		log.Fatalf("HTTP server Serve: %v\n", err)
+	}
+
+	// Wait for graceful shutdown
+	<-s.idleConnsClosed
+	s.runShutdownHooks()
+
+	// Let the background tasks and the pending hash calculations complete
+	s.backgroundWg.Wait()
+	ctx, cancel := context.WithTimeout(context.Background(), s.cfg.ShutdownHookTimeout)
+	s.audit.Close(ctx)
+	cancel()
+	s.storage.Close()
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// shutdownHook is the cleanup of the embedding application run while the service shuts down
+type shutdownHook struct {
+	fn      func(ctx context.Context) error
+	timeout time.Duration
+}
+
+// shutdownHooks holds the registered hooks and the errors they reported
+type shutdownHooks struct {
+	mu     sync.Mutex
+	hooks  []shutdownHook
+	errors []error
+}
+
+// OnShutdown registers the hook run once the requests are drained, before the pending hash
+// calculations are completed and the storage is closed. The hooks run in the reverse order
+// of their registration, each with the context cancelled after the shutdown_hook_timeout
+func (s *HashService) OnShutdown(fn func(ctx context.Context) error) {
+	s.OnShutdownTimeout(s.cfg.ShutdownHookTimeout, fn)
+}
+
+// OnShutdownTimeout registers the hook like OnShutdown, with its own timeout
+func (s *HashService) OnShutdownTimeout(timeout time.Duration, fn func(ctx context.Context) error) {
+	s.shutdownHooks.mu.Lock()
+	defer s.shutdownHooks.mu.Unlock()
+	s.shutdownHooks.hooks = append(s.shutdownHooks.hooks, shutdownHook{fn: fn, timeout: timeout})
+}
+
+// ShutdownErrors returns the errors reported by the shutdown hooks, including their timeouts
+func (s *HashService) ShutdownErrors() []error {
+	s.shutdownHooks.mu.Lock()
+	defer s.shutdownHooks.mu.Unlock()
+	return append([]error(nil), s.shutdownHooks.errors...)
+}
+
+// runShutdownHooks runs the registered hooks one by one, logging their failures. A hook exceeding
+// its timeout is abandoned, so that it cannot hold up the shutdown
+func (s *HashService) runShutdownHooks() {
+	s.shutdownHooks.mu.Lock()
+	hooks := append([]shutdownHook(nil), s.shutdownHooks.hooks...)
+	s.shutdownHooks.mu.Unlock()
+	for i := len(hooks) - 1; i >= 0; i-- {
+		hook := hooks[i]
+		ctx, cancel := context.WithTimeout(context.Background(), hook.timeout)
+		done := make(chan error, 1)
+		start := time.Now()
+		go func() {
+			defer func() {
+				if p := recover(); p != nil {
+					done <- fmt.Errorf("panic: %v", p)
+				}
+			}()
+			done <- hook.fn(ctx)
+		}()
+		var err error
+		select {
+		case err = <-done:
+		case <-ctx.Done():
+			err = fmt.Errorf("timed out after %v", hook.timeout)
+		}
+		cancel()
+		if err != nil {
+			err = fmt.Errorf("shutdown hook %d: %v", i+1, err)
+			logf(logLevelError, "%v\n", err)
+			s.shutdownHooks.mu.Lock()
+			s.shutdownHooks.errors = append(s.shutdownHooks.errors, err)
+			s.shutdownHooks.mu.Unlock()
+			continue
+		}
+		logf(logLevelDebug, "Shutdown hook %d completed in %v\n", i+1, time.Since(start))
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// smokeTest runs the checks against a running instance
+type smokeTest struct {
+	target  string
+	token   string
+	timeout time.Duration
+	client  *http.Client
+	out     io.Writer
+	failed  int
+}
+
+// runSmoke runs the smoke test subcommand and returns the exit code
+func runSmoke(args []string) int {
+	fs := flag.NewFlagSet("smoke", flag.ContinueOnError)
+	target := fs.String("target", "", "Base URL of the instance under test")
+	token := fs.String("token", "", "API key sent with the requests")
+	timeout := fs.Duration("timeout", 30*time.Second, "Time to wait for the hash calculation")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *target == "" {
+		fmt.Fprintln(os.Stderr, "smoke: -target is required")
+		return 2
+	}
+	t := &smokeTest{
+		target:  strings.TrimSuffix(*target, "/"),
+		token:   *token,
+		timeout: *timeout,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		out:     os.Stdout,
+	}
+	t.run()
+	if t.failed > 0 {
+		fmt.Fprintf(t.out, "%d checks failed\n", t.failed)
+		return 1
+	}
+	fmt.Fprintln(t.out, "All checks passed")
+	return 0
+}
+
+// run performs all the checks, skipping those depending on a failed one
+func (t *smokeTest) run() {
+	t.check("POST /hash without password is rejected", func() error {
+		return t.expect(http.MethodPost, hashRoutePath, url.Values{}, http.StatusBadRequest, nil)
+	})
+	t.check("GET /hash with malformed identifier is rejected", func() error {
+		return t.expect(http.MethodGet, hashRoutePath+"/not-a-number", nil, http.StatusBadRequest, nil)
+	})
+	t.check("GET /hash of unknown identifier is not found", func() error {
+		return t.expect(http.MethodGet, hashRoutePath+"/"+strconv.FormatUint(1<<63, 10), nil, http.StatusNotFound, nil)
+	})
+
+	suffix, err := randomString(8, hex.EncodeToString)
+	if err != nil {
+		suffix = strconv.FormatInt(time.Now().UnixNano(), 10)
+	}
+	pw := "smoke-" + suffix
+	var created hashIdentifier
+	if !t.check("POST /hash queues the calculation", func() error {
+		err := t.expect(http.MethodPost, hashRoutePath, url.Values{"password": {pw}}, http.StatusCreated, &created)
+		if err == nil && created.ID == 0 {
+			err = errors.New("no identifier returned")
+		}
+		return err
+	}) {
+		return
+	}
+	path := hashRoutePath + "/" + strconv.FormatUint(created.ID, 10)
+
+	t.check("GET /hash of pending calculation", func() error {
+		status, _, err := t.do(http.MethodGet, path, nil)
+		if err == nil && status != http.StatusNotFound && status != http.StatusOK {
+			err = fmt.Errorf("status %d, expected 404 while pending or 200 if completed", status)
+		}
+		return err
+	})
+	if !t.check("GET /hash returns the completed hash", func() error {
+		deadline := time.Now().Add(t.timeout)
+		for {
+			var val hashValue
+			status, body, err := t.do(http.MethodGet, path, nil)
+			if err != nil {
+				return err
+			}
+			if status == http.StatusOK {
+				if err := json.Unmarshal(body, &val); err != nil {
+					return err
+				}
+				if val.Hash != calculateHash(pw) {
+					return errors.New("unexpected hash")
+				}
+				return nil
+			}
+			if status != http.StatusNotFound {
+				return fmt.Errorf("status %d", status)
+			}
+			if time.Now().After(deadline) {
+				return fmt.Errorf("not completed within %v", t.timeout)
+			}
+			time.Sleep(250 * time.Millisecond)
+		}
+	}) {
+		return
+	}
+
+	id := strconv.FormatUint(created.ID, 10)
+	t.check("POST /verify matches the password", func() error {
+		var res verifyResult
+		err := t.expect(http.MethodPost, verifyRoutePath, url.Values{"id": {id}, "password": {pw}}, http.StatusOK, &res)
+		if err == nil && !res.Match {
+			err = errors.New("password does not match")
+		}
+		return err
+	})
+	t.check("POST /verify rejects a wrong password", func() error {
+		var res verifyResult
+		err := t.expect(http.MethodPost, verifyRoutePath, url.Values{"id": {id}, "password": {pw + "-wrong"}}, http.StatusOK, &res)
+		if err == nil && res.Match {
+			err = errors.New("wrong password matches")
+		}
+		return err
+	})
+	t.check("GET /stats reports the calculations", func() error {
+		var stats HashStats
+		err := t.expect(http.MethodGet, statsRoutePath, nil, http.StatusOK, &stats)
+		if err == nil && stats.Total == 0 {
+			err = errors.New("no calculations reported")
+		}
+		return err
+	})
+	if t.check("DELETE /hash removes the hash", func() error {
+		return t.expect(http.MethodDelete, path, nil, http.StatusNoContent, nil)
+	}) {
+		t.check("GET /hash of deleted hash is not found", func() error {
+			return t.expect(http.MethodGet, path, nil, http.StatusNotFound, nil)
+		})
+	}
+}
+
+// check runs the named check and reports its outcome
+func (t *smokeTest) check(name string, fn func() error) bool {
+	if err := fn(); err != nil {
+		t.failed++
+		fmt.Fprintf(t.out, "FAIL %s: %v\n", name, err)
+		return false
+	}
+	fmt.Fprintf(t.out, "ok   %s\n", name)
+	return true
+}
+
+// expect sends the request and checks the response status, decoding the JSON body into v if set
+func (t *smokeTest) expect(method, path string, form url.Values, status int, v interface{}) error {
+	got, body, err := t.do(method, path, form)
+	if err != nil {
+		return err
+	}
+	if got != status {
+		return fmt.Errorf("status %d, expected %d", got, status)
+	}
+	if v != nil {
+		return json.Unmarshal(body, v)
+	}
+	return nil
+}
+
+// do sends the request, with the form as the body if set, and returns the response status and body
+func (t *smokeTest) do(method, path string, form url.Values) (int, []byte, error) {
+	var body io.Reader
+	if form != nil {
+		body = strings.NewReader(form.Encode())
+	}
+	req, err := http.NewRequest(method, t.target+path, body)
+	if err != nil {
+		return 0, nil, err
+	}
+	if form != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	if t.token != "" {
+		req.Header.Set("Authorization", "Bearer "+t.token)
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, data, err
+}
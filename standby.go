@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// isReplica checks whether the instance serves a storage maintained by another instance,
+// which is no longer the case once a standby has promoted itself
+func (s *HashService) isReplica() bool {
+	return s.cfg.Replica && atomic.LoadInt32(&s.promoted) == 0
+}
+
+// checkActive checks the health of the active instance watched by the standby
+func checkActive(client *http.Client, healthURL string) bool {
+	resp, err := client.Get(healthURL)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode == http.StatusOK
+}
+
+// runStandby polls the health of the active instance until the service shuts down or the standby
+// promotes itself, once the active has failed its health checks for the failover period. A single
+// successful check resets the period, so that a slow or restarting active is not taken over
+func (s *HashService) runStandby(done <-chan struct{}) {
+	healthURL := strings.TrimSuffix(s.cfg.StandbyOf, "/") + healthzRoutePath
+	client := &http.Client{Timeout: s.cfg.StandbyPollInterval}
+	failures := metrics.NewCounter("phs_standby_health_check_failures_total", "Number of failed health checks of the active instance")
+	metrics.NewGaugeFunc("phs_standby_promoted", "Whether the standby has promoted itself", func() float64 {
+		return float64(atomic.LoadInt32(&s.promoted))
+	})
+	logf(logLevelInfo, "Standby: Watching the active instance at %s\n", healthURL)
+	ticker := time.NewTicker(s.cfg.StandbyPollInterval)
+	defer ticker.Stop()
+	var failingSince time.Time
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		if checkActive(client, healthURL) {
+			if !failingSince.IsZero() {
+				logf(logLevelInfo, "Standby: Active instance recovered after %v\n", time.Since(failingSince).Round(time.Millisecond))
+				failingSince = time.Time{}
+			}
+			continue
+		}
+		failures.Inc()
+		now := time.Now()
+		if failingSince.IsZero() {
+			logf(logLevelWarn, "Standby: Active instance failed its health check, promoting in %v unless it recovers\n", s.cfg.StandbyFailoverAfter)
+			failingSince = now
+		}
+		if now.Sub(failingSince) < s.cfg.StandbyFailoverAfter {
+			continue
+		}
+		if err := s.promote(); err != nil {
+			// Retried on the next failed check
+			logf(logLevelError, "Standby: Promotion failed: %v\n", err)
+			continue
+		}
+		return
+	}
+}
+
+// promote turns the standby into the primary: the storage becomes writable after loading the records
+// written by the failed active, the background maintenance of the storage starts, and the readiness
+// file and the registration are updated with the new role
+func (s *HashService) promote() error {
+	logf(logLevelWarn, "Standby: Active instance at %s is down, promoting to primary\n", s.cfg.StandbyOf)
+	if err := s.storage.Promote(s.cfg); err != nil {
+		return err
+	}
+	s.keys.Promote()
+	atomic.StoreInt32(&s.promoted, 1)
+	s.startPrimaryTasks()
+	if err := s.register(s.readiness()); err != nil {
+		logf(logLevelError, "Standby: Updating the readiness file: %v\n", err)
+	}
+	logf(logLevelInfo, "Standby: Promoted to primary\n")
+	return nil
+}
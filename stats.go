@@ -1,41 +1,175 @@
-package main
-
-import (
-	"sync"
-	"time"
-)
-
-// HashStats represents the password hashing statistics data
-type HashStats struct {
-	Total   uint64 `json:"total"`
-	Average uint64 `json:"average"`
-}
-
-// HashStatsStorage manipulates the statistics data
-type HashStatsStorage struct {
-	mu    sync.RWMutex
-	Stats HashStats
-}
-
-// NewHashStatsStorage constructs a new instance of the password hashing statistics data storage
-func NewHashStatsStorage() *HashStatsStorage {
-	hashStatsStorage := &HashStatsStorage{}
-	return hashStatsStorage
-}
-
-// Update the statistics data with the new call information
-func (s *HashStatsStorage) Update(startTime time.Time) {
-	elapsed := time.Now().Sub(startTime)
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	s.Stats.Average = (s.Stats.Average*s.Stats.Total + uint64(elapsed.Microseconds())) / (s.Stats.Total + 1)
-	s.Stats.Total++
-	return
-}
-
-// GetCurrentStats returns current statistics
-func (s *HashStatsStorage) GetCurrentStats() HashStats {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
-	return s.Stats
-}
+package main
+
+import (
+	"math"
+	"math/bits"
+	"sync"
+	"time"
+)
+
+// HashStats represents the password hashing statistics data
+type HashStats struct {
+	Total   uint64 `json:"total"`
+	Average uint64 `json:"average"`
+}
+
+// durationSum is a 128-bit sum of durations in nanoseconds, which cannot overflow
+// within any realistic number of calls
+type durationSum struct {
+	hi, lo uint64
+}
+
+// add adds the duration to the sum
+func (d *durationSum) add(elapsed time.Duration) {
+	if elapsed < 0 {
+		elapsed = 0
+	}
+	var carry uint64
+	d.lo, carry = bits.Add64(d.lo, uint64(elapsed), 0)
+	d.hi += carry
+}
+
+// average returns the average duration of n calls in microseconds, saturating at the maximal uint64 value
+func (d durationSum) average(n uint64) uint64 {
+	if n == 0 {
+		return 0
+	}
+	if d.hi >= n {
+		return math.MaxUint64
+	}
+	q, _ := bits.Div64(d.hi, d.lo, n)
+	return q / uint64(time.Microsecond)
+}
+
+// HashStatsStorage manipulates the statistics data
+type HashStatsStorage struct {
+	mu    sync.RWMutex
+	Stats HashStats
+	// Warmup holds the calls made during the warm-up phase, which are excluded from Stats
+	Warmup      HashStats
+	warmupUntil time.Time
+	warmupCount uint64
+	// sum and warmupSum accumulate the call durations the averages are calculated from
+	sum       durationSum
+	warmupSum durationSum
+	// history, if set, keeps the statistics of the calls after the warm-up over time
+	history *statsHistory
+}
+
+// NewHashStatsStorage constructs a new instance of the password hashing statistics data storage.
+// The calls made within the warm-up duration after the start, or the first warm-up count calls,
+// whichever ends first, are accounted separately. Zero disables the respective limit
+func NewHashStatsStorage(warmupDuration time.Duration, warmupCount uint64) *HashStatsStorage {
+	hashStatsStorage := &HashStatsStorage{warmupCount: warmupCount}
+	if warmupDuration > 0 {
+		hashStatsStorage.warmupUntil = time.Now().Add(warmupDuration)
+	}
+	return hashStatsStorage
+}
+
+// inWarmup checks whether the warm-up phase is still active. Must be called with the lock held
+func (s *HashStatsStorage) inWarmup(now time.Time) bool {
+	if s.warmupUntil.IsZero() && s.warmupCount == 0 {
+		return false
+	}
+	return (s.warmupUntil.IsZero() || now.Before(s.warmupUntil)) &&
+		(s.warmupCount == 0 || s.Warmup.Total < s.warmupCount)
+}
+
+// Update the statistics data with the new call information
+func (s *HashStatsStorage) Update(startTime time.Time) {
+	now := time.Now()
+	elapsed := now.Sub(startTime)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stats, sum := &s.Stats, &s.sum
+	if s.inWarmup(now) {
+		stats, sum = &s.Warmup, &s.warmupSum
+	} else if s.history != nil {
+		s.history.Record(now, elapsed)
+	}
+	sum.add(elapsed)
+	stats.Total++
+	stats.Average = sum.average(stats.Total)
+	return
+}
+
+// GetWarmupStats returns the statistics of the warm-up phase
+func (s *HashStatsStorage) GetWarmupStats() HashStats {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.Warmup
+}
+
+// GetCurrentStats returns current statistics
+func (s *HashStatsStorage) GetCurrentStats() HashStats {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.Stats
+}
+
+// statsSnapshot represents the statistics saved by a single instance
+type statsSnapshot struct {
+	Instance string    `json:"instance"`
+	Updated  time.Time `json:"updated"`
+	HashStats
+}
+
+// statsSnapshotSaver saves the statistics snapshots of the instance
+type statsSnapshotSaver interface {
+	PutStats(snap statsSnapshot) error
+}
+
+// statsSnapshotStore is implemented by the backends able to keep the statistics
+// snapshots shared by the instances of the cluster
+type statsSnapshotStore interface {
+	statsSnapshotSaver
+	ListStats() ([]statsSnapshot, error)
+}
+
+// runStatsSnapshots periodically saves the statistics of the instance to the store until done is closed.
+// The last snapshot is saved on exit
+func runStatsSnapshots(store statsSnapshotSaver, instance string, stats *HashStatsStorage, interval time.Duration, done <-chan struct{}) {
+	save := func() {
+		snap := statsSnapshot{Instance: instance, Updated: time.Now().UTC(), HashStats: stats.GetCurrentStats()}
+		if err := store.PutStats(snap); err != nil {
+			logf(logLevelError, "Error while saving statistics snapshot: %v\n", err)
+		}
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			save()
+			return
+		case <-ticker.C:
+			save()
+		}
+	}
+}
+
+// aggregateStats combines the statistics of several instances
+func aggregateStats(all []HashStats) HashStats {
+	var result HashStats
+	var weighted, total float64
+	for _, stats := range all {
+		// The totals saturate rather than wrap around, like the averages
+		sum, carry := bits.Add64(result.Total, stats.Total, 0)
+		if carry != 0 {
+			sum = math.MaxUint64
+		}
+		result.Total = sum
+		total += float64(stats.Total)
+		weighted += float64(stats.Average) * float64(stats.Total)
+	}
+	if total > 0 {
+		// float64(math.MaxUint64) is 2^64, beyond the range of uint64
+		if average := weighted / total; average < float64(math.MaxUint64) {
+			result.Average = uint64(average)
+		} else {
+			result.Average = math.MaxUint64
+		}
+	}
+	return result
+}
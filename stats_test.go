@@ -0,0 +1,106 @@
+package main
+
+import (
+	"math"
+	"math/bits"
+	"testing"
+	"time"
+)
+
+func TestDurationSumAddCarries(t *testing.T) {
+	d := durationSum{lo: math.MaxUint64 - 10}
+	d.add(11)
+	if d.hi != 1 || d.lo != 0 {
+		t.Fatalf("got hi=%d lo=%d, want hi=1 lo=0", d.hi, d.lo)
+	}
+	d.add(math.MaxInt64)
+	d.add(math.MaxInt64)
+	d.add(2)
+	if d.hi != 2 || d.lo != 0 {
+		t.Fatalf("got hi=%d lo=%d, want hi=2 lo=0", d.hi, d.lo)
+	}
+	d.add(-time.Second)
+	if d.hi != 2 || d.lo != 0 {
+		t.Fatalf("negative duration changed the sum to hi=%d lo=%d", d.hi, d.lo)
+	}
+}
+
+func TestDurationSumAverageSaturates(t *testing.T) {
+	for _, tt := range []struct {
+		sum durationSum
+		n   uint64
+	}{
+		{durationSum{hi: 1}, 1},
+		{durationSum{hi: 5, lo: 1}, 5},
+		{durationSum{hi: math.MaxUint64, lo: math.MaxUint64}, 3},
+	} {
+		if got := tt.sum.average(tt.n); got != math.MaxUint64 {
+			t.Errorf("average(%+v, %d) = %d, want saturation at %d", tt.sum, tt.n, got, uint64(math.MaxUint64))
+		}
+	}
+	if got := (durationSum{hi: 1}).average(0); got != 0 {
+		t.Errorf("average of no call = %d, want 0", got)
+	}
+}
+
+func TestDurationSumAverageAcross64Bits(t *testing.T) {
+	// 2^64 + 2^63 ns over 3 calls is 2^63 ns per call
+	d := durationSum{hi: 1, lo: 1 << 63}
+	want := uint64(1<<63) / uint64(time.Microsecond)
+	if got := d.average(3); got != want {
+		t.Fatalf("average = %d, want %d", got, want)
+	}
+
+	// The same sum accumulated call by call
+	var acc durationSum
+	for i := 0; i < 3; i++ {
+		acc.add(1 << 62)
+		acc.add(1 << 62)
+	}
+	hi, lo := bits.Mul64(6, 1<<62)
+	if acc.hi != hi || acc.lo != lo {
+		t.Fatalf("accumulated hi=%d lo=%d, want hi=%d lo=%d", acc.hi, acc.lo, hi, lo)
+	}
+	if got := acc.average(3); got != want {
+		t.Fatalf("accumulated average = %d, want %d", got, want)
+	}
+}
+
+func TestAggregateStatsLargeTotals(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		all  []HashStats
+		want HashStats
+	}{
+		{
+			name: "empty",
+			want: HashStats{},
+		},
+		{
+			name: "weighted",
+			all:  []HashStats{{Total: 3, Average: 10}, {Total: 1, Average: 50}},
+			want: HashStats{Total: 4, Average: 20},
+		},
+		{
+			name: "large totals",
+			all:  []HashStats{{Total: 1 << 62, Average: 1000}, {Total: 1 << 62, Average: 3000}},
+			want: HashStats{Total: 1 << 63, Average: 2000},
+		},
+		{
+			name: "saturated averages",
+			all:  []HashStats{{Total: 1 << 40, Average: math.MaxUint64}, {Total: 1 << 40, Average: math.MaxUint64}},
+			want: HashStats{Total: 1 << 41, Average: math.MaxUint64},
+		},
+		{
+			name: "saturated totals",
+			all:  []HashStats{{Total: math.MaxUint64, Average: 7}, {Total: 2, Average: 7}},
+			want: HashStats{Total: math.MaxUint64, Average: 7},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := aggregateStats(tt.all); got != tt.want {
+				t.Fatalf("aggregateStats = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// historyTier keeps the statistics of the calls in buckets of the resolution for the retention
+type historyTier struct {
+	resolution time.Duration
+	retention  time.Duration
+	buckets    []historyBucket
+}
+
+// historyTiers are the tiers of the statistics history, from the finest. Every call is accounted
+// in all of them, so that the coarser tiers hold the downsampled history of the finer ones
+var historyTiers = []struct {
+	resolution, retention time.Duration
+}{
+	{10 * time.Second, time.Hour},
+	{time.Minute, 24 * time.Hour},
+	{time.Hour, 30 * 24 * time.Hour},
+}
+
+// historyBucket accumulates the calls started within the bucket
+type historyBucket struct {
+	start time.Time
+	total uint64
+	sum   time.Duration
+	max   time.Duration
+}
+
+// historyPoint is a bucket of the statistics history as reported by /stats/history
+type historyPoint struct {
+	Start time.Time `json:"start"`
+	HashStats
+	// Max is the longest call in microseconds
+	Max uint64 `json:"max"`
+}
+
+// statsHistory keeps the history of the call statistics in tiers of decreasing resolution and
+// increasing retention, in a fixed number of buckets whatever the traffic
+type statsHistory struct {
+	mu    sync.Mutex
+	tiers []*historyTier
+}
+
+// newStatsHistory constructs a new instance of the statistics history
+func newStatsHistory() *statsHistory {
+	h := &statsHistory{}
+	for _, t := range historyTiers {
+		h.tiers = append(h.tiers, &historyTier{
+			resolution: t.resolution,
+			retention:  t.retention,
+			buckets:    make([]historyBucket, t.retention/t.resolution),
+		})
+	}
+	return h
+}
+
+// bucket returns the bucket of the tier holding the time, or nil if it has been reused for a later time
+func (t *historyTier) bucket(at time.Time) *historyBucket {
+	start := at.Truncate(t.resolution)
+	b := &t.buckets[int(start.UnixNano()/int64(t.resolution))%len(t.buckets)]
+	if !b.start.Equal(start) {
+		if b.start.After(start) {
+			return nil
+		}
+		*b = historyBucket{start: start}
+	}
+	return b
+}
+
+// Record accounts the call which took elapsed at the time
+func (h *statsHistory) Record(now time.Time, elapsed time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, t := range h.tiers {
+		if b := t.bucket(now); b != nil {
+			b.total++
+			b.sum += elapsed
+			if elapsed > b.max {
+				b.max = elapsed
+			}
+		}
+	}
+}
+
+// Query returns the history since the time, by buckets of the resolution, or of the finest tier retaining
+// the whole range if 0. The buckets without calls are reported with zeros, so that the points are evenly spaced
+func (h *statsHistory) Query(since, now time.Time, resolution time.Duration) ([]historyPoint, time.Duration, error) {
+	var tier *historyTier
+	for _, t := range h.tiers {
+		if (resolution == 0 || t.resolution == resolution) && !since.Before(now.Add(-t.retention)) {
+			tier = t
+			break
+		}
+	}
+	if tier == nil {
+		if resolution != 0 {
+			for _, t := range h.tiers {
+				if t.resolution == resolution {
+					return nil, 0, policyViolation("resolution %v is retained for %v", resolution, t.retention)
+				}
+			}
+			return nil, 0, policyViolation("resolution must be one of %s", historyResolutions())
+		}
+		last := h.tiers[len(h.tiers)-1]
+		return nil, 0, policyViolation("history is retained for %v", last.retention)
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var points []historyPoint
+	for at := since.Truncate(tier.resolution); !at.After(now); at = at.Add(tier.resolution) {
+		point := historyPoint{Start: at.UTC()}
+		if b := tier.bucket(at); b != nil && b.total > 0 {
+			point.Total = b.total
+			point.Average = uint64(b.sum / time.Duration(b.total) / time.Microsecond)
+			point.Max = uint64(b.max / time.Microsecond)
+		}
+		points = append(points, point)
+	}
+	return points, tier.resolution, nil
+}
+
+// historyResolutions lists the resolutions of the history tiers
+func historyResolutions() string {
+	var list string
+	for i, t := range historyTiers {
+		if i > 0 {
+			list += ", "
+		}
+		list += fmt.Sprint(t.resolution)
+	}
+	return list
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"html/template"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// maintenanceMetaName is the metadata document holding the maintenance notice
+	maintenanceMetaName = "maintenance"
+	// statusCacheTTL is the time the status page is served from cache, so that the public
+	// route does not reach the storage and the health checks on every request
+	statusCacheTTL = 5 * time.Second
+)
+
+// The availability reported by the status page
+const (
+	statusOperational = "operational"
+	statusDegraded    = "degraded"
+	statusUnavailable = "unavailable"
+)
+
+// maintenanceNotice is the notice shown on the status page, during its window if it has one.
+// A notice without a start is shown until its end, one without an end until it is cleared
+type maintenanceNotice struct {
+	Message string     `json:"message"`
+	Starts  *time.Time `json:"starts,omitempty"`
+	Ends    *time.Time `json:"ends,omitempty"`
+	// Active tells whether the maintenance is under way, it is set when reported
+	Active bool `json:"active"`
+}
+
+// shown reports whether the notice is shown at the given time: it is under way, or scheduled
+func (n *maintenanceNotice) shown(now time.Time) bool {
+	return n.Message != "" && (n.Ends == nil || now.Before(*n.Ends))
+}
+
+// at returns the notice as reported at the given time
+func (n maintenanceNotice) at(now time.Time) *maintenanceNotice {
+	n.Active = n.shown(now) && (n.Starts == nil || !now.Before(*n.Starts))
+	return &n
+}
+
+// parseMaintenanceNotice parses the notice from the message, starts and ends form fields,
+// the times as RFC 3339
+func parseMaintenanceNotice(message, starts, ends string) (maintenanceNotice, error) {
+	notice := maintenanceNotice{Message: strings.TrimSpace(message)}
+	if notice.Message == "" {
+		return notice, policyViolation("the maintenance notice requires a message")
+	}
+	for _, field := range []struct {
+		name, value string
+		t           **time.Time
+	}{{"starts", starts, &notice.Starts}, {"ends", ends, &notice.Ends}} {
+		if field.value == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, field.value)
+		if err != nil {
+			return notice, policyViolation("invalid %s %q, expected an RFC 3339 time", field.name, field.value)
+		}
+		t = t.UTC()
+		*field.t = &t
+	}
+	if notice.Starts != nil && notice.Ends != nil && !notice.Ends.After(*notice.Starts) {
+		return notice, policyViolation("the maintenance must end after it starts")
+	}
+	return notice, nil
+}
+
+// statusReport is the status page, meant for the end users: it tells nothing of the deployment
+// but whether the service is available, how long a new hash waits and the maintenance notice
+type statusReport struct {
+	Status          string             `json:"status"`
+	EstimatedWaitMs int64              `json:"estimated_wait_ms"`
+	Maintenance     *maintenanceNotice `json:"maintenance,omitempty"`
+	UpdatedAt       time.Time          `json:"updated_at"`
+}
+
+// statusCache holds the status page served until it expires
+type statusCache struct {
+	mu      sync.Mutex
+	report  statusReport
+	expires time.Time
+}
+
+// statusPage returns the status page, from cache while fresh
+func (s *HashService) statusPage(now time.Time) statusReport {
+	s.statusCache.mu.Lock()
+	defer s.statusCache.mu.Unlock()
+	if now.Before(s.statusCache.expires) {
+		return s.statusCache.report
+	}
+	report := statusReport{Status: statusOperational, UpdatedAt: now.UTC().Truncate(time.Second)}
+	if reason := s.checkReadiness(); reason != "" {
+		report.Status = statusUnavailable
+	} else if s.health(now).Status != healthOK {
+		report.Status = statusDegraded
+	}
+	report.EstimatedWaitMs = s.backoffGuidance("").EstimatedWaitMs
+	notice, err := s.maintenanceNotice()
+	if err != nil {
+		logf(logLevelWarn, "Error while loading the maintenance notice: %v\n", err)
+	} else if notice != nil && notice.shown(now) {
+		report.Maintenance = notice.at(now)
+	}
+	s.statusCache.report, s.statusCache.expires = report, now.Add(statusCacheTTL)
+	return report
+}
+
+// maintenanceNotice loads the maintenance notice from the metadata store, nil if there is none
+func (s *HashService) maintenanceNotice() (*maintenanceNotice, error) {
+	var notice maintenanceNotice
+	ok, err := s.storage.backend.(metadataStore).GetMeta(maintenanceMetaName, &notice)
+	if err != nil || !ok || notice.Message == "" {
+		return nil, err
+	}
+	return &notice, nil
+}
+
+// setMaintenanceNotice saves the maintenance notice, or clears it if nil, and refreshes the status page
+func (s *HashService) setMaintenanceNotice(notice *maintenanceNotice) error {
+	if notice == nil {
+		notice = &maintenanceNotice{}
+	}
+	if err := s.storage.backend.(metadataStore).PutMeta(maintenanceMetaName, notice); err != nil {
+		return err
+	}
+	s.statusCache.mu.Lock()
+	s.statusCache.expires = time.Time{}
+	s.statusCache.mu.Unlock()
+	return nil
+}
+
+// statusTemplate renders the status page as HTML
+var statusTemplate = template.Must(template.New("status").Funcs(template.FuncMap{
+	"wait": func(ms int64) string {
+		if ms < 1000 {
+			return "less than a second"
+		}
+		return (time.Duration(ms) * time.Millisecond).Round(time.Second).String()
+	},
+	"time": func(t *time.Time) string { return t.Format("2006-01-02 15:04 MST") },
+}).Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<meta http-equiv="refresh" content="30">
+<title>Password hash service status</title>
+<style>
+body { font-family: sans-serif; max-width: 40em; margin: 2em auto; padding: 0 1em; color: #222; }
+.status { padding: 1em; border-radius: 4px; color: #fff; }
+.operational { background: #2e7d32; } .degraded { background: #ef6c00; } .unavailable { background: #c62828; }
+.maintenance { padding: 1em; border: 1px solid #1565c0; border-radius: 4px; margin-top: 1em; }
+footer { margin-top: 2em; color: #777; font-size: small; }
+</style>
+</head>
+<body>
+<h1>Password hash service</h1>
+<div class="status {{.Status}}">
+{{if eq .Status "operational"}}All systems operational{{else if eq .Status "degraded"}}Degraded performance{{else}}Service unavailable{{end}}
+</div>
+<p>A new password hash is currently available in about {{wait .EstimatedWaitMs}}.</p>
+{{with .Maintenance}}<div class="maintenance">
+<strong>{{if .Active}}Maintenance in progress{{else}}Scheduled maintenance{{end}}</strong>
+{{if .Starts}}from {{time .Starts}}{{end}}{{if .Ends}} until {{time .Ends}}{{end}}
+<p>{{.Message}}</p>
+</div>{{end}}
+<footer>Updated {{.UpdatedAt.Format "2006-01-02 15:04:05 MST"}}</footer>
+</body>
+</html>
+`))
@@ -1,56 +1,823 @@
-package main
-
-import (
-	"crypto/sha512"
-	"encoding/base64"
-	"log"
-	"sync"
-	"time"
-)
-
-// HashStorage represents the password hash storage implementation
-type HashStorage struct {
-	mu         sync.RWMutex
-	data       map[uint64]string
-	currentKey uint64
-}
-
-// NewHashStorage constructs a new instance of the password hash storage
-func NewHashStorage() *HashStorage {
-	hashStorage := &HashStorage{data: make(map[uint64]string)}
-	return hashStorage
-}
-
-// AddPassword adds a new password hash record to the storage and returns its identifier.
-// The hash calculation is delayed by 5 seconds
-func (s *HashStorage) AddPassword(pw string) uint64 {
-	s.mu.Lock()
-	s.currentKey++
-	u := s.currentKey
-	s.mu.Unlock()
-
-	go func() {
-		time.Sleep(5 * time.Second)
-
-		alg := sha512.New()
-		_, err := alg.Write([]byte(pw))
-		if err != nil {
-			log.Printf("Error while calculating hash: %v\n", err)
-			return
-		}
-		encodedHash := base64.StdEncoding.EncodeToString(alg.Sum(nil))
-
-		s.mu.Lock()
-		defer s.mu.Unlock()
-		s.data[u] = encodedHash
-	}()
-	return u
-}
-
-// GetPasswordHash returns the previously stored hash
-func (s *HashStorage) GetPasswordHash(u uint64) (encodedHash string, ok bool) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
-	encodedHash, ok = s.data[u]
-	return
-}
+package main
+
+import (
+	"container/heap"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// regionShift is the position of the region number in the hash identifiers
+	regionShift = 56
+	// maxRegionID is the greatest region number
+	maxRegionID = 1<<(64-regionShift) - 1
+)
+
+// regionOf returns the region number of the hash identifier
+func regionOf(u uint64) int {
+	return int(u >> regionShift)
+}
+
+// replicatedWins resolves the conflict between the local and the replicated records stored
+// under the same identifier. The record completed last wins, with the ties broken by the hash,
+// so that all the replicating instances pick the same record
+func replicatedWins(local, replicated hashRecord) bool {
+	if !local.Created.Equal(replicated.Created) {
+		return replicated.Created.After(local.Created)
+	}
+	return replicated.Hash > local.Hash
+}
+
+// hashJob represents a pending password hash calculation
+type hashJob struct {
+	id uint64
+	pw string
+	// salt, if set, is the salt of the caller the hash is calculated with
+	salt *callerSalt
+	// tenant is the tenant the record is created for, which selects its residency region
+	tenant   string
+	enqueued time.Time
+	expires  *time.Time
+	// queued is the time the job was queued to its pool once delayed
+	queued time.Time
+	// retain, if set, is how long the completed record is kept unless fetched
+	retain time.Duration
+	// arm is the experiment arm picked for the job, if any, and pool the worker pool calculating it
+	arm     *experimentArm
+	pool    *workerPool
+	journal *journalEntry
+}
+
+// RecoveryReport describes the loading of the records which survived the restart
+type RecoveryReport struct {
+	Started  time.Time `json:"started"`
+	Duration float64   `json:"duration_ms"`
+	// Records is the number of the loaded records, Expired the number of those which expired while the service was down
+	Records uint64 `json:"records"`
+	Expired uint64 `json:"expired"`
+	LastID  uint64 `json:"last_id"`
+}
+
+// HashStorage represents the password hash storage implementation
+type HashStorage struct {
+	mu         sync.Mutex
+	backend    HashBackend
+	region     int
+	currentKey uint64
+	delay      time.Duration
+	// jitter bounds the random time added to the calculation delay and the lookups,
+	// masking the timing of the cache hits and the password checks
+	jitter     time.Duration
+	defaultTTL time.Duration
+	readOnly   int32
+	// shared calculates the hashes of the algorithms without a dedicated pool in pools
+	shared    *workerPool
+	pools     map[string]*workerPool
+	jobsWg    sync.WaitGroup
+	workersWg sync.WaitGroup
+	// pending holds the hash calculations which have not completed yet.
+	// The value is set when the record is deleted before its calculation completes
+	pending map[uint64]bool
+	// enqueued holds the time the pending hash calculations were requested
+	enqueued map[uint64]time.Time
+	// expiry orders the records having a TTL by their expiration time
+	expiry     expiryQueue
+	reaperDone chan struct{}
+	reaperWg   sync.WaitGroup
+	jobStats   *JobStats
+	recovery   RecoveryReport
+	// notFound, if set, caches the identifiers not found in the backend
+	notFound *negativeCache
+	// tombstones, if set, remembers the records purged by the retention
+	tombstones *tombstoneSet
+	// known, if set, holds the identifiers of all the records, so that the lookups of the others skip the backend
+	known *bloomFilter
+	// experiment, if set, hashes a share of the passwords with alternate parameters
+	experiment *HashExperiment
+	// hardening, if set, hashes the passwords with PBKDF2 or bcrypt at the cost in effect on its schedule
+	hardening *HardeningSchedule
+	// buffered holds the completed records waiting for the batched write when the batching is enabled.
+	// They stay pending until written
+	buffered     map[uint64]bufferedRecord
+	batchSize    int
+	batchSync    bool
+	batchFlushes *Counter
+	// onComplete, if set, is called with every record stored by this instance.
+	// It is called while holding the lock, so it must not block
+	onComplete func(id uint64, rec hashRecord)
+	// notifiers notify the subscriptions of the completion of the pending hash calculations, see Watch
+	notifiers *notifierRegistry
+	// health remembers the outcome of the last write of a completed record
+	health healthState
+}
+
+// jobCompletion reports the outcome of a hash calculation to its watchers: Err is nil once the
+// record is stored, ErrNotFound if it was deleted before its calculation completed, or the storage error
+type jobCompletion struct {
+	ID  uint64
+	Err error
+}
+
+// NewHashStorage constructs a new instance of the password hash storage on top of the backend.
+// The hashes are calculated by the configured number of workers after the configured delay
+func NewHashStorage(backend HashBackend, cfg *Config) (*HashStorage, error) {
+	hashStorage := &HashStorage{backend: backend}
+	// The identifiers of the records created by this instance carry its region number
+	hashStorage.region = cfg.RegionID
+	hashStorage.currentKey = uint64(cfg.RegionID) << regionShift
+	hashStorage.delay = cfg.HashDelay
+	hashStorage.jitter = cfg.TimingJitter
+	hashStorage.defaultTTL = cfg.DefaultTTL
+	if cfg.Replica {
+		hashStorage.readOnly = 1
+	}
+	hashStorage.pending = make(map[uint64]bool)
+	hashStorage.enqueued = make(map[uint64]time.Time)
+	hashStorage.reaperDone = make(chan struct{})
+	hashStorage.jobStats = NewJobStats()
+	hashStorage.notifiers = newNotifierRegistry(hashStorage)
+
+	// Continue numbering after the records which survived the restart
+	// and pick up their expiration times
+	recovery := &hashStorage.recovery
+	recovery.Started = time.Now().UTC()
+	var ids []uint64
+	err := backend.Scan(func(id uint64, rec hashRecord) error {
+		if cfg.BloomFilterCapacity > 0 {
+			ids = append(ids, id)
+		}
+		if regionOf(id) == hashStorage.region && id > hashStorage.currentKey {
+			hashStorage.currentKey = id
+		}
+		pushExpiry(&hashStorage.expiry, id, rec)
+		recovery.Records++
+		if rec.expired(recovery.Started) {
+			recovery.Expired++
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	recovery.LastID = hashStorage.currentKey
+	recovery.Duration = float64(time.Since(recovery.Started)) / float64(time.Millisecond)
+	logf(logLevelInfo, "Recovered %d hashes (%d expired) in %.1f ms\n", recovery.Records, recovery.Expired, recovery.Duration)
+
+	if !cfg.Replica {
+		if err := hashStorage.setupHashing(cfg); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.BloomFilterCapacity > 0 {
+		// The filter is rebuilt on every start, leaving room for the growth if the capacity is exceeded already
+		capacity := cfg.BloomFilterCapacity
+		if len(ids) > capacity/2 {
+			capacity = 2 * len(ids)
+		}
+		hashStorage.known = newBloomFilter(capacity, cfg.BloomFilterFPRate)
+		for _, id := range ids {
+			hashStorage.known.Add(id)
+		}
+	}
+	if cfg.TombstoneTTL > 0 {
+		if hashStorage.tombstones, err = newTombstoneSet(backend.(metadataStore), cfg.TombstoneTTL); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.NegativeCacheTTL > 0 {
+		hashStorage.notFound = newNegativeCache(cfg.NegativeCacheTTL)
+	}
+	if cfg.WriteBatchSize > 0 {
+		hashStorage.batchSize = cfg.WriteBatchSize
+		hashStorage.batchSync = cfg.WriteBatchSync
+		hashStorage.buffered = make(map[uint64]bufferedRecord)
+		hashStorage.batchFlushes = metrics.NewCounter("phs_storage_batch_flushes_total", "Number of batched writes of the completed hashes")
+		hashStorage.reaperWg.Add(1)
+		go hashStorage.flusher(cfg.WriteBatchDelay)
+	}
+
+	if err := hashStorage.startPools(cfg); err != nil {
+		return nil, err
+	}
+	hashStorage.reaperWg.Add(1)
+	go hashStorage.reaper(cfg.ReaperInterval)
+	return hashStorage, nil
+}
+
+// setupHashing sets up the hashing parameters experiment or the hardening schedule of the new hashes, if configured
+func (s *HashStorage) setupHashing(cfg *Config) (err error) {
+	if cfg.ExperimentArms != "" {
+		if s.experiment, err = NewHashExperiment(cfg.ExperimentName, cfg.ExperimentArms); err != nil {
+			return err
+		}
+	}
+	if cfg.HardeningSchedule != "" {
+		if s.hardening, err = NewHardeningSchedule(cfg.HardeningSchedule); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isReadOnly checks whether the storage rejects the modifications
+func (s *HashStorage) isReadOnly() bool {
+	return atomic.LoadInt32(&s.readOnly) != 0
+}
+
+// Promote makes the storage of a promoted standby replica writable. The records written by the
+// failed primary since the start are scanned again, so that the numbering continues after them
+// and their expiration times are picked up
+func (s *HashStorage) Promote(cfg *Config) error {
+	if !s.isReadOnly() {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var expiry expiryQueue
+	current, records := s.currentKey, 0
+	err := s.backend.Scan(func(id uint64, rec hashRecord) error {
+		if regionOf(id) == s.region && id > current {
+			current = id
+		}
+		pushExpiry(&expiry, id, rec)
+		records++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := s.setupHashing(cfg); err != nil {
+		return err
+	}
+	s.currentKey, s.expiry = current, expiry
+	atomic.StoreInt32(&s.readOnly, 0)
+	logf(logLevelInfo, "Promoted the storage with %d hashes, numbering from %d\n", records, current+1)
+	return nil
+}
+
+// AddPassword adds a new password hash record to the storage and returns its identifier.
+// The hash calculation is delayed by the configured interval. The record expires after
+// the ttl, or after the default TTL if ttl is 0. The records without TTL never expire.
+// The completed record is purged after the retain period, if set, unless fetched with ClaimRecord before.
+// The hash is calculated with the salt of the caller, if any, and stored for the tenant, if any.
+// The calculation lifecycle is recorded to the journal entry, if any
+func (s *HashStorage) AddPassword(pw string, salt *callerSalt, ttl, retain time.Duration, tenant string, journal *journalEntry) (uint64, error) {
+	if s.isReadOnly() {
+		return 0, ErrReadOnly
+	}
+	job, err := s.newJob(pw, salt, ttl, tenant, journal)
+	if err != nil {
+		return 0, err
+	}
+	job.retain = retain
+	s.jobsWg.Add(1)
+	time.AfterFunc(s.delay+randomJitter(s.jitter), func() {
+		journal.Record("queue_enqueue")
+		job.queued = time.Now().UTC()
+		job.pool.jobs <- job
+	})
+	return job.id, nil
+}
+
+// errCancelled is returned when the record is deleted while its hash is calculated
+var errCancelled = errors.New("hash deleted while being calculated")
+
+// AddPasswordSync calculates the password hash right away, without the delay and the queue,
+// and returns its identifier along with the stored record. It fails unless the record has been stored
+func (s *HashStorage) AddPasswordSync(pw string, salt *callerSalt, ttl time.Duration, tenant string, journal *journalEntry) (uint64, hashRecord, error) {
+	if s.isReadOnly() {
+		return 0, hashRecord{}, ErrReadOnly
+	}
+	job, err := s.newJob(pw, salt, ttl, tenant, journal)
+	if err != nil {
+		return 0, hashRecord{}, err
+	}
+	rec := s.calculate(job)
+	if err := s.complete(job, rec, true); err != nil {
+		return 0, hashRecord{}, err
+	}
+	return job.id, rec, nil
+}
+
+// newJob assigns the identifier to the new hash calculation and marks it pending.
+// The job expires after the ttl, or after the default TTL if ttl is 0
+func (s *HashStorage) newJob(pw string, salt *callerSalt, ttl time.Duration, tenant string, journal *journalEntry) (hashJob, error) {
+	if ttl == 0 {
+		ttl = s.defaultTTL
+	}
+	enqueued := time.Now().UTC()
+	var expires *time.Time
+	if ttl > 0 {
+		t := enqueued.Add(ttl)
+		expires = &t
+	}
+
+	// The algorithm, and the experiment arm, are picked up front to queue the job to its pool
+	algorithm := algorithmSHA512
+	var arm *experimentArm
+	switch {
+	case salt != nil:
+		algorithm = algorithmPBKDF2
+	case s.experiment != nil:
+		if arm = s.experiment.pick(); arm.prf != nil {
+			algorithm = algorithmPBKDF2
+		}
+	case s.hardening != nil:
+		algorithm = s.hardening.algorithm
+	}
+	pool := s.poolOf(algorithm)
+
+	s.mu.Lock()
+	if pool.pending >= pool.queueSize {
+		s.mu.Unlock()
+		return hashJob{}, ErrQueueFull
+	}
+	pool.pending++
+	s.currentKey++
+	u := s.currentKey
+	s.pending[u] = false
+	s.enqueued[u] = enqueued
+	s.remember(u)
+	s.mu.Unlock()
+	journal.SetHashID(u)
+	return hashJob{id: u, pw: pw, salt: salt, tenant: tenant, enqueued: enqueued, queued: enqueued, expires: expires, arm: arm, pool: pool, journal: journal}, nil
+}
+
+// worker calculates the hashes of the passwords queued to the pool until its queue is closed
+func (s *HashStorage) worker(p *workerPool) {
+	defer s.workersWg.Done()
+	for job := range p.jobs {
+		// The failures are logged and sent to the watchers of the calculation
+		s.complete(job, s.calculate(job), false)
+		s.jobsWg.Done()
+	}
+}
+
+// calculate calculates the hash of the job password and accounts the calculation
+func (s *HashStorage) calculate(job hashJob) hashRecord {
+	defer func() { crashScrubbed(recover(), job.pw) }()
+	job.journal.Record("worker_start")
+	rec := hashRecord{Tenant: job.tenant, Enqueued: job.enqueued, Started: time.Now().UTC(), Expires: job.expires}
+	switch {
+	case job.salt != nil:
+		rec.Hash, rec.Algorithm = job.salt.Hash(job.pw), algorithmPBKDF2
+	case s.experiment != nil:
+		rec.Hash, rec.Algorithm, rec.Arm = s.experiment.Calculate(job.arm, job.pw)
+	case s.hardening != nil:
+		var err error
+		if rec.Hash, rec.Algorithm, err = s.hardening.Calculate(job.pw); err != nil {
+			logf(logLevelError, "Hardening: %v, falling back to the legacy hash\n", err)
+			rec.Hash, rec.Algorithm = calculateHash(job.pw), ""
+		}
+	default:
+		rec.Hash = calculateHash(job.pw)
+	}
+	rec.Created = time.Now().UTC()
+	if job.retain > 0 {
+		unclaimed := rec.Created.Add(job.retain)
+		rec.Unclaimed = &unclaimed
+	}
+	s.jobStats.Record(rec.Enqueued, job.queued, rec.Started, rec.Created)
+	return rec
+}
+
+// complete stores the calculated record unless it has been deleted in the meantime, in which case
+// it returns errCancelled. With the batching enabled, the record is buffered and written along with
+// the others once the batch is full or the batch delay passes, or at once if flush is set
+func (s *HashStorage) complete(job hashJob, rec hashRecord, flush bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job.pool.pending--
+	if s.buffered != nil && !s.pending[job.id] {
+		s.buffered[job.id] = bufferedRecord{rec: rec, journal: job.journal}
+		if len(s.buffered) >= s.batchSize || flush {
+			return s.flushLocked()
+		}
+		return nil
+	}
+	deleted := s.pending[job.id]
+	delete(s.pending, job.id)
+	delete(s.enqueued, job.id)
+	if deleted {
+		job.journal.Record("cancelled")
+		s.notifyLocked(job.id, ErrNotFound)
+		return errCancelled
+	}
+	err := s.backend.Put(job.id, rec)
+	s.health.Record(err)
+	if err != nil {
+		logf(logLevelError, "Error while storing hash %d: %v\n", job.id, err)
+		job.journal.Record("storage_write_failed")
+		if s.experiment != nil {
+			s.experiment.RecordWriteFailure(rec)
+		}
+		s.notifyLocked(job.id, err)
+		return err
+	}
+	job.journal.Record("storage_write")
+	s.stored(job.id, rec)
+	return nil
+}
+
+// stored schedules the expiration of the record written by this instance and reports its completion
+func (s *HashStorage) stored(id uint64, rec hashRecord) {
+	if s.notFound != nil {
+		s.notFound.Invalidate(id)
+	}
+	pushExpiry(&s.expiry, id, rec)
+	if s.onComplete != nil {
+		s.onComplete(id, rec)
+	}
+	s.notifyLocked(id, nil)
+}
+
+// remember adds the identifier to the bloom filter, if any. The identifiers are added before
+// their records are written, so that a lookup never skips the backend holding the record
+func (s *HashStorage) remember(id uint64) {
+	if s.known != nil {
+		s.known.Add(id)
+	}
+}
+
+// calculateHash returns the base64 encoded SHA512 hash of the password
+func calculateHash(pw string) string {
+	sum := sha512.Sum512([]byte(pw))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// ImportHash stores the hash imported from another system and returns its identifier.
+// The hash is kept in its native encoding along with its algorithm, for the tenant if any. The record
+// expires after the ttl, or never if ttl is 0
+func (s *HashStorage) ImportHash(encodedHash string, ttl time.Duration, tenant string) (uint64, error) {
+	if s.isReadOnly() {
+		return 0, ErrReadOnly
+	}
+	algorithm, err := detectHashAlgorithm(encodedHash)
+	if err != nil {
+		return 0, err
+	}
+	now := time.Now().UTC()
+	rec := hashRecord{Hash: encodedHash, Algorithm: algorithm, Tenant: tenant, Enqueued: now, Started: now, Created: now}
+	if ttl > 0 {
+		expires := now.Add(ttl)
+		rec.Expires = &expires
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.currentKey++
+	u := s.currentKey
+	s.remember(u)
+	if err := s.backend.Put(u, rec); err != nil {
+		return 0, err
+	}
+	s.stored(u, rec)
+	return u, nil
+}
+
+// ApplyReplicated stores the record shipped by a replication peer under its original identifier.
+// A different record stored under the same identifier is a conflict, which is resolved by
+// replicatedWins. The records of the peers in other regions never conflict with the local ones
+func (s *HashStorage) ApplyReplicated(u uint64, rec hashRecord) (conflict bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.pending[u]; ok {
+		// The local calculation completes after the replicated one and wins
+		return true, nil
+	}
+	existing, ok, err := s.backend.Get(u)
+	if err != nil {
+		return false, err
+	}
+	if ok {
+		if existing.Hash == rec.Hash && existing.Created.Equal(rec.Created) {
+			// Shipped again after a catch-up
+			return false, nil
+		}
+		if !replicatedWins(existing, rec) {
+			return true, nil
+		}
+		conflict = true
+	}
+	s.remember(u)
+	// The claim deadline is kept by the region which calculated the hash, the copies last for the TTL
+	rec.Unclaimed = nil
+	if err := s.backend.Put(u, rec); err != nil {
+		return conflict, err
+	}
+	if s.notFound != nil {
+		s.notFound.Invalidate(u)
+	}
+	// The numbering of the local records continues after the ones shipped from the same region
+	if regionOf(u) == s.region && u > s.currentKey {
+		s.currentKey = u
+	}
+	pushExpiry(&s.expiry, u, rec)
+	return conflict, nil
+}
+
+// GetPasswordHash returns the previously stored hash
+func (s *HashStorage) GetPasswordHash(u uint64) (string, error) {
+	rec, err := s.GetRecord(u)
+	return rec.Hash, err
+}
+
+// GetRecord returns the previously stored record unless it has expired.
+// It returns ErrPending while the hash is being calculated and ErrNotFound if there is no record,
+// wrapped in purgedError if the record was purged by the retention and its tombstone is kept
+func (s *HashStorage) GetRecord(u uint64) (hashRecord, error) {
+	if s.jitter > 0 {
+		defer time.Sleep(randomJitter(s.jitter))
+	}
+	s.mu.Lock()
+	deleted, pending := s.pending[u]
+	var b bufferedRecord
+	var buffered bool
+	if s.buffered != nil {
+		b, buffered = s.buffered[u]
+	}
+	s.mu.Unlock()
+	if buffered {
+		if deleted || b.rec.expired(time.Now()) {
+			return hashRecord{}, ErrNotFound
+		}
+		return b.rec, nil
+	}
+	if pending {
+		if deleted {
+			return hashRecord{}, ErrNotFound
+		}
+		return hashRecord{}, ErrPending
+	}
+	if purged, ok := s.tombstones.Get(u); ok {
+		return hashRecord{}, &purgedError{Purged: purged}
+	}
+	if s.known != nil && !s.known.MayContain(u) {
+		return hashRecord{}, ErrNotFound
+	}
+	now := time.Now()
+	var generation uint64
+	if s.notFound != nil {
+		if s.notFound.Contains(u, now) {
+			return hashRecord{}, ErrNotFound
+		}
+		generation = s.notFound.Generation()
+	}
+	rec, ok, err := s.backend.Get(u)
+	if err != nil {
+		return hashRecord{}, err
+	}
+	if !ok && s.notFound != nil {
+		s.notFound.Add(u, now, generation)
+	}
+	if !ok || rec.expired(now) {
+		// The expired records are hidden until the reaper evicts them
+		if ok && s.tombstones != nil {
+			return hashRecord{}, &purgedError{Purged: *rec.deadline()}
+		}
+		return hashRecord{}, ErrNotFound
+	}
+	return rec, nil
+}
+
+// ClaimRecord returns the previously stored record like GetRecord and clears its claim deadline,
+// so that a fetched record is kept for its TTL. The replicas leave the claims to the primary instance
+func (s *HashStorage) ClaimRecord(u uint64) (hashRecord, error) {
+	rec, err := s.GetRecord(u)
+	if err != nil || rec.Unclaimed == nil || s.isReadOnly() {
+		return rec, err
+	}
+	rec.Unclaimed = nil
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if b, ok := s.buffered[u]; ok {
+		b.rec.Unclaimed = nil
+		s.buffered[u] = b
+		return rec, nil
+	}
+	current, ok, err := s.backend.Get(u)
+	if err != nil || !ok || current.Unclaimed == nil {
+		// Deleted or claimed in the meantime, the record was fetched all the same
+		return rec, nil
+	}
+	current.Unclaimed = nil
+	if err := s.backend.Put(u, current); err != nil {
+		// The next fetch claims it again
+		logf(logLevelError, "Error while claiming hash %d: %v\n", u, err)
+		return rec, nil
+	}
+	pushExpiry(&s.expiry, u, current)
+	return rec, nil
+}
+
+// VerifyPassword checks the password against the previously stored hash,
+// calculated by the service or imported
+func (s *HashStorage) VerifyPassword(u uint64, pw string) (ok bool, err error) {
+	rec, err := s.GetRecord(u)
+	if err != nil {
+		return false, err
+	}
+	if s.experiment != nil {
+		start := time.Now()
+		defer func() { s.experiment.RecordVerification(rec, time.Since(start), err) }()
+	}
+	if rec.Algorithm != "" {
+		return verifyExternalHash(rec.Algorithm, rec.Hash, pw)
+	}
+	return subtle.ConstantTimeCompare([]byte(calculateHash(pw)), []byte(rec.Hash)) == 1, nil
+}
+
+// DeletePassword removes the password hash record, cancelling its calculation if it is still pending.
+// It returns ErrNotFound if there is no record
+func (s *HashStorage) DeletePassword(u uint64) error {
+	if s.isReadOnly() {
+		return ErrReadOnly
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if deleted, pending := s.pending[u]; pending {
+		if deleted {
+			return ErrNotFound
+		}
+		s.pending[u] = true
+		return nil
+	}
+	if s.known != nil && !s.known.MayContain(u) {
+		return ErrNotFound
+	}
+	ok, err := s.backend.Delete(u)
+	if err == nil && !ok {
+		return ErrNotFound
+	}
+	return err
+}
+
+// Recovery returns the report on loading the records which survived the restart
+func (s *HashStorage) Recovery() RecoveryReport {
+	return s.recovery
+}
+
+// QueueLength returns the number of pending hash calculations
+func (s *HashStorage) QueueLength() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.pending)
+}
+
+// OldestPending returns how long the oldest pending hash calculation has been waiting, or 0 if none is pending
+func (s *HashStorage) OldestPending(now time.Time) time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var oldest time.Time
+	for _, t := range s.enqueued {
+		if oldest.IsZero() || t.Before(oldest) {
+			oldest = t
+		}
+	}
+	if oldest.IsZero() {
+		return 0
+	}
+	return now.Sub(oldest)
+}
+
+// Unflushed returns the number of completed records waiting for the batched write
+func (s *HashStorage) Unflushed() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.buffered)
+}
+
+// Saturated checks whether new passwords are being rejected because of the pending hash calculations
+// of the shared pool. A full dedicated pool rejects the passwords of its algorithm only
+func (s *HashStorage) Saturated() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.shared.pending >= s.shared.queueSize
+}
+
+// DetailedStats returns the timing statistics of the hash calculations
+func (s *HashStorage) DetailedStats() DetailedStats {
+	return s.jobStats.Detailed(s.QueueLength())
+}
+
+// Ping checks whether the storage backend is reachable
+func (s *HashStorage) Ping() error {
+	if p, ok := s.backend.(storagePinger); ok {
+		return p.Ping()
+	}
+	return nil
+}
+
+// Usage reports the storage backend usage
+func (s *HashStorage) Usage() (StorageUsage, error) {
+	if r, ok := s.backend.(storageUsageReporter); ok {
+		return r.Usage()
+	}
+	return StorageUsage{}, errors.New("storage backend does not report its usage")
+}
+
+// reaper periodically evicts the expired records and collects the watches left behind
+// until the storage is closed
+func (s *HashStorage) reaper(interval time.Duration) {
+	defer s.reaperWg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.reaperDone:
+			return
+		case <-ticker.C:
+			s.collectNotifiers(time.Now())
+			// The records of a replica are evicted by the primary instance
+			if !s.isReadOnly() {
+				s.evictExpired(time.Now())
+			} else if s.tombstones != nil {
+				if err := s.tombstones.Reload(); err != nil {
+					logf(logLevelError, "Error while loading the tombstones: %v\n", err)
+				}
+			}
+		}
+	}
+}
+
+// evictExpired removes the records expired by now
+func (s *HashStorage) evictExpired(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	purged := make(map[uint64]time.Time)
+	for s.expiry.Len() > 0 && !now.Before(s.expiry[0].expires) {
+		item := heap.Pop(&s.expiry).(expiryItem)
+		if item.unclaimed {
+			// The claim deadline is void once the record has been fetched, or deleted
+			rec, ok, err := s.backend.Get(item.id)
+			if err == nil && (!ok || rec.Unclaimed == nil) {
+				continue
+			}
+		}
+		if _, err := s.backend.Delete(item.id); err != nil {
+			logf(logLevelError, "Error while evicting hash %d: %v\n", item.id, err)
+			heap.Push(&s.expiry, item)
+			break
+		}
+		purged[item.id] = item.expires
+	}
+	evicted := len(purged)
+	if err := s.tombstones.Add(purged, now); err != nil {
+		logf(logLevelError, "Error while saving the tombstones: %v\n", err)
+	}
+	if evicted > 0 {
+		logf(logLevelDebug, "Evicted %d expired hashes\n", evicted)
+	}
+}
+
+// Close waits for the pending hash calculations to complete and stops the workers.
+// No passwords may be added after the storage is closed
+func (s *HashStorage) Close() {
+	s.jobsWg.Wait()
+	s.closePools()
+	s.workersWg.Wait()
+	close(s.reaperDone)
+	s.reaperWg.Wait()
+	if s.buffered != nil {
+		s.mu.Lock()
+		s.flushLocked()
+		s.mu.Unlock()
+	}
+	if err := s.backend.Close(); err != nil {
+		logf(logLevelError, "Error while closing storage backend: %v\n", err)
+	}
+}
+
+// expiryItem is the expiration time of a single record
+type expiryItem struct {
+	id      uint64
+	expires time.Time
+	// unclaimed tells the claim deadline of the record from its expiration
+	unclaimed bool
+}
+
+// pushExpiry schedules the purge of the record, if it expires or has to be claimed
+func pushExpiry(q *expiryQueue, id uint64, rec hashRecord) {
+	if d := rec.deadline(); d != nil {
+		heap.Push(q, expiryItem{id: id, expires: *d, unclaimed: d == rec.Unclaimed})
+	}
+}
+
+// expiryQueue is a min-heap of the record expiration times
+type expiryQueue []expiryItem
+
+func (q expiryQueue) Len() int            { return len(q) }
+func (q expiryQueue) Less(i, j int) bool  { return q[i].expires.Before(q[j].expires) }
+func (q expiryQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *expiryQueue) Push(x interface{}) { *q = append(*q, x.(expiryItem)) }
+func (q *expiryQueue) Pop() interface{} {
+	old := *q
+	item := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return item
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// tenantCountersInterval is the interval of saving the tenant counters to the metadata store.
+// At most the counts of the last interval are lost when the instance crashes
+const tenantCountersInterval = 5 * time.Second
+
+const (
+	// tenantDayLayout formats the UTC days the daily counts are kept by
+	tenantDayLayout = "2006-01-02"
+	// tenantDailyRetention is the number of days the daily counts are kept, covering a year and a month
+	tenantDailyRetention = 400
+)
+
+// tenantCounts holds the totals of the operations of a tenant. Requests counts the authorized requests
+// of the tenant and LatencyMicros their total handling time
+type tenantCounts struct {
+	Created       uint64 `json:"created"`
+	Verified      uint64 `json:"verified"`
+	Deleted       uint64 `json:"deleted"`
+	Requests      uint64 `json:"requests"`
+	LatencyMicros uint64 `json:"latency_us"`
+}
+
+// add adds the counts of other to c
+func (c *tenantCounts) add(other *tenantCounts) {
+	c.Created += other.Created
+	c.Verified += other.Verified
+	c.Deleted += other.Deleted
+	c.Requests += other.Requests
+	c.LatencyMicros += other.LatencyMicros
+}
+
+// tenantCountersDoc is the metadata document keeping the tenant counters of an instance
+type tenantCountersDoc struct {
+	Updated time.Time                `json:"updated"`
+	Tenants map[string]*tenantCounts `json:"tenants"`
+	// Daily holds the counts of the tenants by UTC day
+	Daily map[string]map[string]*tenantCounts `json:"daily,omitempty"`
+}
+
+// TenantCounters counts the operations of each tenant, in total and by day, persisting the counts
+// so that they survive restarts
+type TenantCounters struct {
+	mu      sync.Mutex
+	meta    metadataStore
+	name    string
+	tenants map[string]*tenantCounts
+	daily   map[string]map[string]*tenantCounts
+	dirty   bool
+}
+
+// NewTenantCounters constructs a new instance of the counters of the instance,
+// loading the totals saved before the restart
+func NewTenantCounters(meta metadataStore, instance string) (*TenantCounters, error) {
+	c := &TenantCounters{meta: meta, name: "tenant-counters-" + instance}
+	var doc tenantCountersDoc
+	if _, err := meta.GetMeta(c.name, &doc); err != nil {
+		return nil, err
+	}
+	c.tenants, c.daily = doc.Tenants, doc.Daily
+	if c.tenants == nil {
+		c.tenants = make(map[string]*tenantCounts)
+	}
+	if c.daily == nil {
+		c.daily = make(map[string]map[string]*tenantCounts)
+	}
+	return c, nil
+}
+
+// Add counts the operation of the tenant of the request, if any. It is safe to call on a nil instance
+func (c *TenantCounters) Add(r *http.Request, count func(*tenantCounts)) {
+	if c == nil {
+		return
+	}
+	key := requestAPIKey(r)
+	if key == nil || key.Tenant == "" {
+		return
+	}
+	day := time.Now().UTC().Format(tenantDayLayout)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	counts, ok := c.tenants[key.Tenant]
+	if !ok {
+		counts = &tenantCounts{}
+		c.tenants[key.Tenant] = counts
+	}
+	count(counts)
+	tenants, ok := c.daily[day]
+	if !ok {
+		tenants = make(map[string]*tenantCounts)
+		c.daily[day] = tenants
+	}
+	if counts, ok = tenants[key.Tenant]; !ok {
+		counts = &tenantCounts{}
+		tenants[key.Tenant] = counts
+	}
+	count(counts)
+	c.dirty = true
+}
+
+// Period returns the counts of the tenant, or of all the tenants if tenant is empty, summed over
+// the UTC days from the day of from to that of to, both included
+func (c *TenantCounters) Period(tenant string, from, to time.Time) map[string]tenantCounts {
+	first, last := from.UTC().Format(tenantDayLayout), to.UTC().Format(tenantDayLayout)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	result := make(map[string]tenantCounts)
+	for day, tenants := range c.daily {
+		if day < first || day > last {
+			continue
+		}
+		for name, counts := range tenants {
+			if tenant == "" || name == tenant {
+				sum := result[name]
+				sum.add(counts)
+				result[name] = sum
+			}
+		}
+	}
+	return result
+}
+
+// Get returns the totals of the tenant, or of all the tenants if tenant is empty
+func (c *TenantCounters) Get(tenant string) map[string]tenantCounts {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	result := make(map[string]tenantCounts)
+	for name, counts := range c.tenants {
+		if tenant == "" || name == tenant {
+			result[name] = *counts
+		}
+	}
+	return result
+}
+
+// Save writes the totals to the metadata store if they have changed since the last save
+func (c *TenantCounters) Save() error {
+	c.mu.Lock()
+	if !c.dirty {
+		c.mu.Unlock()
+		return nil
+	}
+	now := time.Now().UTC()
+	doc := tenantCountersDoc{Updated: now, Tenants: make(map[string]*tenantCounts), Daily: make(map[string]map[string]*tenantCounts)}
+	for name, counts := range c.tenants {
+		copied := *counts
+		doc.Tenants[name] = &copied
+	}
+	oldest := now.AddDate(0, 0, -tenantDailyRetention).Format(tenantDayLayout)
+	for day, tenants := range c.daily {
+		if day < oldest {
+			delete(c.daily, day)
+			continue
+		}
+		doc.Daily[day] = make(map[string]*tenantCounts, len(tenants))
+		for name, counts := range tenants {
+			copied := *counts
+			doc.Daily[day][name] = &copied
+		}
+	}
+	c.dirty = false
+	c.mu.Unlock()
+	if err := c.meta.PutMeta(c.name, doc); err != nil {
+		c.mu.Lock()
+		c.dirty = true
+		c.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// Run periodically saves the totals until done is closed, saving them once more before returning
+func (c *TenantCounters) Run(done <-chan struct{}) {
+	save := func() {
+		if err := c.Save(); err != nil {
+			logf(logLevelError, "Error while saving tenant counters: %v\n", err)
+		}
+	}
+	ticker := time.NewTicker(tenantCountersInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			save()
+			return
+		case <-ticker.C:
+			save()
+		}
+	}
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// tieredEntry is a record kept in the hot tier
+type tieredEntry struct {
+	id    uint64
+	rec   hashRecord
+	added time.Time
+	// dirty is set until the record has been written to the cold tier
+	dirty bool
+}
+
+// TieredBackend keeps the recent records in memory (the hot tier) and demotes
+// the older ones to the persistent backend (the cold tier). The cold records are
+// promoted back to the hot tier when accessed.
+// The records which have not been demoted yet are lost if the process crashes
+type TieredBackend struct {
+	mu      sync.Mutex
+	cold    HashBackend
+	maxSize int
+	maxAge  time.Duration
+	// lru orders the hot records from the most to the least recently used
+	lru     *list.List
+	entries map[uint64]*list.Element
+	done    chan struct{}
+	wg      sync.WaitGroup
+
+	hotHits    *Counter
+	coldHits   *Counter
+	misses     *Counter
+	promotions *Counter
+	demotions  *Counter
+
+	// deletions counts the deletions, so that a record read from the cold tier is not promoted
+	// if it may have been deleted meanwhile
+	deletions uint64
+}
+
+// NewTieredBackend constructs a new instance of the tiered storage backend on top of
+// the cold backend. At most maxSize records stay in the hot tier for at most maxAge
+func NewTieredBackend(cold HashBackend, maxSize int, maxAge time.Duration) *TieredBackend {
+	b := &TieredBackend{
+		cold:    cold,
+		maxSize: maxSize,
+		maxAge:  maxAge,
+		lru:     list.New(),
+		entries: make(map[uint64]*list.Element),
+		done:    make(chan struct{}),
+	}
+	const help = "Number of record lookups served by the storage tier"
+	b.hotHits = metrics.NewCounter("phs_storage_tier_hits_total", help, "tier", "hot")
+	b.coldHits = metrics.NewCounter("phs_storage_tier_hits_total", help, "tier", "cold")
+	b.misses = metrics.NewCounter("phs_storage_tier_misses_total", "Number of record lookups not found in any storage tier")
+	b.promotions = metrics.NewCounter("phs_storage_tier_promotions_total", "Number of records promoted to the hot tier")
+	b.demotions = metrics.NewCounter("phs_storage_tier_demotions_total", "Number of records demoted to the cold tier")
+	metrics.NewGaugeFunc("phs_storage_hot_records", "Number of records in the hot tier", func() float64 {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		return float64(b.lru.Len())
+	})
+
+	b.wg.Add(1)
+	go b.demoteLoop()
+	return b
+}
+
+// Put stores the record in the hot tier. The record is stored even if the demotion of
+// the least recently used ones fails, which is logged and retried by the next eviction
+func (b *TieredBackend) Put(id uint64, rec hashRecord) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.insert(id, rec, true)
+	b.evict()
+	return nil
+}
+
+// Get returns the record from the hot tier or promotes it from the cold tier
+func (b *TieredBackend) Get(id uint64) (rec hashRecord, ok bool, err error) {
+	b.mu.Lock()
+	if el, found := b.entries[id]; found {
+		b.lru.MoveToFront(el)
+		rec = el.Value.(*tieredEntry).rec
+		b.mu.Unlock()
+		b.hotHits.Inc()
+		return rec, true, nil
+	}
+	deletions := b.deletions
+	b.mu.Unlock()
+
+	rec, ok, err = b.cold.Get(id)
+	if err != nil {
+		return
+	}
+	if !ok {
+		b.misses.Inc()
+		return
+	}
+	b.coldHits.Inc()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, found := b.entries[id]; !found && b.deletions == deletions {
+		b.insert(id, rec, false)
+		b.promotions.Inc()
+		b.evict()
+	}
+	return
+}
+
+// Delete removes the record from both tiers
+func (b *TieredBackend) Delete(id uint64) (ok bool, err error) {
+	// Hold the lock while deleting from the cold tier, and count the deletion, so that a concurrent Get
+	// reading the record from the cold tier before the deletion does not promote it afterwards
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.deletions++
+	if el, found := b.entries[id]; found {
+		b.lru.Remove(el)
+		delete(b.entries, id)
+		ok = true
+	}
+	coldOK, err := b.cold.Delete(id)
+	return ok || coldOK, err
+}
+
+// Scan calls fn for every record stored in either tier
+func (b *TieredBackend) Scan(fn func(id uint64, rec hashRecord) error) error {
+	b.mu.Lock()
+	hot := make(map[uint64]hashRecord, len(b.entries))
+	for id, el := range b.entries {
+		hot[id] = el.Value.(*tieredEntry).rec
+	}
+	b.mu.Unlock()
+
+	for id, rec := range hot {
+		if err := fn(id, rec); err != nil {
+			return err
+		}
+	}
+	return b.cold.Scan(func(id uint64, rec hashRecord) error {
+		if _, found := hot[id]; found {
+			return nil
+		}
+		return fn(id, rec)
+	})
+}
+
+// PutStats saves the statistics snapshot of the instance to the cold tier
+func (b *TieredBackend) PutStats(snap statsSnapshot) error {
+	if store, ok := b.cold.(statsSnapshotStore); ok {
+		return store.PutStats(snap)
+	}
+	return nil
+}
+
+// ListStats returns the statistics snapshots saved in the cold tier
+func (b *TieredBackend) ListStats() ([]statsSnapshot, error) {
+	if store, ok := b.cold.(statsSnapshotStore); ok {
+		return store.ListStats()
+	}
+	return nil, nil
+}
+
+// PutKey saves the API key to the cold tier
+func (b *TieredBackend) PutKey(key apiKey) error {
+	return b.cold.(apiKeyStore).PutKey(key)
+}
+
+// GetKey returns the API key saved in the cold tier
+func (b *TieredBackend) GetKey(id string) (apiKey, bool, error) {
+	return b.cold.(apiKeyStore).GetKey(id)
+}
+
+// ListKeys returns the API keys saved in the cold tier
+func (b *TieredBackend) ListKeys() ([]apiKey, error) {
+	return b.cold.(apiKeyStore).ListKeys()
+}
+
+// Ping checks whether the cold tier is reachable
+func (b *TieredBackend) Ping() error {
+	if p, ok := b.cold.(storagePinger); ok {
+		return p.Ping()
+	}
+	return nil
+}
+
+// Close demotes all the hot records and closes the cold backend
+func (b *TieredBackend) Close() error {
+	close(b.done)
+	b.wg.Wait()
+
+	b.mu.Lock()
+	var firstErr error
+	for b.lru.Len() > 0 {
+		if err := b.demote(b.lru.Back()); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	b.mu.Unlock()
+
+	if err := b.cold.Close(); err != nil && firstErr == nil {
+		firstErr = err
+	}
+	return firstErr
+}
+
+// insert adds the record to the front of the hot tier. Must be called with the lock held
+func (b *TieredBackend) insert(id uint64, rec hashRecord, dirty bool) {
+	if el, found := b.entries[id]; found {
+		b.lru.Remove(el)
+	}
+	b.entries[id] = b.lru.PushFront(&tieredEntry{id: id, rec: rec, added: time.Now(), dirty: dirty})
+}
+
+// evict demotes the least recently used records exceeding the hot tier size. A record failing
+// to be demoted stays in the hot tier, over its size until the next eviction.
+// Must be called with the lock held
+func (b *TieredBackend) evict() {
+	for b.lru.Len() > b.maxSize {
+		el := b.lru.Back()
+		if err := b.demote(el); err != nil {
+			logf(logLevelError, "Error while demoting record %d: %v\n", el.Value.(*tieredEntry).id, err)
+			return
+		}
+	}
+}
+
+// demote moves the record to the cold tier. Must be called with the lock held
+func (b *TieredBackend) demote(el *list.Element) error {
+	entry := el.Value.(*tieredEntry)
+	if entry.dirty {
+		if err := b.cold.Put(entry.id, entry.rec); err != nil {
+			// Keep the record in the hot tier so that it is not lost
+			b.lru.MoveToFront(el)
+			return err
+		}
+		b.demotions.Inc()
+	}
+	b.lru.Remove(el)
+	delete(b.entries, entry.id)
+	return nil
+}
+
+// demoteLoop periodically demotes the records which stayed in the hot tier for too long
+func (b *TieredBackend) demoteLoop() {
+	defer b.wg.Done()
+	interval := b.maxAge / 2
+	if interval < time.Second {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-b.done:
+			return
+		case <-ticker.C:
+			b.demoteExpired()
+		}
+	}
+}
+
+// demoteExpired demotes the records older than the maximal hot tier age
+func (b *TieredBackend) demoteExpired() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	deadline := time.Now().Add(-b.maxAge)
+	for el := b.lru.Back(); el != nil; {
+		prev := el.Prev()
+		if el.Value.(*tieredEntry).added.Before(deadline) {
+			if err := b.demote(el); err != nil {
+				logf(logLevelError, "Error while demoting record %d: %v\n", el.Value.(*tieredEntry).id, err)
+				return
+			}
+		}
+		el = prev
+	}
+}
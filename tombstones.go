@@ -0,0 +1,104 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// tombstonesMetaName is the metadata document holding the tombstones of the purged records
+	tombstonesMetaName = "tombstones"
+	// maxTombstones bounds the number of tombstones kept, the oldest are dropped when exceeded
+	maxTombstones = 100000
+)
+
+// tombstonesDoc is the persisted form of the tombstones, the purge times by the record identifiers
+type tombstonesDoc struct {
+	Purged map[uint64]int64 `json:"purged"`
+}
+
+// tombstoneSet remembers for the tombstone TTL the identifiers of the records purged by the retention
+// and when they were purged, so that their lookups are answered with 410 Gone rather than 404 Not Found.
+// Only the identifier and the time are kept, the record itself is gone
+type tombstoneSet struct {
+	mu     sync.Mutex
+	meta   metadataStore
+	ttl    time.Duration
+	purged map[uint64]time.Time
+}
+
+// newTombstoneSet constructs a new instance of the set keeping the tombstones for the ttl,
+// loading the tombstones saved in the metadata store
+func newTombstoneSet(meta metadataStore, ttl time.Duration) (*tombstoneSet, error) {
+	t := &tombstoneSet{meta: meta, ttl: ttl}
+	if err := t.Reload(); err != nil {
+		return nil, err
+	}
+	metrics.NewGaugeFunc("phs_tombstones", "Number of tombstones of the purged records kept", func() float64 {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		return float64(len(t.purged))
+	})
+	return t, nil
+}
+
+// Reload loads the tombstones saved in the metadata store, e.g. by the primary instance
+func (t *tombstoneSet) Reload() error {
+	var doc tombstonesDoc
+	if _, err := t.meta.GetMeta(tombstonesMetaName, &doc); err != nil {
+		return err
+	}
+	purged := make(map[uint64]time.Time, len(doc.Purged))
+	for id, secs := range doc.Purged {
+		purged[id] = time.Unix(secs, 0).UTC()
+	}
+	t.mu.Lock()
+	t.purged = purged
+	t.mu.Unlock()
+	return nil
+}
+
+// Get returns the time the record was purged, if its tombstone is kept
+func (t *tombstoneSet) Get(id uint64) (time.Time, bool) {
+	if t == nil {
+		return time.Time{}, false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	purged, ok := t.purged[id]
+	return purged, ok && time.Since(purged) < t.ttl
+}
+
+// Add records the tombstones of the purged records and saves all the tombstones, dropping those
+// older than the TTL, and the oldest ones over maxTombstones
+func (t *tombstoneSet) Add(purged map[uint64]time.Time, now time.Time) error {
+	if t == nil || len(purged) == 0 {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for id, at := range purged {
+		t.purged[id] = at
+	}
+	for id, at := range t.purged {
+		if now.Sub(at) >= t.ttl {
+			delete(t.purged, id)
+		}
+	}
+	if len(t.purged) > maxTombstones {
+		ids := make([]uint64, 0, len(t.purged))
+		for id := range t.purged {
+			ids = append(ids, id)
+		}
+		sort.Slice(ids, func(i, j int) bool { return t.purged[ids[i]].Before(t.purged[ids[j]]) })
+		for _, id := range ids[:len(ids)-maxTombstones] {
+			delete(t.purged, id)
+		}
+	}
+	doc := tombstonesDoc{Purged: make(map[uint64]int64, len(t.purged))}
+	for id, at := range t.purged {
+		doc.Purged[id] = at.Unix()
+	}
+	return t.meta.PutMeta(tombstonesMetaName, doc)
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// maxParallelSyncs bounds the record files of a batch flushed to the disk concurrently
+const maxParallelSyncs = 16
+
+// batchPutter is implemented by the backends able to store several records at once
+// more cheaply than one by one. Unless durable is set, the records may be lost on a power failure
+type batchPutter interface {
+	PutBatch(recs map[uint64]hashRecord, durable bool) error
+}
+
+// putBatch stores the records in the backend, one by one if it cannot store them at once
+func putBatch(backend HashBackend, recs map[uint64]hashRecord, durable bool) error {
+	if b, ok := backend.(batchPutter); ok {
+		return b.PutBatch(recs, durable)
+	}
+	for id, rec := range recs {
+		if err := backend.Put(id, rec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PutBatch stores the records. All the record files are written before any is flushed to the disk,
+// and the flushes run concurrently, so that the filesystem can combine them into fewer journal commits
+func (b *FileBackend) PutBatch(recs map[uint64]hashRecord, durable bool) error {
+	type stagedFile struct {
+		tmp  *os.File
+		path string
+	}
+	staged := make([]stagedFile, 0, len(recs))
+	abort := func(err error) error {
+		for _, f := range staged {
+			if f.tmp == nil {
+				continue
+			}
+			f.tmp.Close()
+			os.Remove(f.tmp.Name())
+		}
+		return err
+	}
+	for id, rec := range recs {
+		data, err := b.encode(rec)
+		if err != nil {
+			return abort(err)
+		}
+		dir := b.shardDir(id)
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return abort(err)
+		}
+		tmp, err := ioutil.TempFile(dir, recordTempPrefix)
+		if err != nil {
+			return abort(err)
+		}
+		staged = append(staged, stagedFile{tmp: tmp, path: b.recordPath(id)})
+		if _, err := tmp.Write(data); err != nil {
+			return abort(err)
+		}
+	}
+
+	if durable {
+		var wg sync.WaitGroup
+		var mu sync.Mutex
+		var syncErr error
+		sem := make(chan struct{}, maxParallelSyncs)
+		for _, f := range staged {
+			wg.Add(1)
+			sem <- struct{}{}
+			go func(tmp *os.File) {
+				defer func() { <-sem; wg.Done() }()
+				if err := tmp.Sync(); err != nil {
+					mu.Lock()
+					syncErr = err
+					mu.Unlock()
+				}
+			}(f.tmp)
+		}
+		wg.Wait()
+		if syncErr != nil {
+			return abort(syncErr)
+		}
+	}
+
+	for i, f := range staged {
+		if err := f.tmp.Close(); err != nil {
+			return abort(err)
+		}
+		if err := os.Rename(f.tmp.Name(), f.path); err != nil {
+			return abort(err)
+		}
+		// The renamed files must not be removed when a later one fails
+		staged[i].tmp = nil
+	}
+	return nil
+}
+
+// PutBatch stores the records in the hot tier, evicting the least recently used ones once
+func (b *TieredBackend) PutBatch(recs map[uint64]hashRecord, durable bool) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for id, rec := range recs {
+		b.insert(id, rec, true)
+	}
+	b.evict()
+	return nil
+}
+
+// bufferedRecord is a completed record waiting for the batched write
+type bufferedRecord struct {
+	rec     hashRecord
+	journal *journalEntry
+}
+
+// flusher periodically writes the buffered records until the storage is closed
+func (s *HashStorage) flusher(interval time.Duration) {
+	defer s.reaperWg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.reaperDone:
+			return
+		case <-ticker.C:
+			s.mu.Lock()
+			s.flushLocked()
+			s.mu.Unlock()
+		}
+	}
+}
+
+// flushLocked writes the buffered records in a single batch. The records deleted while buffered
+// are dropped. It returns the error of the write. The caller must hold the lock, so that no record is deleted during the write
+func (s *HashStorage) flushLocked() error {
+	if len(s.buffered) == 0 {
+		return nil
+	}
+	recs := make(map[uint64]hashRecord, len(s.buffered))
+	for id, b := range s.buffered {
+		if !s.pending[id] {
+			recs[id] = b.rec
+		}
+	}
+	err := putBatch(s.backend, recs, s.batchSync)
+	s.health.Record(err)
+	if err != nil {
+		logf(logLevelError, "Error while storing %d hashes: %v\n", len(recs), err)
+	}
+	for id, b := range s.buffered {
+		deleted := s.pending[id]
+		delete(s.pending, id)
+		delete(s.enqueued, id)
+		switch {
+		case deleted:
+			b.journal.Record("cancelled")
+			s.notifyLocked(id, ErrNotFound)
+		case err != nil:
+			b.journal.Record("storage_write_failed")
+			if s.experiment != nil {
+				s.experiment.RecordWriteFailure(b.rec)
+			}
+			s.notifyLocked(id, err)
+		default:
+			b.journal.Record("storage_write")
+			s.stored(id, b.rec)
+		}
+	}
+	s.buffered = make(map[uint64]bufferedRecord)
+	s.batchFlushes.Inc()
+	return err
+}